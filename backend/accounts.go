@@ -33,6 +33,7 @@ import (
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/coins/eth"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/config"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/keystore"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/signing"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
@@ -254,7 +255,7 @@ func (backend *Backend) accountFiatBalance(account accounts.Interface, fiat stri
 	}
 
 	coinDecimals := coin.DecimalsExp(account.Coin())
-	price, err := backend.RatesUpdater().LatestPriceForPair(account.Coin().Unit(false), fiat)
+	price, err := backend.RatesUpdater().LatestPriceForCoin(rates.CoinCode(account.Coin().Code()), rates.Fiat(fiat))
 	if err != nil {
 		return nil, err
 	}
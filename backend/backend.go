@@ -283,7 +283,8 @@ func NewBackend(arguments *arguments.Arguments, environment Environment) (*Backe
 	if err := os.MkdirAll(ratesCache, 0700); err != nil {
 		log.Errorf("RateUpdater DB cache dir: %v", err)
 	}
-	backend.ratesUpdater = rates.NewRateUpdater(hclient, ratesCache)
+	backend.ratesUpdater = rates.NewRateUpdater(hclient, ratesCache,
+		rates.WithUserAgent(fmt.Sprintf("BitBoxApp/%s", Version)))
 	backend.ratesUpdater.Observe(backend.Notify)
 
 	backend.banners = banners.NewBanners()
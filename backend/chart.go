@@ -22,6 +22,7 @@ import (
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/accounts"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/accounts/errors"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/coins/coin"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
 )
 
@@ -82,9 +83,9 @@ func (backend *Backend) addChartData(
 	chartEntries map[int64]RatChartEntry,
 ) {
 	for _, e := range timeseries {
-		price := backend.RatesUpdater().HistoricalPriceAt(
-			string(coinCode),
-			fiat,
+		price := backend.RatesUpdater().HistoricalPriceForCoin(
+			rates.CoinCode(coinCode),
+			rates.Fiat(fiat),
 			e.Time)
 		timestamp := e.Time.Unix()
 		chartEntry := chartEntries[timestamp]
@@ -78,7 +78,7 @@ func ConversionsAtTime(amount Amount, coin Coin, isFee bool, ratesUpdater *rates
 	if lastRates != nil {
 		unit := coin.Unit(isFee)
 		for currency := range lastRates[unit] {
-			value := ratesUpdater.HistoricalPriceAt(string(coin.Code()), currency, *timeStamp)
+			value := ratesUpdater.HistoricalPriceForCoin(ratesPkg.CoinCode(coin.Code()), ratesPkg.Fiat(currency), *timeStamp)
 			if value == 0 {
 				conversions[currency] = ""
 			} else {
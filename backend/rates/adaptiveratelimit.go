@@ -0,0 +1,109 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+)
+
+const (
+	// rateLimitRemainingHeader is the number of requests left in the current rate limit window
+	// of the CoinGecko pro API.
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	// rateLimitResetHeader is the time the current rate limit window ends, in unix seconds or
+	// as an HTTP date.
+	rateLimitResetHeader = "X-RateLimit-Reset"
+
+	// adaptiveRateLimitThreshold is the number of remaining requests below which
+	// WithAdaptiveRateLimiting backs off.
+	adaptiveRateLimitThreshold = 10
+)
+
+// WithAdaptiveRateLimiting makes the updater read the rate limit headers of each CoinGecko
+// response, see parseRateLimitHeaders. If fewer than 10 requests remain in the current window,
+// the rate limit is lowered right away to spread the remaining ones until the window resets.
+// The previous rate limit is restored with the first response after the reset.
+// Responses without these headers, e.g. of the Shift mirror, don't change the rate limit.
+func WithAdaptiveRateLimiting() Option {
+	return func(updater *RateUpdater) {
+		updater.adaptiveRateLimit = true
+	}
+}
+
+// parseRateLimitHeaders returns the number of requests remaining in the current rate limit
+// window and the time it resets, from the X-RateLimit-Remaining and X-RateLimit-Reset headers.
+// The reset time is accepted in unix seconds or as an HTTP date. ok is false if either header
+// is missing or invalid.
+func parseRateLimitHeaders(res *http.Response) (remaining int, resetAt time.Time, ok bool) {
+	if res == nil {
+		return 0, time.Time{}, false
+	}
+	remaining, err := strconv.Atoi(res.Header.Get(rateLimitRemainingHeader))
+	if err != nil || remaining < 0 {
+		return 0, time.Time{}, false
+	}
+	reset := res.Header.Get(rateLimitResetHeader)
+	if sec, err := strconv.ParseInt(reset, 10, 64); err == nil {
+		if sec <= 0 {
+			return 0, time.Time{}, false
+		}
+		return remaining, time.Unix(sec, 0), true
+	}
+	resetAt, err = http.ParseTime(reset)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return remaining, resetAt, true
+}
+
+// adaptRateLimit adjusts the rate limit to the rate limit headers of res if enabled.
+// See WithAdaptiveRateLimiting.
+func (updater *RateUpdater) adaptRateLimit(res *http.Response) {
+	if !updater.adaptiveRateLimit {
+		return
+	}
+	remaining, resetAt, ok := parseRateLimitHeaders(res)
+	if !ok {
+		return
+	}
+	now := updater.clock()
+	updater.geckoLimiterMu.Lock()
+	defer updater.geckoLimiterMu.Unlock()
+	if updater.backoffLimiter != nil {
+		if now.Before(updater.backoffUntil) {
+			return
+		}
+		// Keep a rate limit set with UpdateRateLimit during the backoff.
+		if updater.geckoLimiter == updater.backoffLimiter {
+			updater.geckoLimiter = updater.normalLimiter
+		}
+		updater.log.Info("rate limit window reset, restored the rate limit")
+		updater.backoffLimiter, updater.normalLimiter = nil, nil
+	}
+	if remaining >= adaptiveRateLimitThreshold || !resetAt.After(now) {
+		return
+	}
+	backoff := resetAt.Sub(now) / time.Duration(remaining+1)
+	updater.log.Warningf("%d API requests remaining until %v, backing off to one per %v",
+		remaining, resetAt, backoff)
+	updater.normalLimiter = updater.geckoLimiter
+	updater.backoffLimiter = ratelimit.NewLimitedCall(backoff)
+	updater.backoffUntil = resetAt
+	updater.geckoLimiter = updater.backoffLimiter
+}
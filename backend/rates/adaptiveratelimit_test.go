@@ -0,0 +1,127 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rateLimitResponse returns a response with the given rate limit headers, omitted if empty.
+func rateLimitResponse(remaining, reset string) *http.Response {
+	res := &http.Response{Header: http.Header{}}
+	if remaining != "" {
+		res.Header.Set(rateLimitRemainingHeader, remaining)
+	}
+	if reset != "" {
+		res.Header.Set(rateLimitResetHeader, reset)
+	}
+	return res
+}
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	resetAt := time.Unix(1598832060, 0)
+	tests := []struct {
+		name      string
+		res       *http.Response
+		remaining int
+		resetAt   time.Time
+		ok        bool
+	}{
+		{"unix", rateLimitResponse("5", "1598832060"), 5, resetAt, true},
+		{"http date", rateLimitResponse("5", resetAt.UTC().Format(http.TimeFormat)), 5, resetAt, true},
+		{"zero remaining", rateLimitResponse("0", "1598832060"), 0, resetAt, true},
+		{"nil response", nil, 0, time.Time{}, false},
+		{"no headers", rateLimitResponse("", ""), 0, time.Time{}, false},
+		{"no remaining", rateLimitResponse("", "1598832060"), 0, time.Time{}, false},
+		{"no reset", rateLimitResponse("5", ""), 0, time.Time{}, false},
+		{"negative remaining", rateLimitResponse("-1", "1598832060"), 0, time.Time{}, false},
+		{"fractional remaining", rateLimitResponse("5.5", "1598832060"), 0, time.Time{}, false},
+		{"zero reset", rateLimitResponse("5", "0"), 0, time.Time{}, false},
+		{"invalid reset", rateLimitResponse("5", "soon"), 0, time.Time{}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remaining, resetAt, ok := parseRateLimitHeaders(test.res)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.remaining, remaining)
+			assert.True(t, test.resetAt.Equal(resetAt), "resetAt %v", resetAt)
+		})
+	}
+}
+
+func TestAdaptRateLimit(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	normal := ratelimit.NewLimitedCall(time.Nanosecond)
+	updater := NewRateUpdater(nil, "/dev/null", WithAdaptiveRateLimiting(),
+		withGeckoLimiter(normal), WithClockFunc(clock.Now), WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	updater.adaptRateLimit(rateLimitResponse("50", "1598832060"))
+	assert.Same(t, normal, updater.limiter())
+	updater.adaptRateLimit(rateLimitResponse("5", ""))
+	assert.Same(t, normal, updater.limiter())
+
+	// 5 remaining requests in 60s are spread to one per 10s.
+	updater.adaptRateLimit(rateLimitResponse("5", "1598832060"))
+	backoff := updater.limiter()
+	assert.NotSame(t, normal, backoff)
+	assert.True(t, updater.backoffUntil.Equal(time.Unix(1598832060, 0)))
+
+	// The backoff is kept until the reset.
+	updater.adaptRateLimit(rateLimitResponse("2", "1598832060"))
+	assert.Same(t, backoff, updater.limiter())
+	clock.Advance(59 * time.Second)
+	updater.adaptRateLimit(rateLimitResponse("500", "1598832120"))
+	assert.Same(t, backoff, updater.limiter())
+
+	clock.Advance(time.Second)
+	updater.adaptRateLimit(rateLimitResponse("500", "1598832120"))
+	assert.Same(t, normal, updater.limiter())
+	assert.Nil(t, updater.backoffLimiter)
+
+	// A window which already reset doesn't back off.
+	updater.adaptRateLimit(rateLimitResponse("1", "1598832060"))
+	assert.Same(t, normal, updater.limiter())
+
+	// A rate limit updated during the backoff is kept.
+	updater.adaptRateLimit(rateLimitResponse("1", "1598832120"))
+	assert.NotSame(t, normal, updater.limiter())
+	updater.UpdateRateLimit(100, time.Second)
+	updated := updater.limiter()
+	clock.Advance(time.Minute)
+	updater.adaptRateLimit(rateLimitResponse("500", "1598832180"))
+	assert.Same(t, updated, updater.limiter())
+}
+
+func TestAdaptiveRateLimitingFetch(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(rateLimitRemainingHeader, "0")
+		w.Header().Set(rateLimitResetHeader, fmt.Sprint(time.Now().Add(time.Minute).Unix()))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	for _, adaptive := range []bool{false, true} {
+		opts := []Option{withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)), WithLogger(newTestLogger())}
+		if adaptive {
+			opts = append(opts, WithAdaptiveRateLimiting())
+		}
+		updater := NewRateUpdater(http.DefaultClient, "/dev/null", opts...)
+		updater.coingeckoURL = ts.URL
+		limiter := updater.limiter()
+		_, err := updater.fetch(context.Background(), ts.URL+"/simple/price")
+		require.Error(t, err)
+		assert.Equal(t, adaptive, limiter != updater.limiter())
+		updater.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// adminHistoryEntry is a historical rate as served by the admin server.
+type adminHistoryEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// WithAdminServer makes StartCurrentRates start an HTTP server listening at addr, e.g.
+// "127.0.0.1:8091", for operators monitoring a headless app. It is shut down by Stop.
+// The server has no authentication and should not be exposed beyond localhost.
+//
+// The endpoints are:
+//   - GET /rates/current: the latest rates, see LatestPrice.
+//   - GET /rates/history/{coin}/{fiat}?from=&to=: the historical rates in memory of the pair,
+//     optionally limited to the given unix timestamps in seconds, oldest first.
+//   - GET /rates/diagnostics: see Diagnostics.
+//   - POST /rates/pause and POST /rates/resume: see Pause and Resume.
+func WithAdminServer(addr string) Option {
+	return func(updater *RateUpdater) {
+		updater.adminAddr = addr
+	}
+}
+
+// Pause stops the periodic updates of the latest rates started by StartCurrentRates, until
+// Resume is called. An ongoing update is finished. Historical rates are still updated.
+func (updater *RateUpdater) Pause() {
+	updater.paused.Store(true)
+}
+
+// Resume continues the periodic updates of the latest rates stopped by Pause, starting with
+// the next interval.
+func (updater *RateUpdater) Resume() {
+	updater.paused.Store(false)
+}
+
+// Paused returns whether the updates of the latest rates are paused. See Pause.
+func (updater *RateUpdater) Paused() bool {
+	return updater.paused.Load()
+}
+
+// adminHandler returns the handler of the admin server. See WithAdminServer.
+func (updater *RateUpdater) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /rates/current", func(w http.ResponseWriter, r *http.Request) {
+		last := updater.LatestPrice()
+		if last == nil {
+			http.Error(w, string(ErrRatesNotAvailable), http.StatusServiceUnavailable)
+			return
+		}
+		updater.writeAdminJSON(w, last)
+	})
+	mux.HandleFunc("GET /rates/history/{coin}/{fiat}", func(w http.ResponseWriter, r *http.Request) {
+		from, err := parseAdminTime(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+		to, err := parseAdminTime(r.URL.Query().Get("to"))
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		entries := []adminHistoryEntry{}
+		updater.history.view(r.PathValue("coin")+r.PathValue("fiat"), func(rates []exchangeRate) {
+			for _, rate := range rates {
+				if (!from.IsZero() && rate.timestamp.Before(from)) || (!to.IsZero() && rate.timestamp.After(to)) {
+					continue
+				}
+				entries = append(entries, adminHistoryEntry{Timestamp: rate.timestamp, Value: rate.value})
+			}
+		})
+		updater.writeAdminJSON(w, entries)
+	})
+	mux.HandleFunc("GET /rates/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		updater.writeAdminJSON(w, updater.Diagnostics())
+	})
+	mux.HandleFunc("POST /rates/pause", func(w http.ResponseWriter, r *http.Request) {
+		updater.Pause()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /rates/resume", func(w http.ResponseWriter, r *http.Request) {
+		updater.Resume()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// parseAdminTime parses a unix timestamp in seconds. An empty string is the zero time.
+func parseAdminTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// writeAdminJSON responds with the JSON encoded value.
+func (updater *RateUpdater) writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		updater.log.WithError(err).Error("could not write admin server response")
+	}
+}
+
+// startAdminServer starts the admin server if configured. See WithAdminServer.
+// Failing to listen is logged and the updater continues without it.
+func (updater *RateUpdater) startAdminServer() {
+	if updater.adminAddr == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", updater.adminAddr)
+	if err != nil {
+		updater.log.WithError(err).Errorf("could not start the admin server at %s", updater.adminAddr)
+		return
+	}
+	updater.adminListenAddr = listener.Addr().String()
+	updater.adminServer = &http.Server{
+		Handler:           updater.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	server := updater.adminServer
+	updater.goTracked(func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			updater.log.WithError(err).Error("admin server")
+		}
+	})
+}
+
+// stopAdminServer closes the admin server and all its connections, if started.
+func (updater *RateUpdater) stopAdminServer() {
+	if updater.adminServer == nil {
+		return
+	}
+	if err := updater.adminServer.Close(); err != nil {
+		updater.log.WithError(err).Error("could not close the admin server")
+	}
+}
@@ -0,0 +1,152 @@
+package rates
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminGet requests the path of the admin server and decodes the JSON response into value.
+func adminGet(t *testing.T, serverURL, path string, value interface{}) {
+	t.Helper()
+	res, err := http.Get(serverURL + path)
+	require.NoError(t, err)
+	defer res.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(res.Body).Decode(value))
+}
+
+func TestAdminServerCurrent(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	ts := httptest.NewServer(updater.adminHandler())
+	defer ts.Close()
+
+	var last map[string]map[string]float64
+	adminGet(t, ts.URL, "/rates/current", &last)
+	assert.Equal(t, updater.LatestPrice(), last)
+
+	updater.last = nil
+	res, err := http.Get(ts.URL + "/rates/current")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func TestAdminServerHistory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	ts := httptest.NewServer(updater.adminHandler())
+	defer ts.Close()
+
+	var entries []adminHistoryEntry
+	adminGet(t, ts.URL, "/rates/history/btc/USD", &entries)
+	require.Len(t, entries, 4)
+	assert.Equal(t, 1.0, entries[0].Value)
+	assert.True(t, entries[0].Timestamp.Equal(time.Unix(1598832062, 0)))
+
+	entries = nil
+	adminGet(t, ts.URL, "/rates/history/btc/USD?from=1598918700&to=1598922501", &entries)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 2.0, entries[0].Value)
+	assert.Equal(t, 3.0, entries[1].Value)
+
+	entries = nil
+	adminGet(t, ts.URL, "/rates/history/btc/USD?from=1598922502", &entries)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 4.0, entries[0].Value)
+
+	entries = nil
+	adminGet(t, ts.URL, "/rates/history/eth/EUR", &entries)
+	assert.Empty(t, entries)
+
+	res, err := http.Get(ts.URL + "/rates/history/btc/USD?from=yesterday")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestAdminServerDiagnostics(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	ts := httptest.NewServer(updater.adminHandler())
+	defer ts.Close()
+
+	var diag RateDiagnostics
+	adminGet(t, ts.URL, "/rates/diagnostics", &diag)
+	assert.Equal(t, updater.Diagnostics(), diag)
+	assert.Equal(t, []string{"btcUSD", "ltcUSD"}, diag.ActiveHistoryPairs)
+}
+
+func TestAdminServerPauseResume(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	ts := httptest.NewServer(updater.adminHandler())
+	defer ts.Close()
+
+	post := func(path string) int {
+		res, err := http.Post(ts.URL+path, "", nil)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	require.Equal(t, http.StatusNoContent, post("/rates/pause"))
+	assert.True(t, updater.Paused())
+	var diag RateDiagnostics
+	adminGet(t, ts.URL, "/rates/diagnostics", &diag)
+	assert.True(t, diag.Paused)
+
+	require.Equal(t, http.StatusNoContent, post("/rates/resume"))
+	assert.False(t, updater.Paused())
+
+	res, err := http.Get(ts.URL + "/rates/pause")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	assert.False(t, updater.Paused())
+}
+
+func TestWithAdminServer(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().
+		On("/api/v3/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithAdminServer("127.0.0.1:0"),
+		WithClockFunc(clock.Now), WithTimer(clock), WithLogger(newTestLogger()))
+	updater.coingeckoURL = "https://example.com/api/v3"
+	updater.Pause()
+	updater.StartCurrentRates()
+	require.NotEmpty(t, updater.adminListenAddr)
+
+	var diag RateDiagnostics
+	adminGet(t, "http://"+updater.adminListenAddr, "/rates/diagnostics", &diag)
+	assert.True(t, diag.Paused)
+	// The paused loop waits for the next interval without updating.
+	clock.BlockUntil(1)
+	assert.Empty(t, mock.Requests())
+
+	updater.Stop()
+	_, err := http.Get("http://" + updater.adminListenAddr + "/rates/diagnostics")
+	assert.Error(t, err)
+}
+
+func TestWithAdminServerInvalidAddr(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithAdminServer("invalid"), WithLogger(newTestLogger()))
+	updater.Pause()
+	updater.StartCurrentRates()
+	defer updater.Stop()
+	assert.Empty(t, updater.adminListenAddr)
+	assert.Nil(t, updater.adminServer)
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"go.etcd.io/bbolt"
+)
+
+// annotationsBucket is the database bucket of the event annotations, keyed by their ID as 8 bytes
+// big endian, with the JSON encoded annotations as values. It is not a coin+fiat pair, so it
+// doesn't clash with the history buckets.
+var annotationsBucket = []byte("annotations")
+
+// EventAnnotation marks a significant market event on a timeline, e.g. "Bitcoin halving".
+type EventAnnotation struct {
+	// ID identifies the annotation for UpdateEventAnnotation and DeleteEventAnnotation.
+	ID    uint64    `json:"id"`
+	Time  time.Time `json:"time"`
+	Label string    `json:"label"`
+}
+
+func annotationKey(id uint64) []byte {
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], id)
+	return key[:]
+}
+
+// putAnnotation stores the annotation in the annotations bucket, creating it if needed.
+func putAnnotation(tx *bbolt.Tx, annotation EventAnnotation) error {
+	bucket, err := tx.CreateBucketIfNotExists(annotationsBucket)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(annotation)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(annotationKey(annotation.ID), value)
+}
+
+// AddEventAnnotation stores an annotation of an event at t in the database cache, so that it
+// persists across restarts. It returns the annotation with its newly assigned ID.
+func (updater *RateUpdater) AddEventAnnotation(t time.Time, label string) (EventAnnotation, error) {
+	annotation := EventAnnotation{Time: t, Label: label}
+	err := updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(annotationsBucket)
+		if err != nil {
+			return err
+		}
+		if annotation.ID, err = bucket.NextSequence(); err != nil {
+			return err
+		}
+		return putAnnotation(tx, annotation)
+	})
+	if err != nil {
+		return EventAnnotation{}, errp.WithStack(err)
+	}
+	return annotation, nil
+}
+
+// UpdateEventAnnotation replaces the time and label of the annotation with the given ID.
+// An error is returned if there is no such annotation.
+func (updater *RateUpdater) UpdateEventAnnotation(id uint64, t time.Time, label string) error {
+	return errp.WithStack(updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(annotationsBucket)
+		if bucket == nil || bucket.Get(annotationKey(id)) == nil {
+			return errp.Newf("no event annotation with ID %d", id)
+		}
+		return putAnnotation(tx, EventAnnotation{ID: id, Time: t, Label: label})
+	}))
+}
+
+// DeleteEventAnnotation removes the annotation with the given ID.
+// An error is returned if there is no such annotation.
+func (updater *RateUpdater) DeleteEventAnnotation(id uint64) error {
+	return errp.WithStack(updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(annotationsBucket)
+		if bucket == nil || bucket.Get(annotationKey(id)) == nil {
+			return errp.Newf("no event annotation with ID %d", id)
+		}
+		return bucket.Delete(annotationKey(id))
+	}))
+}
+
+// EventAnnotations returns the annotations of events in the period [from, to], sorted by time.
+// Errors reading the database cache are logged and result in no annotations.
+func (updater *RateUpdater) EventAnnotations(from, to time.Time) []EventAnnotation {
+	var annotations []EventAnnotation
+	err := updater.historyDB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(annotationsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var annotation EventAnnotation
+			if err := json.Unmarshal(v, &annotation); err != nil {
+				return err
+			}
+			if !annotation.Time.Before(from) && !annotation.Time.After(to) {
+				annotations = append(annotations, annotation)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		updater.log.WithError(err).Error("EventAnnotations")
+		return nil
+	}
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Time.Before(annotations[j].Time)
+	})
+	return annotations
+}
@@ -0,0 +1,70 @@
+package rates
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventAnnotations(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestEventAnnotations")
+	defer os.RemoveAll(dbdir)
+	halving := time.Date(2020, 5, 11, 19, 23, 0, 0, time.UTC)
+	hack := time.Date(2022, 11, 11, 0, 0, 0, 0, time.UTC)
+
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	assert.Empty(t, updater.EventAnnotations(time.Time{}, hack))
+	hackAnnotation, err := updater.AddEventAnnotation(hack, "Exchange hack")
+	require.NoError(t, err)
+	halvingAnnotation, err := updater.AddEventAnnotation(halving, "Bitcoin halving")
+	require.NoError(t, err)
+	assert.NotEqual(t, hackAnnotation.ID, halvingAnnotation.ID)
+	assert.Equal(t, "Bitcoin halving", halvingAnnotation.Label)
+
+	// Sorted by time, the period is inclusive.
+	annotations := updater.EventAnnotations(halving, hack)
+	require.Len(t, annotations, 2)
+	assert.Equal(t, "Bitcoin halving", annotations[0].Label)
+	assert.True(t, annotations[0].Time.Equal(halving))
+	assert.Equal(t, "Exchange hack", annotations[1].Label)
+	assert.Len(t, updater.EventAnnotations(halving.Add(time.Second), hack), 1)
+	assert.Empty(t, updater.EventAnnotations(hack.Add(time.Second), hack.Add(time.Hour)))
+	// Not a history pair.
+	pairs, err := updater.ListTrackedPairs(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pairs)
+
+	require.NoError(t, updater.UpdateEventAnnotation(hackAnnotation.ID, hack.Add(time.Hour), "FTX collapse"))
+	require.Error(t, updater.UpdateEventAnnotation(42, hack, "missing"))
+	updater.Stop()
+
+	// Persisted across restarts.
+	updater2 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater2.Stop()
+	annotations = updater2.EventAnnotations(time.Time{}, hack.Add(24*time.Hour))
+	require.Len(t, annotations, 2)
+	assert.Equal(t, hackAnnotation.ID, annotations[1].ID)
+	assert.Equal(t, "FTX collapse", annotations[1].Label)
+	assert.True(t, annotations[1].Time.Equal(hack.Add(time.Hour)))
+
+	require.NoError(t, updater2.DeleteEventAnnotation(halvingAnnotation.ID))
+	require.Error(t, updater2.DeleteEventAnnotation(halvingAnnotation.ID))
+	annotations = updater2.EventAnnotations(time.Time{}, hack.Add(24*time.Hour))
+	require.Len(t, annotations, 1)
+	assert.Equal(t, "FTX collapse", annotations[0].Label)
+}
+
+func TestEventAnnotationsUnusableDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	_, err := updater.AddEventAnnotation(time.Now(), "label")
+	require.Error(t, err)
+	assert.Empty(t, updater.EventAnnotations(time.Time{}, time.Now()))
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditEntry is a line of the audit log, see WithAuditLog.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"statusCode"`
+	DurationMs int64     `json:"durationMs"`
+	RequestID  string    `json:"requestID"`
+	Error      string    `json:"error"`
+}
+
+// auditLog writes auditEntry lines to a buffered writer. It is safe for concurrent use.
+type auditLog struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// WithAuditLog makes the updater write a JSON line for every request sent to the API:
+//
+//	{"time":..., "url":..., "statusCode":..., "durationMs":..., "requestID":..., "error":...}
+//
+// statusCode is 0 if no response was received, and error is empty on success. requestID is a
+// random UUID identifying the call. Writes to w are buffered and flushed on Stop and StopAndWait.
+func WithAuditLog(w io.Writer) Option {
+	return func(updater *RateUpdater) {
+		updater.auditLog = &auditLog{w: bufio.NewWriter(w)}
+	}
+}
+
+// write appends entry to the log.
+func (l *auditLog) write(entry *auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// flush writes the buffered entries to the underlying writer.
+func (l *auditLog) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Flush()
+}
+
+// audit records an API call started at start, if WithAuditLog is used.
+func (updater *RateUpdater) audit(start time.Time, url string, statusCode int, err error) {
+	if updater.auditLog == nil {
+		return
+	}
+	entry := &auditEntry{
+		Time:       start.UTC(),
+		URL:        url,
+		StatusCode: statusCode,
+		DurationMs: updater.clock().Sub(start).Milliseconds(),
+		RequestID:  uuid.NewString(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := updater.auditLog.write(entry); err != nil {
+		updater.log.WithError(err).Error("could not write the audit log")
+	}
+}
+
+// flushAuditLog flushes the audit log, if WithAuditLog is used.
+func (updater *RateUpdater) flushAuditLog() {
+	if updater.auditLog == nil {
+		return
+	}
+	if err := updater.auditLog.flush(); err != nil {
+		updater.log.WithError(err).Error("could not flush the audit log")
+	}
+}
@@ -0,0 +1,73 @@
+package rates
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("auditlog")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	var buf bytes.Buffer
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		WithAuditLog(&buf),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	updater.coingeckoURL = "https://coingecko.test"
+
+	updater.updateLast(context.Background())
+	mock.On("/simple/price", http.StatusTooManyRequests, "")
+	updater.updateLast(context.Background())
+	assert.Zero(t, buf.Len(), "written before flush")
+
+	updater.Stop()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2)
+
+	for _, entry := range entries {
+		assert.ElementsMatch(t,
+			[]string{"time", "url", "statusCode", "durationMs", "requestID", "error"},
+			keys(entry))
+		assert.Contains(t, entry["url"], "https://coingecko.test/simple/price?")
+		_, err := time.Parse(time.RFC3339Nano, entry["time"].(string))
+		assert.NoError(t, err)
+		_, err = uuid.Parse(entry["requestID"].(string))
+		assert.NoError(t, err)
+	}
+	assert.NotEqual(t, entries[0]["requestID"], entries[1]["requestID"])
+	assert.Equal(t, float64(http.StatusOK), entries[0]["statusCode"])
+	assert.Empty(t, entries[0]["error"])
+	assert.Equal(t, float64(http.StatusTooManyRequests), entries[1]["statusCode"])
+	assert.Equal(t, "bad response code 429", entries[1]["error"])
+}
+
+func keys(m map[string]interface{}) []string {
+	var result []string
+	for key := range m {
+		result = append(result, key)
+	}
+	return result
+}
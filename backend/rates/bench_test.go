@@ -0,0 +1,428 @@
+package rates
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// The benchmarks in this file guard the hot paths of the rates package
+// against performance regressions.
+//
+// To execute them, use the following:
+//
+//     go test -bench=. -benchmem -test.run=Benchmark
+
+// makeHistory returns n exchange rates spaced one minute apart, starting at unix epoch.
+func makeHistory(n int) []exchangeRate {
+	rates := make([]exchangeRate, n)
+	for i := range rates {
+		rates[i] = exchangeRate{
+			value:     float64(i),
+			timestamp: time.Unix(int64(i*60), 0),
+		}
+	}
+	return rates
+}
+
+func BenchmarkHistoricalPriceAt(b *testing.B) {
+	const n = 100000
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": makeHistory(n)})
+
+	tt := []struct {
+		name string
+		at   time.Time
+	}{
+		{"first", time.Unix(0, 0)},
+		{"mid", time.Unix(n/2*60+30, 0)}, // interpolated
+		{"last", time.Unix((n-1)*60, 0)},
+	}
+	for _, test := range tt {
+		b.Run(test.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				updater.HistoricalPriceAt("btc", "USD", test.at)
+			}
+		})
+	}
+}
+
+// BenchmarkHistoricalPriceAtBatch looks up 500 timestamps in a row, similar to
+// what the transactions list does when annotating each transaction with its fiat value.
+func BenchmarkHistoricalPriceAtBatch(b *testing.B) {
+	const n = 100000
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": makeHistory(n)})
+	timestamps := make([]time.Time, 500)
+	for i := range timestamps {
+		timestamps[i] = time.Unix(int64(i*(n/500)*60+30), 0)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, at := range timestamps {
+			updater.HistoricalPriceAt("btc", "USD", at)
+		}
+	}
+}
+
+func BenchmarkUpdateLast(b *testing.B) {
+	var body strings.Builder
+	body.WriteString("{")
+	first := true
+	for geckoID := range geckoCoinToUnit {
+		if !first {
+			body.WriteString(",")
+		}
+		first = false
+		fmt.Fprintf(&body, "%q:{", geckoID)
+		i := 0
+		for geckoFiat := range fromGeckoFiat {
+			if i > 0 {
+				body.WriteString(",")
+			}
+			fmt.Fprintf(&body, "%q:%d.%d", geckoFiat, 10000+i, i)
+			i++
+		}
+		body.WriteString("}")
+	}
+	body.WriteString("}")
+	response := body.String()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	defer ts.Close()
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		updater.updateLast(context.Background())
+	}
+	b.StopTimer()
+	require.NotEmpty(b, updater.last, "updater.last")
+}
+
+// BenchmarkParseSimplePrice measures decoding of a /simple/price response larger
+// than what is currently requested: 50 coins with 17 currencies each.
+func BenchmarkParseSimplePrice(b *testing.B) {
+	response := make(map[string]map[string]float64)
+	for i := 0; i < 50; i++ {
+		val := make(map[string]float64)
+		for j := 0; j < 17; j++ {
+			val[fmt.Sprintf("fiat%d", j)] = float64(i*1000+j) + 0.123456
+		}
+		response[fmt.Sprintf("coin-%d", i)] = val
+	}
+	body, err := json.Marshal(response)
+	require.NoError(b, err, "json.Marshal")
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var geckoRates map[string]map[string]float64
+		if err := json.Unmarshal(body, &geckoRates); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDumpHistoryBucket1000(b *testing.B) {
+	rates := makeHistory(1000)
+	updater := NewRateUpdater(nil, test.TstTempDir("BenchmarkDumpHistoryBucket1000"), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := updater.dumpHistoryBucket("btcUSD", rates)
+		require.NoError(b, err, "updater.dumpHistoryBucket")
+	}
+}
+
+// BenchmarkRatesDeepEqual measures the comparison updateLast does on every
+// iteration to decide whether to notify observers.
+func BenchmarkRatesDeepEqual(b *testing.B) {
+	makeRates := func() map[string]map[string]float64 {
+		rates := make(map[string]map[string]float64)
+		for _, coinUnit := range geckoCoinToUnit {
+			val := make(map[string]float64)
+			for _, fiat := range fromGeckoFiat {
+				val[fiat] = 12345.678
+			}
+			rates[coinUnit] = val
+		}
+		return rates
+	}
+	a, c := makeRates(), makeRates()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !reflect.DeepEqual(a, c) {
+			b.Fatal("rates differ")
+		}
+	}
+}
+
+// makePriceHistory returns n hourly BTC/USD-like rates.
+func makePriceHistory(n int) []exchangeRate {
+	rates := makeHistory(n)
+	value := 10000.0
+	for i := range rates {
+		rates[i].timestamp = time.Unix(1598918400+int64(i)*3600, 0)
+		// Random walk with 2 decimals like the prices returned by CoinGecko.
+		value += float64(rand.Intn(20001)-10000) / 100
+		rates[i].value = value
+	}
+	return rates
+}
+
+// marshalEntries encodes rates as fixed-size records packed sequentially: the 8 bytes big
+// endian unix timestamp in nanoseconds followed by the 8 bytes big endian IEEE 754 float.
+// It is the alternative to encodeDelta compared in BenchmarkHistoryStorage and
+// BenchmarkHistoryEncoding.
+func marshalEntries(rates []exchangeRate) []byte {
+	buf := make([]byte, 0, 16*len(rates))
+	for _, rate := range rates {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(rate.timestamp.UnixNano()))
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(rate.value))
+	}
+	return buf
+}
+
+// unmarshalEntries decodes rates encoded with marshalEntries.
+func unmarshalEntries(data []byte) ([]exchangeRate, error) {
+	if len(data)%16 != 0 {
+		return nil, fmt.Errorf("invalid length %d", len(data))
+	}
+	rates := make([]exchangeRate, 0, len(data)/16)
+	for ; len(data) > 0; data = data[16:] {
+		rates = append(rates, exchangeRate{
+			timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(data))),
+			value:     math.Float64frombits(binary.BigEndian.Uint64(data[8:])),
+		})
+	}
+	return rates, nil
+}
+
+// writeHistoryBucketV2 replaces the bucket identified by the key with a version 2 bucket
+// containing the rates and their granularity, for tests of the migration and comparisons with
+// version 3 in benchmarks.
+func writeHistoryBucketV2(tx *bbolt.Tx, key string, rates []exchangeRate, granularity Granularity) error {
+	if err := tx.DeleteBucket([]byte(key)); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	bucket, err := tx.CreateBucket([]byte(key))
+	if err != nil {
+		return err
+	}
+	if err := bucket.Put(historyGranularityKey, []byte{byte(granularity)}); err != nil {
+		return err
+	}
+	return bucket.Put(historyDeltaKey, encodeDelta(rates))
+}
+
+// BenchmarkHistoryStorage compares the space used by 5000 hourly BTC/USD-like rates
+// in the history bucket schema versions 1, 2 and 3, and with fixed-size records encoded by
+// marshalEntries, reported as bytes per entry.
+// At the time of writing, version 1 used 32 bytes/entry, version 2 and 3 about 9 and the
+// fixed-size records 16.
+func BenchmarkHistoryStorage(b *testing.B) {
+	rates := makePriceHistory(5000)
+	dumpV1 := func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("btcUSD"))
+		if err != nil {
+			return err
+		}
+		for _, rate := range rates {
+			var tsbytes, vbytes [8]byte
+			binary.BigEndian.PutUint64(tsbytes[:], uint64(rate.timestamp.Unix()))
+			binary.BigEndian.PutUint64(vbytes[:], math.Float64bits(rate.value))
+			if err := bucket.Put(tsbytes[:], vbytes[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	dumpV2 := func(tx *bbolt.Tx) error {
+		return writeHistoryBucketV2(tx, "btcUSD", rates, GranularityHourly)
+	}
+	dumpV3 := func(tx *bbolt.Tx) error {
+		return writeHistoryBucket(tx, "btcUSD", rates, GranularityHourly)
+	}
+	dumpFixed := func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("btcUSD"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put(historyDeltaKey, marshalEntries(rates))
+	}
+	for _, v := range []struct {
+		name string
+		dump func(*bbolt.Tx) error
+	}{{"v1", dumpV1}, {"v2", dumpV2}, {"v3", dumpV3}, {"fixed", dumpFixed}} {
+		b.Run(v.name, func(b *testing.B) {
+			var inuse int
+			for i := 0; i < b.N; i++ {
+				db, err := bbolt.Open(test.TstTempFile("BenchmarkHistoryStorage"), 0600, nil)
+				require.NoError(b, err, "bbolt.Open")
+				require.NoError(b, db.Update(v.dump))
+				require.NoError(b, db.View(func(tx *bbolt.Tx) error {
+					stats := tx.Bucket([]byte("btcUSD")).Stats()
+					inuse = stats.LeafInuse + stats.BranchInuse + stats.InlineBucketInuse
+					return nil
+				}))
+				require.NoError(b, db.Close())
+			}
+			b.ReportMetric(float64(inuse)/float64(len(rates)), "bytes/entry")
+		})
+	}
+}
+
+// BenchmarkHistoryWrite measures the cost of storing one new hourly rate in a bucket with
+// 2 years of hourly rates, like the history update loop does, in the history bucket schema
+// versions 2 and 3. Each write reads the bucket, merges the new rate and writes the result.
+// Besides the time, the bytes of the pages written per stored rate are reported.
+// At the time of writing, version 2 wrote about 170kB per rate, as the whole history is
+// rewritten, and version 3 about 34kB, as only the chunk of the current month is. Both took
+// about 3ms, most of it spent reading and merging the whole history.
+func BenchmarkHistoryWrite(b *testing.B) {
+	const n = 2 * 365 * 24
+	for _, v := range []struct {
+		name  string
+		write func(tx *bbolt.Tx, key string, rates []exchangeRate, granularity Granularity) error
+	}{{"v2", writeHistoryBucketV2}, {"v3", writeHistoryBucket}} {
+		b.Run(v.name, func(b *testing.B) {
+			db, err := bbolt.Open(test.TstTempFile("BenchmarkHistoryWrite"), 0600, nil)
+			require.NoError(b, err, "bbolt.Open")
+			defer db.Close() //nolint:errcheck
+			rates := makePriceHistory(n)
+			require.NoError(b, db.Update(func(tx *bbolt.Tx) error {
+				return v.write(tx, "btcUSD", rates, GranularityHourly)
+			}))
+			next := rates[len(rates)-1]
+			before := db.Stats()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				next.timestamp = next.timestamp.Add(time.Hour)
+				next.value++
+				err := db.Update(func(tx *bbolt.Tx) error {
+					existing, err := readHistoryBucket(tx.Bucket([]byte("btcUSD")))
+					if err != nil {
+						return err
+					}
+					merged := mergeHistoryEntries(existing, []exchangeRate{next})
+					return v.write(tx, "btcUSD", merged, GranularityHourly)
+				})
+				require.NoError(b, err)
+			}
+			b.StopTimer()
+			after := db.Stats()
+			stats := after.Sub(&before)
+			b.ReportMetric(float64(stats.TxStats.GetPageAlloc())/float64(b.N), "written-B/op")
+		})
+	}
+}
+
+// BenchmarkHistoryEncoding compares the throughput of encoding and decoding 5000 hourly
+// BTC/USD-like rates with encodeDelta, used by the history bucket schema versions 2 and 3, and with
+// fixed-size records encoded by marshalEntries.
+func BenchmarkHistoryEncoding(b *testing.B) {
+	rates := makePriceHistory(5000)
+	for _, v := range []struct {
+		name   string
+		encode func([]exchangeRate) []byte
+		decode func([]byte) ([]exchangeRate, error)
+	}{{"delta", encodeDelta, decodeDelta}, {"fixed", marshalEntries, unmarshalEntries}} {
+		b.Run(v.name+"/write", func(b *testing.B) {
+			b.SetBytes(int64(16 * len(rates)))
+			for i := 0; i < b.N; i++ {
+				v.encode(rates)
+			}
+		})
+		b.Run(v.name+"/read", func(b *testing.B) {
+			data := v.encode(rates)
+			b.SetBytes(int64(16 * len(rates)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				decoded, err := v.decode(data)
+				require.NoError(b, err)
+				require.Len(b, decoded, len(rates))
+			}
+		})
+	}
+}
+
+// BenchmarkDailyPriceAt looks up the closing rates of 365 days in a row, similar to what a
+// portfolio chart with a data point per day does, comparing the cached and uncached lookups.
+func BenchmarkDailyPriceAt(b *testing.B) {
+	const n = 2 * 365 * 24 * 12 // 2 years of 5 minute rates
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": makeHistory(n)})
+	days := make([]time.Time, 365)
+	for i := range days {
+		days[i] = time.Unix(int64(i*secondsPerDay), 0)
+	}
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, day := range days {
+				updater.history.view("btcUSD", func(rates []exchangeRate) {
+					closingPrice(rates, unixDay(day))
+				})
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, day := range days {
+				updater.DailyPriceAt("btc", "USD", day)
+			}
+		}
+	})
+}
+
+// BenchmarkHistoricalPriceAtFromDB measures HistoricalPriceAt for a pair with rates only in the
+// database cache, see QueryPlanner. Timestamps outside of their range don't read the database.
+func BenchmarkHistoricalPriceAtFromDB(b *testing.B) {
+	const n = 10000
+	dbdir := test.TstTempDir("BenchmarkHistoricalPriceAtFromDB")
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.NoError(b, updater.dumpHistoryBucket("btcUSD", makeHistory(n)))
+
+	tt := []struct {
+		name string
+		at   time.Time
+	}{
+		{"in-range", time.Unix(n/2*60+30, 0)},
+		{"out-of-range", time.Unix(n*60, 0)},
+	}
+	for _, test := range tt {
+		b.Run(test.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				updater.HistoricalPriceAt("btc", "USD", test.at)
+			}
+		})
+	}
+}
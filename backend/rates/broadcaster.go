@@ -0,0 +1,142 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+)
+
+// RatesBroadcaster fans out the events of a RateUpdater to subscribers, each served by its
+// own goroutine, so that a slow subscriber does not block the updater or other subscribers.
+//
+// RatesBroadcaster is safe for concurrent use.
+type RatesBroadcaster struct {
+	updater *RateUpdater
+	// capacity is the number of events buffered per subscriber.
+	capacity int
+	// maxBlocked is how long a subscriber's buffer may stay full before it is unsubscribed.
+	maxBlocked time.Duration
+	unobserve  func()
+
+	mu          sync.Mutex
+	subscribers map[int]*broadcastSubscriber
+	nextID      int
+}
+
+// broadcastSubscriber is a subscriber of RatesBroadcaster.
+type broadcastSubscriber struct {
+	events chan observable.Event
+	// done is closed when the subscriber is unsubscribed, stopping its dispatch goroutine.
+	done chan struct{}
+	// fullSince is when an event was first dropped because events was full,
+	// or zero if the last event was delivered.
+	fullSince time.Time
+}
+
+// NewRatesBroadcaster starts broadcasting the events of updater until Close is called.
+// Each subscriber buffers up to capacity events. Events are dropped while a subscriber's
+// buffer is full, and the subscriber is unsubscribed if this lasts longer than maxBlocked.
+func NewRatesBroadcaster(updater *RateUpdater, capacity int, maxBlocked time.Duration) *RatesBroadcaster {
+	broadcaster := &RatesBroadcaster{
+		updater:     updater,
+		capacity:    capacity,
+		maxBlocked:  maxBlocked,
+		subscribers: map[int]*broadcastSubscriber{},
+	}
+	broadcaster.unobserve = updater.Observe(broadcaster.broadcast)
+	return broadcaster
+}
+
+// Subscribe calls fn with every event of the updater in a goroutine dedicated to fn.
+// The returned function unsubscribes fn. Events still buffered are dropped then.
+func (broadcaster *RatesBroadcaster) Subscribe(fn func(observable.Event)) func() {
+	subscriber := &broadcastSubscriber{
+		events: make(chan observable.Event, broadcaster.capacity),
+		done:   make(chan struct{}),
+	}
+	broadcaster.mu.Lock()
+	id := broadcaster.nextID
+	broadcaster.nextID++
+	broadcaster.subscribers[id] = subscriber
+	broadcaster.mu.Unlock()
+
+	go func() {
+		for {
+			select {
+			case <-subscriber.done:
+				return
+			case event := <-subscriber.events:
+				select {
+				case <-subscriber.done:
+					return
+				default:
+				}
+				fn(event)
+			}
+		}
+	}()
+	return func() {
+		broadcaster.mu.Lock()
+		defer broadcaster.mu.Unlock()
+		broadcaster.unsubscribe(id)
+	}
+}
+
+// Close stops broadcasting and unsubscribes all subscribers.
+func (broadcaster *RatesBroadcaster) Close() {
+	broadcaster.unobserve()
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+	for id := range broadcaster.subscribers {
+		broadcaster.unsubscribe(id)
+	}
+}
+
+// unsubscribe removes a subscriber if it still exists. broadcaster.mu must be held.
+func (broadcaster *RatesBroadcaster) unsubscribe(id int) {
+	subscriber, ok := broadcaster.subscribers[id]
+	if !ok {
+		return
+	}
+	delete(broadcaster.subscribers, id)
+	close(subscriber.done)
+}
+
+// broadcast queues event for all subscribers without blocking.
+func (broadcaster *RatesBroadcaster) broadcast(event observable.Event) {
+	now := broadcaster.updater.clock()
+	broadcaster.mu.Lock()
+	defer broadcaster.mu.Unlock()
+	for id, subscriber := range broadcaster.subscribers {
+		select {
+		case subscriber.events <- event:
+			subscriber.fullSince = time.Time{}
+			continue
+		default:
+		}
+		if subscriber.fullSince.IsZero() {
+			subscriber.fullSince = now
+		}
+		if blocked := now.Sub(subscriber.fullSince); blocked > broadcaster.maxBlocked {
+			broadcaster.updater.log.
+				WithField("subject", event.Subject).
+				Errorf("unsubscribing rates subscriber blocked for %v", blocked)
+			broadcaster.unsubscribe(id)
+		}
+	}
+}
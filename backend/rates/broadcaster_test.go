@@ -0,0 +1,106 @@
+package rates
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatesBroadcasterSlowSubscriber(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var clockMu sync.Mutex
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	advance := func(d time.Duration) {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(d)
+	}
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()), WithClockFunc(func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}))
+	broadcaster := NewRatesBroadcaster(updater, 1, time.Minute)
+	defer broadcaster.Close()
+
+	fast := make(chan string, 10)
+	broadcaster.Subscribe(func(event observable.Event) { fast <- event.Subject })
+
+	slowStarted := make(chan struct{}, 10)
+	release := make(chan struct{})
+	var slowMu sync.Mutex
+	var slowEvents []string
+	broadcaster.Subscribe(func(event observable.Event) {
+		slowMu.Lock()
+		slowEvents = append(slowEvents, event.Subject)
+		slowMu.Unlock()
+		slowStarted <- struct{}{}
+		<-release
+	})
+
+	// notify broadcasts an event and waits for the fast subscriber to get it, showing that it
+	// is not delayed by the slow one.
+	notify := func(subject string) {
+		t.Helper()
+		updater.Notify(observable.Event{Subject: subject})
+		select {
+		case got := <-fast:
+			assert.Equal(t, subject, got)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timeout", "event %s", subject)
+		}
+	}
+	subscribers := func() int {
+		broadcaster.mu.Lock()
+		defer broadcaster.mu.Unlock()
+		return len(broadcaster.subscribers)
+	}
+
+	// The slow subscriber blocks on the first event, the second one is buffered.
+	notify("1")
+	<-slowStarted
+	notify("2")
+	// The buffer is full, the slow subscriber misses these.
+	notify("3")
+	advance(time.Minute)
+	notify("4")
+	assert.Equal(t, 2, subscribers())
+	// Full for longer than a minute: unsubscribed.
+	advance(time.Second)
+	notify("5")
+	assert.Equal(t, 1, subscribers())
+
+	// Once unblocked, the unsubscribed slow subscriber gets no further events.
+	close(release)
+	notify("6")
+	time.Sleep(10 * time.Millisecond)
+	slowMu.Lock()
+	defer slowMu.Unlock()
+	assert.Equal(t, []string{"1"}, slowEvents)
+}
+
+func TestRatesBroadcasterUnsubscribe(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	broadcaster := NewRatesBroadcaster(updater, 10, time.Minute)
+
+	events := make(chan string, 10)
+	unsubscribe := broadcaster.Subscribe(func(event observable.Event) { events <- event.Subject })
+	updater.Notify(observable.Event{Subject: RatesEventSubject})
+	assert.Equal(t, RatesEventSubject, <-events)
+
+	unsubscribe()
+	unsubscribe()
+	updater.Notify(observable.Event{Subject: RatesEventSubject})
+	broadcaster.Subscribe(func(observable.Event) {})
+	broadcaster.Close()
+	broadcaster.mu.Lock()
+	assert.Empty(t, broadcaster.subscribers)
+	broadcaster.mu.Unlock()
+	updater.Notify(observable.Event{Subject: RatesEventSubject})
+	assert.Empty(t, events)
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"go.etcd.io/bbolt"
+)
+
+// ErrCallBudgetExhausted is returned for requests to the API once the monthly call budget set
+// with WithMonthlyCallBudget is used up.
+const ErrCallBudgetExhausted errp.ErrorCode = "callBudgetExhausted"
+
+var (
+	// apiCallsBucket is the database bucket of the API call counter. It is not a coin+fiat
+	// pair, so it doesn't clash with the history buckets.
+	apiCallsBucket = []byte("apicalls")
+	// apiCallsMonthKey is the key of the month the counter is for, formatted by callMonth.
+	// A different month resets the counter.
+	apiCallsMonthKey = []byte("month")
+	// apiCallsCountKey is the key of the counter as 8 bytes big endian.
+	apiCallsCountKey = []byte("count")
+)
+
+// APICallBudget is the usage of the monthly API call budget. See RateUpdater.RemainingBudget.
+type APICallBudget struct {
+	// CallsThisMonth is the number of API requests made in the current UTC month.
+	CallsThisMonth int `json:"callsThisMonth"`
+	// EstimatedCost is CallsThisMonth times the cost set with WithAPICallCost.
+	EstimatedCost float64 `json:"estimatedCost"`
+	// BudgetLimit is the limit set with WithMonthlyCallBudget, zero if unlimited.
+	BudgetLimit int `json:"budgetLimit"`
+}
+
+// WithMonthlyCallBudget limits the number of API requests per UTC month. Once reached, a warning
+// is logged and requests fail with ErrCallBudgetExhausted until the next month. The number of
+// requests is stored in the database cache, so it is kept across restarts. Zero, the default,
+// is unlimited.
+//
+// All requests to the API are counted, including the ones of RetryMiddleware and the
+// revalidations of the responses cached with WithHTTPCache, but not the responses used from
+// WithHTTPCache or CachingMiddleware without a request.
+func WithMonthlyCallBudget(limit int) Option {
+	return func(updater *RateUpdater) {
+		updater.callBudget = limit
+	}
+}
+
+// WithAPICallCost sets the cost of an API request used for APICallBudget.EstimatedCost,
+// e.g. the price of the API plan divided by its monthly call credits.
+func WithAPICallCost(cost float64) Option {
+	return func(updater *RateUpdater) {
+		updater.callCost = cost
+	}
+}
+
+// callMonth returns the UTC month of t, which identifies the counted API calls.
+func callMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// RemainingBudget returns the usage of the monthly API call budget.
+func (updater *RateUpdater) RemainingBudget() APICallBudget {
+	updater.callsMu.Lock()
+	defer updater.callsMu.Unlock()
+	updater.resetCallsIfNewMonth()
+	return APICallBudget{
+		CallsThisMonth: updater.calls,
+		EstimatedCost:  float64(updater.calls) * updater.callCost,
+		BudgetLimit:    updater.callBudget,
+	}
+}
+
+// resetCallsIfNewMonth resets the API call counter if the current month differs from the
+// counted one. callsMu must be held.
+func (updater *RateUpdater) resetCallsIfNewMonth() {
+	if month := callMonth(updater.clock()); month != updater.callsMonth {
+		updater.callsMonth = month
+		updater.calls = 0
+	}
+}
+
+// countAPICall counts an API request about to be made. If the monthly call budget is used up,
+// it returns ErrCallBudgetExhausted instead.
+func (updater *RateUpdater) countAPICall() error {
+	updater.callsMu.Lock()
+	defer updater.callsMu.Unlock()
+	updater.resetCallsIfNewMonth()
+	if updater.callBudget > 0 && updater.calls >= updater.callBudget {
+		if updater.callsMonth != updater.callBudgetWarned {
+			updater.callBudgetWarned = updater.callsMonth
+			updater.log.Warningf("monthly API call budget of %d used up, no more requests until the next month",
+				updater.callBudget)
+		}
+		return errp.WithStack(ErrCallBudgetExhausted)
+	}
+	updater.calls++
+	err := updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(apiCallsBucket)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(apiCallsMonthKey, []byte(updater.callsMonth)); err != nil {
+			return err
+		}
+		return bucket.Put(apiCallsCountKey, binary.BigEndian.AppendUint64(nil, uint64(updater.calls)))
+	})
+	if err != nil && err != bbolt.ErrDatabaseNotOpen {
+		// Non-critical: the count is kept in memory.
+		updater.log.WithError(err).Error("could not store the API call count")
+	}
+	return nil
+}
+
+// loadAPICalls restores the API call counter stored by countAPICall.
+func (updater *RateUpdater) loadAPICalls() error {
+	updater.callsMu.Lock()
+	defer updater.callsMu.Unlock()
+	return updater.historyDB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(apiCallsBucket)
+		if bucket == nil {
+			return nil
+		}
+		count := bucket.Get(apiCallsCountKey)
+		if len(count) != 8 {
+			return errp.New("invalid API call count")
+		}
+		updater.callsMonth = string(bucket.Get(apiCallsMonthKey))
+		updater.calls = int(binary.BigEndian.Uint64(count))
+		return nil
+	})
+}
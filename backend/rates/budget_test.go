@@ -0,0 +1,83 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonthlyCallBudget(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestMonthlyCallBudget")
+	defer os.RemoveAll(dbdir)
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintln(w, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	}))
+	defer ts.Close()
+	now := time.Date(2024, 5, 31, 23, 0, 0, 0, time.UTC)
+	newUpdater := func() *RateUpdater {
+		updater := NewRateUpdater(http.DefaultClient, dbdir,
+			WithMonthlyCallBudget(2), WithAPICallCost(0.5),
+			WithClockFunc(func() time.Time { return now }),
+			withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+			WithLogger(newTestLogger()))
+		updater.coingeckoURL = ts.URL
+		return updater
+	}
+	updater := newUpdater()
+	assert.Equal(t, APICallBudget{BudgetLimit: 2}, updater.RemainingBudget())
+
+	updater.updateLast(context.Background())
+	updater.updateLast(context.Background())
+	assert.Equal(t, APICallBudget{CallsThisMonth: 2, EstimatedCost: 1, BudgetLimit: 2}, updater.RemainingBudget())
+	updater.updateLast(context.Background())
+	assert.Equal(t, 2, requests)
+	assert.Contains(t, updater.Diagnostics().LastFetchError, string(ErrCallBudgetExhausted))
+	_, err := updater.fetch(context.Background(), ts.URL+"/coins/list")
+	assert.Equal(t, ErrCallBudgetExhausted, errp.Cause(err))
+	updater.Stop()
+
+	// The count is kept across restarts.
+	updater = newUpdater()
+	defer func() { updater.Stop() }()
+	assert.Equal(t, 2, updater.RemainingBudget().CallsThisMonth)
+	updater.updateLast(context.Background())
+	assert.Equal(t, 2, requests)
+
+	// And reset in the next month.
+	now = now.Add(time.Hour)
+	assert.Zero(t, updater.RemainingBudget().CallsThisMonth)
+	updater.updateLast(context.Background())
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, 1, updater.RemainingBudget().CallsThisMonth)
+	updater.Stop()
+	updater = newUpdater()
+	assert.Equal(t, 1, updater.RemainingBudget().CallsThisMonth)
+}
+
+func TestMonthlyCallBudgetUnlimited(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := newSimplePriceServer(t, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	for i := 0; i < 3; i++ {
+		updater.updateLast(context.Background())
+	}
+	assert.Empty(t, updater.Diagnostics().LastFetchError)
+	require.Equal(t, APICallBudget{CallsThisMonth: 3}, updater.RemainingBudget())
+}
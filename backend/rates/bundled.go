@@ -0,0 +1,176 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// defaultBundledSnapshotMaxAge is how old a bundled rates snapshot may be to be used by default.
+const defaultBundledSnapshotMaxAge = 30 * 24 * time.Hour
+
+// WithBundledAsset makes NewRateUpdater warm up the latest rates with the snapshot at path
+// in fs, see WarmFromBundledAsset. Errors are logged.
+func WithBundledAsset(fs embed.FS, path string) Option {
+	return func(updater *RateUpdater) {
+		updater.bundledFS = &fs
+		updater.bundledPath = path
+	}
+}
+
+// WithBundledSnapshotMaxAge sets how old a bundled rates snapshot may be to be used.
+// The default is 30 days.
+func WithBundledSnapshotMaxAge(maxAge time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.bundledMaxAge = maxAge
+	}
+}
+
+// WarmFromBundledAsset sets the latest rates to the snapshot at path in fs, so that rates
+// can be shown on first launch without internet. The rates are marked as stale until they
+// are fetched, see IsLatestPriceStale. No event is notified.
+//
+// The snapshot is refused if it is older than the max age, see WithBundledSnapshotMaxAge,
+// or if the latest rates have already been fetched.
+// WarmFromBundledAsset must be called before StartCurrentRates.
+func (updater *RateUpdater) WarmFromBundledAsset(fs embed.FS, path string) error {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	var snapshot RateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return errp.WithMessage(err, "could not parse bundled rates snapshot")
+	}
+	if age := updater.clock().Sub(snapshot.Timestamp); age > updater.bundledMaxAge {
+		return errp.Newf("bundled rates snapshot is too old: %s", age.Round(time.Hour))
+	}
+	if len(snapshot.Rates) == 0 {
+		return errp.New("bundled rates snapshot is empty")
+	}
+	updater.lastMu.Lock()
+	defer updater.lastMu.Unlock()
+	if len(updater.last) > 0 {
+		return errp.New("latest rates already available")
+	}
+	updater.last = snapshot.Rates
+	updater.lastStale = true
+	return nil
+}
+
+// IsLatestPriceStale reports whether the rates returned by LatestPrice are from a bundled
+// snapshot and not fetched yet.
+func (updater *RateUpdater) IsLatestPriceStale() bool {
+	updater.lastMu.RLock()
+	defer updater.lastMu.RUnlock()
+	return updater.lastStale
+}
+
+// bundledHistorySnapshot is the format of a bundled historical rates snapshot, generated at
+// release build time and stored gzip compressed.
+type bundledHistorySnapshot struct {
+	// Timestamp is when the rates were fetched.
+	Timestamp time.Time `json:"timestamp"`
+	// Rates are keyed by coin+fiat pair, e.g. "btcUSD", as [unix timestamp in seconds, value]
+	// sorted by timestamp in ascending order.
+	Rates map[string][][2]float64 `json:"rates"`
+}
+
+// WithBundledHistory configures the historical rates snapshot used by PrewarmFromBundledHistory,
+// a gzip compressed file at path in fs. Release builds bundle the last 90 days of the main
+// coins and fiats.
+func WithBundledHistory(fs embed.FS, path string) Option {
+	return func(updater *RateUpdater) {
+		updater.bundledHistoryFS = &fs
+		updater.bundledHistoryPath = path
+	}
+}
+
+// PrewarmFromBundledHistory loads the historical rates snapshot configured with
+// WithBundledHistory, so that historical rates can be shown on first launch without internet.
+// The bundled rates are used for pairs which have no historical rates yet, now and when they
+// are configured later with ReconfigureHistory. They are never stored in the database cache,
+// and are replaced by the fetched rates of a pair as soon as they arrive.
+func (updater *RateUpdater) PrewarmFromBundledHistory() error {
+	if updater.bundledHistoryFS == nil {
+		return errp.New("no bundled historical rates configured")
+	}
+	file, err := updater.bundledHistoryFS.Open(updater.bundledHistoryPath)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer file.Close() //nolint:errcheck
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return errp.WithMessage(err, "could not decompress bundled historical rates")
+	}
+	var snapshot bundledHistorySnapshot
+	if err := json.NewDecoder(reader).Decode(&snapshot); err != nil {
+		return errp.WithMessage(err, "could not parse bundled historical rates")
+	}
+	bundled := make(map[string][]exchangeRate, len(snapshot.Rates))
+	for key, values := range snapshot.Rates {
+		if _, _, ok := splitHistoryKey(key); !ok {
+			updater.log.Errorf("bundled historical rates: unsupported pair %q", key)
+			continue
+		}
+		rates := make([]exchangeRate, len(values))
+		for i, v := range values {
+			rates[i] = exchangeRate{
+				value:     v[1],
+				timestamp: time.Unix(int64(v[0]), 0),
+				bundled:   true,
+			}
+		}
+		// Sorts and removes duplicates in case the snapshot has any.
+		bundled[key] = mergeHistoryEntries(nil, rates)
+	}
+	if len(bundled) == 0 {
+		return errp.New("bundled historical rates are empty")
+	}
+
+	updater.historyGoMu.Lock()
+	defer updater.historyGoMu.Unlock()
+	updater.bundledHistory = bundled
+	for key := range updater.historyGo {
+		updater.prewarmHistoryKey(key)
+	}
+	return nil
+}
+
+// prewarmHistoryKey sets the history of the coin+fiat pair given as a key to the bundled
+// rates, unless it has rates already. It must be called with historyGoMu held.
+func (updater *RateUpdater) prewarmHistoryKey(key string) {
+	bundled := updater.bundledHistory[key]
+	if len(bundled) == 0 {
+		return
+	}
+	var prewarmed bool
+	updater.history.update(key, func(rates []exchangeRate) []exchangeRate {
+		if len(rates) > 0 {
+			return rates
+		}
+		prewarmed = true
+		return bundled
+	})
+	if prewarmed {
+		updater.invalidateDailyKey(key)
+	}
+}
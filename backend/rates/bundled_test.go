@@ -0,0 +1,137 @@
+package rates
+
+import (
+	"context"
+	"embed"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+//go:embed testdata/rates-snapshot.json testdata/rates-history.json.gz
+var testBundledFS embed.FS
+
+const testBundledPath = "testdata/rates-snapshot.json"
+
+// testBundledHistoryPath has hourly rates of btc, eth and ltc in USD and EUR on 2024-06-01.
+const testBundledHistoryPath = "testdata/rates-history.json.gz"
+
+// testBundledTime is the timestamp of the snapshot in testdata.
+var testBundledTime = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func TestWarmFromBundledAsset(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	clock := testutil.NewFakeClock(testBundledTime.Add(30 * 24 * time.Hour))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithBundledAsset(testBundledFS, testBundledPath),
+		WithClockFunc(clock.Now),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.True(t, updater.IsLatestPriceStale())
+	assert.Equal(t, map[string]map[string]float64{
+		"BTC": {"USD": 67500.5, "EUR": 62200.1},
+		"ETH": {"USD": 3800.25},
+	}, updater.LatestPrice())
+
+	// Fetched rates replace the snapshot.
+	ts := newSimplePriceServer(t, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.updateLast(context.Background())
+	assert.False(t, updater.IsLatestPriceStale())
+	assert.Equal(t, 1.0, updater.LatestPrice()["BTC"]["USD"])
+
+	// Not applied once rates are available.
+	require.Error(t, updater.WarmFromBundledAsset(testBundledFS, testBundledPath))
+	assert.False(t, updater.IsLatestPriceStale())
+}
+
+func TestWarmFromBundledAssetTooOld(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	clock := testutil.NewFakeClock(testBundledTime.Add(2 * time.Hour))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithBundledAsset(testBundledFS, testBundledPath),
+		WithBundledSnapshotMaxAge(time.Hour),
+		WithClockFunc(clock.Now),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.False(t, updater.IsLatestPriceStale())
+	assert.Empty(t, updater.LatestPrice())
+
+	require.Error(t, updater.WarmFromBundledAsset(testBundledFS, testBundledPath))
+	clock.Advance(-time.Hour)
+	require.NoError(t, updater.WarmFromBundledAsset(testBundledFS, testBundledPath))
+	assert.True(t, updater.IsLatestPriceStale())
+	require.Error(t, updater.WarmFromBundledAsset(testBundledFS, "testdata/missing.json"))
+}
+
+func TestPrewarmFromBundledHistory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestPrewarmFromBundledHistory")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(http.DefaultClient, dbdir,
+		WithBundledHistory(testBundledFS, testBundledHistoryPath),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	// Not fetching anything.
+	updater.coingeckoURL = "unused"
+
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	require.NoError(t, updater.PrewarmFromBundledHistory())
+	assert.Equal(t, 67000.0, updater.HistoricalPriceAt("btc", "USD", testBundledTime))
+	assert.Equal(t, testBundledTime.Add(23*time.Hour).Unix(), updater.HistoryLatestTimestamp("btc", "USD").Unix())
+	// Pairs configured later are prewarmed as well.
+	updater.ReconfigureHistory([]string{"btc", "eth"}, []string{"EUR"})
+	assert.Equal(t, 61800.0, updater.HistoricalPriceAt("btc", "EUR", testBundledTime))
+	assert.Equal(t, 3500.0, updater.HistoricalPriceAt("eth", "EUR", testBundledTime))
+	assert.Zero(t, updater.HistoricalPriceAt("btc", "USD", testBundledTime))
+
+	// Fetched rates replace the bundled ones and only they are stored.
+	fetched := []exchangeRate{{value: 1, timestamp: time.Unix(testBundledTime.Add(24*time.Hour).Unix(), 0)}}
+	updater.storeHistory("btc", "EUR", fetched)
+	assert.Zero(t, updater.HistoricalPriceAt("btc", "EUR", testBundledTime))
+	assert.Equal(t, fetched[0].timestamp, updater.HistoryEarliestTimestamp("btc", "EUR"))
+	stored, err := updater.loadHistoryBucket("btcEUR")
+	require.NoError(t, err)
+	assert.Equal(t, fetched, stored)
+	assert.Equal(t, 3500.0, updater.HistoricalPriceAt("eth", "EUR", testBundledTime))
+}
+
+func TestPrewarmFromBundledHistoryStoredRates(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestPrewarmFromBundledHistoryStoredRates")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(http.DefaultClient, dbdir,
+		WithBundledHistory(testBundledFS, testBundledHistoryPath),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "unused"
+	stored := []exchangeRate{{value: 2, timestamp: testBundledTime}}
+	require.NoError(t, updater.dumpHistoryBucket("btcUSD", stored))
+
+	// Not used if there are rates already.
+	require.NoError(t, updater.PrewarmFromBundledHistory())
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	assert.Equal(t, 2.0, updater.HistoricalPriceAt("btc", "USD", testBundledTime))
+}
+
+func TestPrewarmFromBundledHistoryErrors(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.Error(t, updater.PrewarmFromBundledHistory())
+
+	// Not compressed.
+	updater = NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithBundledHistory(testBundledFS, testBundledPath),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.Error(t, updater.PrewarmFromBundledHistory())
+}
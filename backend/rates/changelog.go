@@ -0,0 +1,98 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"time"
+)
+
+// defaultRateChangeLogSize is the default maximum number of entries in the rate change log.
+const defaultRateChangeLogSize = 1000
+
+// RateChangeEntry is a change of a latest rate, see RateChangeLog.
+type RateChangeEntry struct {
+	// Timestamp is when the new rate was fetched.
+	Timestamp time.Time `json:"timestamp"`
+	// Coin and Fiat are the units as in LatestPrice, e.g. "BTC" and "USD".
+	Coin string `json:"coin"`
+	Fiat string `json:"fiat"`
+	// OldRate is 0 if there was no rate for the pair before.
+	OldRate float64 `json:"oldRate"`
+	NewRate float64 `json:"newRate"`
+	// PctChange is the change from OldRate to NewRate in percent, e.g. 10 for a 10% increase.
+	// It is 0 if OldRate is 0.
+	PctChange float64 `json:"pctChange"`
+}
+
+// WithRateChangeLogSize sets the maximum number of entries in the rate change log,
+// see RateChangeLog. The oldest entries are evicted first. The default is 1000.
+func WithRateChangeLogSize(n int) Option {
+	return func(updater *RateUpdater) {
+		updater.changeLogSize = n
+	}
+}
+
+// RateChangeLog returns the changes of the latest rates since StartCurrentRates was called
+// in chronological order, limited to the most recent ones, see WithRateChangeLogSize.
+// Rates provided for testnet coins are not included, since they are the same as the mainnet ones.
+func (updater *RateUpdater) RateChangeLog() []RateChangeEntry {
+	updater.changeLogMu.Lock()
+	defer updater.changeLogMu.Unlock()
+	return append([]RateChangeEntry(nil), updater.changeLog...)
+}
+
+// logRateChanges appends the changes from the old to the new latest rates to the change log.
+// Changes within an update are sorted by coin and fiat.
+func (updater *RateUpdater) logRateChanges(oldRates, newRates map[string]map[string]float64) {
+	updater.testnetMu.RLock()
+	testnetUnits := make(map[string]bool, len(updater.testnetUnits))
+	for testnetUnit := range updater.testnetUnits {
+		testnetUnits[testnetUnit] = true
+	}
+	updater.testnetMu.RUnlock()
+
+	now := updater.clock()
+	var entries []RateChangeEntry
+	for coin, fiatRates := range newRates {
+		if testnetUnits[coin] {
+			continue
+		}
+		for fiat, newRate := range fiatRates {
+			oldRate := oldRates[coin][fiat]
+			if oldRate == newRate {
+				continue
+			}
+			entry := RateChangeEntry{Timestamp: now, Coin: coin, Fiat: fiat, OldRate: oldRate, NewRate: newRate}
+			if oldRate != 0 {
+				entry.PctChange = 100 * (newRate - oldRate) / oldRate
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Coin != entries[j].Coin {
+			return entries[i].Coin < entries[j].Coin
+		}
+		return entries[i].Fiat < entries[j].Fiat
+	})
+
+	updater.changeLogMu.Lock()
+	defer updater.changeLogMu.Unlock()
+	updater.changeLog = append(updater.changeLog, entries...)
+	if drop := len(updater.changeLog) - updater.changeLogSize; drop > 0 {
+		updater.changeLog = append(updater.changeLog[:0], updater.changeLog[drop:]...)
+	}
+}
@@ -0,0 +1,82 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateChangeLog(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	clock := testutil.NewFakeClock(time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithClockFunc(clock.Now),
+		WithTestnetPassthrough(true),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	assert.Empty(t, updater.RateChangeLog())
+
+	body = `{"bitcoin":{"usd":100},"litecoin":{"usd":2},"ethereum":{"usd":3}}`
+	updater.updateLast(context.Background())
+	t0 := clock.Now()
+	log := updater.RateChangeLog()
+	// The sat rates are derived from BTC. Testnet rates are omitted.
+	require.Len(t, log, 4)
+	assert.Equal(t, RateChangeEntry{Timestamp: t0, Coin: "BTC", Fiat: "USD", NewRate: 100}, log[0])
+	assert.Equal(t, "ETH", log[1].Coin)
+	assert.Equal(t, "LTC", log[2].Coin)
+	assert.Equal(t, "sat", log[3].Coin)
+
+	// Unchanged rates are not logged.
+	clock.Advance(time.Minute)
+	updater.updateLast(context.Background())
+	assert.Len(t, updater.RateChangeLog(), 4)
+
+	body = `{"bitcoin":{"usd":110},"litecoin":{"usd":2},"ethereum":{"usd":3}}`
+	clock.Advance(time.Minute)
+	updater.updateLast(context.Background())
+	log = updater.RateChangeLog()
+	require.Len(t, log, 6)
+	assert.Equal(t, clock.Now(), log[4].Timestamp)
+	assert.Equal(t, "BTC", log[4].Coin)
+	assert.Equal(t, 100.0, log[4].OldRate)
+	assert.Equal(t, 110.0, log[4].NewRate)
+	assert.InDelta(t, 10, log[4].PctChange, 1e-9)
+	assert.Equal(t, "sat", log[5].Coin)
+	assert.InDelta(t, 10, log[5].PctChange, 1e-9)
+
+	// The returned log is a copy.
+	log[0].NewRate = 42
+	assert.Equal(t, 100.0, updater.RateChangeLog()[0].NewRate)
+}
+
+func TestRateChangeLogSize(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRateChangeLogSize(3),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	for i := 1; i <= 5; i++ {
+		updater.logRateChanges(nil, map[string]map[string]float64{"BTC": {"USD": float64(i)}})
+	}
+	log := updater.RateChangeLog()
+	require.Len(t, log, 3)
+	for i, entry := range log {
+		assert.Equal(t, float64(i+3), entry.NewRate)
+	}
+}
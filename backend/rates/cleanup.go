@@ -0,0 +1,117 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// WithHistoryCleanupSchedule makes StartCurrentRates start a goroutine calling PruneHistory with
+// maxAge right away and then every interval, e.g. weekly. Zero interval prunes only once.
+// The goroutine is stopped by Stop.
+//
+// The database file doesn't shrink: bbolt reuses the freed pages for rates stored later.
+func WithHistoryCleanupSchedule(interval, maxAge time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.historyCleanupInterval = interval
+		updater.historyCleanupMaxAge = maxAge
+	}
+}
+
+// pruneOlder returns the rates, which must be sorted by timestamp in ascending order, without
+// the ones before cutoff. The argument is not modified.
+func pruneOlder(rates []exchangeRate, cutoff time.Time) []exchangeRate {
+	i := sort.Search(len(rates), func(i int) bool {
+		return !rates[i].timestamp.Before(cutoff)
+	})
+	return append([]exchangeRate(nil), rates[i:]...)
+}
+
+// PruneHistory removes the historical rates older than maxAge of all coin+fiat pairs, both in
+// memory and in the database cache, including the pairs not currently configured with
+// ReconfigureHistory. It returns the number of rates removed, counting the ones in memory for
+// the pairs in both.
+func (updater *RateUpdater) PruneHistory(maxAge time.Duration) (int, error) {
+	if maxAge <= 0 {
+		return 0, errp.Newf("invalid max age %v", maxAge)
+	}
+	cutoff := updater.clock().Add(-maxAge)
+	removedInMemory := make(map[string]int)
+	for key := range updater.history.all() {
+		updater.history.update(key, func(rates []exchangeRate) []exchangeRate {
+			pruned := pruneOlder(rates, cutoff)
+			updater.recordPruned(key, rates, pruned)
+			removedInMemory[key] = len(rates) - len(pruned)
+			return pruned
+		})
+		if removedInMemory[key] > 0 {
+			updater.invalidateDailyKey(key)
+		}
+	}
+	removed := 0
+	for _, n := range removedInMemory {
+		removed += n
+	}
+	keys, err := historyKeys(updater.historyStore)
+	if err != nil {
+		return removed, errp.WithStack(err)
+	}
+	for _, key := range keys {
+		err := updater.updateHistoryBucket(key, func(rates []exchangeRate) ([]exchangeRate, bool) {
+			pruned := pruneOlder(rates, cutoff)
+			if len(pruned) == len(rates) {
+				return nil, false
+			}
+			if _, inMemory := removedInMemory[key]; !inMemory {
+				removed += len(rates) - len(pruned)
+			}
+			return pruned, true
+		})
+		if err != nil {
+			return removed, errp.WithStack(err)
+		}
+	}
+	updater.telemetry(TelemetryHistoryCompacted, map[string]interface{}{
+		"operation": "prune", "removed": removed,
+	})
+	return removed, nil
+}
+
+// historyCleanupLoop calls PruneHistory right away and then periodically, see
+// WithHistoryCleanupSchedule. It never returns until the context is done, unless the
+// interval is zero.
+func (updater *RateUpdater) historyCleanupLoop(ctx context.Context) {
+	for {
+		removed, err := updater.PruneHistory(updater.historyCleanupMaxAge)
+		if err != nil {
+			updater.log.WithError(err).Error("historyCleanupLoop")
+		} else {
+			updater.log.Printf("historyCleanupLoop: removed %d rates older than %v", removed, updater.historyCleanupMaxAge)
+		}
+		if updater.historyCleanupInterval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-updater.timer.After(updater.historyCleanupInterval):
+			// continue
+		}
+	}
+}
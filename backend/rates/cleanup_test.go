@@ -0,0 +1,81 @@
+package rates
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestPruneHistory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestPruneHistory")
+	defer os.RemoveAll(dbdir)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	now := start.Add(10 * 24 * time.Hour)
+	updater := NewRateUpdater(nil, dbdir,
+		WithClockFunc(func() time.Time { return now }), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	// Daily rates of 10 days, in memory and in the database.
+	updater.storeHistory("btc", "USD", ratesEvery(start, 24*time.Hour, 10))
+	// Only in the database, as if not configured anymore.
+	require.NoError(t, updater.dumpHistoryBucket("ethEUR", ratesEvery(start, 24*time.Hour, 10)))
+
+	removed, err := updater.PruneHistory(5 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 10, removed)
+	assert.Equal(t, ratesEvery(start, 24*time.Hour, 10)[5:], updater.history.all()["btcUSD"])
+	for _, key := range []string{"btcUSD", "ethEUR"} {
+		rates, err := updater.loadHistoryBucket(key)
+		require.NoError(t, err)
+		assert.Equal(t, ratesEvery(start, 24*time.Hour, 10)[5:], rates, key)
+	}
+	assert.Equal(t, 0.0, updater.HistoricalPriceAt("btc", "USD", start))
+
+	removed, err = updater.PruneHistory(5 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+	_, err = updater.PruneHistory(0)
+	assert.Error(t, err)
+}
+
+func TestWithHistoryCleanupSchedule(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestWithHistoryCleanupSchedule")
+	defer os.RemoveAll(dbdir)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	now := start.Add(10 * 24 * time.Hour)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK,
+		`{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		WithHistoryCleanupSchedule(0, 5*24*time.Hour),
+		WithClockFunc(func() time.Time { return now }),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.storeHistory("btc", "USD", ratesEvery(start, 24*time.Hour, 10))
+
+	updater.StartCurrentRates()
+	require.Eventually(t, func() bool {
+		var n int
+		updater.history.view("btcUSD", func(rates []exchangeRate) { n = len(rates) })
+		return n == 5
+	}, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool {
+		var n int
+		err := updater.historyDB.View(func(tx *bbolt.Tx) error {
+			rates, err := readHistoryBucket(tx.Bucket([]byte("btcUSD")))
+			n = len(rates)
+			return err
+		})
+		return err == nil && n == 5
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+)
+
+const (
+	// ClockSkewEventSubject is the Subject of the event generated if the rates provider's clock
+	// and the local clock differ by more than allowed. The Object is the time.Duration by which
+	// the local clock is ahead of the provider's. See WithClockSkewDetection.
+	ClockSkewEventSubject = "rates/clock-skew"
+
+	// geckoLastUpdatedAt is the key of the time a coin's rates were last updated in the
+	// /simple/price response, in unix seconds, if requested with include_last_updated_at.
+	geckoLastUpdatedAt = "last_updated_at"
+)
+
+// WithClockSkewDetection makes updateLast compare the time the latest rates were updated
+// according to the API with the local clock. If they differ by more than maxSkew, a warning
+// is logged and a ClockSkewEventSubject event is emitted. This detects local clocks out of
+// sync as well as stale mirrors. Zero, the default, disables the detection.
+func WithClockSkewDetection(maxSkew time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.maxClockSkew = maxSkew
+	}
+}
+
+// checkClockSkew removes the geckoLastUpdatedAt entries from the /simple/price response and
+// compares the most recent one with the local clock.
+func (updater *RateUpdater) checkClockSkew(geckoRates map[string]map[string]float64) {
+	var lastUpdated float64
+	for _, rates := range geckoRates {
+		if t, ok := rates[geckoLastUpdatedAt]; ok {
+			delete(rates, geckoLastUpdatedAt)
+			if t > lastUpdated {
+				lastUpdated = t
+			}
+		}
+	}
+	if lastUpdated == 0 {
+		updater.log.Warning("checkClockSkew: no last_updated_at in the rates response")
+		return
+	}
+	skew := updater.clock().Sub(time.Unix(int64(lastUpdated), 0))
+	if skew <= updater.maxClockSkew && skew >= -updater.maxClockSkew {
+		return
+	}
+	updater.log.Warningf("clock skew of %v between the local clock and the rates provider", skew)
+	updater.Notify(observable.Event{
+		Subject: ClockSkewEventSubject,
+		Action:  action.Replace,
+		Object:  skew,
+	})
+}
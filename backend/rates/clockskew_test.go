@@ -0,0 +1,64 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClockSkewDetection(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Unix(1700000000, 0)
+	lastUpdatedAt := now.Add(-10 * time.Minute)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("include_last_updated_at"))
+		fmt.Fprintf(w, `{"bitcoin":{"usd":20000,"last_updated_at":%d},"litecoin":{"usd":70,"last_updated_at":%d},"ethereum":{"usd":1500}}`,
+			lastUpdatedAt.Unix(), lastUpdatedAt.Unix()-60)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithClockSkewDetection(5*time.Minute),
+		WithClockFunc(func() time.Time { return now }),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	var skews []time.Duration
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == ClockSkewEventSubject {
+			skews = append(skews, event.Object.(time.Duration))
+		}
+	})
+
+	updater.updateLast(context.Background())
+	require.Equal(t, []time.Duration{10 * time.Minute}, skews)
+	// The timestamps are not mistaken for rates.
+	assert.Equal(t, map[string]float64{"USD": 20000}, updater.LatestPrice()["BTC"])
+
+	lastUpdatedAt = now.Add(-time.Minute)
+	updater.updateLast(context.Background())
+	assert.Len(t, skews, 1)
+}
+
+func TestClockSkewDetectionDisabled(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := newSimplePriceServer(t, `{"bitcoin":{"usd":20000},"litecoin":{"usd":70},"ethereum":{"usd":1500}}`)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.Observe(func(event observable.Event) {
+		assert.NotEqual(t, ClockSkewEventSubject, event.Subject)
+	})
+	updater.updateLast(context.Background())
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"time"
+)
+
+// ReadOnlyRateUpdater is a snapshot of the rates of a RateUpdater, safe to be queried from
+// multiple goroutines, e.g. a worker pool enriching transactions. It has only the query methods
+// of RateUpdater, so it can't be used to change the configuration or stop the updater.
+// See RateUpdater.Clone.
+type ReadOnlyRateUpdater struct {
+	last    map[string]map[string]float64
+	history map[string][]exchangeRate
+}
+
+// Clone returns a snapshot of the latest and historical rates. Rates updated later are not
+// reflected in it. It is cheap since neither the latest rates nor the slices of historical
+// rates are modified once stored, they are replaced by updates, so they are shared and not
+// copied.
+func (updater *RateUpdater) Clone() *ReadOnlyRateUpdater {
+	return &ReadOnlyRateUpdater{
+		last:    updater.LatestPrice(),
+		history: updater.history.all(),
+	}
+}
+
+// LatestPrice is like RateUpdater.LatestPrice. The returned map must not be modified.
+func (updater *ReadOnlyRateUpdater) LatestPrice() map[string]map[string]float64 {
+	return updater.last
+}
+
+// LatestPriceForPair is like RateUpdater.LatestPriceForPair.
+func (updater *ReadOnlyRateUpdater) LatestPriceForPair(coinUnit, fiat string) (float64, error) {
+	if updater.last == nil {
+		return 0, ErrRatesNotAvailable
+	}
+	return updater.last[coinUnit][fiat], nil
+}
+
+// HistoricalPriceAt is like RateUpdater.HistoricalPriceAt.
+func (updater *ReadOnlyRateUpdater) HistoricalPriceAt(coin, fiat string, at time.Time) float64 {
+	return priceAt(updater.history[coin+fiat], at)
+}
+
+// HistoryEarliestTimestamp is like RateUpdater.HistoryEarliestTimestamp.
+func (updater *ReadOnlyRateUpdater) HistoryEarliestTimestamp(coin, fiat string) time.Time {
+	if rates := updater.history[coin+fiat]; len(rates) > 0 {
+		return rates[0].timestamp
+	}
+	return time.Time{}
+}
+
+// HistoryLatestTimestamp is like RateUpdater.HistoryLatestTimestamp.
+func (updater *ReadOnlyRateUpdater) HistoryLatestTimestamp(coin, fiat string) time.Time {
+	if rates := updater.history[coin+fiat]; len(rates) > 0 {
+		return rates[len(rates)-1].timestamp
+	}
+	return time.Time{}
+}
@@ -0,0 +1,49 @@
+package rates
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClone(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.last = nil
+	_, err := updater.Clone().LatestPriceForPair("BTC", "USD")
+	require.Equal(t, ErrRatesNotAvailable, err)
+
+	start := time.Unix(1598918400, 0)
+	updater.last = map[string]map[string]float64{"BTC": {"USD": 20000}}
+	updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 3))
+	clone := updater.Clone()
+
+	// Later updates don't affect the clone.
+	updater.last = map[string]map[string]float64{"BTC": {"USD": 30000}}
+	updater.storeHistory("btc", "USD", []exchangeRate{{value: 10, timestamp: start.Add(3 * time.Hour)}})
+	updater.storeHistory("eth", "USD", ratesEvery(start, time.Hour, 3))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			price, err := clone.LatestPriceForPair("BTC", "USD")
+			assert.NoError(t, err)
+			assert.Equal(t, 20000.0, price)
+			assert.Equal(t, 1.5, clone.HistoricalPriceAt("btc", "USD", start.Add(30*time.Minute)))
+			assert.Zero(t, clone.HistoricalPriceAt("btc", "USD", start.Add(3*time.Hour)))
+			assert.Zero(t, clone.HistoricalPriceAt("eth", "USD", start))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 20000.0, clone.LatestPrice()["BTC"]["USD"])
+	assert.Equal(t, start.Unix(), clone.HistoryEarliestTimestamp("btc", "USD").Unix())
+	assert.Equal(t, start.Add(2*time.Hour).Unix(), clone.HistoryLatestTimestamp("btc", "USD").Unix())
+	assert.True(t, clone.HistoryLatestTimestamp("eth", "USD").IsZero())
+	assert.Equal(t, 10.0, updater.HistoricalPriceAt("btc", "USD", start.Add(3*time.Hour)))
+}
@@ -0,0 +1,76 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// CoinCode is a BitBoxApp coin code like coin.Code of the backend/coins/coin package, e.g. "btc"
+// or "eth-erc20-usdt". That package depends on this one and can't be used here, so convert
+// with rates.CoinCode(code).
+type CoinCode string
+
+// coinCodeUnits are the units of all coin codes supported by the BitBoxApp, the same as the
+// Unit(false) of their coin.Coin. Keep in sync with geckoCoin.
+var coinCodeUnits = map[CoinCode]string{
+	"btc":    "BTC",
+	"tbtc":   "TBTC",
+	"rbtc":   "RBTC",
+	"ltc":    "LTC",
+	"tltc":   "TLTC",
+	"eth":    "ETH",
+	"sepeth": "SEPETH",
+	// ERC20 tokens as used in the backend.
+	"eth-erc20-bat":       "BAT",
+	"eth-erc20-dai0x6b17": "DAI",
+	"eth-erc20-link":      "LINK",
+	"eth-erc20-mkr":       "MKR",
+	"eth-erc20-usdc":      "USDC",
+	"eth-erc20-usdt":      "USDT",
+	"eth-erc20-zrx":       "ZRX",
+	"eth-erc20-wbtc":      "WBTC",
+	"eth-erc20-paxg":      "PAXG",
+}
+
+// Unit returns the unit of the coin, e.g. "BTC" for "btc", the key of its latest rates.
+// It returns an empty string for unsupported coins.
+func (code CoinCode) Unit() string {
+	return coinCodeUnits[code]
+}
+
+// GeckoID returns the CoinGecko ID of the coin, e.g. "bitcoin" for "btc" and "tbtc".
+// It returns an empty string for unsupported coins.
+func (code CoinCode) GeckoID() string {
+	return geckoCoin[code]
+}
+
+// LatestPriceForCoin returns the latest conversion rate of the coin in the fiat currency.
+// It returns an error if the coin is not supported or the rates have not been fetched yet.
+func (updater *RateUpdater) LatestPriceForCoin(coin CoinCode, fiat Fiat) (float64, error) {
+	unit := coin.Unit()
+	if unit == "" {
+		return 0, errp.Newf("unsupported coin %q", coin)
+	}
+	return updater.latestPriceForPair(unit, string(fiat))
+}
+
+// HistoricalPriceForCoin returns the historical conversion rate of the coin in the fiat currency
+// at the given time, interpolated if needed, or 0 if no data is available. See HistoricalPriceAt.
+func (updater *RateUpdater) HistoricalPriceForCoin(coin CoinCode, fiat Fiat, at time.Time) float64 {
+	return updater.historicalPriceAt(string(coin), string(fiat), at)
+}
@@ -0,0 +1,21 @@
+package rates_test
+
+import (
+	"testing"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/coins/coin"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/stretchr/testify/assert"
+)
+
+// The ERC20 token codes are unexported in the backend package and not checked here.
+func TestCoinCodeSupportsAllCoins(t *testing.T) {
+	for _, code := range []coin.Code{
+		coin.CodeBTC, coin.CodeTBTC, coin.CodeRBTC,
+		coin.CodeLTC, coin.CodeTLTC,
+		coin.CodeETH, coin.CodeSEPETH,
+	} {
+		assert.NotEmpty(t, rates.CoinCode(code).Unit(), code)
+		assert.NotEmpty(t, rates.CoinCode(code).GeckoID(), code)
+	}
+}
@@ -0,0 +1,50 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoinCodeMappings(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.Len(t, coinCodeUnits, len(geckoCoin))
+	for code, unit := range coinCodeUnits {
+		require.NotEmpty(t, code.GeckoID(), code)
+		// Testnet units are mapped to their mainnet units, see RegisterTestnetMapping.
+		if mainnetUnit, ok := updater.testnetUnits[unit]; ok {
+			unit = mainnetUnit
+		}
+		assert.Equal(t, unit, geckoCoinToUnit[code.GeckoID()], code)
+	}
+	assert.Empty(t, CoinCode("doge").Unit())
+	assert.Empty(t, CoinCode("doge").GeckoID())
+}
+
+func TestPriceForCoin(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.last = map[string]map[string]float64{
+		"BTC":  {"USD": 20000},
+		"USDT": {"USD": 1},
+	}
+	start := time.Unix(1598918400, 0)
+	updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 2))
+
+	price, err := updater.LatestPriceForCoin("btc", USD)
+	require.NoError(t, err)
+	assert.Equal(t, 20000.0, price)
+	price, err = updater.LatestPriceForCoin("eth-erc20-usdt", USD)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, price)
+	_, err = updater.LatestPriceForCoin("doge", USD)
+	assert.Error(t, err)
+
+	assert.Equal(t, 1.5, updater.HistoricalPriceForCoin("btc", USD, start.Add(30*time.Minute)))
+	assert.Zero(t, updater.HistoricalPriceForCoin("eth", USD, start))
+}
@@ -0,0 +1,86 @@
+package rates
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// encodeDelta encodes the rates, sorted by timestamp in asc order, in a compact form:
+//
+//	uvarint(count) varint(ts[0]) uint64(value[0])
+//	uvarint(ts[i]-ts[i-1]) uvarint(bits(value[i]) ^ bits(value[i-1]))  for i > 0
+//
+// Timestamps are in seconds, equally spaced in practice, so their deltas take 2-3 bytes.
+// Sub-second precision of the timestamps is not stored.
+// The XOR of consecutive values has its most significant bits zeroed if the values are close,
+// as the sign, exponent and leading mantissa bits are equal. The encoding is lossless.
+func encodeDelta(entries []exchangeRate) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(entries)*(2*binary.MaxVarintLen64))
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	var prevTimestamp int64
+	var prevBits uint64
+	for i, entry := range entries {
+		timestamp := entry.timestamp.Unix()
+		bits := math.Float64bits(entry.value)
+		if i == 0 {
+			buf = binary.AppendVarint(buf, timestamp)
+			buf = binary.BigEndian.AppendUint64(buf, bits)
+		} else {
+			buf = binary.AppendUvarint(buf, uint64(timestamp-prevTimestamp))
+			buf = binary.AppendUvarint(buf, bits^prevBits)
+		}
+		prevTimestamp, prevBits = timestamp, bits
+	}
+	return buf
+}
+
+var errCorruptDelta = errors.New("corrupt delta encoded rates")
+
+// decodeDelta decodes rates encoded with encodeDelta.
+func decodeDelta(data []byte) ([]exchangeRate, error) {
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, errCorruptDelta
+	}
+	data = data[n:]
+	// Each entry takes at least 2 bytes. Don't trust count for allocations.
+	if count > uint64(len(data)/2+1) {
+		return nil, errCorruptDelta
+	}
+	entries := make([]exchangeRate, 0, count)
+	var timestamp int64
+	var bits uint64
+	for i := uint64(0); i < count; i++ {
+		if i == 0 {
+			timestamp, n = binary.Varint(data)
+			if n <= 0 || len(data[n:]) < 8 {
+				return nil, errCorruptDelta
+			}
+			bits = binary.BigEndian.Uint64(data[n:])
+			data = data[n+8:]
+		} else {
+			delta, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errCorruptDelta
+			}
+			data = data[n:]
+			xor, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, errCorruptDelta
+			}
+			data = data[n:]
+			timestamp += int64(delta)
+			bits ^= xor
+		}
+		entries = append(entries, exchangeRate{
+			value:     math.Float64frombits(bits),
+			timestamp: time.Unix(timestamp, 0),
+		})
+	}
+	if len(data) != 0 {
+		return nil, errCorruptDelta
+	}
+	return entries, nil
+}
@@ -0,0 +1,55 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeDelta(t *testing.T) {
+	tt := [][]exchangeRate{
+		nil,
+		{{value: 11691.3, timestamp: time.Unix(1598918700, 0)}},
+		{
+			{value: 11691.3, timestamp: time.Unix(1598918700, 0)},
+			{value: 11692.7, timestamp: time.Unix(1598922300, 0)},
+			{value: 11692.7, timestamp: time.Unix(1598925900, 0)},
+			{value: 0.000012345, timestamp: time.Unix(1598925901, 0)},
+			{value: -1, timestamp: time.Unix(1598925900, 0)}, // unsorted
+			{value: 1e300, timestamp: time.Unix(0, 0)},
+		},
+	}
+	for _, rates := range tt {
+		decoded, err := decodeDelta(encodeDelta(rates))
+		require.NoError(t, err)
+		assert.Len(t, decoded, len(rates))
+		for i := range rates {
+			assert.Equal(t, rates[i].value, decoded[i].value)
+			assert.Equal(t, rates[i].timestamp.Unix(), decoded[i].timestamp.Unix())
+		}
+	}
+
+	hourly := makeHistory(1000)
+	for i := range hourly {
+		hourly[i].timestamp = time.Unix(1598918400+int64(i)*3600, 0)
+		hourly[i].value = 10000 + float64(i%7)*1.5
+	}
+	assert.Less(t, len(encodeDelta(hourly)), 1000*16*3/4, "encoded size")
+}
+
+func TestDecodeDeltaCorrupt(t *testing.T) {
+	valid := encodeDelta([]exchangeRate{
+		{value: 1, timestamp: time.Unix(1598918700, 0)},
+		{value: 2, timestamp: time.Unix(1598922300, 0)},
+	})
+	for i := 0; i < len(valid); i++ {
+		_, err := decodeDelta(valid[:i])
+		assert.Error(t, err, "truncated to %d bytes", i)
+	}
+	_, err := decodeDelta(append(valid, 0))
+	assert.Error(t, err, "trailing data")
+	_, err = decodeDelta([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	assert.Error(t, err, "huge count")
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PairConfig is a coin+fiat pair of historical rates, e.g. "btc" and "USD".
+type PairConfig struct {
+	Coin string `json:"coin"`
+	Fiat string `json:"fiat"`
+}
+
+// RateConfig is the configuration of a RateUpdater, see Config and NewRateUpdaterFromConfig.
+// It can be serialized as JSON, e.g. to a config file.
+//
+// Secrets like the CoinGecko API key and settings not expressible as data, like middlewares
+// and the clock, are not part of it.
+type RateConfig struct {
+	// CoingeckoURL is the URL of the CoinGecko API v3 or a compatible server.
+	CoingeckoURL string `json:"coingeckoURL"`
+	// DBDir is the location of the historical rates database cache.
+	DBDir string `json:"dbDir"`
+	// UpdateInterval is the interval between updates of the latest rates.
+	UpdateInterval time.Duration `json:"updateInterval"`
+	// ActiveHistoryPairs are the pairs configured with ReconfigureHistory, sorted by
+	// coin and fiat.
+	ActiveHistoryPairs []PairConfig `json:"activeHistoryPairs"`
+	// FiatCurrencies are the fiat codes the latest rates are fetched in, sorted.
+	// They are currently always all the supported ones and informational only.
+	FiatCurrencies []string `json:"fiatCurrencies"`
+	// CoinUnits are the coin units the latest rates are fetched for, sorted.
+	// See AutoConfigureFromWallet.
+	CoinUnits []string `json:"coinUnits"`
+}
+
+// Config returns the current configuration of the updater, which NewRateUpdaterFromConfig
+// turns into an updater with the same settings.
+func (updater *RateUpdater) Config() RateConfig {
+	config := RateConfig{
+		CoingeckoURL:       updater.coingeckoURL,
+		DBDir:              updater.dbdir,
+		UpdateInterval:     updater.updateInterval,
+		ActiveHistoryPairs: []PairConfig{},
+		CoinUnits:          []string{},
+	}
+	updater.historyGoMu.Lock()
+	for key := range updater.historyGo {
+		if coin, fiat, ok := splitHistoryKey(key); ok {
+			config.ActiveHistoryPairs = append(config.ActiveHistoryPairs, PairConfig{Coin: coin, Fiat: fiat})
+		}
+	}
+	updater.historyGoMu.Unlock()
+	sort.Slice(config.ActiveHistoryPairs, func(i, j int) bool {
+		a, b := config.ActiveHistoryPairs[i], config.ActiveHistoryPairs[j]
+		if a.Coin != b.Coin {
+			return a.Coin < b.Coin
+		}
+		return a.Fiat < b.Fiat
+	})
+	for _, geckoFiat := range strings.Split(simplePriceAllCurrencies, ",") {
+		config.FiatCurrencies = append(config.FiatCurrencies, fromGeckoFiat[geckoFiat])
+	}
+	sort.Strings(config.FiatCurrencies)
+	updater.simplePriceMu.RLock()
+	for _, unit := range updater.simplePriceUnits {
+		config.CoinUnits = append(config.CoinUnits, unit)
+	}
+	updater.simplePriceMu.RUnlock()
+	sort.Strings(config.CoinUnits)
+	return config
+}
+
+// defaultCoinUnits returns the sorted coin units the latest rates are fetched for by default.
+func defaultCoinUnits() []string {
+	units := make([]string, 0, len(geckoCoinToUnit))
+	for _, unit := range geckoCoinToUnit {
+		units = append(units, unit)
+	}
+	sort.Strings(units)
+	return units
+}
+
+// NewRateUpdaterFromConfig returns a new rates updater with the settings of config, as returned
+// by Config, and the given options applied afterwards. The history of the ActiveHistoryPairs is
+// updated right away, as if configured with ReconfigureHistory, while the caller still needs
+// to call StartCurrentRates for the latest rates.
+//
+// If CoinUnits differ from the default, they are configured with AutoConfigureFromWallet,
+// which may have to fetch the list of CoinGecko coins. Units which can't be configured are
+// logged and skipped.
+func NewRateUpdaterFromConfig(config RateConfig, client *http.Client, opts ...Option) *RateUpdater {
+	opts = append([]Option{func(updater *RateUpdater) {
+		if config.CoingeckoURL != "" {
+			updater.coingeckoURL = config.CoingeckoURL
+		}
+		if config.UpdateInterval > 0 {
+			updater.updateInterval = config.UpdateInterval
+		}
+	}}, opts...)
+	updater := NewRateUpdater(client, config.DBDir, opts...)
+
+	units := append([]string(nil), config.CoinUnits...)
+	sort.Strings(units)
+	if len(units) > 0 && strings.Join(units, ",") != strings.Join(defaultCoinUnits(), ",") {
+		if err := updater.AutoConfigureFromWallet(units); err != nil {
+			updater.log.WithError(err).Error("NewRateUpdaterFromConfig: could not configure all coin units")
+		}
+	}
+
+	// The pairs of a single ReconfigureHistory call are all combinations of its coins and fiats.
+	var coins, fiats []string
+	seenCoins, seenFiats := map[string]bool{}, map[string]bool{}
+	for _, pair := range config.ActiveHistoryPairs {
+		if !seenCoins[pair.Coin] {
+			seenCoins[pair.Coin] = true
+			coins = append(coins, pair.Coin)
+		}
+		if !seenFiats[pair.Fiat] {
+			seenFiats[pair.Fiat] = true
+			fiats = append(fiats, pair.Fiat)
+		}
+	}
+	if len(coins) > 0 {
+		updater.ReconfigureHistory(coins, fiats)
+	}
+	return updater
+}
@@ -0,0 +1,82 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestConfigRoundTrip")
+	defer os.RemoveAll(dbdir)
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":20000,"eur":19000},"ethereum":{"usd":1500,"eur":1400}}`)
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		WithUpdateInterval(5*time.Minute),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	updater.coingeckoURL = "https://coingecko.test"
+	require.NoError(t, updater.AutoConfigureFromWallet([]string{"ETH", "BTC"}))
+	updater.ReconfigureHistory([]string{"eth", "btc"}, []string{"USD", "EUR"})
+	updater.updateLast(context.Background())
+
+	config := updater.Config()
+	assert.Equal(t, RateConfig{
+		CoingeckoURL:   "https://coingecko.test",
+		DBDir:          dbdir,
+		UpdateInterval: 5 * time.Minute,
+		ActiveHistoryPairs: []PairConfig{
+			{"btc", "EUR"}, {"btc", "USD"}, {"eth", "EUR"}, {"eth", "USD"},
+		},
+		FiatCurrencies: []string{
+			"AUD", "BRL", "BTC", "CAD", "CHF", "CNY", "CZK", "EUR", "GBP", "HKD",
+			"ILS", "JPY", "KRW", "NOK", "PLN", "RUB", "SEK", "SGD", "USD",
+		},
+		CoinUnits: []string{"BTC", "ETH"},
+	}, config)
+	latest := updater.LatestPrice()
+	require.NoError(t, updater.StopAndWait(context.Background()))
+
+	jsonConfig, err := json.Marshal(config)
+	require.NoError(t, err)
+	var decoded RateConfig
+	require.NoError(t, json.Unmarshal(jsonConfig, &decoded))
+	restored := NewRateUpdaterFromConfig(decoded, mock.Client(),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer restored.Stop()
+	assert.Equal(t, config, restored.Config())
+	assert.Equal(t, 5*time.Minute, restored.updateInterval)
+
+	// The restored updater requests and returns the same latest rates.
+	restored.updateLast(context.Background())
+	assert.Equal(t, latest, restored.LatestPrice())
+	var ids []string
+	for _, req := range mock.Requests() {
+		if req.URL.Path == "/simple/price" {
+			ids = append(ids, req.URL.Query().Get("ids"))
+		}
+	}
+	assert.Equal(t, []string{"bitcoin,ethereum", "bitcoin,ethereum"}, ids)
+}
+
+func TestNewRateUpdaterFromConfigDefaults(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdaterFromConfig(RateConfig{DBDir: "/dev/null"}, nil, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.Equal(t, shiftGeckoMirrorAPIV3, updater.coingeckoURL)
+	assert.Equal(t, interval, updater.updateInterval)
+	assert.Equal(t, simplePriceAllIDs, updater.simplePriceIDs)
+	assert.Equal(t, defaultCoinUnits(), updater.Config().CoinUnits)
+	assert.Empty(t, updater.Config().ActiveHistoryPairs)
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// CrossFiatRate returns the latest exchange rate from fromFiat to toFiat, i.e. the amount of
+// toFiat one unit of fromFiat is worth, derived from the BTC rates of both:
+// (BTC/toFiat) / (BTC/fromFiat). It returns ErrRatesNotAvailable if the latest rates are not
+// fetched yet, and an error if the BTC rate of either fiat is zero.
+func (updater *RateUpdater) CrossFiatRate(fromFiat, toFiat string) (float64, error) {
+	last := updater.LatestPrice()
+	if len(last) == 0 {
+		return 0, ErrRatesNotAvailable
+	}
+	fromRate, toRate := last[BTC.String()][fromFiat], last[BTC.String()][toFiat]
+	if fromRate == 0 {
+		return 0, errp.Newf("no BTC/%s rate", fromFiat)
+	}
+	if toRate == 0 {
+		return 0, errp.Newf("no BTC/%s rate", toFiat)
+	}
+	return toRate / fromRate, nil
+}
+
+// ConvertFiat converts amount from fromFiat to toFiat at the latest rates, e.g. to show that
+// $500 received are worth €463. See CrossFiatRate for the errors.
+func (updater *RateUpdater) ConvertFiat(amount float64, fromFiat, toFiat string) (float64, error) {
+	rate, err := updater.CrossFiatRate(fromFiat, toFiat)
+	if err != nil {
+		return 0, err
+	}
+	return amount * rate, nil
+}
@@ -0,0 +1,56 @@
+package rates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertFiat(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null")
+	_, err := updater.ConvertFiat(500, "USD", "EUR")
+	require.ErrorIs(t, err, ErrRatesNotAvailable)
+
+	updater.last = map[string]map[string]float64{
+		"BTC": {"USD": 50000, "EUR": 46300, "CHF": 0},
+	}
+	eur, err := updater.ConvertFiat(500, "USD", "EUR")
+	require.NoError(t, err)
+	assert.InDelta(t, 463, eur, 1e-9)
+	usd, err := updater.ConvertFiat(463, "EUR", "USD")
+	require.NoError(t, err)
+	assert.InDelta(t, 500, usd, 1e-9)
+
+	_, err = updater.ConvertFiat(500, "USD", "CHF")
+	require.EqualError(t, err, "no BTC/CHF rate")
+	_, err = updater.CrossFiatRate("CHF", "USD")
+	require.EqualError(t, err, "no BTC/CHF rate")
+	_, err = updater.CrossFiatRate("USD", "XYZ")
+	require.EqualError(t, err, "no BTC/XYZ rate")
+}
+
+func TestCrossFiatRateAllFiats(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null")
+	btcRates := map[string]float64{}
+	for i, fiat := range SupportedFiats() {
+		btcRates[string(fiat)] = float64(1000 * (i + 1))
+	}
+	updater.last = map[string]map[string]float64{"BTC": btcRates}
+	for _, from := range SupportedFiats() {
+		for _, to := range SupportedFiats() {
+			rate, err := updater.CrossFiatRate(string(from), string(to))
+			require.NoError(t, err, "%s to %s", from, to)
+			assert.InDelta(t, btcRates[string(to)]/btcRates[string(from)], rate, 1e-9, "%s to %s", from, to)
+			back, err := updater.CrossFiatRate(string(to), string(from))
+			require.NoError(t, err)
+			assert.InDelta(t, 1, rate*back, 1e-9)
+
+			converted, err := updater.ConvertFiat(100, string(from), string(to))
+			require.NoError(t, err)
+			assert.InDelta(t, 100*rate, converted, 1e-9)
+		}
+	}
+}
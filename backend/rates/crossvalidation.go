@@ -0,0 +1,104 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+)
+
+// CrossValidationFailedEventSubject is the Subject of the event generated if the latest rates
+// are rejected because they diverge from the ones of the secondary provider. The Object is a
+// CrossValidationFailure. See WithCrossValidation.
+const CrossValidationFailedEventSubject = "rates/cross-validation-failed"
+
+// ErrCrossValidationFailed is returned if the latest rates diverge from the ones of the
+// secondary provider configured with WithCrossValidation.
+var ErrCrossValidationFailed = errp.New("rates diverge from the secondary provider")
+
+// RateProvider is a source of the latest exchange rates, independent of CoinGecko.
+type RateProvider interface {
+	// LatestPrice returns the latest rates keyed by coin unit and fiat code,
+	// e.g. rates["BTC"]["USD"], like RateUpdater.LatestPrice.
+	LatestPrice(ctx context.Context) (map[string]map[string]float64, error)
+}
+
+// RateProviderFunc adapts a function to the RateProvider interface.
+type RateProviderFunc func(ctx context.Context) (map[string]map[string]float64, error)
+
+// LatestPrice calls f.
+func (f RateProviderFunc) LatestPrice(ctx context.Context) (map[string]map[string]float64, error) {
+	return f(ctx)
+}
+
+// CrossValidationFailure is the Object of a CrossValidationFailedEventSubject event.
+type CrossValidationFailure struct {
+	// Primary and Secondary are the BTC/USD rates of CoinGecko and the secondary provider.
+	// Secondary is zero if the secondary provider failed.
+	Primary   float64 `json:"primary"`
+	Secondary float64 `json:"secondary"`
+	// DivergencePct is the difference between the two relative to Secondary, in percent.
+	DivergencePct float64 `json:"divergencePct"`
+}
+
+// WithCrossValidation makes updateLast compare the BTC/USD rate fetched from CoinGecko with the
+// one of the secondary provider and keep the previous rates if they differ by more than
+// maxDivergencePct percent, or if the secondary provider fails. Rejected rates are logged as
+// a possible attack or compromised provider and a CrossValidationFailedEventSubject event is
+// emitted. This doubles the requests for the latest rates, it is meant for high-security
+// deployments.
+func WithCrossValidation(secondary RateProvider, maxDivergencePct float64) Option {
+	return func(updater *RateUpdater) {
+		updater.crossValidation = secondary
+		updater.maxDivergencePct = maxDivergencePct
+	}
+}
+
+// crossValidate compares the BTC/USD rate of the /simple/price response with the one of the
+// secondary provider.
+func (updater *RateUpdater) crossValidate(ctx context.Context, geckoRates map[string]map[string]float64) error {
+	failure := CrossValidationFailure{Primary: geckoRates[geckoCoin[CoinCode("btc")]]["usd"]}
+	if failure.Primary == 0 {
+		return errp.WithMessage(ErrCrossValidationFailed, "BTC/USD missing in the response")
+	}
+	var err error
+	secondary, secondaryErr := updater.crossValidation.LatestPrice(ctx)
+	switch {
+	case secondaryErr != nil:
+		err = errp.WithMessage(ErrCrossValidationFailed, secondaryErr.Error())
+	case secondary[BTC.String()]["USD"] <= 0:
+		err = errp.WithMessage(ErrCrossValidationFailed, "BTC/USD missing in the secondary provider")
+	default:
+		failure.Secondary = secondary[BTC.String()]["USD"]
+		failure.DivergencePct = math.Abs(failure.Primary-failure.Secondary) / failure.Secondary * 100
+		if failure.DivergencePct <= updater.maxDivergencePct {
+			return nil
+		}
+		err = errp.WithMessage(ErrCrossValidationFailed, fmt.Sprintf("BTC/USD %v diverges by %.2f%% from %v",
+			failure.Primary, failure.DivergencePct, failure.Secondary))
+	}
+	updater.log.WithError(err).Error("SECURITY: rejecting the latest rates failing cross-validation")
+	updater.Notify(observable.Event{
+		Subject: CrossValidationFailedEventSubject,
+		Action:  action.Replace,
+		Object:  failure,
+	})
+	return err
+}
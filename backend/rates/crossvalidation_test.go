@@ -0,0 +1,63 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCrossValidation(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK,
+		`{"bitcoin":{"usd":20000},"litecoin":{"usd":70},"ethereum":{"usd":1500}}`)
+	var secondaryBTCUSD float64
+	var secondaryErr error
+	secondary := RateProviderFunc(func(context.Context) (map[string]map[string]float64, error) {
+		return map[string]map[string]float64{"BTC": {"USD": secondaryBTCUSD}}, secondaryErr
+	})
+	updater := NewRateUpdater(mock.Client(), "/dev/null",
+		WithCrossValidation(secondary, 5),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	var failures []CrossValidationFailure
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == CrossValidationFailedEventSubject {
+			failures = append(failures, event.Object.(CrossValidationFailure))
+		}
+	})
+	previous := map[string]map[string]float64{"BTC": {"USD": 19000}}
+	updater.last = previous
+
+	// 30% divergence.
+	secondaryBTCUSD = 20000 / 1.3
+	updater.updateLast(context.Background())
+	assert.Equal(t, previous, updater.LatestPrice())
+	require.Len(t, failures, 1)
+	assert.Equal(t, 20000.0, failures[0].Primary)
+	assert.Equal(t, secondaryBTCUSD, failures[0].Secondary)
+	assert.InDelta(t, 30, failures[0].DivergencePct, 1e-9)
+	assert.Contains(t, updater.Diagnostics().LastFetchError, ErrCrossValidationFailed.Error())
+
+	secondaryErr = errors.New("secondary down")
+	updater.updateLast(context.Background())
+	assert.Equal(t, previous, updater.LatestPrice())
+	require.Len(t, failures, 2)
+	assert.Zero(t, failures[1].Secondary)
+
+	// 2% divergence is within the limit.
+	secondaryBTCUSD, secondaryErr = 20000/1.02, nil
+	updater.updateLast(context.Background())
+	assert.Equal(t, map[string]float64{"USD": 20000}, updater.LatestPrice()["BTC"])
+	assert.Len(t, failures, 2)
+	assert.Empty(t, updater.Diagnostics().LastFetchError)
+}
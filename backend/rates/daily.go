@@ -0,0 +1,98 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"time"
+)
+
+// secondsPerDay is the length of a unix day, used to key the daily cache.
+const secondsPerDay = 24 * 60 * 60
+
+// unixDay returns the number of days since the unix epoch (UTC) at t.
+func unixDay(t time.Time) int64 {
+	unix := t.Unix()
+	day := unix / secondsPerDay
+	if unix < 0 && unix%secondsPerDay != 0 {
+		day-- // round towards negative infinity
+	}
+	return day
+}
+
+// DailyPriceAt returns the closing exchange rate of the given coin on the UTC day containing at,
+// which is the last historical rate within that day. It returns 0 if there is no rate on that day.
+//
+// Results are cached until new historical rates arrive for the day, so repeated lookups for the
+// same days, like those of a portfolio chart with a data point per day, are cheap.
+func (updater *RateUpdater) DailyPriceAt(coin, fiat string, at time.Time) float64 {
+	day := unixDay(at)
+	updater.dailyMu.RLock()
+	// Concatenating in the index expression doesn't allocate.
+	price, ok := updater.dailyCache[coin+fiat][day]
+	updater.dailyMu.RUnlock()
+	if ok {
+		return price
+	}
+	key := coin + fiat
+
+	// Read the version to not cache a price computed before a concurrent invalidation.
+	updater.dailyMu.RLock()
+	version := updater.dailyVersion
+	updater.dailyMu.RUnlock()
+	updater.history.view(key, func(rates []exchangeRate) {
+		price = closingPrice(rates, day)
+	})
+	updater.dailyMu.Lock()
+	defer updater.dailyMu.Unlock()
+	if version == updater.dailyVersion {
+		if updater.dailyCache[key] == nil {
+			updater.dailyCache[key] = make(map[int64]float64)
+		}
+		updater.dailyCache[key][day] = price
+	}
+	return price
+}
+
+// closingPrice returns the last of the rates, sorted in asc order, within the given unix day,
+// or 0 if there is none.
+func closingPrice(rates []exchangeRate, day int64) float64 {
+	// Find the index of the first rate of the next day.
+	next := sort.Search(len(rates), func(i int) bool {
+		return rates[i].timestamp.Unix() >= (day+1)*secondsPerDay
+	})
+	if next == 0 || rates[next-1].timestamp.Unix() < day*secondsPerDay {
+		return 0
+	}
+	return rates[next-1].value
+}
+
+// invalidateDailyDays removes the cached daily prices of the coin+fiat key on the days of the rates.
+func (updater *RateUpdater) invalidateDailyDays(key string, rates []exchangeRate) {
+	updater.dailyMu.Lock()
+	defer updater.dailyMu.Unlock()
+	updater.dailyVersion++
+	for _, rate := range rates {
+		delete(updater.dailyCache[key], unixDay(rate.timestamp))
+	}
+}
+
+// invalidateDailyKey removes all cached daily prices of the coin+fiat key.
+func (updater *RateUpdater) invalidateDailyKey(key string) {
+	updater.dailyMu.Lock()
+	defer updater.dailyMu.Unlock()
+	updater.dailyVersion++
+	delete(updater.dailyCache, key)
+}
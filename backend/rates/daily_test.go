@@ -0,0 +1,62 @@
+package rates
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnixDay(t *testing.T) {
+	assert.Equal(t, int64(0), unixDay(time.Unix(0, 0)))
+	assert.Equal(t, int64(0), unixDay(time.Unix(86399, 0)))
+	assert.Equal(t, int64(1), unixDay(time.Unix(86400, 0)))
+	assert.Equal(t, int64(-1), unixDay(time.Unix(-1, 0)))
+	assert.Equal(t, int64(-1), unixDay(time.Unix(-86400, 0)))
+	assert.Equal(t, int64(18506), unixDay(time.Date(2020, 9, 1, 23, 0, 0, 0, time.UTC)))
+}
+
+func TestDailyPriceAt(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "unused" // avoid hitting real API
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	day := func(d, h int) time.Time { return time.Date(2020, 9, d, h, 0, 0, 0, time.UTC) }
+	updater.storeHistory("btc", "USD", []exchangeRate{
+		{value: 1, timestamp: day(1, 0)},
+		{value: 2, timestamp: day(1, 12)},
+		{value: 3, timestamp: day(1, 23)},
+		{value: 4, timestamp: day(3, 1)},
+	})
+
+	assert.Equal(t, 3.0, updater.DailyPriceAt("btc", "USD", day(1, 5)))
+	assert.Equal(t, 0.0, updater.DailyPriceAt("btc", "USD", day(2, 5)), "no rates on that day")
+	assert.Equal(t, 4.0, updater.DailyPriceAt("btc", "USD", day(3, 0)))
+	assert.Equal(t, 0.0, updater.DailyPriceAt("btc", "USD", day(4, 0)))
+	assert.Equal(t, 0.0, updater.DailyPriceAt("ltc", "USD", day(1, 0)))
+	assert.Equal(t, map[int64]float64{
+		unixDay(day(1, 0)): 3,
+		unixDay(day(2, 0)): 0,
+		unixDay(day(3, 0)): 4,
+		unixDay(day(4, 0)): 0,
+	}, updater.dailyCache["btcUSD"])
+
+	// New rates invalidate the cached prices of their days only.
+	updater.storeHistory("btc", "USD", []exchangeRate{
+		{value: 5, timestamp: day(2, 6)},
+		{value: 6, timestamp: day(3, 22)},
+	})
+	assert.Equal(t, map[int64]float64{
+		unixDay(day(1, 0)): 3,
+		unixDay(day(4, 0)): 0,
+	}, updater.dailyCache["btcUSD"])
+	assert.Equal(t, 5.0, updater.DailyPriceAt("btc", "USD", day(2, 0)))
+	assert.Equal(t, 6.0, updater.DailyPriceAt("btc", "USD", day(3, 0)))
+
+	// Reconfiguring drops the cache of the pair.
+	updater.ReconfigureHistory(nil, nil)
+	assert.NotContains(t, updater.dailyCache, "btcUSD")
+	assert.Equal(t, 0.0, updater.DailyPriceAt("btc", "USD", day(1, 0)))
+}
@@ -1,59 +1,424 @@
 package rates
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"math"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"go.etcd.io/bbolt"
 )
 
-func openRatesDB(dir string) (*bbolt.DB, error) {
-	opt := &bbolt.Options{Timeout: 5 * time.Second} // network disks may take long
+// Schema versions of the history buckets in the database.
+// Version 1 stores each rate in its own key/value pair: the 8 bytes big endian unix timestamp
+// in seconds as the key and the 8 bytes big endian IEEE 754 float as the value.
+// Version 2 stores all rates of a bucket under historyDeltaKey, encoded with encodeDelta.
+// Version 3 splits the rates of a bucket into chunks per calendar month in UTC, each encoded
+// with encodeDelta and stored in the nested bucket historyChunksKey under the month, see
+// historyChunkKey. This way, storing new rates only rewrites the chunks they fall into.
+// Version 1 and 2 buckets are migrated to version 3 when loaded.
+const (
+	historySchemaV1 = 1
+	historySchemaV2 = 2
+	historySchemaV3 = 3
+)
+
+// historyDeltaKey is the key of the rates in a version 2 history bucket.
+var historyDeltaKey = []byte("delta")
+
+// historyChunksKey is the key of the nested bucket holding the chunks of a version 3 history
+// bucket.
+var historyChunksKey = []byte("chunks")
+
+// historyChunkLayout is the time layout of the keys of the chunks of a version 3 history bucket.
+// The keys sort like the months they represent.
+const historyChunkLayout = "2006-01"
+
+// historyGranularityKey is the key of the Granularity of the rates in a version 2 or 3 history
+// bucket, stored as a single byte. Buckets written before it was introduced don't have it.
+var historyGranularityKey = []byte("granularity")
+
+func defaultBBoltOptions() *bbolt.Options {
+	return &bbolt.Options{Timeout: 5 * time.Second} // network disks may take long
+}
+
+func openRatesDB(dir string, opt *bbolt.Options) (*bbolt.DB, error) {
 	return bbolt.Open(filepath.Join(dir, "rates.db"), 0600, opt)
 }
 
-// loadHistoryBucket loads data from an updater.historyDB bucket identified by the key.
-// The returned value is sorted by timestamp in ascending order.
-func (updater *RateUpdater) loadHistoryBucket(key string) ([]exchangeRate, error) {
-	var rates []exchangeRate
-	err := updater.historyDB.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(key))
-		if bucket == nil {
-			return nil // no history exists for this key
-		}
-		// The func is called with k items in already byte-sorted order.
-		return bucket.ForEach(func(k, v []byte) error {
-			timestamp := binary.BigEndian.Uint64(k)
-			value := math.Float64frombits(binary.BigEndian.Uint64(v))
-			rates = append(rates, exchangeRate{
-				value:     value,
-				timestamp: time.Unix(int64(timestamp), 0),
-			})
+// historyBucketSchema reports the schema version of a history bucket.
+func historyBucketSchema(bucket *bbolt.Bucket) int {
+	switch {
+	case bucket.Bucket(historyChunksKey) != nil:
+		return historySchemaV3
+	case bucket.Get(historyDeltaKey) != nil:
+		return historySchemaV2
+	}
+	return historySchemaV1
+}
+
+// historyChunkKey returns the key of the chunk of a version 3 history bucket holding the rates
+// of the month of t in UTC, and the start of the next month.
+func historyChunkKey(t time.Time) ([]byte, time.Time) {
+	t = t.UTC()
+	next := time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	return []byte(t.Format(historyChunkLayout)), next
+}
+
+// readHistoryBucket returns all rates of a bucket in any schema version,
+// sorted by timestamp in ascending order.
+func readHistoryBucket(bucket *bbolt.Bucket) ([]exchangeRate, error) {
+	switch historyBucketSchema(bucket) {
+	case historySchemaV3:
+		var chunks [][]exchangeRate
+		var n int
+		// The chunks are visited in the order of their months.
+		err := bucket.Bucket(historyChunksKey).ForEach(func(_, v []byte) error {
+			chunk, err := decodeDelta(v)
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, chunk)
+			n += len(chunk)
 			return nil
 		})
+		if err != nil || n == 0 {
+			return nil, err
+		}
+		rates := make([]exchangeRate, 0, n)
+		for _, chunk := range chunks {
+			rates = append(rates, chunk...)
+		}
+		return rates, nil
+	case historySchemaV2:
+		return decodeDelta(bucket.Get(historyDeltaKey))
+	}
+	var rates []exchangeRate
+	// The func is called with k items in already byte-sorted order.
+	err := bucket.ForEach(func(k, v []byte) error {
+		timestamp := binary.BigEndian.Uint64(k)
+		value := math.Float64frombits(binary.BigEndian.Uint64(v))
+		rates = append(rates, exchangeRate{
+			value:     value,
+			timestamp: time.Unix(int64(timestamp), 0),
+		})
+		return nil
 	})
 	return rates, err
 }
 
-// dumpHistoryBucket stores rates in a DB bucket identified by the key.
-// It assumes rates are already sorted by timestamp in ascending order.
-func (updater *RateUpdater) dumpHistoryBucket(key string, rates []exchangeRate) error {
-	return updater.historyDB.Update(func(tx *bbolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(key))
-		if err != nil {
+// readHistoryGranularity returns the granularity stored in a history bucket and whether
+// it is stored at all.
+func readHistoryGranularity(bucket *bbolt.Bucket) (Granularity, bool) {
+	value := bucket.Get(historyGranularityKey)
+	if len(value) != 1 {
+		return GranularityHourly, false
+	}
+	return Granularity(value[0]), true
+}
+
+// writeHistoryBucket replaces the rates of the bucket identified by the key with the rates,
+// which must be sorted by timestamp in ascending order, and stores their granularity.
+// A bucket of an older schema version is replaced by a version 3 bucket. Only the chunks whose
+// rates changed are written and the ones without rates anymore deleted, so that storing new
+// rates in a long history only touches the pages of the months they fall into.
+func writeHistoryBucket(tx *bbolt.Tx, key string, rates []exchangeRate, granularity Granularity) error {
+	bucket := tx.Bucket([]byte(key))
+	if bucket != nil && historyBucketSchema(bucket) != historySchemaV3 {
+		if err := tx.DeleteBucket([]byte(key)); err != nil {
 			return err
 		}
-		for _, rate := range rates {
-			var tsbytes [8]byte
-			binary.BigEndian.PutUint64(tsbytes[:], uint64(rate.timestamp.Unix()))
-			var vbytes [8]byte
-			binary.BigEndian.PutUint64(vbytes[:], math.Float64bits(rate.value))
-			if err := bucket.Put(tsbytes[:], vbytes[:]); err != nil {
+		bucket = nil
+	}
+	if bucket == nil {
+		var err error
+		if bucket, err = tx.CreateBucket([]byte(key)); err != nil {
+			return err
+		}
+	}
+	if stored, ok := readHistoryGranularity(bucket); !ok || stored != granularity {
+		if err := bucket.Put(historyGranularityKey, []byte{byte(granularity)}); err != nil {
+			return err
+		}
+	}
+	chunks, err := bucket.CreateBucketIfNotExists(historyChunksKey)
+	if err != nil {
+		return err
+	}
+	written := make(map[string]struct{})
+	for len(rates) > 0 {
+		chunkKey, next := historyChunkKey(rates[0].timestamp)
+		n := sort.Search(len(rates), func(i int) bool { return !rates[i].timestamp.Before(next) })
+		data := encodeDelta(rates[:n])
+		if !bytes.Equal(chunks.Get(chunkKey), data) {
+			if err := chunks.Put(chunkKey, data); err != nil {
 				return err
 			}
 		}
+		written[string(chunkKey)] = struct{}{}
+		rates = rates[n:]
+	}
+	var stale [][]byte
+	err = chunks.ForEach(func(k, _ []byte) error {
+		if _, ok := written[string(k)]; !ok {
+			stale = append(stale, append([]byte(nil), k...))
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, chunkKey := range stale {
+		if err := chunks.Delete(chunkKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadHistoryBucket loads data from an updater.historyStore bucket identified by the key.
+// The returned value is sorted by timestamp in ascending order.
+// Unless set already, the granularity of the key becomes the one stored in the bucket, if the
+// store persists granularities. Buckets without one were written before granularities could be
+// selected and are hourly.
+func (updater *RateUpdater) loadHistoryBucket(key string) ([]exchangeRate, error) {
+	if store, ok := updater.historyStore.(granularityStore); ok {
+		granularity, hasGranularity, err := store.storedGranularity(key)
+		if err != nil {
+			return nil, err
+		}
+		if hasGranularity {
+			updater.adoptHistoryGranularity(key, granularity)
+		}
+	}
+	return updater.historyStore.ReadBucket(key)
+}
+
+// dumpHistoryBucket stores rates in a DB bucket identified by the key, merging them with
+// the rates already stored. Existing rates with the same timestamp are replaced.
+// The result is compacted according to the granularity of the key and
+// WithMaxHistoryEntriesPerPair.
+func (updater *RateUpdater) dumpHistoryBucket(key string, rates []exchangeRate) error {
+	return updater.updateHistoryBucket(key, func(existing []exchangeRate) ([]exchangeRate, bool) {
+		return updater.compactHistory(key, mergeHistoryEntries(existing, rates)), true
+	})
+}
+
+// updateHistoryBucket replaces the rates of the updater.historyStore bucket identified by the
+// key with the result of fn called with the stored ones, unless fn returns false.
+// Updates of the store are serialized, so that concurrent updates don't get lost.
+func (updater *RateUpdater) updateHistoryBucket(key string, fn func(rates []exchangeRate) ([]exchangeRate, bool)) error {
+	updater.historyStoreMu.Lock()
+	defer updater.historyStoreMu.Unlock()
+	existing, err := updater.historyStore.ReadBucket(key)
+	if err != nil {
+		return err
+	}
+	rates, ok := fn(existing)
+	if !ok {
+		return nil
+	}
+	if err := updater.historyStore.WriteBucket(key, rates); err != nil {
+		updater.planner.forget(key)
+		return err
+	}
+	updater.planner.recordWrite(key, rates)
+	return nil
+}
+
+// mergeHistoryEntries returns the union of the existing and new rates sorted by timestamp in
+// ascending order, without duplicate timestamps, as needed by priceAt. Timestamps are compared
+// in seconds, the precision they are stored with, so that rates within the same second are not
+// kept apart in memory only to collide in the database. The existing rates must be sorted. For
+// equal timestamps, the new rate wins, e.g. of a retried fetch overlapping with the existing
+// rates. The new rates are sorted first only if they are not sorted already, which is usually
+// the case for API responses. Neither argument is modified.
+func mergeHistoryEntries(existing, newEntries []exchangeRate) []exchangeRate {
+	less := func(a, b exchangeRate) bool { return a.timestamp.Unix() < b.timestamp.Unix() }
+	if !sort.SliceIsSorted(newEntries, func(i, j int) bool { return less(newEntries[i], newEntries[j]) }) {
+		sorted := make([]exchangeRate, len(newEntries))
+		copy(sorted, newEntries)
+		// Stable so that the last of equal timestamps wins below.
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		newEntries = sorted
+	}
+	merged := make([]exchangeRate, 0, len(existing)+len(newEntries))
+	var i, j int
+	for i < len(existing) || j < len(newEntries) {
+		var next exchangeRate
+		isNew := j < len(newEntries) && (i == len(existing) || !less(existing[i], newEntries[j]))
+		if isNew {
+			next = newEntries[j]
+			j++
+		} else {
+			next = existing[i]
+			i++
+		}
+		if n := len(merged); n > 0 && merged[n-1].timestamp.Unix() == next.timestamp.Unix() {
+			if isNew {
+				merged[n-1] = next
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// CoinFiatPair describes the historical rates of a coin+fiat pair stored in the database cache.
+type CoinFiatPair struct {
+	// Coin is the coin code as used in ReconfigureHistory, e.g. "btc".
+	Coin string `json:"coin"`
+	// Fiat is the fiat code as used in ReconfigureHistory, e.g. "USD".
+	Fiat string `json:"fiat"`
+	// EarliestEntry and LatestEntry are the timestamps of the oldest and newest rates.
+	EarliestEntry time.Time `json:"earliestEntry"`
+	LatestEntry   time.Time `json:"latestEntry"`
+	// EntryCount is the number of stored rates.
+	EntryCount int `json:"entryCount"`
+}
+
+// splitHistoryKey returns the coin and fiat of a coin+fiat pair key, e.g. "btc" and "USD" for
+// "btcUSD". It returns false if the key is not made of a supported coin and fiat.
+func splitHistoryKey(key string) (string, string, bool) {
+	for fiat := range toGeckoFiat {
+		coin, ok := strings.CutSuffix(key, fiat)
+		if ok && geckoCoin[CoinCode(coin)] != "" {
+			return coin, fiat, true
+		}
+	}
+	return "", "", false
+}
+
+// ListTrackedPairs returns all coin+fiat pairs with historical rates in the database cache,
+// including the ones not currently configured with ReconfigureHistory, sorted by coin and fiat.
+// Buckets of unsupported coins or fiats are skipped. It returns an error if the database
+// is unusable or the context is done while reading it.
+func (updater *RateUpdater) ListTrackedPairs(ctx context.Context) ([]CoinFiatPair, error) {
+	keys, err := historyKeys(updater.historyStore)
+	if err != nil {
+		return nil, err
+	}
+	var pairs []CoinFiatPair
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rates, err := updater.historyStore.ReadBucket(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(rates) == 0 {
+			continue
+		}
+		coin, fiat, _ := splitHistoryKey(key)
+		pairs = append(pairs, CoinFiatPair{
+			Coin:          coin,
+			Fiat:          fiat,
+			EarliestEntry: rates[0].timestamp,
+			LatestEntry:   rates[len(rates)-1].timestamp,
+			EntryCount:    len(rates),
+		})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Coin != pairs[j].Coin {
+			return pairs[i].Coin < pairs[j].Coin
+		}
+		return pairs[i].Fiat < pairs[j].Fiat
+	})
+	return pairs, nil
+}
+
+// MergeHistoryDB merges the historical rates of all coin+fiat pairs in the bbolt database at
+// sourcePath, e.g. of a backup from another device, into the database cache, see
+// WithHistoryStore. Rates with timestamps already present are kept. The source is opened
+// read-only and may use any schema version, see BBoltHistoryStore. The rates of the pairs
+// currently configured with ReconfigureHistory are merged in memory as well. It returns the
+// number of rates inserted.
+//
+// Nothing is merged if the source can't be read or the context is done before the source was
+// read completely. If storing the rates of a pair fails, the pairs merged until then are kept
+// and counted.
+func (updater *RateUpdater) MergeHistoryDB(ctx context.Context, sourcePath string) (int, error) {
+	source, err := bbolt.Open(sourcePath, 0600, &bbolt.Options{ReadOnly: true, Timeout: defaultBBoltOptions().Timeout})
+	if err != nil {
+		return 0, err
+	}
+	sourceRates, err := readHistoryStore(ctx, NewBBoltHistoryStore(source, updater.log))
+	if closeErr := source.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// The rates missing in the database cache, per pair.
+	inserted := make(map[string][]exchangeRate)
+	var total int
+	for key, rates := range sourceRates {
+		err = updater.updateHistoryBucket(key, func(existing []exchangeRate) ([]exchangeRate, bool) {
+			missing := missingHistoryEntries(existing, rates)
+			if len(missing) == 0 {
+				return nil, false
+			}
+			inserted[key] = missing
+			total += len(missing)
+			return mergeHistoryEntries(existing, missing), true
+		})
+		if err != nil {
+			break
+		}
+	}
+	// Also the rates merged before a failure.
+	for key, rates := range inserted {
+		if !updater.history.exists(key) {
+			continue
+		}
+		updater.history.update(key, func(current []exchangeRate) []exchangeRate {
+			return mergeHistoryEntries(current, missingHistoryEntries(current, rates))
+		})
+		updater.invalidateDailyKey(key)
+	}
+	return total, err
+}
+
+// readHistoryStore returns the rates of all history buckets of store, keyed by coin+fiat pair.
+func readHistoryStore(ctx context.Context, store HistoryStore) (map[string][]exchangeRate, error) {
+	keys, err := historyKeys(store)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]exchangeRate, len(keys))
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rates, err := store.ReadBucket(key)
+		if err != nil {
+			return nil, err
+		}
+		result[key] = rates
+	}
+	return result, nil
+}
+
+// missingHistoryEntries returns the rates with timestamps not in existing. Like in
+// mergeHistoryEntries, timestamps are compared in seconds.
+// Neither argument is modified.
+func missingHistoryEntries(existing, rates []exchangeRate) []exchangeRate {
+	timestamps := make(map[int64]struct{}, len(existing))
+	for _, rate := range existing {
+		timestamps[rate.timestamp.Unix()] = struct{}{}
+	}
+	var missing []exchangeRate
+	for _, rate := range rates {
+		if _, ok := timestamps[rate.timestamp.Unix()]; !ok {
+			missing = append(missing, rate)
+		}
+	}
+	return missing
 }
@@ -0,0 +1,98 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// CircuitStateNone is the RateDiagnostics.CircuitState of an updater without a circuit breaker.
+const CircuitStateNone = "none"
+
+// RateDiagnostics describes the state of a RateUpdater, for troubleshooting.
+type RateDiagnostics struct {
+	CoingeckoURL string `json:"coingeckoURL"`
+	// LastFetchDuration is how long the latest rates request took, including waiting for
+	// the rate limit and the middlewares configured with WithMiddleware.
+	LastFetchDuration time.Duration `json:"lastFetchDuration"`
+	// LastFetchError is the error of the latest rates update, or empty if it succeeded.
+	LastFetchError string `json:"lastFetchError"`
+	// ActiveHistoryPairs are the coin+fiat pairs of which historical rates are kept
+	// up to date, e.g. "btcUSD", sorted.
+	ActiveHistoryPairs []string `json:"activeHistoryPairs"`
+	// InMemoryHistoryEntryCount is the number of historical rates in memory per coin+fiat pair.
+	InMemoryHistoryEntryCount map[string]int `json:"inMemoryHistoryEntryCount"`
+	// DetectedHistoryGranularity is the granularity of the most recent historical rates in memory
+	// per coin+fiat pair, "hourly" or "daily", detected from the intervals between them.
+	DetectedHistoryGranularity map[string]string `json:"detectedHistoryGranularity"`
+	// DBSizeBytes is the size of the historical rates database cache, or 0 if it is unusable.
+	DBSizeBytes int64 `json:"dbSizeBytes"`
+	// CircuitState is always CircuitStateNone: requests are rate limited but there is
+	// no circuit breaker.
+	CircuitState string `json:"circuitState"`
+	// RateLimiterQueueDepth is the number of requests waiting for the rate limit.
+	RateLimiterQueueDepth int `json:"rateLimiterQueueDepth"`
+	// Paused is whether the updates of the latest rates are paused. See Pause.
+	Paused bool `json:"paused"`
+}
+
+// setLastFetch records the outcome of the latest rates update for Diagnostics.
+func (updater *RateUpdater) setLastFetch(duration time.Duration, err error) {
+	updater.lastFetchMu.Lock()
+	defer updater.lastFetchMu.Unlock()
+	updater.lastFetchDuration = duration
+	updater.lastFetchErr = err
+	if err == nil {
+		updater.lastFetchOKAt = updater.clock()
+	}
+}
+
+// Diagnostics returns the current state of the updater. It doesn't wait for ongoing
+// requests or configuration changes: the active history pairs are the ones in memory,
+// which are added and removed at the same time as their goroutines.
+func (updater *RateUpdater) Diagnostics() RateDiagnostics {
+	diag := RateDiagnostics{
+		CoingeckoURL:               updater.coingeckoURL,
+		InMemoryHistoryEntryCount:  make(map[string]int),
+		DetectedHistoryGranularity: make(map[string]string),
+		CircuitState:               CircuitStateNone,
+		RateLimiterQueueDepth:      int(updater.geckoWaiting.Load()),
+		Paused:                     updater.Paused(),
+	}
+
+	updater.lastFetchMu.Lock()
+	diag.LastFetchDuration = updater.lastFetchDuration
+	if updater.lastFetchErr != nil {
+		diag.LastFetchError = updater.lastFetchErr.Error()
+	}
+	updater.lastFetchMu.Unlock()
+
+	for key, rates := range updater.history.all() {
+		diag.ActiveHistoryPairs = append(diag.ActiveHistoryPairs, key)
+		diag.InMemoryHistoryEntryCount[key] = len(rates)
+		diag.DetectedHistoryGranularity[key] = detectGranularity(rates).String()
+	}
+	sort.Strings(diag.ActiveHistoryPairs)
+
+	// Read transactions don't wait for writers. An unusable database leaves the size at 0.
+	_ = updater.historyDB.View(func(tx *bbolt.Tx) error {
+		diag.DBSizeBytes = tx.Size()
+		return nil
+	})
+	return diag
+}
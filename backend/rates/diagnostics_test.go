@@ -0,0 +1,73 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnostics(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestDiagnostics")
+	defer os.RemoveAll(dbdir)
+	ts := newSimplePriceServer(t, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.storeHistory("btc", "USD", []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832000, 0)},
+		{value: 2, timestamp: time.Unix(1598832300, 0)},
+	})
+	updater.storeHistory("ltc", "EUR", []exchangeRate{{value: 3, timestamp: time.Unix(1598832000, 0)}})
+
+	updater.updateLast(context.Background())
+	diag := updater.Diagnostics()
+	assert.Equal(t, ts.URL, diag.CoingeckoURL)
+	assert.Positive(t, diag.LastFetchDuration)
+	assert.Empty(t, diag.LastFetchError)
+	assert.Equal(t, []string{"btcUSD", "ltcEUR"}, diag.ActiveHistoryPairs)
+	assert.Equal(t, map[string]int{"btcUSD": 2, "ltcEUR": 1}, diag.InMemoryHistoryEntryCount)
+	assert.Equal(t, map[string]string{"btcUSD": "hourly", "ltcEUR": "hourly"}, diag.DetectedHistoryGranularity)
+	assert.Positive(t, diag.DBSizeBytes)
+	assert.Equal(t, CircuitStateNone, diag.CircuitState)
+	assert.Zero(t, diag.RateLimiterQueueDepth)
+
+	updater.coingeckoURL = "unused"
+	updater.updateLast(context.Background())
+	assert.NotEmpty(t, updater.Diagnostics().LastFetchError)
+}
+
+func TestDiagnosticsRateLimiterQueueDepth(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.Zero(t, updater.Diagnostics().DBSizeBytes)
+
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Hour)
+	// Consume the first tick so that the next calls wait.
+	require.NoError(t, updater.geckoCall(context.Background(), "test", func() error { return nil }))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			_ = updater.geckoCall(ctx, "test", func() error { return nil })
+			done <- struct{}{}
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		return updater.Diagnostics().RateLimiterQueueDepth == 2
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+	<-done
+	assert.Zero(t, updater.Diagnostics().RateLimiterQueueDepth)
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rate qualities of EnrichedTxRecord.
+const (
+	// RateQualityExact means a historical rate exists at the exact timestamp.
+	RateQualityExact = "exact"
+	// RateQualityInterpolated means the rate is interpolated between the two closest
+	// historical rates, see HistoricalPriceAt.
+	RateQualityInterpolated = "interpolated"
+	// RateQualityUnavailable means no historical rate is available, and the fiat value is 0.
+	RateQualityUnavailable = "unavailable"
+)
+
+// defaultEnrichmentConcurrency is the default of WithEnrichmentConcurrency.
+const defaultEnrichmentConcurrency = 4
+
+// TxRecord is a transaction to be valued by EnrichTransactions.
+type TxRecord struct {
+	// Coin is the coin unit as used by the historical rates, e.g. "btc".
+	Coin      string
+	Amount    float64
+	Timestamp time.Time
+}
+
+// EnrichedTxRecord is a TxRecord valued in fiat at the time of the transaction.
+type EnrichedTxRecord struct {
+	TxRecord
+	// FiatValue is Amount times RateAtTime.
+	FiatValue float64
+	// RateAtTime is the historical exchange rate at Timestamp.
+	RateAtTime float64
+	// RateQuality is one of the RateQuality* constants.
+	RateQuality string
+}
+
+// WithEnrichmentConcurrency sets the number of transactions EnrichTransactions processes
+// concurrently. Values below 1 are treated as 1. The default is 4.
+func WithEnrichmentConcurrency(n int) Option {
+	return func(updater *RateUpdater) {
+		updater.enrichmentConcurrency = n
+	}
+}
+
+// EnrichTransactions values txs in the given fiat at the historical exchange rates at their
+// timestamps, for example when importing the transaction history of a wallet. The result has
+// the same order as txs. Transactions without a historical rate are annotated with
+// RateQualityUnavailable instead of failing the batch.
+//
+// An error is returned only if ctx is done before all transactions are processed.
+func (updater *RateUpdater) EnrichTransactions(ctx context.Context, txs []TxRecord, fiat string) ([]EnrichedTxRecord, error) {
+	workers := updater.enrichmentConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	result := make([]EnrichedTxRecord, len(txs))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				result[i] = updater.enrichTransaction(txs[i], fiat)
+			}
+		}()
+	}
+	var err error
+feed:
+	for i := range txs {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// enrichTransaction values a single transaction, see EnrichTransactions.
+func (updater *RateUpdater) enrichTransaction(tx TxRecord, fiat string) EnrichedTxRecord {
+	enriched := EnrichedTxRecord{TxRecord: tx, RateQuality: RateQualityUnavailable}
+	updater.history.view(tx.Coin+fiat, func(rates []exchangeRate) {
+		enriched.RateAtTime = priceAt(rates, tx.Timestamp)
+		if enriched.RateAtTime == 0 {
+			return
+		}
+		idx := sort.Search(len(rates), func(i int) bool {
+			return !rates[i].timestamp.Before(tx.Timestamp)
+		})
+		if rates[idx].timestamp.Equal(tx.Timestamp) {
+			enriched.RateQuality = RateQualityExact
+		} else {
+			enriched.RateQuality = RateQualityInterpolated
+		}
+	})
+	enriched.FiatValue = tx.Amount * enriched.RateAtTime
+	return enriched
+}
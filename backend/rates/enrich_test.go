@@ -0,0 +1,70 @@
+package rates
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichTransactions(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1700000000, 0)
+	for _, concurrency := range []int{0, 1, 3} {
+		updater := NewRateUpdater(nil, "/dev/null", WithEnrichmentConcurrency(concurrency))
+		// 1 at start, 2 an hour later, etc.
+		updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 5))
+		updater.storeHistory("eth", "USD", ratesEvery(start, time.Hour, 2))
+
+		txs := []TxRecord{
+			{Coin: "btc", Amount: 2, Timestamp: start.Add(time.Hour)},
+			{Coin: "btc", Amount: -1, Timestamp: start.Add(90 * time.Minute)},
+			{Coin: "eth", Amount: 4, Timestamp: start},
+			{Coin: "eth", Amount: 1, Timestamp: start.Add(2 * time.Hour)},
+			{Coin: "ltc", Amount: 1, Timestamp: start},
+		}
+		enriched, err := updater.EnrichTransactions(context.Background(), txs, "USD")
+		require.NoError(t, err)
+		require.Len(t, enriched, len(txs))
+		for i, tx := range txs {
+			assert.Equal(t, tx, enriched[i].TxRecord)
+		}
+
+		assert.Equal(t, RateQualityExact, enriched[0].RateQuality)
+		assert.InDelta(t, 2, enriched[0].RateAtTime, 1e-9)
+		assert.InDelta(t, 4, enriched[0].FiatValue, 1e-9)
+
+		assert.Equal(t, RateQualityInterpolated, enriched[1].RateQuality)
+		assert.InDelta(t, 2.5, enriched[1].RateAtTime, 1e-9)
+		assert.InDelta(t, -2.5, enriched[1].FiatValue, 1e-9)
+
+		assert.Equal(t, RateQualityExact, enriched[2].RateQuality)
+		assert.InDelta(t, 4, enriched[2].FiatValue, 1e-9)
+
+		for _, unavailable := range enriched[3:] {
+			assert.Equal(t, RateQualityUnavailable, unavailable.RateQuality)
+			assert.Zero(t, unavailable.RateAtTime)
+			assert.Zero(t, unavailable.FiatValue)
+		}
+	}
+}
+
+func TestEnrichTransactionsEmpty(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null")
+	enriched, err := updater.EnrichTransactions(context.Background(), nil, "USD")
+	require.NoError(t, err)
+	assert.Empty(t, enriched)
+}
+
+func TestEnrichTransactionsCanceled(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithEnrichmentConcurrency(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	txs := make([]TxRecord, 100)
+	_, err := updater.EnrichTransactions(ctx, txs, "USD")
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,243 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/sirupsen/logrus"
+)
+
+// eventLogDayFormat is the suffix of rotated event log files.
+const eventLogDayFormat = "2006-01-02"
+
+// defaultEventLogMaxRotated is the default number of rotated event log files kept.
+const defaultEventLogMaxRotated = 7
+
+// RateEvent is a latest rates event as stored in an EventLog.
+type RateEvent struct {
+	Timestamp time.Time                     `json:"timestamp"`
+	Subject   string                        `json:"subject"`
+	Rates     map[string]map[string]float64 `json:"rates"`
+}
+
+// EventLog is an append-only log of latest rates events, for auditing and replay.
+// Each event is stored as a JSON line in the log file. The file is rotated daily (UTC)
+// by renaming it to the path with the day appended, e.g. "rates.jsonl.2020-09-01".
+//
+// All methods are safe for concurrent use.
+type EventLog struct {
+	path string
+	log  *logrus.Entry
+
+	mu sync.Mutex // guards all fields below
+	// file is the current log file, opened for appending.
+	file *os.File
+	// day is when the first event in file was written, in eventLogDayFormat.
+	// Empty if file has no events yet.
+	day string
+	// maxRotated is how many rotated files are kept. Older ones are removed.
+	maxRotated int
+	// unobserve stops appending events of the observable set in Observe.
+	unobserve func()
+}
+
+// NewEventLog opens the event log at path for appending, creating it if necessary. Errors
+// appending observed events are logged to log, e.g. the one passed to WithLogger.
+// By default, the last 7 rotated files are kept; see SetMaxRotated.
+func NewEventLog(path string, log *logrus.Entry) (*EventLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	l := &EventLog{
+		path:       path,
+		log:        log,
+		file:       file,
+		maxRotated: defaultEventLogMaxRotated,
+	}
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		l.day = info.ModTime().UTC().Format(eventLogDayFormat)
+	}
+	return l, nil
+}
+
+// SetMaxRotated sets how many rotated log files are kept, starting with the next rotation.
+func (l *EventLog) SetMaxRotated(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxRotated = n
+}
+
+// Observe appends all RatesEventSubject events notified by o, e.g. a RateUpdater,
+// until Close is called. Errors are logged. Only one observable can be observed at a time.
+func (l *EventLog) Observe(o observable.Interface) {
+	unobserve := o.Observe(func(event observable.Event) {
+		if event.Subject != RatesEventSubject {
+			return
+		}
+		rates, ok := event.Object.(map[string]map[string]float64)
+		if !ok {
+			return
+		}
+		err := l.Append(RateEvent{Timestamp: time.Now(), Subject: event.Subject, Rates: rates})
+		if err != nil {
+			l.log.WithError(err).Error("EventLog.Append")
+		}
+	})
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unobserve != nil {
+		l.unobserve()
+	}
+	l.unobserve = unobserve
+}
+
+// Append writes the event to the log, rotating the log file first if the event
+// is on a different day than the events already in the file.
+func (l *EventLog) Append(event RateEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errp.New("event log is closed")
+	}
+	day := event.Timestamp.UTC().Format(eventLogDayFormat)
+	if l.day != "" && l.day != day {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	l.day = day
+	_, err = l.file.Write(append(line, '\n'))
+	return errp.WithStack(err)
+}
+
+// rotate renames the current log file and opens a new one. It must be called with mu held.
+func (l *EventLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	l.file = nil
+	if err := os.Rename(l.path, l.path+"."+l.day); err != nil {
+		return errp.WithStack(err)
+	}
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	l.file = file
+	l.day = ""
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.maxRotated {
+		if err := os.Remove(rotated[0]); err != nil {
+			return errp.WithStack(err)
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// rotatedFiles returns the paths of the rotated log files, oldest first.
+func (l *EventLog) rotatedFiles() ([]string, error) {
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	var rotated []string
+	for _, match := range matches {
+		suffix := match[len(l.path)+1:]
+		if _, err := time.Parse(eventLogDayFormat, suffix); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated, nil
+}
+
+// Replay calls fn with all logged events at or after from, in the order they were appended,
+// including the ones in rotated files. It stops at the first error returned by fn.
+func (l *EventLog) Replay(from time.Time, fn func(RateEvent) error) error {
+	l.mu.Lock()
+	rotated, err := l.rotatedFiles()
+	l.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, path := range append(rotated, l.path) {
+		if err := replayFile(path, from, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replayFile(path string, from time.Time, fn func(RateEvent) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer file.Close() //nolint:errcheck
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var event RateEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return errp.WithMessage(err, path)
+		}
+		if event.Timestamp.Before(from) {
+			continue
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return errp.WithStack(scanner.Err())
+}
+
+// Close stops observing and closes the log file.
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	unobserve := l.unobserve
+	l.unobserve = nil
+	l.mu.Unlock()
+	// Unobserve without holding mu, since a concurrent notification may wait for it in Append.
+	if unobserve != nil {
+		unobserve()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return errp.WithStack(err)
+}
@@ -0,0 +1,112 @@
+package rates
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEventLog(t *testing.T) (*EventLog, string) {
+	t.Helper()
+	dir := test.TstTempDir("TestEventLog")
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "rates.jsonl")
+	l, err := NewEventLog(path, newTestLogger())
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l, path
+}
+
+func replayAll(t *testing.T, l *EventLog, from time.Time) []RateEvent {
+	t.Helper()
+	var events []RateEvent
+	require.NoError(t, l.Replay(from, func(event RateEvent) error {
+		events = append(events, event)
+		return nil
+	}))
+	return events
+}
+
+func TestEventLogAppendReplay(t *testing.T) {
+	l, path := newTestEventLog(t)
+	day := time.Date(2020, 9, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, l.Append(RateEvent{
+			Timestamp: day.Add(time.Duration(i) * time.Minute),
+			Subject:   RatesEventSubject,
+			Rates:     map[string]map[string]float64{"BTC": {"USD": float64(i)}},
+		}))
+	}
+
+	events := replayAll(t, l, time.Time{})
+	require.Len(t, events, 3)
+	assert.True(t, day.Equal(events[0].Timestamp))
+	assert.Equal(t, RatesEventSubject, events[0].Subject)
+	assert.Equal(t, 2.0, events[2].Rates["BTC"]["USD"])
+	assert.Len(t, replayAll(t, l, day.Add(time.Minute)), 2)
+
+	// Reopening appends to the existing file.
+	require.NoError(t, l.Close())
+	require.Error(t, l.Append(RateEvent{Timestamp: day}))
+	l2, err := NewEventLog(path, newTestLogger())
+	require.NoError(t, err)
+	defer l2.Close()
+	require.NoError(t, l2.Append(RateEvent{Timestamp: day.Add(time.Hour)}))
+	assert.Len(t, replayAll(t, l2, time.Time{}), 4)
+
+	errStop := errors.New("stop")
+	var n int
+	err = l2.Replay(time.Time{}, func(RateEvent) error {
+		n++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestEventLogRotation(t *testing.T) {
+	l, path := newTestEventLog(t)
+	l.SetMaxRotated(2)
+	start := time.Date(2020, 9, 1, 23, 0, 0, 0, time.UTC)
+	for h := 0; h < 4*24; h += 12 {
+		require.NoError(t, l.Append(RateEvent{Timestamp: start.Add(time.Duration(h) * time.Hour)}))
+	}
+	// 09-01 23:00; 09-02 11:00, 23:00; 09-03 11:00, 23:00; 09-04 11:00, 23:00; 09-05 11:00
+	rotated, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{path + ".2020-09-03", path + ".2020-09-04"}, rotated)
+
+	events := replayAll(t, l, time.Time{})
+	require.Len(t, events, 5)
+	assert.True(t, start.Add(36*time.Hour).Equal(events[0].Timestamp)) // 09-03 11:00
+	assert.True(t, start.Add(84*time.Hour).Equal(events[4].Timestamp))
+}
+
+func TestEventLogObserve(t *testing.T) {
+	l, _ := newTestEventLog(t)
+	var o observable.Implementation
+	l.Observe(&o)
+	o.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Action:  action.Replace,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 1}},
+	})
+	o.Notify(observable.Event{Subject: "other", Object: map[string]map[string]float64{}})
+	require.NoError(t, l.Close())
+	o.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 2}},
+	})
+
+	events := replayAll(t, l, time.Time{})
+	require.Len(t, events, 1)
+	assert.Equal(t, 1.0, events[0].Rates["BTC"]["USD"])
+}
@@ -0,0 +1,125 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FiatDisplaySpec describes how amounts in a fiat currency are displayed.
+type FiatDisplaySpec struct {
+	// Decimals is the number of decimal places, e.g. 2 for cents.
+	Decimals int
+	// Symbol is the currency symbol, e.g. "$".
+	Symbol string
+	// SymbolAfter is true if the symbol follows the amount, separated by a space, e.g. "10 kr".
+	// Otherwise it precedes the amount without a space, e.g. "$10".
+	SymbolAfter bool
+}
+
+// fiatDisplaySpecs are the FiatDisplaySpec of all Fiat constants.
+var fiatDisplaySpecs = map[Fiat]FiatDisplaySpec{
+	AUD: {Decimals: 2, Symbol: "A$"},
+	BRL: {Decimals: 2, Symbol: "R$"},
+	CAD: {Decimals: 2, Symbol: "CA$"},
+	CHF: {Decimals: 2, Symbol: "CHF", SymbolAfter: true},
+	CNY: {Decimals: 2, Symbol: "CN¥"},
+	CZK: {Decimals: 2, Symbol: "Kč", SymbolAfter: true},
+	EUR: {Decimals: 2, Symbol: "€"},
+	GBP: {Decimals: 2, Symbol: "£"},
+	HKD: {Decimals: 2, Symbol: "HK$"},
+	ILS: {Decimals: 2, Symbol: "₪"},
+	JPY: {Decimals: 0, Symbol: "¥"},
+	KRW: {Decimals: 0, Symbol: "₩"},
+	NOK: {Decimals: 2, Symbol: "kr", SymbolAfter: true},
+	PLN: {Decimals: 2, Symbol: "zł", SymbolAfter: true},
+	RUB: {Decimals: 2, Symbol: "₽", SymbolAfter: true},
+	SEK: {Decimals: 2, Symbol: "kr", SymbolAfter: true},
+	SGD: {Decimals: 2, Symbol: "S$"},
+	USD: {Decimals: 2, Symbol: "$"},
+	BTC: {Decimals: 8, Symbol: "BTC", SymbolAfter: true},
+	SAT: {Decimals: 0, Symbol: "sat", SymbolAfter: true},
+}
+
+// maxSatDisplayBTC is the largest BTC amount FormatRateWithSymbol displays in sat.
+const maxSatDisplayBTC = 0.001
+
+// DisplaySpec returns how amounts in the fiat currency are displayed. Unknown currencies are
+// displayed with 2 decimals and their code as the symbol.
+func DisplaySpec(fiat string) FiatDisplaySpec {
+	if spec, ok := fiatDisplaySpecs[Fiat(fiat)]; ok {
+		return spec
+	}
+	return FiatDisplaySpec{Decimals: 2, Symbol: fiat, SymbolAfter: true}
+}
+
+// FormatRate formats the rate of one coinUnit, e.g. "ETH", in the fiat currency with the
+// decimals of its DisplaySpec and ' as the thousands separator, like coin.FormatAsCurrency.
+// Rates below 1 get more decimals if needed to show at least 2 significant digits, e.g. for
+// tokens worth fractions of a cent or for the sat unit.
+func FormatRate(coinUnit, fiat string, rate float64) string {
+	return formatDecimals(rate, rateDecimals(rate, DisplaySpec(fiat).Decimals))
+}
+
+// FormatRateWithSymbol is like FormatRate, with the symbol of the fiat currency, e.g. "$1.50"
+// or "1.50 CHF". BTC rates below 0.001 BTC are displayed in sat, e.g. "1'234 sat".
+func FormatRateWithSymbol(coinUnit, fiat string, rate float64) string {
+	if Fiat(fiat) == BTC && math.Abs(rate) < maxSatDisplayBTC {
+		fiat, rate = SAT.String(), rate*unitSatoshi
+	}
+	spec := DisplaySpec(fiat)
+	formatted := FormatRate(coinUnit, fiat, rate)
+	if spec.SymbolAfter {
+		return formatted + " " + spec.Symbol
+	}
+	if strings.HasPrefix(formatted, "-") {
+		return "-" + spec.Symbol + formatted[1:]
+	}
+	return spec.Symbol + formatted
+}
+
+// rateDecimals returns the number of decimals to show rate with, at least decimals.
+func rateDecimals(rate float64, decimals int) int {
+	abs := math.Abs(rate)
+	if abs == 0 || abs >= 1 {
+		return decimals
+	}
+	// The position of the first significant digit, e.g. 3 for 0.00123.
+	first := int(math.Ceil(-math.Log10(abs)))
+	if significant := first + 1; significant > decimals {
+		return significant
+	}
+	return decimals
+}
+
+// formatDecimals formats value with the given number of decimals and ' as the thousands
+// separator.
+func formatDecimals(value float64, decimals int) string {
+	formatted := strconv.FormatFloat(value, 'f', decimals, 64)
+	end := strings.IndexByte(formatted, '.')
+	if end < 0 {
+		end = len(formatted)
+	}
+	start := 0
+	if strings.HasPrefix(formatted, "-") {
+		start = 1
+	}
+	for position := end - 3; position > start; position -= 3 {
+		formatted = formatted[:position] + "'" + formatted[position:]
+	}
+	return formatted
+}
@@ -0,0 +1,41 @@
+package rates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiatDisplaySpecs(t *testing.T) {
+	for _, fiat := range allFiats {
+		assert.Contains(t, fiatDisplaySpecs, fiat)
+	}
+	assert.Equal(t, FiatDisplaySpec{Decimals: 2, Symbol: "XYZ", SymbolAfter: true}, DisplaySpec("XYZ"))
+}
+
+func TestFormatRate(t *testing.T) {
+	tt := []struct {
+		coinUnit, fiat string
+		rate           float64
+		want, wantSym  string
+	}{
+		{"BTC", "USD", 27123.456, "27'123.46", "$27'123.46"},
+		{"BTC", "USD", -1234.5, "-1'234.50", "-$1'234.50"},
+		{"BTC", "JPY", 4012345.6, "4'012'346", "¥4'012'346"},
+		{"ETH", "JPY", 123.4, "123", "¥123"},
+		{"sat", "JPY", 0.04012, "0.040", "¥0.040"},
+		{"BTC", "CHF", 23456.789, "23'456.79", "23'456.79 CHF"},
+		{"USDT", "CHF", 0.9, "0.90", "0.90 CHF"},
+		{"SHIB", "CHF", 0.00000812, "0.0000081", "0.0000081 CHF"},
+		{"ETH", "BTC", 0.0543219876, "0.05432199", "0.05432199 BTC"},
+		{"LINK", "BTC", 0.00012345, "0.00012345", "12'345 sat"},
+		{"SHIB", "BTC", 1.3e-13, "0.00000000000013", "0.000013 sat"},
+		{"BTC", "BTC", 1, "1.00000000", "1.00000000 BTC"},
+		{"BTC", "sat", 100000000, "100'000'000", "100'000'000 sat"},
+		{"BTC", "USD", 0, "0.00", "$0.00"},
+	}
+	for _, test := range tt {
+		assert.Equal(t, test.want, FormatRate(test.coinUnit, test.fiat, test.rate), "%s/%s", test.coinUnit, test.fiat)
+		assert.Equal(t, test.wantSym, FormatRateWithSymbol(test.coinUnit, test.fiat, test.rate), "%s/%s", test.coinUnit, test.fiat)
+	}
+}
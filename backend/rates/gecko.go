@@ -1,10 +1,37 @@
 package rates
 
-import "time"
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// The CoinGecko API is available in multiple tiers. From most to least capable:
+//
+//   - The pro tier, requiring a paid API key, see CoinGeckoTierPro.
+//   - The Shift mirror, used by default. It forwards requests to the pro tier using Shift's
+//     API key and caches the responses, so that it can serve all BitBoxApp users without
+//     them needing an API key.
+//   - The public API with a free demo API key, see CoinGeckoTierDemo. Its rate limit is too
+//     low for fetching the history of more than a few coins.
+//
+// Use WithCoinGeckoAPIKey to connect to CoinGecko directly instead of the Shift mirror.
+const (
+	// CoinGeckoTierPro is the tier of paid CoinGecko API plans.
+	CoinGeckoTierPro = "pro"
+	// CoinGeckoTierDemo is the tier of the free CoinGecko API plan.
+	CoinGeckoTierDemo = "demo"
+)
 
 const (
 	// See the following for docs and details: https://www.coingecko.com/en/api.
 	coingeckoAPIV3 = "https://api.coingecko.com/api/v3"
+	// The API for paid plans, see CoinGeckoTierPro.
+	coingeckoProAPIV3 = "https://pro-api.coingecko.com/api/v3"
 	// A mirror of CoinGecko API specifically for use with BitBoxApp.
 	shiftGeckoMirrorAPIV3 = "https://exchangerates.shiftcrypto.io/api/v3"
 	// The maximum duration the updater is allowed to get exchange rates for
@@ -23,10 +50,11 @@ func apiRateLimit(baseURL string) time.Duration {
 	default:
 		return time.Second // arbitrary; localhost, staging, etc.
 	case coingeckoAPIV3:
-		// API calls. From https://www.coingecko.com/en/api:
-		// > Generous rate limits with up to 100 requests/minute
-		// We use slightly lower value.
+		// The demo plan allows 30 requests/minute.
 		return 2 * time.Second
+	case coingeckoProAPIV3:
+		// The smallest paid plan allows 500 requests/minute.
+		return time.Minute / 500
 	case shiftGeckoMirrorAPIV3:
 		// Avoid zero to prevent unexpected panics like in time.NewTicker
 		// and leave some room to breathe.
@@ -34,10 +62,81 @@ func apiRateLimit(baseURL string) time.Duration {
 	}
 }
 
+// version is the app version sent in the default User-Agent header. It is set at build time with
+//
+//	-ldflags "-X github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates.version=4.46.0"
+var version = "dev"
+
+// defaultUserAgent returns the User-Agent header sent unless overridden with WithUserAgent.
+func defaultUserAgent() string {
+	return "BitBoxApp/" + version
+}
+
+// WithUserAgent sets the User-Agent header of all requests to the API, "BitBoxApp/<version>"
+// by default. Some servers apply rate limits per User-Agent.
+func WithUserAgent(userAgent string) Option {
+	return func(updater *RateUpdater) {
+		updater.userAgent = userAgent
+	}
+}
+
+// WithCoinGeckoAPIKey makes the updater connect to CoinGecko directly with the given API key
+// instead of the Shift mirror. The tier is CoinGeckoTierPro or CoinGeckoTierDemo and
+// determines the API URL and rate limit. An unknown tier is logged and ignored.
+func WithCoinGeckoAPIKey(apiKey, tier string) Option {
+	return func(updater *RateUpdater) {
+		switch tier {
+		case CoinGeckoTierPro:
+			updater.coingeckoURL = coingeckoProAPIV3
+			updater.geckoAPIKeyHeader = "x-cg-pro-api-key"
+		case CoinGeckoTierDemo:
+			updater.coingeckoURL = coingeckoAPIV3
+			updater.geckoAPIKeyHeader = "x-cg-demo-api-key"
+		default:
+			updater.log.Errorf("WithCoinGeckoAPIKey: unknown tier %q", tier)
+			return
+		}
+		updater.geckoAPIKey = apiKey
+	}
+}
+
+// NewSelfHostedRateUpdater returns a rate updater connecting to a self-hosted server compatible
+// with the CoinGecko API v3 at baseURL, e.g. "https://rates.example.com/api/v3", instead of the
+// Shift mirror. Requests are rate limited like for any other unknown server, see apiRateLimit.
+// Only HTTPS URLs are accepted.
+func NewSelfHostedRateUpdater(baseURL string, client *http.Client, dbdir string, opts ...Option) (*RateUpdater, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, errp.Newf("self-hosted rates server URL must be https, got %q", baseURL)
+	}
+	apiURL := strings.TrimSuffix(baseURL, "/")
+	opts = append([]Option{func(updater *RateUpdater) {
+		updater.coingeckoURL = apiURL
+	}}, opts...)
+	return NewRateUpdater(client, dbdir, opts...), nil
+}
+
+// newGeckoRequest returns a GET request to the CoinGecko API endpoint with the configured
+// User-Agent, authenticated with the API key if one is configured.
+func (updater *RateUpdater) newGeckoRequest(endpoint string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", updater.userAgent)
+	if updater.geckoAPIKey != "" {
+		req.Header.Set(updater.geckoAPIKeyHeader, updater.geckoAPIKey)
+	}
+	return req, nil
+}
+
 var (
 	// Values are copied from https://api.coingecko.com/api/v3/coins/list.
-	// TODO: Replace keys with coin.Code.
-	geckoCoin = map[string]string{
+	// The keys are all coin codes supported by the BitBoxApp, see CoinCode.
+	geckoCoin = map[CoinCode]string{
 		"btc": "bitcoin",
 		"ltc": "litecoin",
 		"eth": "ethereum",
@@ -127,3 +226,28 @@ var (
 		"czk": "CZK",
 	}
 )
+
+// SupportedFiats returns all supported fiat currencies, including SAT, sorted.
+func SupportedFiats() []Fiat {
+	fiats := make([]Fiat, 0, len(toGeckoFiat))
+	for fiat := range toGeckoFiat {
+		fiats = append(fiats, Fiat(fiat))
+	}
+	sort.Slice(fiats, func(i, j int) bool { return fiats[i] < fiats[j] })
+	return fiats
+}
+
+// SupportedCoins returns the units of all supported coins, including testnets, sorted.
+// Coins added with AutoConfigureFromWallet are not included.
+func SupportedCoins() []string {
+	seen := make(map[string]struct{}, len(coinCodeUnits))
+	units := make([]string, 0, len(coinCodeUnits))
+	for _, unit := range coinCodeUnits {
+		if _, ok := seen[unit]; !ok {
+			seen[unit] = struct{}{}
+			units = append(units, unit)
+		}
+	}
+	sort.Strings(units)
+	return units
+}
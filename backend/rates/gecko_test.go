@@ -0,0 +1,146 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordTransport records all requests and responds with status 200 and the body.
+type recordTransport struct {
+	bodyTransport
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (transport *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.mu.Lock()
+	transport.requests = append(transport.requests, req)
+	transport.mu.Unlock()
+	return transport.bodyTransport.RoundTrip(req)
+}
+
+func TestWithCoinGeckoAPIKey(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	tt := []struct {
+		tier      string
+		url       string
+		header    string
+		rateLimit time.Duration
+	}{
+		{CoinGeckoTierPro, "https://pro-api.coingecko.com/api/v3/simple/price", "x-cg-pro-api-key", 120 * time.Millisecond},
+		{CoinGeckoTierDemo, "https://api.coingecko.com/api/v3/simple/price", "x-cg-demo-api-key", 2 * time.Second},
+	}
+	for _, test := range tt {
+		t.Run(test.tier, func(t *testing.T) {
+			transport := &recordTransport{bodyTransport: bodyTransport{body: []byte(`{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)}}
+			updater := NewRateUpdater(&http.Client{Transport: transport}, "/dev/null",
+				WithCoinGeckoAPIKey("secret", test.tier),
+				WithLogger(newTestLogger()))
+			defer updater.Stop()
+			assert.Equal(t, test.rateLimit, apiRateLimit(updater.coingeckoURL))
+
+			updater.updateLast(context.Background())
+			assert.Equal(t, 1.0, updater.LatestPrice()["BTC"]["USD"])
+			require.Len(t, transport.requests, 1)
+			req := transport.requests[0]
+			req.URL.RawQuery = ""
+			assert.Equal(t, test.url, req.URL.String())
+			assert.Equal(t, "secret", req.Header.Get(test.header))
+		})
+	}
+}
+
+func TestWithCoinGeckoAPIKeyUnknownTier(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	transport := &recordTransport{bodyTransport: bodyTransport{body: []byte(`{}`)}}
+	updater := NewRateUpdater(&http.Client{Transport: transport}, "/dev/null",
+		WithCoinGeckoAPIKey("secret", "enterprise"),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.updateLast(context.Background())
+	require.Len(t, transport.requests, 1)
+	assert.Equal(t, "exchangerates.shiftcrypto.io", transport.requests[0].URL.Host)
+	assert.Empty(t, transport.requests[0].Header.Get("x-cg-pro-api-key"))
+	assert.Empty(t, transport.requests[0].Header.Get("x-cg-demo-api-key"))
+}
+
+func TestWithUserAgent(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	const userAgent = "BitBoxApp/4.46.0"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != userAgent {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintln(w, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	}))
+	defer ts.Close()
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.updateLast(context.Background())
+	assert.Empty(t, updater.LatestPrice(), "default user agent %q", defaultUserAgent())
+
+	updater = NewRateUpdater(http.DefaultClient, "/dev/null", WithUserAgent(userAgent), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.updateLast(context.Background())
+	assert.Equal(t, 1.0, updater.LatestPrice()["BTC"]["USD"])
+}
+
+func TestNewSelfHostedRateUpdater(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var gotPath string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		fmt.Fprintln(w, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	}))
+	defer ts.Close()
+
+	updater, err := NewSelfHostedRateUpdater(ts.URL+"/api/v3/", ts.Client(), "/dev/null",
+		WithLogger(newTestLogger()))
+	require.NoError(t, err)
+	defer updater.Stop()
+	assert.Equal(t, ts.URL+"/api/v3", updater.coingeckoURL)
+	assert.Equal(t, time.Second, apiRateLimit(updater.coingeckoURL))
+
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.updateLast(context.Background())
+	assert.Equal(t, "/api/v3/simple/price", gotPath)
+	assert.Equal(t, 1.0, updater.LatestPrice()["BTC"]["USD"])
+
+	for _, baseURL := range []string{"http://rates.example.com/api/v3", "rates.example.com", "https://", ":"} {
+		_, err := NewSelfHostedRateUpdater(baseURL, http.DefaultClient, "/dev/null")
+		assert.Error(t, err, baseURL)
+	}
+}
+
+func TestSupportedFiats(t *testing.T) {
+	fiats := SupportedFiats()
+	assert.Len(t, fiats, 20)
+	assert.ElementsMatch(t, allFiats, fiats)
+	assert.True(t, sort.SliceIsSorted(fiats, func(i, j int) bool { return fiats[i] < fiats[j] }))
+}
+
+func TestSupportedCoins(t *testing.T) {
+	coins := SupportedCoins()
+	assert.Len(t, coins, 16)
+	assert.True(t, sort.StringsAreSorted(coins))
+	assert.Contains(t, coins, "BTC")
+	assert.Contains(t, coins, "SEPETH")
+	assert.Contains(t, coins, "USDT")
+}
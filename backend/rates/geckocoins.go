@@ -0,0 +1,164 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// CoinInfo describes a coin supported by CoinGecko.
+type CoinInfo struct {
+	// ID is the CoinGecko coin ID, e.g. "bitcoin".
+	ID string `json:"id"`
+	// Symbol is the ticker symbol in lowercase, e.g. "btc".
+	Symbol string `json:"symbol"`
+	// Name is the human readable name, e.g. "Bitcoin".
+	Name string `json:"name"`
+}
+
+// FetchSupportedCoins returns all coins supported by CoinGecko, using the "coins/list" API.
+func (updater *RateUpdater) FetchSupportedCoins(ctx context.Context) ([]CoinInfo, error) {
+	endpoint := fmt.Sprintf("%s/coins/list", updater.coingeckoURL)
+	// The list has more than 10k coins, about 1Mb.
+	body, err := updater.fetch(withFetchTimeout(ctx, 30*time.Second), endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var coins []CoinInfo
+	if err := json.Unmarshal(body, &coins); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return coins, nil
+}
+
+// FetchSupportedFiats returns the codes of all currencies supported by CoinGecko in lowercase,
+// e.g. "usd", using the "simple/supported_vs_currencies" API. They include cryptocurrencies
+// like "btc".
+func (updater *RateUpdater) FetchSupportedFiats(ctx context.Context) ([]string, error) {
+	endpoint := fmt.Sprintf("%s/simple/supported_vs_currencies", updater.coingeckoURL)
+	body, err := updater.fetch(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var fiats []string
+	if err := json.Unmarshal(body, &fiats); err != nil {
+		return nil, errp.WithStack(err)
+	}
+	return fiats, nil
+}
+
+// ValidateFiatConstants checks the Fiat constants against the currencies supported by CoinGecko,
+// see FetchSupportedFiats, to detect currencies deprecated by CoinGecko. A warning is logged
+// for each Fiat which is not supported, and for each supported currency which has no Fiat.
+// An error is returned if any Fiat is not supported or if the supported currencies can't be fetched.
+func (updater *RateUpdater) ValidateFiatConstants(ctx context.Context) error {
+	supportedList, err := updater.FetchSupportedFiats(ctx)
+	if err != nil {
+		return err
+	}
+	supported := make(map[string]bool, len(supportedList))
+	for _, geckoFiat := range supportedList {
+		supported[geckoFiat] = true
+	}
+	var unsupported []string
+	for _, fiat := range allFiats {
+		geckoFiat, ok := toGeckoFiat[string(fiat)]
+		if !ok || !supported[geckoFiat] {
+			updater.log.Warningf("fiat %s is not supported by CoinGecko", fiat)
+			unsupported = append(unsupported, string(fiat))
+		}
+	}
+	for _, geckoFiat := range supportedList {
+		if _, ok := fromGeckoFiat[geckoFiat]; !ok {
+			updater.log.Warningf("CoinGecko currency %s has no Fiat", geckoFiat)
+		}
+	}
+	if len(unsupported) > 0 {
+		return errp.Newf("fiats not supported by CoinGecko: %s", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// AutoConfigureFromWallet sets the coins for which the latest rates are fetched, starting with
+// the next update. The coinUnits are BitBoxApp coin units like "BTC". Testnet units registered
+// with RegisterTestnetMapping are resolved to their mainnet units.
+//
+// Units already known to this package are mapped to their CoinGecko IDs directly. All others are
+// looked up by symbol in the list returned by FetchSupportedCoins, which is only fetched if
+// needed. Units with no or ambiguous matches are skipped and reported in the returned error,
+// while the rest is still configured.
+func (updater *RateUpdater) AutoConfigureFromWallet(coinUnits []string) error {
+	unitToGecko := make(map[string]string, len(geckoCoinToUnit))
+	for geckoID, unit := range geckoCoinToUnit {
+		unitToGecko[unit] = geckoID
+	}
+
+	geckoUnits := make(map[string]string)
+	var unknownUnits []string
+	updater.testnetMu.RLock()
+	for _, unit := range coinUnits {
+		if mainnetUnit, ok := updater.testnetUnits[unit]; ok {
+			unit = mainnetUnit
+		}
+		if geckoID, ok := unitToGecko[unit]; ok {
+			geckoUnits[geckoID] = unit
+		} else {
+			unknownUnits = append(unknownUnits, unit)
+		}
+	}
+	updater.testnetMu.RUnlock()
+
+	var skipped []string
+	if len(unknownUnits) > 0 {
+		coins, err := updater.FetchSupportedCoins(context.Background())
+		if err != nil {
+			return err
+		}
+		bySymbol := make(map[string][]string)
+		for _, coin := range coins {
+			symbol := strings.ToLower(coin.Symbol)
+			bySymbol[symbol] = append(bySymbol[symbol], coin.ID)
+		}
+		for _, unit := range unknownUnits {
+			if ids := bySymbol[strings.ToLower(unit)]; len(ids) == 1 {
+				geckoUnits[ids[0]] = unit
+			} else {
+				skipped = append(skipped, unit)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(geckoUnits))
+	for geckoID := range geckoUnits {
+		ids = append(ids, geckoID)
+	}
+	sort.Strings(ids)
+	updater.simplePriceMu.Lock()
+	updater.simplePriceIDs = strings.Join(ids, ",")
+	updater.simplePriceUnits = geckoUnits
+	updater.simplePriceMu.Unlock()
+
+	if len(skipped) > 0 {
+		return errp.Newf("no unique CoinGecko coin for units %q", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCoinsList = `[
+	{"id": "bitcoin", "symbol": "btc", "name": "Bitcoin"},
+	{"id": "cardano", "symbol": "ada", "name": "Cardano"},
+	{"id": "ethereum", "symbol": "eth", "name": "Ethereum"},
+	{"id": "first-token", "symbol": "dup", "name": "First token"},
+	{"id": "second-token", "symbol": "dup", "name": "Second token"}
+]`
+
+func newGeckoCoinsServer(t *testing.T, coinsListCalls *int, gotIDs *string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/coins/list":
+			*coinsListCalls++
+			fmt.Fprintln(w, testCoinsList)
+		case "/simple/price":
+			*gotIDs = r.URL.Query().Get("ids")
+			fmt.Fprintln(w, `{"bitcoin": {"usd": 20000.0}, "cardano": {"usd": 0.3}}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetchSupportedCoins(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var coinsListCalls int
+	var gotIDs string
+	ts := newGeckoCoinsServer(t, &coinsListCalls, &gotIDs)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	coins, err := updater.FetchSupportedCoins(context.Background())
+	require.NoError(t, err)
+	require.Len(t, coins, 5)
+	assert.Equal(t, CoinInfo{ID: "cardano", Symbol: "ada", Name: "Cardano"}, coins[1])
+}
+
+func TestAutoConfigureFromWallet(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var coinsListCalls int
+	var gotIDs string
+	ts := newGeckoCoinsServer(t, &coinsListCalls, &gotIDs)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	// Known units don't need the coins list.
+	require.NoError(t, updater.AutoConfigureFromWallet([]string{"TBTC", "ETH", "USDT"}))
+	assert.Zero(t, coinsListCalls)
+	updater.updateLast(context.Background())
+	assert.Equal(t, "bitcoin,ethereum,tether", gotIDs)
+
+	err := updater.AutoConfigureFromWallet([]string{"BTC", "ADA", "DUP", "NOPE"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `["DUP" "NOPE"]`)
+	assert.Equal(t, 1, coinsListCalls)
+	updater.updateLast(context.Background())
+	assert.Equal(t, "bitcoin,cardano", gotIDs)
+	assert.Equal(t, 0.3, updater.LatestPrice()["ADA"]["USD"])
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+}
+
+// testSupportedFiats is a response of the CoinGecko "simple/supported_vs_currencies" API.
+const testSupportedFiats = `["btc","eth","ltc","bch","bnb","eos","xrp","xlm","link","dot","yfi","usd","aed","ars","aud","bdt","bhd","bmd","brl","cad","chf","clp","cny","czk","dkk","eur","gbp","gel","hkd","huf","idr","ils","inr","jpy","krw","kwd","lkr","mmk","mxn","myr","ngn","nok","nzd","php","pkr","pln","rub","sar","sek","sgd","thb","try","twd","uah","vef","vnd","zar","xdr","xag","xau","bits","sats"]`
+
+func newSupportedFiatsServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/simple/supported_vs_currencies", r.URL.Path)
+		fmt.Fprintln(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestFetchSupportedFiats(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := newSupportedFiatsServer(t, `["btc","usd","eur"]`)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	fiats, err := updater.FetchSupportedFiats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"btc", "usd", "eur"}, fiats)
+}
+
+func TestValidateFiatConstants(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	// All Fiat constants are supported. Others, like "inr", are only logged.
+	updater.coingeckoURL = newSupportedFiatsServer(t, testSupportedFiats).URL
+	require.NoError(t, updater.ValidateFiatConstants(context.Background()))
+
+	// Deprecated by CoinGecko.
+	updater.coingeckoURL = newSupportedFiatsServer(t, `["btc","usd","eur"]`).URL
+	err := updater.ValidateFiatConstants(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "RUB")
+	assert.NotContains(t, err.Error(), "USD")
+	// sat rates are computed from btc.
+	assert.NotContains(t, err.Error(), "sat")
+
+	updater.coingeckoURL = "unused"
+	require.Error(t, updater.ValidateFiatConstants(context.Background()))
+}
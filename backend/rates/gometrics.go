@@ -0,0 +1,118 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sync"
+	"time"
+)
+
+// Names of the metrics registered by RegisterGoMetrics.
+const (
+	goMetricFetchCount    = "rates.fetch.count"
+	goMetricFetchErrors   = "rates.fetch.errors"
+	goMetricFetchDuration = "rates.fetch.duration"
+	// goMetricHistoryEntriesPrefix is followed by the coin+fiat pair, e.g.
+	// "rates.history.entries.btcUSD".
+	goMetricHistoryEntriesPrefix = "rates.history.entries."
+)
+
+// MetricsCounter is a counter of a MetricsRegistry. The counters of rcrowley/go-metrics
+// implement it.
+type MetricsCounter interface {
+	Inc(int64)
+}
+
+// MetricsTimer is a timer of a MetricsRegistry. The timers of rcrowley/go-metrics implement it.
+type MetricsTimer interface {
+	Update(time.Duration)
+}
+
+// MetricsRegistry is the part of a metrics registry used by RegisterGoMetrics. The app adapts its
+// registry, e.g. of rcrowley/go-metrics, so that this package doesn't depend on one.
+type MetricsRegistry interface {
+	// GetOrRegisterCounter returns the counter registered with name, registering a new one if
+	// there is none.
+	GetOrRegisterCounter(name string) MetricsCounter
+	// GetOrRegisterTimer returns the timer registered with name, registering a new one if there
+	// is none.
+	GetOrRegisterTimer(name string) MetricsTimer
+	// GetOrRegisterFunctionalGauge registers a gauge with name whose value is returned by fn
+	// each time it is read, unless a gauge with name is registered already.
+	GetOrRegisterFunctionalGauge(name string, fn func() int64)
+}
+
+// goMetrics are the metrics of a RateUpdater in a MetricsRegistry. See RegisterGoMetrics.
+type goMetrics struct {
+	registry      MetricsRegistry
+	fetchCount    MetricsCounter
+	fetchErrors   MetricsCounter
+	fetchDuration MetricsTimer
+
+	// gaugesMu guards gauges, the coin+fiat pairs with a registered history gauge.
+	gaugesMu sync.Mutex
+	gauges   map[string]bool
+}
+
+// RegisterGoMetrics registers the metrics of the updater in registry, for the app's existing
+// instrumentation. The metrics are:
+//   - rates.fetch.count, a counter of the API requests, see FetchFunc;
+//   - rates.fetch.errors, a counter of the failed ones;
+//   - rates.fetch.duration, a timer of the requests, including the wait for the rate limit;
+//   - rates.history.entries.<pair>, a gauge of the number of historical rates in memory for
+//     each coin+fiat pair, e.g. rates.history.entries.btcUSD.
+//
+// The gauges are read from the history when the registry reads them. They are registered for
+// the pairs in memory now and after each request for pairs added since. Metrics already
+// registered with the same names are reused. RegisterGoMetrics should be called once, before
+// the updater is started.
+func (updater *RateUpdater) RegisterGoMetrics(registry MetricsRegistry) {
+	m := &goMetrics{
+		registry:      registry,
+		fetchCount:    registry.GetOrRegisterCounter(goMetricFetchCount),
+		fetchErrors:   registry.GetOrRegisterCounter(goMetricFetchErrors),
+		fetchDuration: registry.GetOrRegisterTimer(goMetricFetchDuration),
+		gauges:        make(map[string]bool),
+	}
+	m.registerHistoryGauges(updater.history)
+	updater.goMetrics.Store(m)
+}
+
+// recordFetch records an API request which took duration and failed if err is not nil.
+func (m *goMetrics) recordFetch(history *historyMap, duration time.Duration, err error) {
+	m.fetchCount.Inc(1)
+	if err != nil {
+		m.fetchErrors.Inc(1)
+	}
+	m.fetchDuration.Update(duration)
+	m.registerHistoryGauges(history)
+}
+
+// registerHistoryGauges registers a gauge for each coin+fiat pair in history without one.
+func (m *goMetrics) registerHistoryGauges(history *historyMap) {
+	m.gaugesMu.Lock()
+	defer m.gaugesMu.Unlock()
+	for key := range history.all() {
+		if m.gauges[key] {
+			continue
+		}
+		m.gauges[key] = true
+		m.registry.GetOrRegisterFunctionalGauge(goMetricHistoryEntriesPrefix+key, func() int64 {
+			var n int
+			history.view(key, func(rates []exchangeRate) { n = len(rates) })
+			return int64(n)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockCounter struct{ count int64 }
+
+func (c *mockCounter) Inc(n int64) { c.count += n }
+
+type mockTimer struct{ durations []time.Duration }
+
+func (t *mockTimer) Update(d time.Duration) { t.durations = append(t.durations, d) }
+
+// mockRegistry is a MetricsRegistry keeping the metrics in maps.
+type mockRegistry struct {
+	mu       sync.Mutex
+	counters map[string]*mockCounter
+	timers   map[string]*mockTimer
+	gauges   map[string]func() int64
+}
+
+func newMockRegistry() *mockRegistry {
+	return &mockRegistry{
+		counters: map[string]*mockCounter{},
+		timers:   map[string]*mockTimer{},
+		gauges:   map[string]func() int64{},
+	}
+}
+
+func (r *mockRegistry) GetOrRegisterCounter(name string) MetricsCounter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counters[name] == nil {
+		r.counters[name] = &mockCounter{}
+	}
+	return r.counters[name]
+}
+
+func (r *mockRegistry) GetOrRegisterTimer(name string) MetricsTimer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timers[name] == nil {
+		r.timers[name] = &mockTimer{}
+	}
+	return r.timers[name]
+}
+
+func (r *mockRegistry) GetOrRegisterFunctionalGauge(name string, fn func() int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gauges[name] == nil {
+		r.gauges[name] = fn
+	}
+}
+
+func TestRegisterGoMetrics(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.storeHistory("ltc", "EUR", []exchangeRate{{value: 1, timestamp: time.Unix(1598832000, 0)}})
+
+	registry := newMockRegistry()
+	updater.RegisterGoMetrics(registry)
+	gauge := func(pair string) int64 {
+		registry.mu.Lock()
+		fn := registry.gauges[goMetricHistoryEntriesPrefix+pair]
+		registry.mu.Unlock()
+		require.NotNil(t, fn, "gauge of %s", pair)
+		return fn()
+	}
+	// Pairs already in memory are registered right away.
+	assert.Equal(t, int64(1), gauge("ltcEUR"))
+
+	updater.storeHistory("btc", "USD", []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832000, 0)},
+		{value: 2, timestamp: time.Unix(1598835600, 0)},
+	})
+	updater.updateLast(context.Background())
+	updater.coingeckoURL = "https://coingecko.test/unknown"
+	updater.updateLast(context.Background())
+
+	assert.Equal(t, int64(2), registry.counters[goMetricFetchCount].count)
+	assert.Equal(t, int64(1), registry.counters[goMetricFetchErrors].count)
+	assert.Len(t, registry.timers[goMetricFetchDuration].durations, 2)
+	// Pairs added later are registered after the next request.
+	assert.Equal(t, int64(2), gauge("btcUSD"))
+
+	// The gauges are read from the history.
+	updater.storeHistory("btc", "USD", []exchangeRate{{value: 3, timestamp: time.Unix(1598839200, 0)}})
+	assert.Equal(t, int64(3), gauge("btcUSD"))
+	updater.history.delete("btcUSD")
+	assert.Zero(t, gauge("btcUSD"))
+}
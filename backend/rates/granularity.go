@@ -0,0 +1,213 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// Granularity is the interval of the historical rates kept for a coin+fiat pair.
+// See SetHistoryGranularity.
+type Granularity int
+
+const (
+	// GranularityHourly keeps the historical rates as fetched. CoinGecko returns hourly rates
+	// for ranges within the last 90 days and daily rates for older ranges, so this is hourly
+	// for the last 90 days and daily before. This is the default.
+	GranularityHourly Granularity = iota
+	// GranularityDaily keeps one rate per UTC day, the last one of the day as used by
+	// DailyPriceAt. Rates that are already daily, e.g. the ones of CoinGecko older than
+	// 90 days, are kept as they are.
+	GranularityDaily
+)
+
+// String returns "hourly" or "daily".
+func (g Granularity) String() string {
+	switch g {
+	case GranularityHourly:
+		return "hourly"
+	case GranularityDaily:
+		return "daily"
+	default:
+		return "unknown"
+	}
+}
+
+// granularityDetectIntervals is the number of most recent intervals between historical
+// rates used by detectGranularity.
+const granularityDetectIntervals = 48
+
+// detectGranularity reports the granularity of the most recent rates, which must be sorted
+// by timestamp in ascending order: GranularityDaily if the median interval between them is
+// at least 12 hours, GranularityHourly otherwise. Only the most recent rates are considered
+// since the older ones are daily with both granularities. The result differs from the selected
+// granularity e.g. after switching from GranularityDaily to GranularityHourly.
+func detectGranularity(rates []exchangeRate) Granularity {
+	if len(rates) > granularityDetectIntervals+1 {
+		rates = rates[len(rates)-granularityDetectIntervals-1:]
+	}
+	if len(rates) < 2 {
+		return GranularityHourly
+	}
+	intervals := make([]time.Duration, len(rates)-1)
+	for i := range intervals {
+		intervals[i] = rates[i+1].timestamp.Sub(rates[i].timestamp)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	if intervals[len(intervals)/2] >= 12*time.Hour {
+		return GranularityDaily
+	}
+	return GranularityHourly
+}
+
+// downsampleDaily returns the last rate of each UTC day of rates, which must be sorted by
+// timestamp in ascending order. Rates which are daily already are unaffected.
+// The argument is not modified.
+func downsampleDaily(rates []exchangeRate) []exchangeRate {
+	var result []exchangeRate
+	for i, rate := range rates {
+		if i+1 < len(rates) && unixDay(rates[i+1].timestamp) == unixDay(rate.timestamp) {
+			continue
+		}
+		result = append(result, rate)
+	}
+	return result
+}
+
+// averageHistory returns rates, which must be sorted by timestamp in ascending order, with the
+// ones before cutoff replaced by their averages per interval. Intervals start at multiples of
+// interval since the unix epoch, and the averages are at their start.
+// The argument is not modified.
+func averageHistory(rates []exchangeRate, cutoff time.Time, interval time.Duration) []exchangeRate {
+	result := make([]exchangeRate, 0, len(rates))
+	i := 0
+	for i < len(rates) && rates[i].timestamp.Before(cutoff) {
+		start := rates[i].timestamp.Add(-time.Duration(rates[i].timestamp.UnixNano() % int64(interval)))
+		end := start.Add(interval)
+		average := exchangeRate{timestamp: start, bundled: rates[i].bundled}
+		var sum float64
+		var n int
+		for ; i < len(rates) && rates[i].timestamp.Before(cutoff) && rates[i].timestamp.Before(end); i++ {
+			sum += rates[i].value
+			n++
+		}
+		average.value = sum / float64(n)
+		result = append(result, average)
+	}
+	return append(result, rates[i:]...)
+}
+
+// CompactHistory replaces the historical rates of the coin+fiat pair older than olderThan with
+// their averages per targetGranularity, e.g. to keep one rate per day for rates older than
+// 90 days, both in memory and in the database cache. The intervals start at multiples of
+// targetGranularity since the unix epoch, i.e. at midnight UTC for 24 hours, and the averages
+// are at their start. It returns the number of rates removed.
+//
+// Unlike SetHistoryGranularity, the compaction is applied once and not to rates stored later.
+func (updater *RateUpdater) CompactHistory(coin, fiat string, olderThan, targetGranularity time.Duration) (int, error) {
+	if targetGranularity <= 0 {
+		return 0, errp.Newf("invalid target granularity %v", targetGranularity)
+	}
+	key := coin + fiat
+	cutoff := updater.clock().Add(-olderThan)
+	removed := -1
+	if updater.history.exists(key) {
+		updater.history.update(key, func(rates []exchangeRate) []exchangeRate {
+			compacted := averageHistory(rates, cutoff, targetGranularity)
+			updater.recordPruned(key, rates, compacted)
+			removed = len(rates) - len(compacted)
+			return compacted
+		})
+		updater.invalidateDailyKey(key)
+	}
+	err := updater.updateHistoryBucket(key, func(rates []exchangeRate) ([]exchangeRate, bool) {
+		if rates == nil {
+			return nil, false
+		}
+		compacted := averageHistory(rates, cutoff, targetGranularity)
+		if removed < 0 {
+			removed = len(rates) - len(compacted)
+		}
+		return compacted, true
+	})
+	if removed < 0 {
+		removed = 0
+	}
+	if err == nil {
+		updater.telemetry(TelemetryHistoryCompacted, map[string]interface{}{
+			"operation": "compact", "pair": key, "removed": removed,
+		})
+	}
+	return removed, errp.WithStack(err)
+}
+
+// SetHistoryGranularity sets the granularity of the historical rates of the coin+fiat pair,
+// which is stored along with them in the database cache. Switching to GranularityDaily
+// downsamples the rates already stored right away. Switching back to GranularityHourly only
+// affects the rates fetched afterwards.
+func (updater *RateUpdater) SetHistoryGranularity(coin, fiat string, granularity Granularity) {
+	key := coin + fiat
+	updater.granularityMu.Lock()
+	updater.granularity[key] = granularity
+	updater.granularityMu.Unlock()
+	// Store nothing new to apply the granularity to the rates already stored.
+	if err := updater.dumpHistoryBucket(key, nil); err != nil {
+		updater.log.Errorf("dumpHistoryBucket(%q): %v", key, err)
+	}
+	if updater.history.exists(key) {
+		updater.history.update(key, func(rates []exchangeRate) []exchangeRate {
+			compacted := updater.compactHistory(key, rates)
+			updater.recordPruned(key, rates, compacted)
+			return compacted
+		})
+		updater.invalidateDailyKey(key)
+	}
+}
+
+// HistoryGranularity returns the granularity of the historical rates of the coin+fiat pair.
+// If none was set with SetHistoryGranularity, it is the one stored in the database cache,
+// if any, or else GranularityHourly.
+func (updater *RateUpdater) HistoryGranularity(coin, fiat string) Granularity {
+	return updater.historyGranularity(coin + fiat)
+}
+
+// historyGranularity is like HistoryGranularity, with the coin+fiat pair given as a key.
+func (updater *RateUpdater) historyGranularity(key string) Granularity {
+	updater.granularityMu.RLock()
+	defer updater.granularityMu.RUnlock()
+	return updater.granularity[key]
+}
+
+// adoptHistoryGranularity sets the granularity of the coin+fiat pair given as a key,
+// unless set already. It is used for the granularity found in the database cache.
+func (updater *RateUpdater) adoptHistoryGranularity(key string, granularity Granularity) {
+	updater.granularityMu.Lock()
+	defer updater.granularityMu.Unlock()
+	if _, ok := updater.granularity[key]; !ok {
+		updater.granularity[key] = granularity
+	}
+}
+
+// compactHistory applies the granularity of the coin+fiat pair given as a key and
+// WithMaxHistoryEntriesPerPair to the rates, which must be sorted by timestamp in ascending order.
+func (updater *RateUpdater) compactHistory(key string, rates []exchangeRate) []exchangeRate {
+	if updater.historyGranularity(key) == GranularityDaily {
+		rates = downsampleDaily(rates)
+	}
+	return updater.trimHistory(rates)
+}
@@ -0,0 +1,155 @@
+package rates
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ratesEvery returns n rates starting at start, interval apart, with values 1, 2, ...
+func ratesEvery(start time.Time, interval time.Duration, n int) []exchangeRate {
+	rates := make([]exchangeRate, n)
+	for i := range rates {
+		rates[i] = exchangeRate{value: float64(i + 1), timestamp: start.Add(time.Duration(i) * interval)}
+	}
+	return rates
+}
+
+func TestDetectGranularity(t *testing.T) {
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	hourly := ratesEvery(start, time.Hour, 24)
+	daily := ratesEvery(start, 24*time.Hour, 10)
+	// Hourly rates of the last 90 days after daily older ones, as returned by CoinGecko.
+	mixed := append(ratesEvery(start.Add(-100*24*time.Hour), 24*time.Hour, 100), ratesEvery(start, time.Hour, 90*24)...)
+	// Daily rates with a few gaps and two rates close to each other at midnight.
+	irregular := append(ratesEvery(start, 24*time.Hour, 5), ratesEvery(start.Add(7*24*time.Hour-time.Hour), time.Hour, 2)...)
+
+	tt := []struct {
+		name  string
+		rates []exchangeRate
+		want  Granularity
+	}{
+		{"empty", nil, GranularityHourly},
+		{"single", hourly[:1], GranularityHourly},
+		{"hourly", hourly, GranularityHourly},
+		{"5min", ratesEvery(start, 5*time.Minute, 10), GranularityHourly},
+		{"daily", daily, GranularityDaily},
+		{"mixed", mixed, GranularityHourly},
+		{"mixed daily last", append(hourly, ratesEvery(start.Add(24*time.Hour), 24*time.Hour, 60)...), GranularityDaily},
+		{"irregular daily", irregular, GranularityDaily},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, detectGranularity(test.rates))
+		})
+	}
+}
+
+func TestDownsampleDaily(t *testing.T) {
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	daily := ratesEvery(start.Add(-3*24*time.Hour), 24*time.Hour, 3)
+	rates := append(append([]exchangeRate{}, daily...), ratesEvery(start, time.Hour, 48)...)
+
+	// The daily rates are kept, the hourly ones reduced to the last one of each day.
+	assert.Equal(t, append(daily,
+		exchangeRate{value: 24, timestamp: start.Add(23 * time.Hour)},
+		exchangeRate{value: 48, timestamp: start.Add(47 * time.Hour)},
+	), downsampleDaily(rates))
+	// Already daily rates are not downsampled again.
+	assert.Equal(t, daily, downsampleDaily(daily))
+	assert.Empty(t, downsampleDaily(nil))
+}
+
+func TestSetHistoryGranularity(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestSetHistoryGranularity")
+	defer os.RemoveAll(dbdir)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	assert.Equal(t, GranularityHourly, updater.HistoryGranularity("btc", "USD"))
+	updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 48))
+
+	updater.SetHistoryGranularity("btc", "USD", GranularityDaily)
+	assert.Equal(t, GranularityDaily, updater.HistoryGranularity("btc", "USD"))
+	assert.Equal(t, GranularityHourly, updater.HistoryGranularity("btc", "EUR"))
+	assert.Equal(t, 2, len(updater.history.all()["btcUSD"]))
+	assert.Equal(t, 24.0, updater.DailyPriceAt("btc", "USD", start))
+	stored, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, stored, 2)
+
+	// New rates are downsampled as well.
+	updater.storeHistory("btc", "USD", ratesEvery(start.Add(48*time.Hour), time.Hour, 24))
+	assert.Equal(t, 3, len(updater.history.all()["btcUSD"]))
+	updater.Stop()
+
+	// The granularity is stored in the database.
+	updater2 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater2.Stop()
+	stored, err = updater2.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+	assert.Equal(t, GranularityDaily, updater2.HistoryGranularity("btc", "USD"))
+
+	// Switching back only affects new rates.
+	updater2.SetHistoryGranularity("btc", "USD", GranularityHourly)
+	require.NoError(t, updater2.dumpHistoryBucket("btcUSD", ratesEvery(start.Add(72*time.Hour), time.Hour, 3)))
+	stored, err = updater2.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, stored, 6)
+	assert.Equal(t, GranularityHourly, detectGranularity(stored))
+}
+
+func TestGranularityString(t *testing.T) {
+	assert.Equal(t, "hourly", GranularityHourly.String())
+	assert.Equal(t, "daily", GranularityDaily.String())
+	assert.Equal(t, "unknown", Granularity(42).String())
+}
+
+func TestCompactHistory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestCompactHistory")
+	defer os.RemoveAll(dbdir)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	// 5-minute rates of 3 days, with values 1, 2, ...
+	rates := ratesEvery(start, 5*time.Minute, 3*288)
+	now := start.Add(3 * 24 * time.Hour)
+	updater := NewRateUpdater(nil, dbdir,
+		WithClockFunc(func() time.Time { return now }), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.storeHistory("btc", "USD", rates)
+
+	// The first 2 days plus the first hour of the third day are older than the cutoff.
+	removed, err := updater.CompactHistory("btc", "USD", 23*time.Hour, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2*288+12-3, removed)
+
+	onDisk, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	for _, compacted := range [][]exchangeRate{updater.history.all()["btcUSD"], onDisk} {
+		require.Len(t, compacted, 3+276)
+		// The averages of 1..288 and 289..576 at the start of their days.
+		assert.Equal(t, start.Unix(), compacted[0].timestamp.Unix())
+		assert.Equal(t, 144.5, compacted[0].value)
+		assert.Equal(t, start.Add(24*time.Hour).Unix(), compacted[1].timestamp.Unix())
+		assert.Equal(t, 432.5, compacted[1].value)
+		// The day of the cutoff only averages the rates before it: 577..588.
+		assert.Equal(t, start.Add(48*time.Hour).Unix(), compacted[2].timestamp.Unix())
+		assert.Equal(t, 582.5, compacted[2].value)
+		assert.Equal(t, rates[2*288+12:], compacted[3:])
+	}
+	assert.Equal(t, 432.5, updater.HistoricalPriceAt("btc", "USD", start.Add(24*time.Hour)))
+
+	// Compacting again changes nothing.
+	removed, err = updater.CompactHistory("btc", "USD", 23*time.Hour, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Zero(t, removed)
+
+	_, err = updater.CompactHistory("btc", "USD", 23*time.Hour, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,324 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// RateService streams the latest exchange rates of a rates.RateUpdater. It is implemented by
+// Server in this package; see generate.go for how to regenerate the Go stubs.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.34.2
+// 	protoc        (unknown)
+// source: rates.proto
+
+package grpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type StreamRatesRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+}
+
+func (x *StreamRatesRequest) Reset() {
+	*x = StreamRatesRequest{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rates_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *StreamRatesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StreamRatesRequest) ProtoMessage() {}
+
+func (x *StreamRatesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_rates_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StreamRatesRequest.ProtoReflect.Descriptor instead.
+func (*StreamRatesRequest) Descriptor() ([]byte, []int) {
+	return file_rates_proto_rawDescGZIP(), []int{0}
+}
+
+// FiatRates are the rates of a coin, keyed by fiat unit, e.g. "USD".
+// Nested maps are not supported by proto3, hence the wrapper message.
+type FiatRates struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Rates map[string]float64 `protobuf:"bytes,1,rep,name=rates,proto3" json:"rates,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"fixed64,2,opt,name=value,proto3"`
+}
+
+func (x *FiatRates) Reset() {
+	*x = FiatRates{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rates_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *FiatRates) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FiatRates) ProtoMessage() {}
+
+func (x *FiatRates) ProtoReflect() protoreflect.Message {
+	mi := &file_rates_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FiatRates.ProtoReflect.Descriptor instead.
+func (*FiatRates) Descriptor() ([]byte, []int) {
+	return file_rates_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *FiatRates) GetRates() map[string]float64 {
+	if x != nil {
+		return x.Rates
+	}
+	return nil
+}
+
+type RatesUpdate struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// rates are keyed by coin unit, e.g. "BTC", like rates.RateUpdater.LatestPrice.
+	Rates map[string]*FiatRates `protobuf:"bytes,1,rep,name=rates,proto3" json:"rates,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// timestamp is when the server received the rates from the updater. The first update of a
+	// stream, which carries the latest rates at the time of the call, is timestamped when sent.
+	Timestamp *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+}
+
+func (x *RatesUpdate) Reset() {
+	*x = RatesUpdate{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_rates_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *RatesUpdate) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RatesUpdate) ProtoMessage() {}
+
+func (x *RatesUpdate) ProtoReflect() protoreflect.Message {
+	mi := &file_rates_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RatesUpdate.ProtoReflect.Descriptor instead.
+func (*RatesUpdate) Descriptor() ([]byte, []int) {
+	return file_rates_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RatesUpdate) GetRates() map[string]*FiatRates {
+	if x != nil {
+		return x.Rates
+	}
+	return nil
+}
+
+func (x *RatesUpdate) GetTimestamp() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Timestamp
+	}
+	return nil
+}
+
+var File_rates_proto protoreflect.FileDescriptor
+
+var file_rates_proto_rawDesc = []byte{
+	0x0a, 0x0b, 0x72, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x0c, 0x62,
+	0x69, 0x74, 0x62, 0x6f, 0x78, 0x2e, 0x72, 0x61, 0x74, 0x65, 0x73, 0x1a, 0x1f, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69, 0x6d,
+	0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x14, 0x0a, 0x12,
+	0x53, 0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x22, 0x7f, 0x0a, 0x09, 0x46, 0x69, 0x61, 0x74, 0x52, 0x61, 0x74, 0x65, 0x73, 0x12,
+	0x38, 0x0a, 0x05, 0x72, 0x61, 0x74, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x22,
+	0x2e, 0x62, 0x69, 0x74, 0x62, 0x6f, 0x78, 0x2e, 0x72, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x46, 0x69,
+	0x61, 0x74, 0x52, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x52, 0x61, 0x74, 0x65, 0x73, 0x45, 0x6e, 0x74,
+	0x72, 0x79, 0x52, 0x05, 0x72, 0x61, 0x74, 0x65, 0x73, 0x1a, 0x38, 0x0a, 0x0a, 0x52, 0x61, 0x74,
+	0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a,
+	0x02, 0x38, 0x01, 0x22, 0xd6, 0x01, 0x0a, 0x0b, 0x52, 0x61, 0x74, 0x65, 0x73, 0x55, 0x70, 0x64,
+	0x61, 0x74, 0x65, 0x12, 0x3a, 0x0a, 0x05, 0x72, 0x61, 0x74, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x24, 0x2e, 0x62, 0x69, 0x74, 0x62, 0x6f, 0x78, 0x2e, 0x72, 0x61, 0x74, 0x65,
+	0x73, 0x2e, 0x52, 0x61, 0x74, 0x65, 0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x2e, 0x52, 0x61,
+	0x74, 0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x05, 0x72, 0x61, 0x74, 0x65, 0x73, 0x12,
+	0x38, 0x0a, 0x09, 0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09,
+	0x74, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x1a, 0x51, 0x0a, 0x0a, 0x52, 0x61, 0x74,
+	0x65, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x2d, 0x0a, 0x05, 0x76, 0x61, 0x6c,
+	0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x62, 0x69, 0x74, 0x62, 0x6f,
+	0x78, 0x2e, 0x72, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x46, 0x69, 0x61, 0x74, 0x52, 0x61, 0x74, 0x65,
+	0x73, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x32, 0x5b, 0x0a, 0x0b,
+	0x52, 0x61, 0x74, 0x65, 0x53, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x4c, 0x0a, 0x0b, 0x53,
+	0x74, 0x72, 0x65, 0x61, 0x6d, 0x52, 0x61, 0x74, 0x65, 0x73, 0x12, 0x20, 0x2e, 0x62, 0x69, 0x74,
+	0x62, 0x6f, 0x78, 0x2e, 0x72, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x53, 0x74, 0x72, 0x65, 0x61, 0x6d,
+	0x52, 0x61, 0x74, 0x65, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x19, 0x2e, 0x62,
+	0x69, 0x74, 0x62, 0x6f, 0x78, 0x2e, 0x72, 0x61, 0x74, 0x65, 0x73, 0x2e, 0x52, 0x61, 0x74, 0x65,
+	0x73, 0x55, 0x70, 0x64, 0x61, 0x74, 0x65, 0x30, 0x01, 0x42, 0x3d, 0x5a, 0x3b, 0x67, 0x69, 0x74,
+	0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x42, 0x69, 0x74, 0x42, 0x6f, 0x78, 0x53, 0x77,
+	0x69, 0x73, 0x73, 0x2f, 0x62, 0x69, 0x74, 0x62, 0x6f, 0x78, 0x2d, 0x77, 0x61, 0x6c, 0x6c, 0x65,
+	0x74, 0x2d, 0x61, 0x70, 0x70, 0x2f, 0x62, 0x61, 0x63, 0x6b, 0x65, 0x6e, 0x64, 0x2f, 0x72, 0x61,
+	0x74, 0x65, 0x73, 0x2f, 0x67, 0x72, 0x70, 0x63, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_rates_proto_rawDescOnce sync.Once
+	file_rates_proto_rawDescData = file_rates_proto_rawDesc
+)
+
+func file_rates_proto_rawDescGZIP() []byte {
+	file_rates_proto_rawDescOnce.Do(func() {
+		file_rates_proto_rawDescData = protoimpl.X.CompressGZIP(file_rates_proto_rawDescData)
+	})
+	return file_rates_proto_rawDescData
+}
+
+var file_rates_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_rates_proto_goTypes = []any{
+	(*StreamRatesRequest)(nil),    // 0: bitbox.rates.StreamRatesRequest
+	(*FiatRates)(nil),             // 1: bitbox.rates.FiatRates
+	(*RatesUpdate)(nil),           // 2: bitbox.rates.RatesUpdate
+	nil,                           // 3: bitbox.rates.FiatRates.RatesEntry
+	nil,                           // 4: bitbox.rates.RatesUpdate.RatesEntry
+	(*timestamppb.Timestamp)(nil), // 5: google.protobuf.Timestamp
+}
+var file_rates_proto_depIdxs = []int32{
+	3, // 0: bitbox.rates.FiatRates.rates:type_name -> bitbox.rates.FiatRates.RatesEntry
+	4, // 1: bitbox.rates.RatesUpdate.rates:type_name -> bitbox.rates.RatesUpdate.RatesEntry
+	5, // 2: bitbox.rates.RatesUpdate.timestamp:type_name -> google.protobuf.Timestamp
+	1, // 3: bitbox.rates.RatesUpdate.RatesEntry.value:type_name -> bitbox.rates.FiatRates
+	0, // 4: bitbox.rates.RateService.StreamRates:input_type -> bitbox.rates.StreamRatesRequest
+	2, // 5: bitbox.rates.RateService.StreamRates:output_type -> bitbox.rates.RatesUpdate
+	5, // [5:6] is the sub-list for method output_type
+	4, // [4:5] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
+}
+
+func init() { file_rates_proto_init() }
+func file_rates_proto_init() {
+	if File_rates_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_rates_proto_msgTypes[0].Exporter = func(v any, i int) any {
+			switch v := v.(*StreamRatesRequest); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rates_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*FiatRates); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_rates_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*RatesUpdate); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_rates_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   5,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rates_proto_goTypes,
+		DependencyIndexes: file_rates_proto_depIdxs,
+		MessageInfos:      file_rates_proto_msgTypes,
+	}.Build()
+	File_rates_proto = out.File
+	file_rates_proto_rawDesc = nil
+	file_rates_proto_goTypes = nil
+	file_rates_proto_depIdxs = nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// RateService streams the latest exchange rates of a rates.RateUpdater. It is implemented by
+// Server in this package; see generate.go for how to regenerate the Go stubs.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: rates.proto
+
+package grpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RateService_StreamRates_FullMethodName = "/bitbox.rates.RateService/StreamRates"
+)
+
+// RateServiceClient is the client API for RateService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RateServiceClient interface {
+	// StreamRates sends the current latest rates, if any, and then every update of them
+	// until the client cancels the call.
+	StreamRates(ctx context.Context, in *StreamRatesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RatesUpdate], error)
+}
+
+type rateServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRateServiceClient(cc grpc.ClientConnInterface) RateServiceClient {
+	return &rateServiceClient{cc}
+}
+
+func (c *rateServiceClient) StreamRates(ctx context.Context, in *StreamRatesRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RatesUpdate], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RateService_ServiceDesc.Streams[0], RateService_StreamRates_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamRatesRequest, RatesUpdate]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RateService_StreamRatesClient = grpc.ServerStreamingClient[RatesUpdate]
+
+// RateServiceServer is the server API for RateService service.
+// All implementations must embed UnimplementedRateServiceServer
+// for forward compatibility.
+type RateServiceServer interface {
+	// StreamRates sends the current latest rates, if any, and then every update of them
+	// until the client cancels the call.
+	StreamRates(*StreamRatesRequest, grpc.ServerStreamingServer[RatesUpdate]) error
+	mustEmbedUnimplementedRateServiceServer()
+}
+
+// UnimplementedRateServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRateServiceServer struct{}
+
+func (UnimplementedRateServiceServer) StreamRates(*StreamRatesRequest, grpc.ServerStreamingServer[RatesUpdate]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamRates not implemented")
+}
+func (UnimplementedRateServiceServer) mustEmbedUnimplementedRateServiceServer() {}
+func (UnimplementedRateServiceServer) testEmbeddedByValue()                     {}
+
+// UnsafeRateServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RateServiceServer will
+// result in compilation errors.
+type UnsafeRateServiceServer interface {
+	mustEmbedUnimplementedRateServiceServer()
+}
+
+func RegisterRateServiceServer(s grpc.ServiceRegistrar, srv RateServiceServer) {
+	// If the following call pancis, it indicates UnimplementedRateServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RateService_ServiceDesc, srv)
+}
+
+func _RateService_StreamRates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRatesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RateServiceServer).StreamRates(m, &grpc.GenericServerStream[StreamRatesRequest, RatesUpdate]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RateService_StreamRatesServer = grpc.ServerStreamingServer[RatesUpdate]
+
+// RateService_ServiceDesc is the grpc.ServiceDesc for RateService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RateService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "bitbox.rates.RateService",
+	HandlerType: (*RateServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamRates",
+			Handler:       _RateService_StreamRates_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rates.proto",
+}
@@ -0,0 +1,98 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpc
+
+import (
+	"sync"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server implements RateServiceServer, streaming the latest rates of a rates.RateUpdater.
+type Server struct {
+	UnimplementedRateServiceServer
+
+	updater *rates.RateUpdater
+}
+
+// NewServer returns a server streaming the latest rates of updater. Register it with
+// RegisterRateServiceServer.
+func NewServer(updater *rates.RateUpdater) *Server {
+	return &Server{updater: updater}
+}
+
+// StreamRates implements RateServiceServer. Every update replaces all previous rates, so if a
+// client is too slow to receive them, intermediate updates are skipped and only the most
+// recent one is sent. The updater is never blocked by a stream.
+func (server *Server) StreamRates(_ *StreamRatesRequest, stream RateService_StreamRatesServer) error {
+	var (
+		pendingMu sync.Mutex
+		pending   *RatesUpdate
+	)
+	signal := make(chan struct{}, 1)
+	unobserve := server.updater.Observe(func(event observable.Event) {
+		if event.Subject != rates.RatesEventSubject {
+			return
+		}
+		latest, ok := event.Object.(map[string]map[string]float64)
+		if !ok {
+			return
+		}
+		update := newRatesUpdate(latest, time.Now())
+		pendingMu.Lock()
+		pending = update
+		pendingMu.Unlock()
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	})
+	defer unobserve()
+
+	if latest := server.updater.LatestPrice(); latest != nil {
+		if err := stream.Send(newRatesUpdate(latest, time.Now())); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-signal:
+			pendingMu.Lock()
+			update := pending
+			pendingMu.Unlock()
+			if err := stream.Send(update); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// newRatesUpdate converts rates keyed by coin and fiat unit, as returned by
+// rates.RateUpdater.LatestPrice, to their protobuf message.
+func newRatesUpdate(latest map[string]map[string]float64, timestamp time.Time) *RatesUpdate {
+	update := &RatesUpdate{
+		Rates:     make(map[string]*FiatRates, len(latest)),
+		Timestamp: timestamppb.New(timestamp),
+	}
+	for coin, fiatRates := range latest {
+		update.Rates[coin] = &FiatRates{Rates: fiatRates}
+	}
+	return update
+}
@@ -0,0 +1,97 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves updater on an in-memory connection and returns a client for it.
+func newTestClient(t *testing.T, updater *rates.RateUpdater) RateServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	RegisterRateServiceServer(server, NewServer(updater))
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return NewRateServiceClient(conn)
+}
+
+func TestStreamRates(t *testing.T) {
+	updater := rates.MockRateUpdater()
+	defer updater.Stop()
+	client := newTestClient(t, updater)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamRates(ctx, &StreamRatesRequest{})
+	require.NoError(t, err)
+
+	// The current latest rates are sent first.
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, 21.0, update.GetRates()["BTC"].GetRates()["USD"])
+	assert.Equal(t, 1.0, update.GetRates()["ETH"].GetRates()["USD"])
+	assert.WithinDuration(t, time.Now(), update.GetTimestamp().AsTime(), time.Minute)
+
+	// The stream is subscribed before the first update is sent.
+	updater.Notify(observable.Event{Subject: "ignored", Object: 1})
+	updater.Notify(observable.Event{
+		Subject: rates.RatesEventSubject,
+		Action:  action.Replace,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 22, "EUR": 20}},
+	})
+	update, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, update.GetRates(), 1)
+	assert.Equal(t, map[string]float64{"USD": 22, "EUR": 20}, update.GetRates()["BTC"].GetRates())
+}
+
+func TestStreamRatesSlowClient(t *testing.T) {
+	updater := rates.MockRateUpdater()
+	defer updater.Stop()
+	client := newTestClient(t, updater)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := client.StreamRates(ctx, &StreamRatesRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// Notifying never blocks, even though the client doesn't receive in the meantime.
+	for i := 1; i <= 1000; i++ {
+		updater.Notify(observable.Event{
+			Subject: rates.RatesEventSubject,
+			Action:  action.Replace,
+			Object:  map[string]map[string]float64{"BTC": {"USD": float64(i)}},
+		})
+	}
+	// Intermediate updates may be skipped, but the last one is always received.
+	for {
+		update, err := stream.Recv()
+		require.NoError(t, err)
+		if update.GetRates()["BTC"].GetRates()["USD"] == 1000 {
+			break
+		}
+	}
+}
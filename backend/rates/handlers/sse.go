@@ -0,0 +1,81 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package handlers provides HTTP handlers for the rates package.
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/logging"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+)
+
+// sseBufferSize is the number of events buffered per client. If a client is slower
+// than that, newer events are dropped for it.
+const sseBufferSize = 16
+
+// NewSSEHandler returns a handler streaming the latest rates events of the updater to clients
+// using server-sent events. Each event is sent as a "data:" line with the JSON encoded
+// observable.Event, the same as sent over the app's websocket.
+// The subscription is removed as soon as the client disconnects.
+func NewSSEHandler(updater *rates.RateUpdater) http.Handler {
+	log := logging.Get().WithGroup("rates/handlers")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		events := make(chan observable.Event, sseBufferSize)
+		unobserve := updater.Observe(func(event observable.Event) {
+			if event.Subject != rates.RatesEventSubject {
+				return
+			}
+			select {
+			case events <- event:
+			default:
+				log.Warning("SSE client too slow; dropping rates event")
+			}
+		})
+		defer unobserve()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event := <-events:
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.WithError(err).Error("could not encode rates event")
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+					return // client disconnected
+				}
+				flusher.Flush()
+			}
+		}
+	})
+}
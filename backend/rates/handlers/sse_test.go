@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSEHandler(t *testing.T) {
+	updater := rates.MockRateUpdater()
+	defer updater.Stop()
+	ts := httptest.NewServer(NewSSEHandler(updater))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer res.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// The handler is subscribed once the headers are received.
+	for i := 1; i <= 3; i++ {
+		updater.Notify(observable.Event{Subject: "ignored", Object: i})
+		updater.Notify(observable.Event{
+			Subject: rates.RatesEventSubject,
+			Action:  action.Replace,
+			Object:  map[string]map[string]float64{"BTC": {"USD": float64(i)}},
+		})
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	for i := 1; i <= 3; i++ {
+		var line string
+		select {
+		case line = <-lines:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		require.True(t, strings.HasPrefix(line, "data: "), line)
+		var event struct {
+			Subject string                        `json:"subject"`
+			Action  string                        `json:"action"`
+			Object  map[string]map[string]float64 `json:"object"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		assert.Equal(t, rates.RatesEventSubject, event.Subject)
+		assert.Equal(t, "replace", event.Action)
+		assert.Equal(t, float64(i), event.Object["BTC"]["USD"])
+		assert.Equal(t, "", <-lines, "event separator")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+)
+
+const (
+	// RestartedEventSubject is the Subject of the event generated when the health monitor
+	// restarts the updates of the latest rates. The Object is the time.Duration for which
+	// they had failed. See WithHealthMonitor.
+	RestartedEventSubject = "rates/restarted"
+
+	// defaultHealthRestartAfter is the default period of failed updates after which the
+	// health monitor restarts them.
+	defaultHealthRestartAfter = 10 * time.Minute
+)
+
+// WithHealthMonitor makes StartCurrentRates check every checkInterval whether the latest rates
+// were updated successfully within restartAfter, 10 minutes if zero. If not, the update loop is
+// stopped, cancelling any request it is stuck in, and started again with a new rate limiter,
+// and a RestartedEventSubject event is emitted. The loop is restarted at most every
+// restartAfter while the updates fail. restartAfter must be longer than the update interval,
+// see WithUpdateInterval, or the loop is restarted between successful updates.
+func WithHealthMonitor(checkInterval, restartAfter time.Duration) Option {
+	return func(updater *RateUpdater) {
+		if restartAfter <= 0 {
+			restartAfter = defaultHealthRestartAfter
+		}
+		updater.healthCheckInterval = checkInterval
+		updater.healthRestartAfter = restartAfter
+	}
+}
+
+// lastFetchOK returns the time of the latest successful updateLast, zero if none yet.
+func (updater *RateUpdater) lastFetchOK() time.Time {
+	updater.lastFetchMu.Lock()
+	defer updater.lastFetchMu.Unlock()
+	return updater.lastFetchOKAt
+}
+
+// healthMonitorLoop runs lastUpdateLoop and restarts it if it fails for too long.
+// It never returns until the context is done, which also stops lastUpdateLoop.
+func (updater *RateUpdater) healthMonitorLoop(ctx context.Context) {
+	// start runs lastUpdateLoop, returning the function to stop it and a channel closed
+	// once it has exited.
+	start := func() (context.CancelFunc, <-chan struct{}) {
+		loopCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		updater.goTracked(func() {
+			defer close(done)
+			updater.lastUpdateLoop(loopCtx)
+		})
+		return cancel, done
+	}
+	stop, done := start()
+	defer func() { stop() }()
+	// failingSince is the time since which no update succeeded.
+	failingSince := updater.clock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updater.timer.After(updater.healthCheckInterval):
+			// continue
+		}
+		// Paused updates are not failing.
+		if updater.Paused() {
+			failingSince = updater.clock()
+			continue
+		}
+		if lastOK := updater.lastFetchOK(); lastOK.After(failingSince) {
+			failingSince = lastOK
+		}
+		failingFor := updater.clock().Sub(failingSince)
+		if failingFor < updater.healthRestartAfter {
+			continue
+		}
+		updater.log.Warningf("no successful rates update for %v, restarting the updates", failingFor)
+		stop()
+		// The updateLast call of the old loop must not overlap with the one of the new loop.
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+		}
+		updater.resetFetchState()
+		stop, done = start()
+		failingSince = updater.clock()
+		updater.Notify(observable.Event{
+			Subject: RestartedEventSubject,
+			Action:  action.Replace,
+			Object:  failingFor,
+		})
+	}
+}
+
+// resetFetchState recreates the state of the latest rates requests kept across updates, as if
+// the updater was created anew: the rate limiter is replaced in case a leaked call holds it,
+// an adaptive backoff is ended and the cached response is dropped. It must only be called
+// while lastUpdateLoop is not running.
+func (updater *RateUpdater) resetFetchState() {
+	updater.geckoLimiterMu.Lock()
+	limiter := updater.geckoLimiter
+	if updater.backoffLimiter != nil && limiter == updater.backoffLimiter {
+		limiter = updater.normalLimiter
+	}
+	updater.geckoLimiter = ratelimit.NewLimitedCall(limiter.Interval())
+	updater.backoffLimiter, updater.normalLimiter = nil, nil
+	updater.backoffUntil = time.Time{}
+	updater.geckoLimiterMu.Unlock()
+
+	updater.lastResponseAt, updater.lastResponseIDs = time.Time{}, ""
+}
@@ -0,0 +1,148 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithHealthMonitor(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var failing atomic.Bool
+	failing.Store(true)
+	requests := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			fmt.Fprintln(w, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+		}
+		requests <- struct{}{}
+	}))
+	defer ts.Close()
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithUpdateInterval(time.Hour),
+		WithHealthMonitor(time.Minute, 3*time.Minute),
+		WithClockFunc(clock.Now), WithTimer(clock),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	restarts := make(chan time.Duration, 10)
+	updates := make(chan map[string]map[string]float64, 10)
+	updater.Observe(func(event observable.Event) {
+		switch event.Subject {
+		case RestartedEventSubject:
+			restarts <- event.Object.(time.Duration)
+		case RatesEventSubject:
+			updates <- event.Object.(map[string]map[string]float64)
+		}
+	})
+
+	updater.StartCurrentRates()
+	<-requests
+	// The monitor checks 3 times while the updates fail, and the server recovers before the
+	// third check, which restarts the update loop.
+	for i := 0; i < 3; i++ {
+		// The update loop and the monitor are waiting.
+		clock.BlockUntil(2)
+		if i == 2 {
+			failing.Store(false)
+		}
+		clock.Advance(time.Minute)
+		if i < 2 {
+			select {
+			case <-restarts:
+				t.Fatal("restarted too early")
+			case <-requests:
+				t.Fatal("updated before the interval passed")
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	assert.Equal(t, 3*time.Minute, <-restarts)
+	<-requests
+	assert.Equal(t, 20000.0, (<-updates)["BTC"]["USD"])
+	assert.Empty(t, restarts)
+}
+
+func TestWithHealthMonitorDefault(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithHealthMonitor(time.Minute, 0), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.Equal(t, defaultHealthRestartAfter, updater.healthRestartAfter)
+}
+
+func TestWithHealthMonitorWaitsForStoppedLoop(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	}))
+	defer ts.Close()
+	var calls atomic.Int32
+	stuck := make(chan struct{})
+	secondDone := make(chan struct{})
+	stuckOnce := func(next FetchFunc) FetchFunc {
+		return func(ctx context.Context, endpoint string) ([]byte, error) {
+			switch calls.Add(1) {
+			case 1:
+				// The first update is stuck until cancelled, and then slow to return, which
+				// would let it overlap with the update of a restarted loop not waiting for it.
+				close(stuck)
+				<-ctx.Done()
+				select {
+				case <-secondDone:
+				case <-time.After(100 * time.Millisecond):
+				}
+				return nil, ctx.Err()
+			case 2:
+				defer close(secondDone)
+			}
+			return next(ctx, endpoint)
+		}
+	}
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithUpdateInterval(time.Hour),
+		WithHealthMonitor(time.Minute, time.Minute),
+		WithClockFunc(clock.Now), WithTimer(clock),
+		WithMiddleware(stuckOnce),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	limiter := updater.limiter()
+	restarted := make(chan struct{}, 1)
+	updated := make(chan struct{}, 1)
+	updater.Observe(func(event observable.Event) {
+		switch event.Subject {
+		case RestartedEventSubject:
+			restarted <- struct{}{}
+		case RatesEventSubject:
+			updated <- struct{}{}
+		}
+	})
+
+	updater.StartCurrentRates()
+	<-stuck
+	// Only the monitor is waiting, the update loop is stuck.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-restarted
+	assert.NotSame(t, limiter, updater.limiter())
+	// The cancelled update of the old loop finished before the new loop updated the rates,
+	// so that it didn't reset them.
+	<-updated
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+}
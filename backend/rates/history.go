@@ -4,32 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"time"
 )
 
-// ReconfigureHistory resets all currently running historical rates goroutines.
-// The end result is only coin/fiat pairs present in the arguments are active.
+// ReconfigureHistory starts and stops the historical rates goroutines, so that
+// only coin/fiat pairs present in the arguments are active. The goroutines of pairs which
+// remain active keep running uninterrupted.
 // Duplicate or unsupported values in coins and fiats are ignored.
 // Supported fiats are currently hardcoded in the unexported geckoFiat map in this package.
 func (updater *RateUpdater) ReconfigureHistory(coins, fiats []string) {
 	updater.log.Printf("ReconfigureHistory: coins=%q; fiats=%q", coins, fiats)
-	updater.historyMu.Lock()
-	defer updater.historyMu.Unlock()
-	// Stop all running history goroutines.
-	for key, stop := range updater.historyGo {
-		stop()
-		delete(updater.historyGo, key)
-		delete(updater.history, key)
-	}
-	// Enable those requested.
+	type pair struct{ coin, fiat string }
+	// The requested pairs keyed by coin+fiat, and their keys in the order of the arguments.
+	requested := make(map[string]pair)
+	var keys []string
 	for _, coin := range coins {
-		if geckoCoin[coin] == "" {
+		if geckoCoin[CoinCode(coin)] == "" {
 			updater.log.Errorf("ReconfigureHistory: unsupported coin %q", coin)
 			continue
 		}
@@ -40,21 +34,51 @@ func (updater *RateUpdater) ReconfigureHistory(coins, fiats []string) {
 			}
 			key := coin + fiat
 			// The coins+fiats args may have duplicates.
-			if _, exists := updater.historyGo[key]; exists {
-				continue // already running
-			}
-			if rates, err := updater.loadHistoryBucket(key); err != nil {
-				// Non-critical: can continue without database cache.
-				updater.log.Errorf("loadHistoryBucket(%q): %v", key, err)
-			} else {
-				updater.history[key] = rates
+			if _, exists := requested[key]; !exists {
+				requested[key] = pair{coin, fiat}
+				keys = append(keys, key)
 			}
-			ctx, cancel := context.WithCancel(context.Background())
-			updater.historyGo[key] = cancel
-			go updater.historyUpdateLoop(ctx, coin, fiat)
-			go updater.backfillHistory(ctx, coin, fiat)
 		}
 	}
+
+	updater.historyGoMu.Lock()
+	defer updater.historyGoMu.Unlock()
+	// Stop the goroutines of the pairs no longer requested.
+	for key, stop := range updater.historyGo {
+		if _, ok := requested[key]; ok {
+			continue
+		}
+		stop()
+		delete(updater.historyGo, key)
+		updater.history.delete(key)
+		updater.invalidateDailyKey(key)
+	}
+	// Start those newly requested.
+	for _, key := range keys {
+		if _, exists := updater.historyGo[key]; exists {
+			continue // already running
+		}
+		coin, fiat := requested[key].coin, requested[key].fiat
+		// A goroutine of a previous configuration may still be storing rates for the key
+		// while it is loaded. Make sure they are not overwritten.
+		if rates, err := updater.loadHistoryBucket(key); err != nil {
+			// Non-critical: can continue without database cache.
+			updater.log.Errorf("loadHistoryBucket(%q): %v", key, err)
+		} else {
+			updater.history.update(key, func(current []exchangeRate) []exchangeRate {
+				if len(current) == 0 {
+					return rates
+				}
+				return mergeHistoryEntries(rates, current)
+			})
+		}
+		updater.invalidateDailyKey(key)
+		updater.prewarmHistoryKey(key)
+		ctx, cancel := context.WithCancel(context.Background())
+		updater.historyGo[key] = cancel
+		updater.goTracked(func() { updater.historyUpdateLoop(ctx, coin, fiat) })
+		updater.goTracked(func() { updater.backfillHistory(ctx, coin, fiat) })
+	}
 }
 
 // stopAllHistory shuts down all historical exchange rates goroutines.
@@ -83,10 +107,10 @@ func (updater *RateUpdater) historyUpdateLoop(ctx context.Context, coin, fiat st
 				start: start,
 				end: func() time.Time {
 					// Make sure we're not requesting too much data at once.
-					if time.Since(start) > maxGeckoRange {
+					if updater.clock().Sub(start) > maxGeckoRange {
 						return start.Add(maxGeckoRange)
 					}
-					return time.Now()
+					return updater.clock()
 				},
 			}
 			if _, err := updater.updateHistory(ctx, coin, fiat, timeRange); err != nil {
@@ -104,7 +128,7 @@ func (updater *RateUpdater) historyUpdateLoop(ctx context.Context, coin, fiat st
 		case <-ctx.Done():
 			updater.log.Printf("stopped historyUpdateLoop for %s/%s: %v", coin, fiat, ctx.Err())
 			return
-		case <-time.After(untilNext):
+		case <-updater.timer.After(untilNext):
 			// continue next iteration
 		}
 	}
@@ -123,16 +147,31 @@ func (updater *RateUpdater) backfillHistory(ctx context.Context, coin, fiat stri
 
 		// We want hourly rates for the last 90 days and daily past that.
 		// 90 days is the max interval CoinGecko responds with hourly timeseries to.
-		end := updater.HistoryEarliestTimestamp(coin, fiat)
+		earliest := updater.HistoryEarliestTimestamp(coin, fiat)
+		end := earliest
 		var start time.Time
 		if end.IsZero() {
 			// First time; don't have historical data yet.
-			end = time.Now()
+			end = updater.clock()
 			start = end.Add(-90*24*time.Hour + time.Hour) // +1h to be sure
 		} else {
 			// Use the max allowed range so that it fits response size limits.
 			end = end.Add(-24 * time.Hour)
 			start = end.Add(-maxGeckoRange)
+			if updater.autoBackfillMaxAge > 0 {
+				start = end.Add(-autoBackfillChunk)
+			}
+		}
+		if maxAge := updater.autoBackfillMaxAge; maxAge > 0 {
+			oldest := updater.clock().Add(-maxAge)
+			if !end.After(oldest) {
+				updater.log.Printf("backfillHistory for %s/%s: reached max age at %s", coin, fiat, end)
+				updater.backfillCompleted(coin, fiat, "max age")
+				return
+			}
+			if start.Before(oldest) {
+				start = oldest
+			}
 		}
 
 		n, err := updater.updateHistory(ctx, coin, fiat, fixedTimeRange(start, end))
@@ -141,6 +180,12 @@ func (updater *RateUpdater) backfillHistory(ctx context.Context, coin, fiat stri
 		// Use it to detect when to stop.
 		case err == nil && n == 0:
 			updater.log.Printf("backfillHistory for %s/%s: reached end of data at %s", coin, fiat, start)
+			updater.backfillCompleted(coin, fiat, "end of data")
+			return
+		// The fetched rates were trimmed right away; see WithMaxHistoryEntriesPerPair.
+		case err == nil && !earliest.IsZero() && !updater.HistoryEarliestTimestamp(coin, fiat).Before(earliest):
+			updater.log.Printf("backfillHistory for %s/%s: reached max history entries", coin, fiat)
+			updater.backfillCompleted(coin, fiat, "max entries")
 			return
 		case err != nil:
 			// Reduce logging by omitting context.Canceled error which simply indiates
@@ -156,12 +201,19 @@ func (updater *RateUpdater) backfillHistory(ctx context.Context, coin, fiat stri
 		case <-ctx.Done():
 			updater.log.Printf("stopped backfillHistory for %s/%s: %v", coin, fiat, ctx.Err())
 			return
-		case <-time.After(untilNext):
+		case <-updater.timer.After(untilNext):
 			// continue next iteration
 		}
 	}
 }
 
+// backfillCompleted sends TelemetryBackfillCompleted for the coin+fiat pair.
+func (updater *RateUpdater) backfillCompleted(coin, fiat, reason string) {
+	updater.telemetry(TelemetryBackfillCompleted, map[string]interface{}{
+		"pair": coin + fiat, "reason": reason,
+	})
+}
+
 // updateHistory fetches and stores historical data in the specified time range
 // for later use. It returns the number of the newly fetched and stored entries.
 // The data is stored in updater.history.
@@ -171,46 +223,136 @@ func (updater *RateUpdater) updateHistory(ctx context.Context, coin, fiat string
 		return 0, err
 	}
 
-	bucketName := coin + fiat
-	if err := updater.dumpHistoryBucket(bucketName, fetchedRates); err != nil {
+	updater.storeHistory(coin, fiat, fetchedRates)
+	return len(fetchedRates), nil
+}
+
+// storeHistory adds the rates to both updater.history and the database cache,
+// trimmed according to WithMaxHistoryEntriesPerPair.
+func (updater *RateUpdater) storeHistory(coin, fiat string, newRates []exchangeRate) {
+	updater.storeHistoryKey(coin+fiat, newRates)
+}
+
+// storeHistoryKey is like storeHistory, with the coin+fiat pair given as a key.
+func (updater *RateUpdater) storeHistoryKey(bucketName string, newRates []exchangeRate) {
+	if err := updater.dumpHistoryBucket(bucketName, newRates); err != nil {
 		// Non-critical: can continue without persistent DB.
 		updater.log.Errorf("dumpHistoryBucket(%q): %v", bucketName, err)
 	}
 
-	updater.historyMu.Lock()
-	defer updater.historyMu.Unlock()
-
-	updater.history[bucketName] = append(updater.history[bucketName], fetchedRates...)
-	sort.Slice(updater.history[bucketName], func(i, j int) bool {
-		return updater.history[bucketName][i].timestamp.Before(updater.history[bucketName][j].timestamp)
+	var previous, merged, trimmed []exchangeRate
+	var hasBundled bool
+	updater.history.update(bucketName, func(rates []exchangeRate) []exchangeRate {
+		previous = rates
+		// The rates are either all bundled or none, see prewarmHistoryKey.
+		// Fetched rates replace the bundled ones entirely.
+		hasBundled = len(rates) > 0 && rates[0].bundled
+		if hasBundled && len(newRates) > 0 {
+			rates = nil
+		}
+		merged = mergeHistoryEntries(rates, newRates)
+		trimmed = updater.compactHistory(bucketName, merged)
+		return trimmed
 	})
+	if len(trimmed) < len(merged) || hasBundled {
+		updater.recordPruned(bucketName, previous, trimmed)
+		updater.invalidateDailyKey(bucketName)
+	} else {
+		updater.invalidateDailyDays(bucketName, newRates)
+	}
+}
 
-	return len(fetchedRates), nil
+// BackfillGaps fetches the historical exchange rates missing in the gaps reported by
+// HistoryGaps with the same arguments, and stores them for later use.
+// Gaps longer than what can be fetched in a single request are fetched in multiple requests.
+// All requests abide the upstream rate limits.
+//
+// It returns the number of the newly stored entries, which may be less than the
+// number of gaps if the upstream has no data for them. In case of an error,
+// the entries stored until then are kept and counted.
+func (updater *RateUpdater) BackfillGaps(ctx context.Context, coin, fiat string, expectedInterval time.Duration, tolerance float64) (int, error) {
+	var total int
+	for _, gap := range updater.HistoryGaps(coin, fiat, expectedInterval, tolerance) {
+		// The gap boundaries are already present; exclude them to avoid duplicates.
+		for start := gap.From.Add(time.Second); start.Before(gap.To); start = start.Add(maxGeckoRange) {
+			end := start.Add(maxGeckoRange)
+			if end.After(gap.To) {
+				end = gap.To
+			}
+			fetchedRates, err := updater.fetchGeckoMarketRange(ctx, coin, fiat, fixedTimeRange(start, end))
+			if err != nil {
+				return total, err
+			}
+			var newRates []exchangeRate
+			for _, rate := range fetchedRates {
+				if rate.timestamp.After(gap.From) && rate.timestamp.Before(gap.To) {
+					newRates = append(newRates, rate)
+				}
+			}
+			updater.storeHistory(coin, fiat, newRates)
+			total += len(newRates)
+		}
+	}
+	return total, nil
+}
+
+// SyncHistoryFrom copies the historical exchange rates of the given coin+fiat pairs,
+// e.g. "btcUSD", from source which are missing in updater, identified by their timestamp.
+// If pairs is nil, all pairs of source are synced. The copied rates are also stored in
+// the database cache. It returns the number of copied entries.
+//
+// An error is returned only if the context is done, in which case the pairs synced
+// until then are kept and counted.
+func (updater *RateUpdater) SyncHistoryFrom(ctx context.Context, source *RateUpdater, pairs []string) (int, error) {
+	if pairs == nil {
+		for key := range source.history.all() {
+			pairs = append(pairs, key)
+		}
+		sort.Strings(pairs)
+	}
+	var total int
+	for _, key := range pairs {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		var sourceRates []exchangeRate
+		source.history.view(key, func(rates []exchangeRate) {
+			sourceRates = append(sourceRates, rates...)
+		})
+		var missing []exchangeRate
+		updater.history.view(key, func(rates []exchangeRate) {
+			missing = missingHistoryEntries(rates, sourceRates)
+		})
+		if len(missing) == 0 {
+			continue
+		}
+		updater.storeHistoryKey(key, missing)
+		total += len(missing)
+	}
+	return total, nil
 }
 
 // HistoryLatestTimestamp reports the most recent timestamp at which an exchange rate
 // is available for the given coin/fiat pair.
 func (updater *RateUpdater) HistoryLatestTimestamp(coin, fiat string) time.Time {
-	key := coin + fiat
-	updater.historyMu.RLock()
-	defer updater.historyMu.RUnlock()
 	var t time.Time
-	if n := len(updater.history[key]); n > 0 {
-		t = updater.history[key][n-1].timestamp
-	}
+	updater.history.view(coin+fiat, func(rates []exchangeRate) {
+		if n := len(rates); n > 0 {
+			t = rates[n-1].timestamp
+		}
+	})
 	return t
 }
 
 // HistoryEarliestTimestamp reports the oldest timestamp at which an exchange rate
 // is available for the given coin/fiat pair.
 func (updater *RateUpdater) HistoryEarliestTimestamp(coin, fiat string) time.Time {
-	key := coin + fiat
-	updater.historyMu.RLock()
-	defer updater.historyMu.RUnlock()
 	var t time.Time
-	if len(updater.history[key]) > 0 {
-		t = updater.history[key][0].timestamp
-	}
+	updater.history.view(coin+fiat, func(rates []exchangeRate) {
+		if len(rates) > 0 {
+			t = rates[0].timestamp
+		}
+	})
 	return t
 }
 
@@ -233,11 +375,9 @@ func (updater *RateUpdater) HistoryLatestTimestampFiat(coins []string, fiat stri
 // HistoryLatestTimestampCoin returns the latest time at which all the active
 // historical rates are available for a given coin.
 func (updater *RateUpdater) HistoryLatestTimestampCoin(coin string) time.Time {
-	updater.historyMu.RLock()
-	defer updater.historyMu.RUnlock()
 	var result time.Time
 	for _, fiat := range fromGeckoFiat {
-		if _, exists := updater.history[coin+fiat]; !exists {
+		if !updater.history.exists(coin + fiat) {
 			// skipping inactive currencies
 			continue
 		}
@@ -252,6 +392,30 @@ func (updater *RateUpdater) HistoryLatestTimestampCoin(coin string) time.Time {
 	return result
 }
 
+// TimeRange is a time interval between From and To.
+type TimeRange struct {
+	From time.Time
+	To   time.Time
+}
+
+// HistoryGaps reports the time ranges in which the historical exchange rates of the
+// given coin/fiat pair are missing. A gap is a pair of consecutive data points further
+// apart than expectedInterval * (1 + tolerance). The From and To of each returned range
+// are the timestamps of these data points, in asc order.
+// It returns nil if there is no history for the pair.
+func (updater *RateUpdater) HistoryGaps(coin, fiat string, expectedInterval time.Duration, tolerance float64) []TimeRange {
+	maxInterval := time.Duration(float64(expectedInterval) * (1 + tolerance))
+	var gaps []TimeRange
+	updater.history.view(coin+fiat, func(rates []exchangeRate) {
+		for i := 1; i < len(rates); i++ {
+			if rates[i].timestamp.Sub(rates[i-1].timestamp) > maxInterval {
+				gaps = append(gaps, TimeRange{From: rates[i-1].timestamp, To: rates[i].timestamp})
+			}
+		}
+	})
+	return gaps
+}
+
 type fetchTimeRange struct {
 	start time.Time
 	end   func() time.Time
@@ -268,7 +432,7 @@ func fixedTimeRange(start, end time.Time) fetchTimeRange {
 // using CoinGecko's "market_chart/range" API.
 func (updater *RateUpdater) fetchGeckoMarketRange(ctx context.Context, coin, fiat string, timeRange fetchTimeRange) ([]exchangeRate, error) {
 	// Prepare a request URL to call the upstream API.
-	gcoin := geckoCoin[coin]
+	gcoin := geckoCoin[CoinCode(coin)]
 	if gcoin == "" {
 		return nil, fmt.Errorf("fetchGeckoMarketRange: unsupported coin %s", coin)
 	}
@@ -277,37 +441,24 @@ func (updater *RateUpdater) fetchGeckoMarketRange(ctx context.Context, coin, fia
 		return nil, fmt.Errorf("fetchGeckoMarketRange: unsupported fiat %s", fiat)
 	}
 
-	// Make the call, abiding the upstream rate limits.
-	msg := fmt.Sprintf("fetch coingecko coin=%s fiat=%s start=%s", coin, fiat, timeRange.start)
+	param := url.Values{
+		"from":        {strconv.FormatInt(timeRange.start.Unix(), 10)},
+		"to":          {strconv.FormatInt(timeRange.end().Unix(), 10)},
+		"vs_currency": {gfiat},
+	}
+	endpoint := fmt.Sprintf("%s/coins/%s/market_chart/range?%s", updater.coingeckoURL, gcoin, param.Encode())
+	body, err := updater.fetch(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// 1Mb is more than enough for a single response, but make sure initial
+	// download with empty cache fits here. See maxGeckoRange.
+	if len(body) > 1<<20 {
+		return nil, fmt.Errorf("fetchGeckoMarketRange: response too long (%d bytes)", len(body))
+	}
 	var jsonBody struct{ Prices [][2]float64 } // [timestamp in milliseconds, value]
-	callErr := updater.geckoLimiter.Call(ctx, msg, func() error {
-		param := url.Values{
-			"from":        {strconv.FormatInt(timeRange.start.Unix(), 10)},
-			"to":          {strconv.FormatInt(timeRange.end().Unix(), 10)},
-			"vs_currency": {gfiat},
-		}
-		endpoint := fmt.Sprintf("%s/coins/%s/market_chart/range?%s", updater.coingeckoURL, gcoin, param.Encode())
-		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
-		if err != nil {
-			return err
-		}
-
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-		res, err := updater.httpClient.Do(req.WithContext(ctx))
-		if err != nil {
-			return err
-		}
-		defer res.Body.Close() //nolint:errcheck
-		if res.StatusCode != http.StatusOK {
-			return fmt.Errorf("fetchGeckoMarketRange: bad response code %d", res.StatusCode)
-		}
-		// 1Mb is more than enough for a single response, but make sure initial
-		// download with empty cache fits here. See maxGeckoRange.
-		return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&jsonBody)
-	})
-	if callErr != nil {
-		return nil, callErr
+	if err := json.Unmarshal(body, &jsonBody); err != nil {
+		return nil, err
 	}
 
 	// Transform the response into a usable result.
@@ -324,3 +475,33 @@ func (updater *RateUpdater) fetchGeckoMarketRange(ctx context.Context, coin, fia
 	}
 	return rates, nil
 }
+
+// CheckHistoryCompleteness reports the fraction of txTimes for which HistoricalPriceAt returns
+// a non-zero exchange rate for the given coin/fiat pair, and the txTimes for which it doesn't,
+// in the given order. This allows to warn about missing historical values of transactions.
+// The coverage is 1 if txTimes is empty.
+func (updater *RateUpdater) CheckHistoryCompleteness(coin, fiat string, txTimes []time.Time) (float64, []time.Time) {
+	if len(txTimes) == 0 {
+		return 1, nil
+	}
+	// Like historicalPriceAt, with a single lookup in the database cache if there are no rates
+	// in memory.
+	prices := make([]float64, len(txTimes))
+	var inMemory bool
+	updater.history.view(coin+fiat, func(rates []exchangeRate) {
+		inMemory = len(rates) > 0
+		for i, txTime := range txTimes {
+			prices[i] = priceAt(rates, txTime)
+		}
+	})
+	if !inMemory {
+		prices = updater.planner.pricesAt(coin+fiat, txTimes)
+	}
+	var missing []time.Time
+	for i, txTime := range txTimes {
+		if prices[i] == 0 {
+			missing = append(missing, txTime)
+		}
+	}
+	return float64(len(txTimes)-len(missing)) / float64(len(txTimes)), missing
+}
@@ -2,30 +2,40 @@ package rates
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
 )
 
 func TestPriceAt(t *testing.T) {
-	updater := NewRateUpdater(nil, "/dev/null") // don't need to make HTTP requests or load DB
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
 	defer updater.Stop()
-	updater.history = map[string][]exchangeRate{
+	updater.history = newHistoryMap(map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 2, timestamp: time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)},
 			{value: 3, timestamp: time.Date(2020, 9, 2, 0, 0, 0, 0, time.UTC)},
 			{value: 5, timestamp: time.Date(2020, 9, 3, 0, 0, 0, 0, time.UTC)},
 			{value: 8, timestamp: time.Date(2020, 9, 4, 0, 0, 0, 0, time.UTC)},
 		},
-	}
+	})
 	tt := []struct {
 		wantValue float64
 		at        time.Time
@@ -49,50 +59,37 @@ func TestPriceAt(t *testing.T) {
 }
 
 func TestUpdateHistory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
 	const wantStartUnix = 1598918462 // 2020-09-01 00:01:02
 	const wantEndUnix = 1599004862   // 2020-09-02 00:01:02
 
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "GET", r.Method, "request method")
-		assert.Equal(t, "/coins/bitcoin/market_chart/range", r.URL.Path, "URL path")
-		assert.Equal(t, strconv.Itoa(wantStartUnix), r.URL.Query().Get("from"), "from query arg")
-		assert.Equal(t, strconv.Itoa(wantEndUnix), r.URL.Query().Get("to"), "to query arg")
-		assert.Equal(t, "usd", r.URL.Query().Get("vs_currency"), "vs_currency query arg")
-
-		// Composed after a real response like this one:
-		// https://api.coingecko.com/api/v3/coins/bitcoin/market_chart/range?vs_currency=usd&from=1598918400&to=1600128000
-		// - 2020-09-01 00:05:00 UTC
-		// - 2020-09-01 01:08:21 UTC
-		fmt.Fprintln(w, `{
-			"prices": [
-			  [
-			    1598918700000,
-			    10000.0
-			  ],
-			  [
-			    1598922501000,
-			    10001.0
-			  ]
-			]
-		}`)
-	}))
-	defer ts.Close()
+	// Composed after a real response like this one:
+	// https://api.coingecko.com/api/v3/coins/bitcoin/market_chart/range?vs_currency=usd&from=1598918400&to=1600128000
+	// - 2020-09-01 00:05:00 UTC
+	// - 2020-09-01 01:08:21 UTC
+	const response = `{"prices": [[1598918700000, 10000.0], [1598922501000, 10001.0]]}`
+	recorder := testutil.NewRecordingRoundTripper(testutil.NewMockHTTPClient().
+		On("/coins/bitcoin/market_chart/range", http.StatusOK, response))
 
 	dbdir := test.TstTempDir("TestUpdateHistory")
 	defer os.RemoveAll(dbdir)
-	updater := NewRateUpdater(http.DefaultClient, dbdir)
-	updater.coingeckoURL = ts.URL
-	updater.history = map[string][]exchangeRate{
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithTransport(recorder), WithLogger(newTestLogger()))
+	updater.SetCoingeckoURL("https://coingecko.test")
+	updater.history = newHistoryMap(map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 1.0, timestamp: time.Unix(1598832062, 0)}, // 2020-08-31 00:01:02
 			{value: 2.0, timestamp: time.Unix(1599091262, 0)}, // 2020-09-03 00:01:02
 		},
-	}
+	})
 
 	g := fixedTimeRange(time.Unix(wantStartUnix, 0), time.Unix(wantEndUnix, 0))
 	n, err := updater.updateHistory(context.Background(), "btc", "USD", g)
 	require.NoError(t, err, "updater.updateHistory err")
 	assert.Equal(t, 2, n, "updater.updateHistory n")
+	assert.Equal(t, fmt.Sprintf(`GET https://coingecko.test/coins/bitcoin/market_chart/range?from=%d&to=%d&vs_currency=usd
+200
+%s
+`, wantStartUnix, wantEndUnix, response), recorder.Transcript())
 	wantHistory := map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 1.0, timestamp: time.Unix(1598832062, 0)}, // preexisting point
@@ -101,14 +98,14 @@ func TestUpdateHistory(t *testing.T) {
 			{value: 2.0, timestamp: time.Unix(1599091262, 0)}, // preexisting point
 		},
 	}
-	assert.Equal(t, wantHistory, updater.history, "updater.history")
+	assert.Equal(t, wantHistory, updater.history.all(), "updater.history")
 	updater.Stop() // closes dbdir so updater2 can load it
 
-	updater2 := NewRateUpdater(http.DefaultClient, dbdir)
+	updater2 := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
 	defer updater2.Stop()
 	updater2.coingeckoURL = "unused"
 	updater2.loadHistoryBucket("btcUSD")
-	assert.Equal(t, wantHistory, updater.history, "updater2.history")
+	assert.Equal(t, wantHistory, updater.history.all(), "updater2.history")
 }
 
 func TestFetchGeckoMarketRangeInvalidCoinFiat(t *testing.T) {
@@ -129,9 +126,10 @@ func TestFetchGeckoMarketRangeInvalidCoinFiat(t *testing.T) {
 }
 
 func TestHistoryEarliestLatest(t *testing.T) {
-	updater := NewRateUpdater(nil, "/dev/null")
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
 	defer updater.Stop()
-	updater.history = map[string][]exchangeRate{
+	updater.history = newHistoryMap(map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 1, timestamp: time.Unix(1598832062, 0)}, // 2020-08-31 00:01:02
 			{value: 2, timestamp: time.Unix(1598918700, 0)},
@@ -142,19 +140,19 @@ func TestHistoryEarliestLatest(t *testing.T) {
 			{value: 4, timestamp: time.Date(2020, 8, 02, 23, 0, 0, 0, time.UTC)},
 			{value: 4, timestamp: time.Date(2020, 9, 02, 23, 0, 0, 0, time.UTC)},
 		},
-	}
+	})
 
 	earliest := updater.HistoryEarliestTimestamp("btc", "USD")
-	assert.Equal(t, updater.history["btcUSD"][0].timestamp, earliest, "earliest")
+	assert.Equal(t, updater.history.all()["btcUSD"][0].timestamp, earliest, "earliest")
 
 	latest := updater.HistoryLatestTimestamp("btc", "USD")
-	assert.Equal(t, updater.history["btcUSD"][3].timestamp, latest, "latest")
+	assert.Equal(t, updater.history.all()["btcUSD"][3].timestamp, latest, "latest")
 
 	assert.Zero(t, updater.HistoryEarliestTimestamp("foo", "bar"), "zero earliest")
 	assert.Zero(t, updater.HistoryLatestTimestamp("foo", "bar"), "zero latest")
 
 	assert.Equal(t,
-		updater.history["ltcUSD"][1].timestamp,
+		updater.history.all()["ltcUSD"][1].timestamp,
 		updater.HistoryLatestTimestampFiat([]string{"btc", "ltc"}, "USD"))
 
 	assert.Zero(t, updater.HistoryLatestTimestampFiat([]string{"btc", "foo"}, "USD"))
@@ -163,7 +161,8 @@ func TestHistoryEarliestLatest(t *testing.T) {
 
 // TestLoadDumpUnusableDB ensures no panic when the RateUpdater.historyDB is unusable.
 func TestLoadDumpBucketUnusableDB(t *testing.T) {
-	updater := NewRateUpdater(nil, "/dev/null")
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
 	defer updater.Stop()
 	_, err1 := updater.loadHistoryBucket("foo")
 	require.Error(t, err1, "loadHistoryBucket")
@@ -172,6 +171,7 @@ func TestLoadDumpBucketUnusableDB(t *testing.T) {
 }
 
 func TestDumpLoadHistoryBucket(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
 	wantRates := []exchangeRate{
 		{value: 1, timestamp: time.Unix(1598832062, 0)},
 		{value: 2, timestamp: time.Unix(1598918700, 0)},
@@ -181,11 +181,11 @@ func TestDumpLoadHistoryBucket(t *testing.T) {
 	dbdir := test.TstTempDir("TestLoadDumpHistoryBucket")
 	defer os.RemoveAll(dbdir)
 
-	updater1 := NewRateUpdater(nil, dbdir)
+	updater1 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
 	require.NoError(t, updater1.dumpHistoryBucket("btcUSD", wantRates), "dumpHistoryBucket")
 	updater1.Stop() // close dbdir so updater2 can load
 
-	updater2 := NewRateUpdater(nil, dbdir)
+	updater2 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
 	defer updater2.Stop()
 	rates, err := updater2.loadHistoryBucket("btcUSD")
 	require.NoError(t, err, "updater2.loadHistoryBucket")
@@ -193,6 +193,7 @@ func TestDumpLoadHistoryBucket(t *testing.T) {
 }
 
 func TestReconfigureHistoryLoadsFromDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
 	sampleRates := []exchangeRate{
 		{value: 1, timestamp: time.Unix(1598832062, 0)},
 		{value: 2, timestamp: time.Unix(1598918700, 0)},
@@ -202,24 +203,251 @@ func TestReconfigureHistoryLoadsFromDB(t *testing.T) {
 	dbdir := test.TstTempDir("TestReconfigureHistoryLoadsFromDB")
 	defer os.RemoveAll(dbdir)
 
-	updater1 := NewRateUpdater(nil, dbdir)
+	updater1 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
 	require.NoError(t, updater1.dumpHistoryBucket("btcUSD", sampleRates), "dumpHistoryBucket")
 	updater1.Stop() // close dbdir so updater2 can load
 
-	updater2 := NewRateUpdater(http.DefaultClient, dbdir)
+	updater2 := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
 	updater2.coingeckoURL = "unused" // avoid hitting real API
 	defer updater2.Stop()
 	updater2.ReconfigureHistory([]string{"btc"}, []string{"USD"})
 	// Loading from bbolt DB may result in unsorted slice.
 	// To test this manually, comment out sortRatesByTimestamp in
 	// RateUpdater.loadHistoryBucket and add the following here:
-	// assert.Equal(t, nil, updater2.history["btcUSD"])
+	// assert.Equal(t, nil, updater2.history.all()["btcUSD"])
 	for _, rate := range sampleRates {
 		v := updater2.HistoricalPriceAt("btc", "USD", rate.timestamp)
 		assert.Equal(t, rate.value, v, "PriceAt(btc, USD, %d)", rate.timestamp.Unix())
 	}
 }
 
+func TestCheckHistoryCompleteness(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	covered := []time.Time{
+		time.Unix(1598832062, 0), // first
+		time.Unix(1598900000, 0), // interpolated
+		time.Unix(1599091262, 0), // last
+	}
+	uncovered := []time.Time{
+		time.Unix(1598832061, 0), // before first
+		time.Unix(1599091263, 0), // after last
+	}
+	txTimes := []time.Time{uncovered[0], covered[0], covered[1], uncovered[1], covered[2]}
+
+	coverage, missing := updater.CheckHistoryCompleteness("btc", "USD", txTimes)
+	assert.Equal(t, 0.6, coverage)
+	assert.Equal(t, uncovered, missing)
+
+	coverage, missing = updater.CheckHistoryCompleteness("btc", "USD", covered)
+	assert.Equal(t, 1.0, coverage)
+	assert.Empty(t, missing)
+
+	coverage, missing = updater.CheckHistoryCompleteness("btc", "EUR", txTimes)
+	assert.Equal(t, 0.0, coverage)
+	assert.Equal(t, txTimes, missing)
+
+	coverage, missing = updater.CheckHistoryCompleteness("btc", "USD", nil)
+	assert.Equal(t, 1.0, coverage)
+	assert.Empty(t, missing)
+}
+
+// TestCheckHistoryCompletenessDB checks that rates only in the database cache count as covered,
+// like they do for HistoricalPriceAt, and that they are read once.
+func TestCheckHistoryCompletenessDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1598918400, 0)
+	store := &countingHistoryStore{HistoryStore: NewMemoryHistoryStore()}
+	updater := NewRateUpdater(nil, "/dev/null", WithHistoryStore(store), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.NoError(t, store.WriteBucket("ethEUR", ratesEvery(start, time.Hour, 5)))
+
+	txTimes := []time.Time{start.Add(-time.Hour), start, start.Add(90 * time.Minute), start.Add(4 * time.Hour)}
+	for _, txTime := range txTimes[1:] {
+		require.NotZero(t, updater.HistoricalPriceAt("eth", "EUR", txTime))
+	}
+	reads := store.reads.Load()
+	coverage, missing := updater.CheckHistoryCompleteness("eth", "EUR", txTimes)
+	assert.Equal(t, 0.75, coverage)
+	assert.Equal(t, txTimes[:1], missing)
+	assert.Equal(t, reads+1, store.reads.Load())
+}
+
+// TestStoreHistoryConcurrent reproduces goroutines of overlapping history configurations
+// storing rates for the same pair while it is reloaded. It is meant to be run with -race.
+func TestStoreHistoryConcurrent(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestStoreHistoryConcurrent")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
+	updater.coingeckoURL = "unused" // avoid hitting real API
+	defer updater.Stop()
+
+	const writers, perWriter = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				ts := time.Unix(int64(1598832000+i*writers+w), 0)
+				updater.storeHistory("btc", "USD", []exchangeRate{{value: float64(w), timestamp: ts}})
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+		}
+	}()
+	wg.Wait()
+
+	rates := updater.history.all()["btcUSD"]
+	require.Len(t, rates, writers*perWriter)
+	for i, rate := range rates {
+		assert.Equal(t, int64(1598832000+i), rate.timestamp.Unix())
+		assert.Equal(t, float64(i%writers), rate.value)
+	}
+	stored, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, stored, writers*perWriter)
+}
+
+func TestWithMaxHistoryEntriesPerPair(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestWithMaxHistoryEntriesPerPair")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithMaxHistoryEntriesPerPair(100), WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	var rates []exchangeRate
+	for i := 0; i < 100; i++ {
+		rates = append(rates, exchangeRate{value: float64(i), timestamp: time.Unix(int64(1598832000+i), 0)})
+	}
+	updater.storeHistory("btc", "USD", rates)
+	require.Len(t, updater.history.all()["btcUSD"], 100)
+
+	// One more drops the oldest 10.
+	updater.storeHistory("btc", "USD", []exchangeRate{{value: 100, timestamp: time.Unix(1598832100, 0)}})
+	onDisk, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	for _, stored := range [][]exchangeRate{updater.history.all()["btcUSD"], onDisk} {
+		require.Len(t, stored, 91)
+		assert.Equal(t, 10.0, stored[0].value)
+		assert.Equal(t, 100.0, stored[90].value)
+	}
+	assert.Zero(t, updater.HistoricalPriceAt("btc", "USD", time.Unix(1598832000, 0)))
+
+	// A batch exceeding the limit by more than n/10 is trimmed to the limit.
+	rates = rates[:0]
+	for i := 101; i < 300; i++ {
+		rates = append(rates, exchangeRate{value: float64(i), timestamp: time.Unix(int64(1598832000+i), 0)})
+	}
+	updater.storeHistory("btc", "USD", rates)
+	stored := updater.history.all()["btcUSD"]
+	require.Len(t, stored, 100)
+	assert.Equal(t, 200.0, stored[0].value)
+}
+
+func TestMergeHistoryEntries(t *testing.T) {
+	rate := func(ts int64, value float64) exchangeRate {
+		return exchangeRate{value: value, timestamp: time.Unix(ts, 0)}
+	}
+	existing := []exchangeRate{rate(1, 1), rate(2, 2), rate(3, 3)}
+	merged := mergeHistoryEntries(existing, []exchangeRate{rate(4, 40), rate(2, 20), rate(3, 30), rate(3, 31)})
+	assert.Equal(t, []exchangeRate{rate(1, 1), rate(2, 20), rate(3, 31), rate(4, 40)}, merged)
+	assert.Equal(t, []exchangeRate{rate(1, 1), rate(2, 2), rate(3, 3)}, existing, "existing modified")
+	assert.Empty(t, mergeHistoryEntries(nil, nil))
+
+	// Timestamps within the same second are equal, as they are stored in seconds.
+	sub := func(ms int64, value float64) exchangeRate {
+		return exchangeRate{value: value, timestamp: time.UnixMilli(ms)}
+	}
+	merged = mergeHistoryEntries([]exchangeRate{sub(1000, 1), sub(2500, 2)}, []exchangeRate{sub(1250, 3), sub(2000, 4)})
+	assert.Equal(t, []exchangeRate{sub(1250, 3), sub(2000, 4)}, merged)
+	assert.Equal(t,
+		[]exchangeRate{sub(3000, 5)},
+		missingHistoryEntries([]exchangeRate{sub(1000, 1), sub(2500, 2)}, []exchangeRate{sub(1999, 3), sub(2000, 4), sub(3000, 5)}))
+}
+
+// TestStoreHistorySubMinute checks that rates of a source finer than CoinGecko's, 30 seconds
+// apart, are stored as distinct rates both in memory and in the database cache.
+func TestStoreHistorySubMinute(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestStoreHistorySubMinute")
+	defer os.RemoveAll(dbdir)
+	start := time.Unix(1598832000, 0)
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	want := []exchangeRate{
+		{value: 1, timestamp: at(0)},
+		{value: 2, timestamp: at(30)},
+		{value: 3, timestamp: at(60)},
+		{value: 4, timestamp: at(90)},
+	}
+
+	updater1 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	updater1.storeHistory("btc", "USD", want[:2])
+	updater1.storeHistory("btc", "USD", want[1:])
+	rates := updater1.history.get("btcUSD")
+	assert.Equal(t, want, rates)
+	assert.Equal(t, 1.5, updater1.HistoricalPriceAt("btc", "USD", at(15)))
+	assert.Equal(t, 2.0, updater1.HistoricalPriceAt("btc", "USD", at(30)))
+	updater1.Stop()
+
+	updater2 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater2.Stop()
+	rates, err := updater2.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	require.Len(t, rates, len(want))
+	for i := range want {
+		assert.True(t, want[i].timestamp.Equal(rates[i].timestamp), "timestamp %d", i)
+		assert.Equal(t, want[i].value, rates[i].value)
+	}
+}
+
+// TestMergeHistoryEntriesRandom compares mergeHistoryEntries with a simple reference
+// implementation for randomly overlapping existing and new rates.
+func TestMergeHistoryEntriesRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 1000; iter++ {
+		// Existing rates are sorted and unique, as stored in the history.
+		var existing []exchangeRate
+		for ts := int64(rnd.Intn(10)); ts < 100; ts += 1 + int64(rnd.Intn(5)) {
+			existing = append(existing, exchangeRate{value: float64(ts), timestamp: time.Unix(ts, 0)})
+		}
+		// New rates start somewhere before, within or after the existing ones.
+		var newRates []exchangeRate
+		start := int64(rnd.Intn(120)) - 10
+		for i := 0; i < rnd.Intn(50); i++ {
+			ts := start + int64(i*(1+rnd.Intn(3)))
+			newRates = append(newRates, exchangeRate{value: float64(-ts), timestamp: time.Unix(ts, 0)})
+		}
+		if rnd.Intn(4) == 0 {
+			rnd.Shuffle(len(newRates), func(i, j int) { newRates[i], newRates[j] = newRates[j], newRates[i] })
+		}
+
+		want := map[int64]float64{}
+		for _, r := range existing {
+			want[r.timestamp.Unix()] = r.value
+		}
+		for _, r := range newRates {
+			want[r.timestamp.Unix()] = r.value
+		}
+
+		merged := mergeHistoryEntries(existing, newRates)
+		require.Len(t, merged, len(want), "iteration %d", iter)
+		for i, r := range merged {
+			if i > 0 {
+				require.Less(t, merged[i-1].timestamp.Unix(), r.timestamp.Unix(), "iteration %d", iter)
+			}
+			require.Equal(t, want[r.timestamp.Unix()], r.value, "iteration %d", iter)
+		}
+	}
+}
+
 func BenchmarkDumpHistoryBucket(b *testing.B) {
 	var rates []exchangeRate
 	for i := 0; i < 5000; i++ {
@@ -228,7 +456,7 @@ func BenchmarkDumpHistoryBucket(b *testing.B) {
 			timestamp: time.Unix(int64(i), 0),
 		})
 	}
-	updater := NewRateUpdater(nil, test.TstTempDir("BenchmarkDumpHistoryBucket"))
+	updater := NewRateUpdater(nil, test.TstTempDir("BenchmarkDumpHistoryBucket"), WithLogger(newTestLogger()))
 	defer updater.Stop()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -246,11 +474,11 @@ func BenchmarkLoadHistoryBucket(b *testing.B) {
 		})
 	}
 	dbdir := test.TstTempDir("BenchmarkLoadHistoryBucket")
-	updater := NewRateUpdater(nil, dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
 	updater.dumpHistoryBucket("btcUSD", rates)
 	updater.Stop()
 
-	updater2 := NewRateUpdater(nil, dbdir)
+	updater2 := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
 	defer updater2.Stop()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -261,9 +489,10 @@ func BenchmarkLoadHistoryBucket(b *testing.B) {
 }
 
 func TestHistoryLatestTimestampCoin(t *testing.T) {
-	updater := NewRateUpdater(nil, "/dev/null") // don't need to make HTTP requests or load DB
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
 	defer updater.Stop()
-	updater.history = map[string][]exchangeRate{
+	updater.history = newHistoryMap(map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 2, timestamp: time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)},
 			{value: 3, timestamp: time.Date(2020, 9, 2, 0, 0, 0, 0, time.UTC)},
@@ -275,9 +504,496 @@ func TestHistoryLatestTimestampCoin(t *testing.T) {
 			{value: 3, timestamp: time.Date(2020, 9, 2, 0, 0, 0, 0, time.UTC)},
 			{value: 5, timestamp: time.Date(2020, 9, 3, 0, 0, 0, 0, time.UTC)},
 		},
-	}
+	})
 	assert.Equal(t, time.Time{}, updater.HistoryLatestTimestampCoin("eth"))
 	assert.Equal(t,
 		time.Date(2020, 9, 3, 0, 0, 0, 0, time.UTC),
 		updater.HistoryLatestTimestampCoin("btc"))
 }
+
+func TestHistoryGaps(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+
+	// Hourly rates for 30 days, with three gaps.
+	start := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	missing := func(h int) bool {
+		return (h > 24 && h < 30) || // 2020-09-02 00:00 - 06:00
+			h == 300 || // 2020-09-13 11:00 - 13:00
+			(h >= 600 && h < 648) // 2020-09-25 23:00 - 2020-09-28 00:00
+	}
+	var rates []exchangeRate
+	for h := 0; h < 30*24; h++ {
+		if !missing(h) {
+			rates = append(rates, exchangeRate{value: float64(h), timestamp: start.Add(time.Duration(h) * time.Hour)})
+		}
+	}
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": rates})
+
+	hour := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+	wantGaps := []TimeRange{
+		{From: hour(24), To: hour(30)},
+		{From: hour(299), To: hour(301)},
+		{From: hour(599), To: hour(648)},
+	}
+	assert.Equal(t, wantGaps, updater.HistoryGaps("btc", "USD", time.Hour, 0.1))
+	// A larger tolerance hides the smaller gaps.
+	assert.Equal(t, wantGaps[2:], updater.HistoryGaps("btc", "USD", time.Hour, 10))
+	assert.Nil(t, updater.HistoryGaps("btc", "USD", 24*time.Hour, 2))
+	assert.Nil(t, updater.HistoryGaps("ltc", "USD", time.Hour, 0.1))
+}
+
+func TestBackfillGaps(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00:00 UTC
+	hour := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+
+	var requests []TimeRange
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/coins/bitcoin/market_chart/range", r.URL.Path, "URL path")
+		from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		require.NoError(t, err)
+		to, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		require.NoError(t, err)
+		requests = append(requests, TimeRange{From: time.Unix(from, 0), To: time.Unix(to, 0)})
+		// Respond with hourly data including the boundaries of the requested range
+		// as upstream may do, rounding to the nearest full hour.
+		var prices []string
+		for ts := time.Unix(from, 0).Truncate(time.Hour); !ts.After(time.Unix(to, 0)); ts = ts.Add(time.Hour) {
+			prices = append(prices, fmt.Sprintf("[%d, 100.0]", ts.UnixMilli()))
+		}
+		fmt.Fprintf(w, `{"prices": [%s]}`, strings.Join(prices, ","))
+	}))
+	defer ts.Close()
+
+	dbdir := test.TstTempDir("TestBackfillGaps")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 1, timestamp: hour(0)},
+			{value: 1, timestamp: hour(1)},
+			{value: 1, timestamp: hour(5)}, // 3 missing
+			{value: 1, timestamp: hour(6)},
+			{value: 1, timestamp: hour(8)}, // 1 missing
+		},
+	})
+
+	n, err := updater.BackfillGaps(context.Background(), "btc", "USD", time.Hour, 0.1)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []TimeRange{
+		{From: hour(1).Add(time.Second), To: hour(5)},
+		{From: hour(6).Add(time.Second), To: hour(8)},
+	}, requests)
+	assert.Nil(t, updater.HistoryGaps("btc", "USD", time.Hour, 0.1))
+	for h := 0; h <= 8; h++ {
+		assert.NotZero(t, updater.HistoricalPriceAt("btc", "USD", hour(h)), "hour %d", h)
+	}
+
+	// Stored in the database cache too.
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, rates, 4)
+
+	// Nothing left to do.
+	n, err = updater.BackfillGaps(context.Background(), "btc", "USD", time.Hour, 0.1)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Len(t, requests, 2)
+}
+
+// immediateTimer is a Timer whose channels receive right away.
+type immediateTimer struct{}
+
+func (immediateTimer) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+func TestWithAutoBackfill(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Unix(1598918400, 0)
+	const day = 24 * time.Hour
+	var requests []TimeRange
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/coins/bitcoin/market_chart/range", r.URL.Path, "URL path")
+		from, err := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		require.NoError(t, err)
+		to, err := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		require.NoError(t, err)
+		requests = append(requests, TimeRange{From: time.Unix(from, 0), To: time.Unix(to, 0)})
+		// Daily rates, valued by the number of the request.
+		var prices []string
+		for ts := time.Unix(from, 0); !ts.After(time.Unix(to, 0)); ts = ts.Add(day) {
+			prices = append(prices, fmt.Sprintf("[%d, %d]", ts.UnixMilli(), len(requests)))
+		}
+		fmt.Fprintf(w, `{"prices": [%s]}`, strings.Join(prices, ","))
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithAutoBackfill(270*day),
+		WithClockFunc(func() time.Time { return now }),
+		WithTimer(immediateTimer{}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	updater.backfillHistory(context.Background(), "btc", "USD")
+	require.Len(t, requests, 3)
+	for i, request := range requests {
+		assert.LessOrEqual(t, request.To.Sub(request.From), 90*day, "request %d", i)
+		assert.False(t, request.From.Before(now.Add(-270*day)), "request %d", i)
+	}
+	assert.Equal(t, now.Add(-270*day).Unix(), updater.HistoryEarliestTimestamp("btc", "USD").Unix())
+	// The rates of all three chunks are stored.
+	assert.Equal(t, 1.0, updater.HistoricalPriceAt("btc", "USD", now.Add(-10*day)))
+	assert.Equal(t, 2.0, updater.HistoricalPriceAt("btc", "USD", now.Add(-120*day)))
+	assert.Equal(t, 3.0, updater.HistoricalPriceAt("btc", "USD", now.Add(-250*day)))
+}
+
+func TestBackfillGapsCanceled(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "unused"
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 1, timestamp: time.Unix(0, 0)},
+			{value: 1, timestamp: time.Unix(3600*10, 0)},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n, err := updater.BackfillGaps(ctx, "btc", "USD", time.Hour, 0)
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, n)
+}
+
+func TestLoadHistoryBucketMigratesV1(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	wantRates := []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832062, 0)},
+		{value: 2, timestamp: time.Unix(1598918700, 0)},
+		{value: 3, timestamp: time.Unix(1598922501, 0)},
+	}
+	dbdir := test.TstTempDir("TestLoadHistoryBucketMigratesV1")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	// Write the rates in schema version 1.
+	require.NoError(t, updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("btcUSD"))
+		if err != nil {
+			return err
+		}
+		for _, rate := range wantRates {
+			var tsbytes, vbytes [8]byte
+			binary.BigEndian.PutUint64(tsbytes[:], uint64(rate.timestamp.Unix()))
+			binary.BigEndian.PutUint64(vbytes[:], math.Float64bits(rate.value))
+			if err := bucket.Put(tsbytes[:], vbytes[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, wantRates, rates)
+	require.NoError(t, updater.historyDB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("btcUSD"))
+		assert.Equal(t, historySchemaV3, historyBucketSchema(bucket))
+		// The granularity, the chunks bucket and the chunks of August and September 2020.
+		assert.Equal(t, 4, bucket.Stats().KeyN)
+		return nil
+	}))
+	rates, err = updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, wantRates, rates)
+
+	// Merging replaces equal timestamps.
+	require.NoError(t, updater.dumpHistoryBucket("btcUSD", []exchangeRate{
+		{value: 20, timestamp: time.Unix(1598918700, 0)},
+		{value: 4, timestamp: time.Unix(1599091262, 0)},
+	}))
+	rates, err = updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832062, 0)},
+		{value: 20, timestamp: time.Unix(1598918700, 0)},
+		{value: 3, timestamp: time.Unix(1598922501, 0)},
+		{value: 4, timestamp: time.Unix(1599091262, 0)},
+	}, rates)
+}
+
+func TestLoadHistoryBucketMigratesV2(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	wantRates := []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832062, 0)},
+		{value: 2, timestamp: time.Unix(1598918700, 0)},
+	}
+	dbdir := test.TstTempDir("TestLoadHistoryBucketMigratesV2")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	require.NoError(t, updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		return writeHistoryBucketV2(tx, "btcUSD", wantRates, GranularityDaily)
+	}))
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, wantRates, rates)
+	assert.Equal(t, GranularityDaily, updater.historyGranularity("btcUSD"))
+	require.NoError(t, updater.historyDB.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte("btcUSD"))
+		assert.Equal(t, historySchemaV3, historyBucketSchema(bucket))
+		assert.Nil(t, bucket.Get(historyDeltaKey))
+		granularity, ok := readHistoryGranularity(bucket)
+		assert.True(t, ok)
+		assert.Equal(t, GranularityDaily, granularity)
+		return nil
+	}))
+}
+
+func TestWriteHistoryBucketChunks(t *testing.T) {
+	db, err := bbolt.Open(test.TstTempFile("TestWriteHistoryBucketChunks"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close() //nolint:errcheck
+
+	// Rates of January to March 2024.
+	rates := ratesEvery(time.Unix(1704067200, 0), 24*time.Hour, 91)
+	chunks := func() map[string][]byte {
+		result := map[string][]byte{}
+		require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte("btcUSD")).Bucket(historyChunksKey).ForEach(func(k, v []byte) error {
+				result[string(k)] = append([]byte(nil), v...)
+				return nil
+			})
+		}))
+		return result
+	}
+	write := func(rates []exchangeRate) {
+		require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+			return writeHistoryBucket(tx, "btcUSD", rates, GranularityHourly)
+		}))
+	}
+
+	write(rates)
+	before := chunks()
+	require.Len(t, before, 3)
+	assert.Equal(t, encodeDelta(rates[:31]), before["2024-01"])
+	assert.Equal(t, encodeDelta(rates[31:60]), before["2024-02"])
+	assert.Equal(t, encodeDelta(rates[60:]), before["2024-03"])
+
+	// Appending a rate only changes the chunk of its month.
+	appended := append(append([]exchangeRate{}, rates...), exchangeRate{value: 100, timestamp: time.Unix(1711886400, 0)})
+	write(appended)
+	after := chunks()
+	assert.Equal(t, before["2024-01"], after["2024-01"])
+	assert.Equal(t, before["2024-02"], after["2024-02"])
+	assert.Equal(t, encodeDelta(appended[60:]), after["2024-03"])
+
+	// Rates removed from the start, e.g. by trimHistory, remove their chunks.
+	write(appended[40:])
+	after = chunks()
+	assert.Len(t, after, 2)
+	assert.Equal(t, encodeDelta(appended[40:60]), after["2024-02"])
+
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		rates, err := readHistoryBucket(tx.Bucket([]byte("btcUSD")))
+		require.NoError(t, err)
+		assert.Equal(t, appended[40:], rates)
+		return nil
+	}))
+
+	// No rates at all.
+	write(nil)
+	assert.Empty(t, chunks())
+	require.NoError(t, db.View(func(tx *bbolt.Tx) error {
+		rates, err := readHistoryBucket(tx.Bucket([]byte("btcUSD")))
+		require.NoError(t, err)
+		assert.Empty(t, rates)
+		return nil
+	}))
+}
+
+func TestSyncHistoryFrom(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestSyncHistoryFrom")
+	defer os.RemoveAll(dbdir)
+	source := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer source.Stop()
+	source.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 1, timestamp: time.Unix(1598832062, 0)},
+			{value: 2, timestamp: time.Unix(1598918700, 0)},
+			{value: 3, timestamp: time.Unix(1598922501, 0)},
+		},
+		"ltcUSD": {
+			{value: 4, timestamp: time.Unix(1598832062, 0)},
+		},
+	})
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 2, timestamp: time.Unix(1598918700, 0)},
+			{value: 5, timestamp: time.Unix(1599091262, 0)},
+		},
+	})
+
+	n, err := updater.SyncHistoryFrom(context.Background(), source, []string{"btcUSD", "ethUSD"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832062, 0)},
+		{value: 2, timestamp: time.Unix(1598918700, 0)},
+		{value: 3, timestamp: time.Unix(1598922501, 0)},
+		{value: 5, timestamp: time.Unix(1599091262, 0)},
+	}, updater.history.all()["btcUSD"])
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Len(t, rates, 2, "only the synced rates are in the DB")
+
+	// All pairs, and nothing duplicated.
+	n, err = updater.SyncHistoryFrom(context.Background(), source, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Len(t, updater.history.all()["btcUSD"], 4)
+	assert.Len(t, updater.history.all()["ltcUSD"], 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = updater.SyncHistoryFrom(ctx, source, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestListTrackedPairs(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestListTrackedPairs")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	pairs, err := updater.ListTrackedPairs(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pairs)
+
+	require.NoError(t, updater.dumpHistoryBucket("ltcEUR", []exchangeRate{
+		{value: 50, timestamp: time.Unix(1598832000, 0)},
+	}))
+	require.NoError(t, updater.dumpHistoryBucket("btcUSD", []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832000, 0)},
+		{value: 2, timestamp: time.Unix(1598835600, 0)},
+		{value: 3, timestamp: time.Unix(1598839200, 0)},
+	}))
+	// Skipped: no rates and unsupported pairs.
+	require.NoError(t, updater.dumpHistoryBucket("ethCHF", nil))
+	require.NoError(t, updater.dumpHistoryBucket("foo", []exchangeRate{
+		{value: 1, timestamp: time.Unix(1598832000, 0)},
+	}))
+
+	pairs, err = updater.ListTrackedPairs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []CoinFiatPair{
+		{
+			Coin:          "btc",
+			Fiat:          "USD",
+			EarliestEntry: time.Unix(1598832000, 0),
+			LatestEntry:   time.Unix(1598839200, 0),
+			EntryCount:    3,
+		},
+		{
+			Coin:          "ltc",
+			Fiat:          "EUR",
+			EarliestEntry: time.Unix(1598832000, 0),
+			LatestEntry:   time.Unix(1598832000, 0),
+			EntryCount:    1,
+		},
+	}, pairs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = updater.ListTrackedPairs(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	unusable := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer unusable.Stop()
+	_, err = unusable.ListTrackedPairs(context.Background())
+	require.Error(t, err)
+}
+
+func TestMergeHistoryDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	sourceDir := test.TstTempDir("TestMergeHistoryDBSource")
+	defer os.RemoveAll(sourceDir)
+	source := NewRateUpdater(nil, sourceDir, WithLogger(newTestLogger()))
+	// Days 3 to 7 of btcUSD with different values than the ones already present, and ethUSD
+	// in schema version 1.
+	sourceBTC := ratesEvery(start.Add(3*24*time.Hour), 24*time.Hour, 5)
+	for i := range sourceBTC {
+		sourceBTC[i].value += 100
+	}
+	require.NoError(t, source.dumpHistoryBucket("btcUSD", sourceBTC))
+	require.NoError(t, source.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("ethUSD"))
+		if err != nil {
+			return err
+		}
+		for _, rate := range ratesEvery(start, time.Hour, 3) {
+			var tsbytes, vbytes [8]byte
+			binary.BigEndian.PutUint64(tsbytes[:], uint64(rate.timestamp.Unix()))
+			binary.BigEndian.PutUint64(vbytes[:], math.Float64bits(rate.value))
+			if err := bucket.Put(tsbytes[:], vbytes[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	_, err := source.AddEventAnnotation(start, "not a pair")
+	require.NoError(t, err)
+	source.Stop()
+
+	dbdir := test.TstTempDir("TestMergeHistoryDB")
+	defer os.RemoveAll(dbdir)
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	// Days 0 to 4 of btcUSD, in memory as if configured, and in the database.
+	updater.storeHistory("btc", "USD", ratesEvery(start, 24*time.Hour, 5))
+
+	n, err := updater.MergeHistoryDB(context.Background(), filepath.Join(sourceDir, "rates.db"))
+	require.NoError(t, err)
+	// Days 5 to 7 of btcUSD and all of ethUSD.
+	assert.Equal(t, 3+3, n)
+	wantBTC := append(ratesEvery(start, 24*time.Hour, 5), sourceBTC[2:]...)
+	assert.Equal(t, wantBTC, updater.history.all()["btcUSD"])
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, wantBTC, rates)
+	rates, err = updater.loadHistoryBucket("ethUSD")
+	require.NoError(t, err)
+	assert.Equal(t, ratesEvery(start, time.Hour, 3), rates)
+	assert.False(t, updater.history.exists("ethUSD"))
+	assert.Empty(t, updater.EventAnnotations(start.Add(-time.Hour), start.Add(time.Hour)))
+
+	// Merging again inserts nothing.
+	n, err = updater.MergeHistoryDB(context.Background(), filepath.Join(sourceDir, "rates.db"))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	_, err = updater.MergeHistoryDB(context.Background(), filepath.Join(sourceDir, "missing.db"))
+	assert.Error(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = updater.MergeHistoryDB(ctx, filepath.Join(sourceDir, "rates.db"))
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"time"
+)
+
+// maxPrunedHistoryEntries is the maximum number of pruned entries remembered per coin+fiat pair
+// for HistoryDiff. Older ones are forgotten.
+const maxPrunedHistoryEntries = 10000
+
+// prunedRate is a historical rate removed from the history at prunedAt.
+type prunedRate struct {
+	rate     exchangeRate
+	prunedAt time.Time
+}
+
+// HistoryDelta is the change of the historical rates of a coin+fiat pair. See HistoryDiff.
+type HistoryDelta struct {
+	// NewEntries are the rates newer than the time of the diff, oldest first.
+	NewEntries []exchangeRate
+	// RemovedEntries are the rates pruned since the time of the diff, in the order they were pruned.
+	RemovedEntries []exchangeRate
+}
+
+// HistoryDiff returns the changes of the historical rates of the coin+fiat pair since the given
+// time, so that a client which cached the history at that time can sync incrementally.
+//
+// New entries are the ones with a timestamp after since. Entries backfilled into older gaps
+// are not included, see HistoryGaps. Removed entries are the ones pruned after since, e.g. by
+// WithMaxHistoryEntriesPerPair or SetHistoryGranularity; only the most recent
+// maxPrunedHistoryEntries of them are remembered.
+func (updater *RateUpdater) HistoryDiff(coin, fiat string, since time.Time) HistoryDelta {
+	key := coin + fiat
+	var delta HistoryDelta
+	updater.history.view(key, func(rates []exchangeRate) {
+		for i, rate := range rates {
+			if rate.timestamp.After(since) {
+				delta.NewEntries = append([]exchangeRate(nil), rates[i:]...)
+				return
+			}
+		}
+	})
+	updater.prunedMu.Lock()
+	defer updater.prunedMu.Unlock()
+	for _, pruned := range updater.pruned[key] {
+		if pruned.prunedAt.After(since) {
+			delta.RemovedEntries = append(delta.RemovedEntries, pruned.rate)
+		}
+	}
+	return delta
+}
+
+// recordPruned remembers the rates of the coin+fiat pair given as a key which are in before but
+// not in after, for HistoryDiff.
+func (updater *RateUpdater) recordPruned(key string, before, after []exchangeRate) {
+	kept := make(map[int64]struct{}, len(after))
+	for _, rate := range after {
+		kept[rate.timestamp.Unix()] = struct{}{}
+	}
+	now := updater.clock()
+	updater.prunedMu.Lock()
+	defer updater.prunedMu.Unlock()
+	pruned := updater.pruned[key]
+	for _, rate := range before {
+		if _, ok := kept[rate.timestamp.Unix()]; !ok {
+			pruned = append(pruned, prunedRate{rate: rate, prunedAt: now})
+		}
+	}
+	if n := len(pruned) - maxPrunedHistoryEntries; n > 0 {
+		pruned = append([]prunedRate(nil), pruned[n:]...)
+	}
+	if updater.pruned == nil {
+		updater.pruned = make(map[string][]prunedRate)
+	}
+	updater.pruned[key] = pruned
+}
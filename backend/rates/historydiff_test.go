@@ -0,0 +1,48 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryDiff(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Unix(1700000000, 0)
+	updater := NewRateUpdater(nil, "/dev/null",
+		WithMaxHistoryEntriesPerPair(100),
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	start := time.Unix(1598918400, 0)
+	rates := ratesEvery(start, time.Hour, 100)
+	updater.storeHistory("btc", "USD", rates)
+
+	delta := updater.HistoryDiff("btc", "USD", time.Time{})
+	assert.Equal(t, rates, delta.NewEntries)
+	assert.Empty(t, delta.RemovedEntries)
+
+	// A client synced up to the 90th entry.
+	syncedAt := rates[89].timestamp
+	now = now.Add(time.Hour)
+	newRates := ratesEvery(start.Add(100*time.Hour), time.Hour, 5)
+	updater.storeHistory("btc", "USD", newRates)
+
+	delta = updater.HistoryDiff("btc", "USD", syncedAt)
+	require.Len(t, delta.NewEntries, 15)
+	assert.Equal(t, rates[90:], delta.NewEntries[:10])
+	assert.Equal(t, newRates, delta.NewEntries[10:])
+	// The oldest 10 were pruned to make room.
+	assert.Equal(t, rates[:10], updater.HistoryDiff("btc", "USD", now.Add(-time.Minute)).RemovedEntries)
+	// Pruned before the time of the diff.
+	assert.Empty(t, updater.HistoryDiff("btc", "USD", now).RemovedEntries)
+
+	// Downsampling prunes all but the last rate per day.
+	now = now.Add(time.Hour)
+	updater.SetHistoryGranularity("btc", "USD", GranularityDaily)
+	delta = updater.HistoryDiff("btc", "USD", now.Add(-time.Minute))
+	assert.Len(t, delta.RemovedEntries, 95-len(updater.history.all()["btcUSD"]))
+	assert.Empty(t, updater.HistoryDiff("eth", "USD", time.Time{}))
+}
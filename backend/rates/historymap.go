@@ -0,0 +1,86 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import "sync"
+
+// historyMap holds historical exchange rates in asc order, keyed by coin+fiat pair, guarded by
+// a single lock.
+//
+// The slices passed to the view and update callbacks must not be retained
+// after the callbacks return.
+type historyMap struct {
+	mu   sync.RWMutex
+	data map[string][]exchangeRate
+}
+
+// newHistoryMap returns a historyMap initialized with a copy of the given data, which may be nil.
+func newHistoryMap(data map[string][]exchangeRate) *historyMap {
+	h := &historyMap{data: make(map[string][]exchangeRate, len(data))}
+	for key, rates := range data {
+		h.data[key] = rates
+	}
+	return h
+}
+
+// view calls fn with the rates of the given key while holding the read lock.
+// The rates are nil if the key doesn't exist.
+func (h *historyMap) view(key string, fn func(rates []exchangeRate)) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	fn(h.data[key])
+}
+
+// get returns the rates of the given key, nil if the key doesn't exist. Unlike in view, the
+// rates may be retained but must not be modified.
+func (h *historyMap) get(key string) []exchangeRate {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.data[key]
+}
+
+// update replaces the rates of the given key with the result of fn while holding the
+// write lock. The rates passed to fn are nil if the key doesn't exist.
+func (h *historyMap) update(key string, fn func(rates []exchangeRate) []exchangeRate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data[key] = fn(h.data[key])
+}
+
+// exists reports whether the given key is present, even if it has no rates.
+func (h *historyMap) exists(key string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.data[key]
+	return ok
+}
+
+// delete removes the given key and all of its rates.
+func (h *historyMap) delete(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.data, key)
+}
+
+// all returns a shallow copy of the whole history, keyed by coin+fiat pair.
+func (h *historyMap) all() map[string][]exchangeRate {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	result := make(map[string][]exchangeRate, len(h.data))
+	for key, rates := range h.data {
+		result[key] = rates
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package rates
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryMap(t *testing.T) {
+	h := newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {{value: 1, timestamp: time.Unix(1, 0)}},
+	})
+	assert.True(t, h.exists("btcUSD"))
+	assert.False(t, h.exists("ltcUSD"))
+
+	h.update("ltcUSD", func(rates []exchangeRate) []exchangeRate {
+		assert.Nil(t, rates)
+		return append(rates, exchangeRate{value: 2, timestamp: time.Unix(2, 0)})
+	})
+	h.view("ltcUSD", func(rates []exchangeRate) {
+		require.Len(t, rates, 1)
+		assert.Equal(t, 2.0, rates[0].value)
+	})
+	assert.Len(t, h.all(), 2)
+
+	h.delete("btcUSD")
+	assert.False(t, h.exists("btcUSD"))
+	h.view("btcUSD", func(rates []exchangeRate) { assert.Nil(t, rates) })
+	assert.NotContains(t, h.all(), "btcUSD")
+}
+
+// TestHistoryMapConcurrent is meant to be run with -race.
+func TestHistoryMapConcurrent(t *testing.T) {
+	h := newHistoryMap(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("coin%dUSD", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.update(key, func(rates []exchangeRate) []exchangeRate {
+					return append(rates, exchangeRate{value: float64(j)})
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				h.view(key, func(rates []exchangeRate) { _ = len(rates) })
+				h.all()
+			}
+		}()
+	}
+	wg.Wait()
+	for key, rates := range h.all() {
+		assert.Len(t, rates, 100, key)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
+)
+
+// HistoryStore persists the historical rates of the coin+fiat pairs in buckets named by the
+// pair, e.g. "btcUSD". It is the database cache of the historical rates, see WithHistoryStore.
+// Implementations must be safe for concurrent use.
+type HistoryStore interface {
+	// ReadBucket returns the rates of a bucket sorted by timestamp in ascending order,
+	// or nil if the bucket doesn't exist.
+	ReadBucket(name string) ([]exchangeRate, error)
+	// WriteBucket replaces the rates of a bucket, creating it if needed.
+	// entries must be sorted by timestamp in ascending order.
+	WriteBucket(name string, entries []exchangeRate) error
+	// DeleteBucket removes a bucket. Removing a bucket which doesn't exist is not an error.
+	DeleteBucket(name string) error
+	// ListBuckets returns the names of all buckets in no particular order. They may include
+	// buckets of other data than historical rates, which callers skip, see splitHistoryKey.
+	ListBuckets() ([]string, error)
+}
+
+// granularityStore is implemented by HistoryStores persisting the Granularity of the rates.
+type granularityStore interface {
+	// storedGranularity returns the granularity stored with a bucket and whether there is any.
+	storedGranularity(name string) (Granularity, bool, error)
+}
+
+// WithHistoryStore makes the updater keep the database cache of the historical rates in
+// store instead of the bbolt database in the directory passed to NewRateUpdater, e.g. a
+// MemoryHistoryStore in tests. Other data, such as the API call count, is still kept in the
+// bbolt database.
+func WithHistoryStore(store HistoryStore) Option {
+	return func(updater *RateUpdater) {
+		updater.historyStore = store
+	}
+}
+
+// BBoltHistoryStore is the HistoryStore of a bbolt database, using the schema versions
+// described at historySchemaV1. Buckets are written in version 3 along with their granularity.
+// Version 1 and 2 buckets are migrated to version 3 when read.
+type BBoltHistoryStore struct {
+	db *bbolt.DB
+	// granularity returns the granularity to store with the rates of a bucket.
+	granularity func(name string) Granularity
+	log         *logrus.Entry
+}
+
+// NewBBoltHistoryStore returns a HistoryStore keeping the rates in db. Failed migrations are
+// logged to log, e.g. the one passed to WithLogger. The rates are stored with GranularityHourly.
+func NewBBoltHistoryStore(db *bbolt.DB, log *logrus.Entry) *BBoltHistoryStore {
+	return &BBoltHistoryStore{
+		db:          db,
+		granularity: func(string) Granularity { return GranularityHourly },
+		log:         log,
+	}
+}
+
+// ReadBucket implements HistoryStore. A version 1 or 2 bucket is migrated to version 3 unless
+// the database is read-only. Failing to do so is not an error since the data could still be
+// read.
+func (store *BBoltHistoryStore) ReadBucket(name string) ([]exchangeRate, error) {
+	var rates []exchangeRate
+	var schema int
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			return nil
+		}
+		schema = historyBucketSchema(bucket)
+		var err error
+		rates, err = readHistoryBucket(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if schema != historySchemaV3 && len(rates) > 0 && !store.db.IsReadOnly() {
+		if err := store.WriteBucket(name, rates); err != nil {
+			store.log.Errorf("migrating history bucket %q to schema version 3: %v", name, err)
+		}
+	}
+	return rates, nil
+}
+
+// WriteBucket implements HistoryStore.
+func (store *BBoltHistoryStore) WriteBucket(name string, entries []exchangeRate) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		return writeHistoryBucket(tx, name, entries, store.granularity(name))
+	})
+}
+
+// DeleteBucket implements HistoryStore.
+func (store *BBoltHistoryStore) DeleteBucket(name string) error {
+	return store.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.DeleteBucket([]byte(name)); err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+}
+
+// ListBuckets implements HistoryStore.
+func (store *BBoltHistoryStore) ListBuckets() ([]string, error) {
+	var names []string
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+	return names, err
+}
+
+// storedGranularity implements granularityStore.
+func (store *BBoltHistoryStore) storedGranularity(name string) (Granularity, bool, error) {
+	var granularity Granularity
+	var ok bool
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(name)); bucket != nil {
+			granularity, ok = readHistoryGranularity(bucket)
+		}
+		return nil
+	})
+	return granularity, ok, err
+}
+
+// MemoryHistoryStore is a HistoryStore keeping the rates in memory, for tests.
+// The zero value is ready to use.
+type MemoryHistoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string][]exchangeRate
+}
+
+// NewMemoryHistoryStore returns an empty MemoryHistoryStore.
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{}
+}
+
+// ReadBucket implements HistoryStore.
+func (store *MemoryHistoryStore) ReadBucket(name string) ([]exchangeRate, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	rates, ok := store.buckets[name]
+	if !ok {
+		return nil, nil
+	}
+	return append([]exchangeRate{}, rates...), nil
+}
+
+// WriteBucket implements HistoryStore.
+func (store *MemoryHistoryStore) WriteBucket(name string, entries []exchangeRate) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.buckets == nil {
+		store.buckets = make(map[string][]exchangeRate)
+	}
+	store.buckets[name] = append([]exchangeRate{}, entries...)
+	return nil
+}
+
+// DeleteBucket implements HistoryStore.
+func (store *MemoryHistoryStore) DeleteBucket(name string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.buckets, name)
+	return nil
+}
+
+// ListBuckets implements HistoryStore.
+func (store *MemoryHistoryStore) ListBuckets() ([]string, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	names := make([]string, 0, len(store.buckets))
+	for name := range store.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// historyKeys returns the names of the buckets of store holding historical rates.
+func historyKeys(store HistoryStore) ([]string, error) {
+	names, err := store.ListBuckets()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, name := range names {
+		if _, _, ok := splitHistoryKey(name); ok {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
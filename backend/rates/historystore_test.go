@@ -0,0 +1,91 @@
+package rates
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryStores(t *testing.T) {
+	dbdir := test.TstTempDir("historystore")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	db, err := openRatesDB(dbdir, defaultBBoltOptions())
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+
+	start := time.Unix(1598918400, 0)
+	for name, store := range map[string]HistoryStore{
+		"bbolt":  NewBBoltHistoryStore(db, newTestLogger()),
+		"memory": NewMemoryHistoryStore(),
+	} {
+		rates, err := store.ReadBucket("btcUSD")
+		require.NoError(t, err, name)
+		assert.Nil(t, rates, name)
+		names, err := store.ListBuckets()
+		require.NoError(t, err, name)
+		assert.Empty(t, names, name)
+
+		require.NoError(t, store.WriteBucket("btcUSD", ratesEvery(start, time.Hour, 3)), name)
+		require.NoError(t, store.WriteBucket("ethEUR", ratesEvery(start, time.Hour, 2)), name)
+		require.NoError(t, store.WriteBucket("btcUSD", ratesEvery(start, time.Hour, 4)), name)
+		rates, err = store.ReadBucket("btcUSD")
+		require.NoError(t, err, name)
+		assert.Equal(t, ratesEvery(start, time.Hour, 4), rates, name)
+		names, err = store.ListBuckets()
+		require.NoError(t, err, name)
+		assert.ElementsMatch(t, []string{"btcUSD", "ethEUR"}, names, name)
+
+		require.NoError(t, store.DeleteBucket("ethEUR"), name)
+		require.NoError(t, store.DeleteBucket("ethEUR"), name)
+		names, err = store.ListBuckets()
+		require.NoError(t, err, name)
+		assert.Equal(t, []string{"btcUSD"}, names, name)
+		require.NoError(t, store.DeleteBucket("btcUSD"), name)
+	}
+}
+
+func TestMemoryHistoryStoreUpdater(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	now := start.Add(10 * 24 * time.Hour)
+	store := NewMemoryHistoryStore()
+	updater := NewRateUpdater(nil, "/dev/null",
+		WithHistoryStore(store),
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+
+	updater.storeHistory("btc", "USD", ratesEvery(start, 24*time.Hour, 10))
+	require.NoError(t, store.WriteBucket("ethEUR", ratesEvery(start, 24*time.Hour, 10)))
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	assert.Equal(t, ratesEvery(start, 24*time.Hour, 10), rates)
+
+	pairs, err := updater.ListTrackedPairs(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pairs, 2)
+	assert.Equal(t, "btc", pairs[0].Coin)
+	assert.Equal(t, "eth", pairs[1].Coin)
+
+	removed, err := updater.PruneHistory(5 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 10, removed)
+	for _, key := range []string{"btcUSD", "ethEUR"} {
+		rates, err := store.ReadBucket(key)
+		require.NoError(t, err)
+		assert.Equal(t, ratesEvery(start, 24*time.Hour, 10)[5:], rates, key)
+	}
+
+	removed, err = updater.CompactHistory("eth", "EUR", 0, 48*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	rates, err = store.ReadBucket("ethEUR")
+	require.NoError(t, err)
+	assert.Len(t, rates, 3)
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/gregjones/httpcache"
+)
+
+// MemoryHTTPCache is an httpcache.Cache keeping a limited number of responses in memory,
+// evicting the least recently used one once full.
+type MemoryHTTPCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	// entries maps the keys to their elements in lru.
+	entries map[string]*list.Element
+	// lru holds the entries, the most recently used one first.
+	lru *list.List
+}
+
+type memoryHTTPCacheEntry struct {
+	key           string
+	responseBytes []byte
+}
+
+// NewMemoryHTTPCache returns an empty MemoryHTTPCache keeping at most maxEntries responses,
+// which must be positive.
+func NewMemoryHTTPCache(maxEntries int) *MemoryHTTPCache {
+	return &MemoryHTTPCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get implements httpcache.Cache.
+func (c *MemoryHTTPCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*memoryHTTPCacheEntry).responseBytes, true
+}
+
+// Set implements httpcache.Cache.
+func (c *MemoryHTTPCache) Set(key string, responseBytes []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*memoryHTTPCacheEntry).responseBytes = responseBytes
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&memoryHTTPCacheEntry{key: key, responseBytes: responseBytes})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Remove(c.lru.Back()).(*memoryHTTPCacheEntry)
+		delete(c.entries, oldest.key)
+	}
+}
+
+// Delete implements httpcache.Cache.
+func (c *MemoryHTTPCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// WithHTTPCache makes the updater cache the responses of the API in store, e.g. a
+// MemoryHTTPCache, using httpcache.Transport. The responses are cached as long as allowed by
+// their Cache-Control header, and stale ones with an ETag or Last-Modified header are
+// revalidated with a conditional request. Fresh cached responses are used without waiting
+// for the rate limit and aren't counted in the monthly call budget, see
+// WithMonthlyCallBudget. The http.Client passed to NewRateUpdater is not modified.
+func WithHTTPCache(store httpcache.Cache) Option {
+	return func(updater *RateUpdater) {
+		updater.httpCache = store
+	}
+}
+
+// freshCachedResponse returns the response to req cached with WithHTTPCache if it can be used
+// without a request to the API, or nil otherwise.
+func (updater *RateUpdater) freshCachedResponse(req *http.Request) *http.Response {
+	probe := &cacheProbe{}
+	transport := &httpcache.Transport{Cache: readOnlyCache{updater.httpCache}, Transport: probe}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil
+	}
+	if probe.missed {
+		// A stale response returned because of the failed request, see stale-if-error.
+		res.Body.Close() //nolint:errcheck
+		return nil
+	}
+	return res
+}
+
+// cacheProbe is the transport of freshCachedResponse, failing all requests the cache can't
+// answer by itself.
+type cacheProbe struct {
+	missed bool
+}
+
+func (probe *cacheProbe) RoundTrip(*http.Request) (*http.Response, error) {
+	probe.missed = true
+	return nil, errp.New("response not cached")
+}
+
+// readOnlyCache is the cache of freshCachedResponse. It doesn't evict the responses on the
+// requests failed by cacheProbe, so that stale ones can still be revalidated.
+type readOnlyCache struct {
+	httpcache.Cache
+}
+
+func (readOnlyCache) Set(string, []byte) {}
+
+func (readOnlyCache) Delete(string) {}
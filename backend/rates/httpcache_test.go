@@ -0,0 +1,132 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const httpCacheTestBody = `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`
+
+func TestWithHTTPCache(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests int32
+	date := time.Now()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Date", date.UTC().Format(http.TimeFormat))
+		fmt.Fprintln(w, httpCacheTestBody)
+	}))
+	defer ts.Close()
+	client := &http.Client{}
+	// The second request to the API would wait for an hour and exceed the call budget.
+	updater := NewRateUpdater(client, "/dev/null",
+		WithHTTPCache(NewMemoryHTTPCache(10)),
+		WithMonthlyCallBudget(1),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Hour)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	assert.Nil(t, client.Transport, "client modified")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	updater.updateLast(ctx)
+	require.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Within max-age, the cached response is used without a request.
+	updater.last = nil
+	updater.updateLast(ctx)
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, 1, updater.RemainingBudget().CallsThisMonth)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestWithHTTPCacheStale(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Header().Set("Date", time.Now().Add(-2*time.Minute).UTC().Format(http.TimeFormat))
+		fmt.Fprintln(w, httpCacheTestBody)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithHTTPCache(NewMemoryHTTPCache(10)),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	for i := 0; i < 2; i++ {
+		updater.updateLast(context.Background())
+		assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, 2, updater.RemainingBudget().CallsThisMonth)
+}
+
+func TestWithHTTPCacheRevalidate(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests, notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Etag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprintln(w, httpCacheTestBody)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithHTTPCache(NewMemoryHTTPCache(10)),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	for i := 0; i < 2; i++ {
+		updater.last = nil
+		updater.updateLast(context.Background())
+		assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+}
+
+func TestMemoryHTTPCache(t *testing.T) {
+	cache := NewMemoryHTTPCache(2)
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	// Using a makes b the least recently used entry.
+	value, ok := cache.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("1"), value)
+	cache.Set("c", []byte("3"))
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+
+	cache.Set("a", []byte("4"))
+	value, _ = cache.Get("a")
+	assert.Equal(t, []byte("4"), value)
+	cache.Delete("a")
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+	value, ok = cache.Get("c")
+	require.True(t, ok)
+	assert.Equal(t, []byte("3"), value)
+}
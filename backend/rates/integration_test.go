@@ -0,0 +1,86 @@
+//go:build integration
+
+package rates
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The integration tests query the real CoinGecko API with a demo API key. They are excluded
+// from regular test runs by the integration build tag. See README.md for how to run them.
+
+// newIntegrationRateUpdater returns an updater using the CoinGecko demo API with the key in the
+// COINGECKO_API_KEY env var, or skips the test if it is not set.
+func newIntegrationRateUpdater(t *testing.T, dbdir string) *RateUpdater {
+	t.Helper()
+	apiKey := os.Getenv("COINGECKO_API_KEY")
+	if apiKey == "" {
+		t.Skip("COINGECKO_API_KEY not set")
+	}
+	updater := NewRateUpdater(http.DefaultClient, dbdir,
+		WithCoinGeckoAPIKey(apiKey, CoinGeckoTierDemo), WithLogger(newTestLogger()))
+	t.Cleanup(updater.Stop)
+	return updater
+}
+
+func TestIntegration_UpdateLast(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := newIntegrationRateUpdater(t, "/dev/null")
+	updater.updateLast(context.Background())
+	require.Empty(t, updater.Diagnostics().LastFetchError)
+
+	latest := updater.LatestPrice()
+	for _, coin := range strings.Split(simplePriceAllIDs, ",") {
+		unit := geckoCoinToUnit[coin]
+		for _, geckoFiat := range strings.Split(simplePriceAllCurrencies, ",") {
+			fiat := fromGeckoFiat[geckoFiat]
+			assert.Positive(t, latest[unit][fiat], "%s/%s", unit, fiat)
+		}
+	}
+}
+
+func TestIntegration_HistoricalPriceAt(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestIntegration_HistoricalPriceAt")
+	defer os.RemoveAll(dbdir)
+	updater := newIntegrationRateUpdater(t, dbdir)
+
+	weekAgo := time.Now().Add(-7 * 24 * time.Hour)
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	require.Eventually(t, func() bool {
+		earliest := updater.HistoryEarliestTimestamp("btc", "USD")
+		return !earliest.IsZero() && earliest.Before(weekAgo)
+	}, time.Minute, time.Second, "backfilling the history")
+	assert.Positive(t, updater.HistoricalPriceAt("btc", "USD", weekAgo))
+}
+
+func TestIntegration_StartCurrentRates(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := newIntegrationRateUpdater(t, "/dev/null")
+	events := make(chan struct{}, 1)
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == RatesEventSubject {
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	})
+
+	updater.StartCurrentRates()
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rates event within 5s")
+	}
+}
@@ -0,0 +1,177 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// updaterCreatedBy identifies goroutines started by RateUpdater methods in a stack trace.
+// These are expected to exit after the updater is stopped.
+const updaterCreatedBy = "created by github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates.(*RateUpdater)."
+
+// newTestLogger returns a logger discarding all output, to keep the test output readable.
+func newTestLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	return logrus.NewEntry(logger)
+}
+
+// updaterGoroutines returns stack traces of all goroutines started by a RateUpdater.
+func updaterGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var result []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, updaterCreatedBy) {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// findLeakedGoroutines waits for the updater goroutines to exit, which may happen shortly
+// after RateUpdater.Stop returns, and returns the stack traces of those still running
+// after the timeout.
+func findLeakedGoroutines(timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		leaked := updaterGoroutines()
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			return leaked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// verifyNoLeakedGoroutines fails the test if any updater goroutines are still running.
+// This is a lightweight equivalent of go.uber.org/goleak limited to this package. Tests
+// creating an updater defer it first, so that it runs after the updater is stopped.
+func verifyNoLeakedGoroutines(t *testing.T) {
+	t.Helper()
+	if leaked := findLeakedGoroutines(time.Second); len(leaked) > 0 {
+		t.Errorf("%d leaked goroutines:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+	}
+}
+
+// TestMain also checks for leaked goroutines once after all tests, catching those of updaters
+// created outside of a test function, e.g. by examples.
+func TestMain(m *testing.M) {
+	test.TstSetupLogging()
+	code := m.Run()
+	if code == 0 {
+		if leaked := findLeakedGoroutines(time.Second); len(leaked) > 0 {
+			fmt.Fprintf(os.Stderr, "%d leaked goroutines:\n\n%s\n", len(leaked), strings.Join(leaked, "\n\n"))
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+func TestStopNoLeakedGoroutines(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestStopNoLeakedGoroutines")
+	defer os.RemoveAll(dbdir)
+
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
+	updater.coingeckoURL = "unused" // avoid hitting real API
+	updater.StartCurrentRates()
+	updater.ReconfigureHistory([]string{"btc", "ltc"}, []string{"USD", "EUR"})
+	require.Len(t, updaterGoroutines(), 1+2*4)
+
+	// Removing pairs stops their goroutines.
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	updater.Stop()
+}
+
+func TestStopAndWait(t *testing.T) {
+	// Wait for the goroutines of updaters of previous tests, which may be exiting still.
+	require.Empty(t, findLeakedGoroutines(time.Second))
+	dbdir := test.TstTempDir("TestStopAndWait")
+	defer os.RemoveAll(dbdir)
+
+	updater := NewRateUpdater(http.DefaultClient, dbdir, WithLogger(newTestLogger()))
+	updater.coingeckoURL = "unused" // avoid hitting real API
+	updater.StartCurrentRates()
+	updater.ReconfigureHistory([]string{"btc", "ltc"}, []string{"USD", "EUR"})
+	require.NoError(t, updater.StopAndWait(context.Background()))
+	// The goroutine of StopAndWait waiting for the others may still be exiting.
+	for _, g := range updaterGoroutines() {
+		require.Contains(t, g, updaterCreatedBy+"StopAndWait")
+	}
+}
+
+func TestStopAndWaitDeadline(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	release := make(chan struct{})
+	updater.goTracked(func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, updater.StopAndWait(ctx))
+	close(release)
+}
+
+// historyGoroutineIDs returns the IDs of the running historyUpdateLoop goroutines.
+func historyGoroutineIDs() map[string]bool {
+	ids := make(map[string]bool)
+	for _, g := range updaterGoroutines() {
+		if strings.Contains(g, "(*RateUpdater).historyUpdateLoop") {
+			// The first line is "goroutine <id> [<state>]:".
+			ids[strings.Fields(g)[1]] = true
+		}
+	}
+	return ids
+}
+
+func TestReconfigureHistoryKeepsUnchangedPairs(t *testing.T) {
+	require.Empty(t, findLeakedGoroutines(time.Second))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	updater.coingeckoURL = "unused" // avoid hitting real API
+	defer func() { require.NoError(t, updater.StopAndWait(context.Background())) }()
+
+	// waitForIDs waits for n historyUpdateLoop goroutines to run, which may take a moment
+	// after they were started, and returns their IDs.
+	waitForIDs := func(n int) map[string]bool {
+		var ids map[string]bool
+		require.Eventually(t, func() bool {
+			ids = historyGoroutineIDs()
+			return len(ids) == n
+		}, time.Second, time.Millisecond)
+		return ids
+	}
+
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	btcUSD := waitForIDs(1)
+
+	updater.ReconfigureHistory([]string{"btc", "ltc"}, []string{"USD"})
+	withLTC := waitForIDs(2)
+	for id := range btcUSD {
+		assert.True(t, withLTC[id], "btcUSD goroutine %s restarted", id)
+	}
+
+	// Removing btcUSD stops only its goroutine.
+	updater.ReconfigureHistory([]string{"ltc"}, []string{"USD"})
+	for id := range waitForIDs(1) {
+		assert.True(t, withLTC[id] && !btcUSD[id], "ltcUSD goroutine %s restarted", id)
+	}
+}
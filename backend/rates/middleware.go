@@ -0,0 +1,416 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFetchResponseSize is the maximum size of a response body returned by fetchHTTP.
+// The largest response is the coins list of FetchSupportedCoins with more than 10k coins.
+const maxFetchResponseSize = 8 << 20
+
+// defaultFetchTimeout is the timeout of a single request, unless set by withFetchTimeout.
+const defaultFetchTimeout = 10 * time.Second
+
+// FetchFunc makes a GET request to a CoinGecko API endpoint, the full URL including the query,
+// and returns the response body. A response status other than 200 OK is an error.
+// The returned body may be shared, e.g. by CachingMiddleware, and must not be modified.
+type FetchFunc func(ctx context.Context, endpoint string) ([]byte, error)
+
+// Middleware wraps a FetchFunc to add behavior to all requests of a RateUpdater,
+// similar to net/http handler middlewares. See WithMiddleware.
+type Middleware func(next FetchFunc) FetchFunc
+
+// WithMiddleware wraps all requests of the updater with the middlewares. The first one is the
+// outermost, i.e. it is called first and its next func calls the second one, and so on.
+// The innermost FetchFunc waits for the rate limit of the CoinGecko API and makes the request,
+// so each request of e.g. RetryMiddleware is rate limited, while responses of
+// CachingMiddleware are not. The option can be given multiple times, appending the middlewares.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(updater *RateUpdater) {
+		updater.middlewares = append(updater.middlewares, mw...)
+	}
+}
+
+// WithContextEnricher makes the updater call fn with each request to the API and the context
+// of the caller right before it is sent, after waiting for the rate limit. The returned request
+// is sent instead, e.g. with an X-Correlation-ID header taken from the context for
+// distributed tracing. fn must not return nil.
+func WithContextEnricher(fn func(req *http.Request, ctx context.Context) *http.Request) Option {
+	return func(updater *RateUpdater) {
+		updater.contextEnricher = fn
+	}
+}
+
+// WithTransport makes the updater send its requests with transport instead of the transport of
+// the HTTP client passed to NewRateUpdater, keeping the other settings of the client, e.g. its
+// timeout. This allows tests to intercept all requests, e.g. with a
+// testutil.RecordingRoundTripper, and together with SetCoingeckoURL to run without network.
+// A cache configured with WithHTTPCache wraps transport.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(updater *RateUpdater) {
+		updater.transport = transport
+	}
+}
+
+// chainMiddlewares wraps fetch with all middlewares, the first one being the outermost.
+func chainMiddlewares(fetch FetchFunc, middlewares []Middleware) FetchFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		fetch = middlewares[i](fetch)
+	}
+	return fetch
+}
+
+type fetchTimeoutKey struct{}
+
+// withFetchTimeout returns a context making fetchHTTP time out each request after timeout
+// instead of defaultFetchTimeout.
+func withFetchTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, fetchTimeoutKey{}, timeout)
+}
+
+// fetchHTTP is the innermost FetchFunc, abiding the rate limit of the CoinGecko API.
+// The timeout of the request starts once the rate limit allows it; see withFetchTimeout.
+// It makes a single request, or none if a fresh response is cached, see WithHTTPCache.
+// Responses with a status set with WithRetryableStatusCodes are retried by
+// statusRetryMiddleware wrapping it.
+func (updater *RateUpdater) fetchHTTP(ctx context.Context, endpoint string) (_ []byte, err error) {
+	if m := updater.goMetrics.Load(); m != nil {
+		start := updater.clock()
+		defer func() { m.recordFetch(updater.history, updater.clock().Sub(start), err) }()
+	}
+	req, err := updater.newGeckoRequest(endpoint)
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if updater.httpCache != nil {
+		if res := updater.freshCachedResponse(req); res != nil {
+			defer res.Body.Close() //nolint:errcheck
+			return updater.readResponse(ctx, res)
+		}
+	}
+	timeout, ok := ctx.Value(fetchTimeoutKey{}).(time.Duration)
+	if !ok {
+		timeout = defaultFetchTimeout
+	}
+	var body []byte
+	callErr := updater.geckoCall(ctx, req.URL.Path, func() (callErr error) {
+		if err := updater.countAPICall(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		req := req.WithContext(ctx)
+		if updater.contextEnricher != nil {
+			req = updater.contextEnricher(req, ctx)
+		}
+		start := updater.clock()
+		statusCode := 0
+		defer func() { updater.audit(start, req.URL.String(), statusCode, callErr) }()
+		res, err := updater.httpClient.Do(req)
+		if err != nil {
+			return errp.WithStack(err)
+		}
+		defer res.Body.Close() //nolint:errcheck
+		statusCode = res.StatusCode
+		updater.adaptRateLimit(res)
+		if res.StatusCode == http.StatusTooManyRequests {
+			updater.telemetry(TelemetryRateLimited, map[string]interface{}{"endpoint": req.URL.Path})
+		}
+		body, err = updater.readResponse(ctx, res)
+		return err
+	})
+	if callErr != nil {
+		return nil, callErr
+	}
+	return body, nil
+}
+
+// readResponse returns the body of a successful response of fetchHTTP, verifying it if
+// WithTrustChain is set.
+func (updater *RateUpdater) readResponse(ctx context.Context, res *http.Response) ([]byte, error) {
+	if res.StatusCode != http.StatusOK {
+		return nil, errp.WithStack(&statusError{
+			statusCode: res.StatusCode,
+			retryAfter: updater.retryAfter(res),
+		})
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxFetchResponseSize+1))
+	if err != nil {
+		return nil, errp.WithStack(err)
+	}
+	if len(body) > maxFetchResponseSize {
+		return nil, errp.Newf("response too long (> %d bytes)", maxFetchResponseSize)
+	}
+	updater.verifyResponse(ctx, res, body)
+	return body, nil
+}
+
+// maxStatusRetries is the maximum number of retries of a request with a retryable status.
+// See WithRetryableStatusCodes.
+const maxStatusRetries = 3
+
+// defaultStatusRetryBackoff is the wait before the first retry of a request with a retryable
+// status, doubled for each further one. See WithRetryableStatusCodes.
+const defaultStatusRetryBackoff = time.Second
+
+// WithRetryableStatusCodes makes the updater retry requests responded with one of the HTTP
+// status codes, e.g. 429, 502 and 503, right away instead of failing, e.g. the update of the
+// latest rates until the next interval. A request is retried up to 3 times, waiting 1s before
+// the first retry and twice as long before each further one, or as long as requested by the
+// Retry-After header of a 429 response if longer. Each retry also waits for the rate limit,
+// like all requests. The retries are made by the innermost middleware, see
+// statusRetryMiddleware, and a RetryMiddleware added with WithMiddleware doesn't retry a
+// request they gave up on.
+func WithRetryableStatusCodes(codes []int) Option {
+	return func(updater *RateUpdater) {
+		updater.retryableStatusCodes = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			updater.retryableStatusCodes[code] = true
+		}
+	}
+}
+
+// statusError is the error of a response with a status other than 200 OK.
+type statusError struct {
+	statusCode int
+	// retryAfter is the wait requested by the Retry-After header of a 429 response, zero if
+	// there is none.
+	retryAfter time.Duration
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("bad response code %d", err.statusCode)
+}
+
+// retryAfter returns the wait requested by the Retry-After header of res, in seconds or as an
+// HTTP date, if it is a 429 response. It is zero otherwise, or if the header is invalid.
+func (updater *RateUpdater) retryAfter(res *http.Response) time.Duration {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return 0
+	}
+	header := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	at, err := http.ParseTime(header)
+	if err != nil || !at.After(updater.clock()) {
+		return 0
+	}
+	return at.Sub(updater.clock())
+}
+
+// retriesExhaustedError is returned by statusRetryMiddleware for a request it gave up on, so
+// that RetryMiddleware doesn't retry it again.
+type retriesExhaustedError struct {
+	err error
+}
+
+func (err *retriesExhaustedError) Error() string {
+	return err.err.Error()
+}
+
+func (err *retriesExhaustedError) Unwrap() error {
+	return err.err
+}
+
+// statusRetryMiddleware is like RetryMiddleware, but it retries only requests responded with a
+// status set with WithRetryableStatusCodes, waiting between the attempts as documented there.
+// It is the innermost middleware, if any status codes are set, so that each attempt is a single
+// request.
+func (updater *RateUpdater) statusRetryMiddleware(next FetchFunc) FetchFunc {
+	return func(ctx context.Context, endpoint string) ([]byte, error) {
+		backoff := updater.statusRetryBackoff
+		for attempt := 0; ; attempt++ {
+			body, err := next(ctx, endpoint)
+			var statusErr *statusError
+			if err == nil || !errors.As(err, &statusErr) || !updater.retryableStatusCodes[statusErr.statusCode] {
+				return body, err
+			}
+			if attempt == maxStatusRetries {
+				return nil, &retriesExhaustedError{err: err}
+			}
+			wait := backoff
+			if statusErr.retryAfter > wait {
+				wait = statusErr.retryAfter
+			}
+			updater.log.WithError(err).Warningf("retrying %s in %v", endpoint, wait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-updater.timer.After(wait):
+			}
+			backoff *= 2
+		}
+	}
+}
+
+// LoggingMiddleware logs each request with its duration at debug level, and failed ones
+// with the error at error level.
+func LoggingMiddleware(log *logrus.Entry) Middleware {
+	return func(next FetchFunc) FetchFunc {
+		return func(ctx context.Context, endpoint string) ([]byte, error) {
+			start := time.Now()
+			body, err := next(ctx, endpoint)
+			entry := log.WithField("endpoint", endpoint).WithField("duration", time.Since(start))
+			if err != nil {
+				entry.WithError(err).Error("fetch failed")
+			} else {
+				entry.Debugf("fetched %d bytes", len(body))
+			}
+			return body, err
+		}
+	}
+}
+
+// FetchMetrics counts the requests passing through MetricsMiddleware.
+// It is safe for concurrent use. The zero value is ready to use.
+type FetchMetrics struct {
+	requests      atomic.Uint64
+	failures      atomic.Uint64
+	totalDuration atomic.Int64
+}
+
+// Requests returns the number of completed requests, including failed ones.
+func (m *FetchMetrics) Requests() uint64 {
+	return m.requests.Load()
+}
+
+// Failures returns the number of requests which returned an error.
+func (m *FetchMetrics) Failures() uint64 {
+	return m.failures.Load()
+}
+
+// TotalDuration returns the sum of the durations of all completed requests.
+func (m *FetchMetrics) TotalDuration() time.Duration {
+	return time.Duration(m.totalDuration.Load())
+}
+
+// MetricsMiddleware records each request in metrics.
+func MetricsMiddleware(metrics *FetchMetrics) Middleware {
+	return func(next FetchFunc) FetchFunc {
+		return func(ctx context.Context, endpoint string) ([]byte, error) {
+			start := time.Now()
+			body, err := next(ctx, endpoint)
+			metrics.totalDuration.Add(int64(time.Since(start)))
+			metrics.requests.Add(1)
+			if err != nil {
+				metrics.failures.Add(1)
+			}
+			return body, err
+		}
+	}
+}
+
+// RetryMiddleware makes up to maxAttempts requests until one succeeds, returning the error of
+// the last one if all fail. Requests are not retried once the context is done, nor if the
+// retries of WithRetryableStatusCodes gave up on them, so that the attempts don't multiply.
+// Values of maxAttempts less than 1 are treated as 1.
+func RetryMiddleware(maxAttempts int) Middleware {
+	return func(next FetchFunc) FetchFunc {
+		return func(ctx context.Context, endpoint string) ([]byte, error) {
+			var body []byte
+			var err error
+			for attempt := 0; attempt < maxAttempts || attempt == 0; attempt++ {
+				body, err = next(ctx, endpoint)
+				var exhausted *retriesExhaustedError
+				if err == nil || ctx.Err() != nil || errors.As(err, &exhausted) {
+					break
+				}
+			}
+			return body, err
+		}
+	}
+}
+
+// CachingMiddleware returns successful responses from memory for ttl after they were fetched,
+// keyed by endpoint. Expired responses are removed when a response is added.
+func CachingMiddleware(ttl time.Duration) Middleware {
+	return newResponseCache(ttl, time.Now).middleware
+}
+
+// responseCache holds the responses of CachingMiddleware.
+type responseCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]responseCacheEntry
+}
+
+type responseCacheEntry struct {
+	body []byte
+	// trusted is the trust result of the request, see withTrustResult.
+	trusted bool
+	expires time.Time
+}
+
+func newResponseCache(ttl time.Duration, now func() time.Time) *responseCache {
+	return &responseCache{ttl: ttl, now: now, entries: make(map[string]responseCacheEntry)}
+}
+
+// get returns the response cached for endpoint if it hasn't expired yet.
+func (cache *responseCache) get(endpoint string) (responseCacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[endpoint]
+	return entry, ok && cache.now().Before(entry.expires)
+}
+
+// add caches the response for endpoint, removing all expired ones, so that the responses of
+// endpoints requested only once, e.g. of historical rates, don't pile up.
+func (cache *responseCache) add(endpoint string, body []byte, trusted bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	now := cache.now()
+	for key, entry := range cache.entries {
+		if !now.Before(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[endpoint] = responseCacheEntry{body: body, trusted: trusted, expires: now.Add(cache.ttl)}
+}
+
+func (cache *responseCache) middleware(next FetchFunc) FetchFunc {
+	return func(ctx context.Context, endpoint string) ([]byte, error) {
+		if entry, ok := cache.get(endpoint); ok {
+			setTrustResult(ctx, entry.trusted)
+			return entry.body, nil
+		}
+		var trusted bool
+		body, err := next(withTrustResult(ctx, &trusted), endpoint)
+		if err != nil {
+			return nil, err
+		}
+		cache.add(endpoint, body, trusted)
+		setTrustResult(ctx, trusted)
+		return body, nil
+	}
+}
@@ -0,0 +1,371 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingFetch returns a FetchFunc returning the errs in order, then the body, and
+// a pointer to the number of calls.
+func countingFetch(body string, errs ...error) (FetchFunc, *int) {
+	var calls int
+	return func(ctx context.Context, endpoint string) ([]byte, error) {
+		calls++
+		if calls <= len(errs) {
+			return nil, errs[calls-1]
+		}
+		return []byte(body), nil
+	}, &calls
+}
+
+func TestWithMiddleware(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var order []string
+	named := func(name string) Middleware {
+		return func(next FetchFunc) FetchFunc {
+			return func(ctx context.Context, endpoint string) ([]byte, error) {
+				order = append(order, name)
+				return next(ctx, endpoint)
+			}
+		}
+	}
+	ts := newSimplePriceServer(t, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithMiddleware(named("a"), named("b")),
+		WithMiddleware(named("c")),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.updateLast(context.Background())
+	assert.Equal(t, []string{"a", "b", "c"}, order)
+	assert.Equal(t, 1.0, updater.LatestPrice()["BTC"]["USD"])
+}
+
+func TestFetchHTTP(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	body, err := updater.fetchHTTP(context.Background(), ts.URL+"/ok")
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	_, err = updater.fetchHTTP(context.Background(), ts.URL+"/missing")
+	require.EqualError(t, err, "bad response code 404")
+}
+
+func TestWithRetryableStatusCodes(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`))
+	}))
+	defer ts.Close()
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRetryableStatusCodes([]int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithClockFunc(clock.Now), WithTimer(clock), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updated := make(chan map[string]map[string]float64, 1)
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == RatesEventSubject {
+			updated <- event.Object.(map[string]map[string]float64)
+		}
+	})
+
+	updater.StartCurrentRates()
+	// Retried after 1s and 2s, instead of the next update a minute later.
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Second)
+	select {
+	case rates := <-updated:
+		assert.Equal(t, 20000.0, rates["BTC"]["USD"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("rates not updated")
+	}
+	assert.Equal(t, int32(3), requests.Load())
+}
+
+func TestWithRetryableStatusCodesGiveUp(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRetryableStatusCodes([]int{http.StatusServiceUnavailable}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.statusRetryBackoff = time.Millisecond
+
+	// Other status codes are not retried.
+	_, err := updater.fetch(context.Background(), ts.URL+"/error")
+	require.EqualError(t, err, "bad response code 500")
+	assert.Equal(t, int32(1), requests.Load())
+
+	requests.Store(0)
+	_, err = updater.fetch(context.Background(), ts.URL+"/unavailable")
+	require.EqualError(t, err, "bad response code 503")
+	assert.Equal(t, int32(1+maxStatusRetries), requests.Load())
+
+	// The wait for a retry ends with the context.
+	requests.Store(0)
+	updater.statusRetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = updater.fetch(ctx, ts.URL+"/unavailable")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, int32(1), requests.Load())
+}
+
+func TestWithRetryableStatusCodesRetryAfter(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer ts.Close()
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRetryableStatusCodes([]int{http.StatusTooManyRequests}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithClockFunc(clock.Now), WithTimer(clock), WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		body, err := updater.fetch(context.Background(), ts.URL+"/limited")
+		done <- result{body, err}
+	}()
+	// Retried after the 30s requested instead of the 1s backoff.
+	clock.BlockUntil(1)
+	clock.Advance(29 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("retried before Retry-After")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	res := <-done
+	require.NoError(t, res.err)
+	assert.Equal(t, "body", string(res.body))
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+// TestWithRetryableStatusCodesRetryMiddleware checks that a RetryMiddleware doesn't retry a
+// request given up on by the retries of WithRetryableStatusCodes, but still retries other errors.
+func TestWithRetryableStatusCodesRetryMiddleware(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 && r.URL.Path == "/flaky" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRetryableStatusCodes([]int{http.StatusServiceUnavailable}),
+		WithMiddleware(RetryMiddleware(3)),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.statusRetryBackoff = time.Millisecond
+
+	_, err := updater.fetch(context.Background(), ts.URL+"/unavailable")
+	require.EqualError(t, err, "bad response code 503")
+	assert.Equal(t, int32(1+maxStatusRetries), requests.Load())
+
+	// The 500 is retried by RetryMiddleware, the 503s only by the status retries.
+	requests.Store(0)
+	_, err = updater.fetch(context.Background(), ts.URL+"/flaky")
+	require.EqualError(t, err, "bad response code 503")
+	assert.Equal(t, int32(1+1+maxStatusRetries), requests.Load())
+}
+
+func TestWithContextEnricher(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	type correlationIDKey struct{}
+	var gotIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotIDs = append(gotIDs, r.Header.Get("X-Correlation-ID"))
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithContextEnricher(func(req *http.Request, ctx context.Context) *http.Request {
+			if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+				req.Header.Set("X-Correlation-ID", id)
+			}
+			return req
+		}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	ctx := context.WithValue(context.Background(), correlationIDKey{}, "abc-123")
+	_, err := updater.fetch(ctx, ts.URL+"/ok")
+	require.NoError(t, err)
+	_, err = updater.fetch(context.Background(), ts.URL+"/ok")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"abc-123", ""}, gotIDs)
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.DebugLevel
+	fetch, _ := countingFetch("body", errors.New("boom"))
+	fetch = LoggingMiddleware(logrus.NewEntry(logger))(fetch)
+
+	_, err := fetch(context.Background(), "http://example.com/a")
+	require.Error(t, err)
+	assert.Contains(t, out.String(), "level=error")
+	assert.Contains(t, out.String(), "boom")
+	assert.Contains(t, out.String(), "http://example.com/a")
+
+	out.Reset()
+	body, err := fetch(context.Background(), "http://example.com/b")
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Contains(t, out.String(), "level=debug")
+	assert.Contains(t, out.String(), "fetched 4 bytes")
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	var metrics FetchMetrics
+	fetch, _ := countingFetch("body", errors.New("boom"))
+	fetch = MetricsMiddleware(&metrics)(fetch)
+	for i := 0; i < 3; i++ {
+		_, _ = fetch(context.Background(), "endpoint")
+	}
+	assert.Equal(t, uint64(3), metrics.Requests())
+	assert.Equal(t, uint64(1), metrics.Failures())
+	assert.GreaterOrEqual(t, metrics.TotalDuration(), time.Duration(0))
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	boom := errors.New("boom")
+
+	fetch, calls := countingFetch("body", boom, boom)
+	body, err := RetryMiddleware(3)(fetch)(context.Background(), "endpoint")
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, 3, *calls)
+
+	fetch, calls = countingFetch("body", boom, boom, boom)
+	_, err = RetryMiddleware(3)(fetch)(context.Background(), "endpoint")
+	require.Equal(t, boom, err)
+	assert.Equal(t, 3, *calls)
+
+	// At least one attempt.
+	fetch, calls = countingFetch("body")
+	_, err = RetryMiddleware(0)(fetch)(context.Background(), "endpoint")
+	require.NoError(t, err)
+	assert.Equal(t, 1, *calls)
+
+	// No retries once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fetch, calls = countingFetch("body", context.Canceled)
+	_, err = RetryMiddleware(3)(fetch)(ctx, "endpoint")
+	require.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, *calls)
+}
+
+func TestCachingMiddleware(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1598918400, 0))
+	fetch, calls := countingFetch("body", errors.New("boom"))
+	fetch = newResponseCache(time.Minute, clock.Now).middleware(fetch)
+
+	// Errors are not cached.
+	_, err := fetch(context.Background(), "a")
+	require.Error(t, err)
+	body, err := fetch(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, 2, *calls)
+
+	clock.Advance(59 * time.Second)
+	body, err = fetch(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+	assert.Equal(t, 2, *calls)
+
+	// Keyed by endpoint.
+	_, err = fetch(context.Background(), "b")
+	require.NoError(t, err)
+	assert.Equal(t, 3, *calls)
+
+	clock.Advance(time.Second)
+	_, err = fetch(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, 4, *calls)
+}
+
+func TestCachingMiddlewareDropsExpired(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1598918400, 0))
+	cache := newResponseCache(time.Minute, clock.Now)
+	fetch, _ := countingFetch("body")
+	fetch = cache.middleware(fetch)
+
+	for _, endpoint := range []string{"a", "b", "c"} {
+		_, err := fetch(context.Background(), endpoint)
+		require.NoError(t, err)
+		clock.Advance(30 * time.Second)
+	}
+	// a and b expired by the time d is added.
+	_, err := fetch(context.Background(), "d")
+	require.NoError(t, err)
+	assert.Len(t, cache.entries, 2)
+	assert.Contains(t, cache.entries, "c")
+	assert.Contains(t, cache.entries, "d")
+}
@@ -21,7 +21,7 @@ import (
 // MockRateUpdater returns a rate updater mock. Remember to defer calling the Stop() method when using it.
 func MockRateUpdater() *RateUpdater {
 	updater := NewRateUpdater(nil, "/dev/null")
-	updater.history = map[string][]exchangeRate{
+	updater.history = newHistoryMap(map[string][]exchangeRate{
 		"btcUSD": {
 			{value: 1, timestamp: time.Unix(1598832062, 0)}, // 2020-08-31 00:01:02
 			{value: 2, timestamp: time.Unix(1598918700, 0)},
@@ -32,7 +32,7 @@ func MockRateUpdater() *RateUpdater {
 			{value: 4, timestamp: time.Date(2020, 8, 02, 23, 0, 0, 0, time.UTC)},
 			{value: 4, timestamp: time.Date(2020, 9, 02, 23, 0, 0, 0, time.UTC)},
 		},
-	}
+	})
 	updater.last = map[string]map[string]float64{
 		"BTC": {
 			"USD": 21.0,
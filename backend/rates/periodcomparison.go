@@ -0,0 +1,119 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// PeriodReturn is the price change of a coin/fiat pair in a period. See PeriodComparison.
+type PeriodReturn struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// StartPrice and EndPrice are the historical rates at Start and End.
+	StartPrice float64 `json:"startPrice"`
+	EndPrice   float64 `json:"endPrice"`
+	// Return is the relative price change (EndPrice - StartPrice) / StartPrice, e.g. 0.1 for
+	// a 10% increase.
+	Return float64 `json:"return"`
+	// HasData is false if the rate at Start or End is unavailable. Return is zero then.
+	HasData bool `json:"hasData"`
+}
+
+// PeriodComparisonReport compares the returns of a coin/fiat pair in two periods.
+// See PeriodComparison.
+type PeriodComparisonReport struct {
+	Coin    string       `json:"coin"`
+	Fiat    string       `json:"fiat"`
+	Period1 PeriodReturn `json:"period1"`
+	Period2 PeriodReturn `json:"period2"`
+	// Comparable is true if both periods have data.
+	Comparable bool `json:"comparable"`
+	// ReturnDifference is Period2.Return - Period1.Return, e.g. 0.05 if period 2 returned
+	// 5 percentage points more. It is zero if not Comparable.
+	ReturnDifference float64 `json:"returnDifference"`
+	// Summary describes the comparison in English, e.g.
+	// "period 2 returned 5.00% more than period 1".
+	Summary string `json:"summary"`
+}
+
+// periodReturn returns the price change of the coin/fiat pair between start and end.
+func (updater *RateUpdater) periodReturn(coin, fiat string, start, end time.Time) PeriodReturn {
+	result := PeriodReturn{
+		Start:      start,
+		End:        end,
+		StartPrice: updater.historicalPriceAt(coin, fiat, start),
+		EndPrice:   updater.historicalPriceAt(coin, fiat, end),
+	}
+	result.HasData = result.StartPrice != 0 && result.EndPrice != 0
+	if result.HasData {
+		result.Return = (result.EndPrice - result.StartPrice) / result.StartPrice
+	}
+	return result
+}
+
+// PeriodComparison compares the returns of the given coin/fiat pair in two time windows, e.g.
+// this year and last year, with the prices at their starts and ends obtained using
+// HistoricalPriceAt. The periods may overlap.
+//
+// A period without data at its start or end is reported with HasData false, and the report is
+// not Comparable. An error is returned if a period doesn't start before it ends, or if neither
+// period has data.
+func (updater *RateUpdater) PeriodComparison(
+	coin, fiat string, period1Start, period1End, period2Start, period2End time.Time,
+) (PeriodComparisonReport, error) {
+	if !period1Start.Before(period1End) {
+		return PeriodComparisonReport{}, errp.Newf("invalid period 1: %s is not before %s", period1Start, period1End)
+	}
+	if !period2Start.Before(period2End) {
+		return PeriodComparisonReport{}, errp.Newf("invalid period 2: %s is not before %s", period2Start, period2End)
+	}
+	report := PeriodComparisonReport{
+		Coin:    coin,
+		Fiat:    fiat,
+		Period1: updater.periodReturn(coin, fiat, period1Start, period1End),
+		Period2: updater.periodReturn(coin, fiat, period2Start, period2End),
+	}
+	switch {
+	case !report.Period1.HasData && !report.Period2.HasData:
+		return report, errp.Newf("no historical rates for %s/%s in either period", coin, fiat)
+	case !report.Period1.HasData:
+		report.Summary = "no data for period 1"
+	case !report.Period2.HasData:
+		report.Summary = "no data for period 2"
+	default:
+		report.Comparable = true
+		report.ReturnDifference = report.Period2.Return - report.Period1.Return
+		report.Summary = periodComparisonSummary(report.ReturnDifference)
+	}
+	return report, nil
+}
+
+// periodComparisonSummary describes the difference of the returns of period 2 and period 1.
+func periodComparisonSummary(diff float64) string {
+	pct := fmt.Sprintf("%.2f%%", math.Abs(diff)*100)
+	switch {
+	case pct == "0.00%":
+		return "both periods returned the same"
+	case diff > 0:
+		return fmt.Sprintf("period 2 returned %s more than period 1", pct)
+	default:
+		return fmt.Sprintf("period 2 returned %s less than period 1", pct)
+	}
+}
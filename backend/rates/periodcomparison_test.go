@@ -0,0 +1,77 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodComparison(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	day := func(d int) time.Time { return time.Date(2020, 9, d, 0, 0, 0, 0, time.UTC) }
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 100, timestamp: day(1)},
+			{value: 80, timestamp: day(2)},
+			{value: 72, timestamp: day(3)},
+			{value: 90, timestamp: day(4)},
+			{value: 108, timestamp: day(5)},
+		},
+	})
+
+	report, err := updater.PeriodComparison("btc", "USD", day(1), day(2), day(3), day(5))
+	require.NoError(t, err)
+	assert.Equal(t, PeriodReturn{
+		Start: day(1), End: day(2), StartPrice: 100, EndPrice: 80, Return: -0.2, HasData: true,
+	}, report.Period1)
+	assert.Equal(t, PeriodReturn{
+		Start: day(3), End: day(5), StartPrice: 72, EndPrice: 108, Return: 0.5, HasData: true,
+	}, report.Period2)
+	assert.True(t, report.Comparable)
+	assert.InDelta(t, 0.7, report.ReturnDifference, 1e-9) // 0.5 - (-0.2)
+	assert.Equal(t, "period 2 returned 70.00% more than period 1", report.Summary)
+
+	// Swapped periods.
+	report, err = updater.PeriodComparison("btc", "USD", day(3), day(5), day(1), day(2))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.7, report.ReturnDifference, 1e-9)
+	assert.Equal(t, "period 2 returned 70.00% less than period 1", report.Summary)
+
+	// Overlapping, interpolated: 90 at day 1 12:00, so (72-90)/90 = -0.2 like (80-100)/100.
+	report, err = updater.PeriodComparison("btc", "USD", day(1), day(2), day(1).Add(12*time.Hour), day(3))
+	require.NoError(t, err)
+	assert.InDelta(t, 90, report.Period2.StartPrice, 1e-9)
+	assert.InDelta(t, -0.2, report.Period2.Return, 1e-9)
+	assert.InDelta(t, 0, report.ReturnDifference, 1e-9)
+	assert.Equal(t, "both periods returned the same", report.Summary)
+
+	// Period 2 ends after the available history.
+	report, err = updater.PeriodComparison("btc", "USD", day(1), day(2), day(4), day(6))
+	require.NoError(t, err)
+	assert.True(t, report.Period1.HasData)
+	assert.False(t, report.Period2.HasData)
+	assert.Equal(t, 90.0, report.Period2.StartPrice)
+	assert.Zero(t, report.Period2.EndPrice)
+	assert.Zero(t, report.Period2.Return)
+	assert.False(t, report.Comparable)
+	assert.Zero(t, report.ReturnDifference)
+	assert.Equal(t, "no data for period 2", report.Summary)
+
+	// Period 1 starts before the available history.
+	report, err = updater.PeriodComparison("btc", "USD", day(1).Add(-time.Hour), day(2), day(4), day(5))
+	require.NoError(t, err)
+	assert.False(t, report.Period1.HasData)
+	assert.True(t, report.Period2.HasData)
+	assert.Equal(t, "no data for period 1", report.Summary)
+
+	_, err = updater.PeriodComparison("eth", "USD", day(1), day(2), day(3), day(4))
+	assert.Error(t, err)
+	_, err = updater.PeriodComparison("btc", "USD", day(2), day(1), day(3), day(4))
+	assert.Error(t, err)
+	_, err = updater.PeriodComparison("btc", "USD", day(1), day(2), day(3), day(3))
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// WithRatePersistenceFile makes the updater store the latest rates in a JSON file at path after
+// each successful update, and NewRateUpdater load them from it, so that the last known rates
+// can be shown right after startup. The loaded rates are marked as stale until they are fetched,
+// see IsLatestPriceStale. They take precedence over a bundled snapshot, see WithBundledAsset.
+func WithRatePersistenceFile(path string) Option {
+	return func(updater *RateUpdater) {
+		updater.persistencePath = path
+	}
+}
+
+// loadPersistedRates sets the latest rates to the ones stored in the persistence file.
+func (updater *RateUpdater) loadPersistedRates() error {
+	data, err := os.ReadFile(updater.persistencePath)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	var snapshot RateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return errp.WithMessage(err, "could not parse persisted rates")
+	}
+	if len(snapshot.Rates) == 0 {
+		return errp.New("persisted rates are empty")
+	}
+	updater.lastMu.Lock()
+	defer updater.lastMu.Unlock()
+	updater.last = snapshot.Rates
+	updater.lastStale = true
+	return nil
+}
+
+// persistRates atomically replaces the persistence file with the rates, by writing them to a
+// temporary file in the same directory first and renaming it.
+func (updater *RateUpdater) persistRates(rates map[string]map[string]float64) error {
+	data, err := json.Marshal(RateSnapshot{Timestamp: updater.clock(), Rates: rates})
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	dir, name := filepath.Split(updater.persistencePath)
+	file, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer os.Remove(file.Name()) //nolint:errcheck // fails after the rename
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return errp.WithStack(err)
+	}
+	if err := file.Close(); err != nil {
+		return errp.WithStack(err)
+	}
+	return errp.WithStack(os.Rename(file.Name(), updater.persistencePath))
+}
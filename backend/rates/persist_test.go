@@ -0,0 +1,85 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRatePersistenceFile(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestRatePersistenceFile")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rates.json")
+
+	// Nothing persisted yet.
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRatePersistenceFile(path),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.Empty(t, updater.LatestPrice())
+	ts := newSimplePriceServer(t, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater.coingeckoURL = ts.URL
+	updater.updateLast(context.Background())
+	want := updater.LatestPrice()
+	require.NotEmpty(t, want)
+	// No temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// Loaded on startup and marked stale.
+	updater2 := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRatePersistenceFile(path),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater2.Stop()
+	assert.Equal(t, want, updater2.LatestPrice())
+	assert.True(t, updater2.IsLatestPriceStale())
+
+	// Replaced by fetched rates, which are persisted again.
+	ts2 := newSimplePriceServer(t, `{"bitcoin":{"usd":10},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater2.coingeckoURL = ts2.URL
+	updater2.updateLast(context.Background())
+	assert.False(t, updater2.IsLatestPriceStale())
+	assert.Equal(t, 10.0, updater2.LatestPrice()["BTC"]["USD"])
+	updater3 := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRatePersistenceFile(path),
+		WithLogger(newTestLogger()))
+	defer updater3.Stop()
+	assert.Equal(t, 10.0, updater3.LatestPrice()["BTC"]["USD"])
+
+	// A failed update keeps the persisted rates.
+	updater3.coingeckoURL = "unused"
+	updater3.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater3.updateLast(context.Background())
+	updater4 := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRatePersistenceFile(path),
+		WithLogger(newTestLogger()))
+	defer updater4.Stop()
+	assert.Equal(t, 10.0, updater4.LatestPrice()["BTC"]["USD"])
+}
+
+func TestRatePersistenceFileInvalid(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestRatePersistenceFileInvalid")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rates.json")
+	require.NoError(t, os.WriteFile(path, []byte("invalid"), 0600))
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithRatePersistenceFile(path),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	assert.Empty(t, updater.LatestPrice())
+	assert.False(t, updater.IsLatestPriceStale())
+}
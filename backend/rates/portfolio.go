@@ -0,0 +1,208 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// Purchase is a purchase of a coin for a fiat amount, see DCAAnalysis.
+type Purchase struct {
+	// Coin is the coin code as used in HistoricalPriceAt, e.g. "btc".
+	Coin string
+	// FiatAmount is the amount spent, in the fiat passed to DCAAnalysis.
+	FiatAmount   float64
+	PurchaseTime time.Time
+}
+
+// DCAResult is the result of DCAAnalysis. All fiat values are in the fiat passed to it.
+type DCAResult struct {
+	// TotalInvested is the sum of the fiat amounts of the purchases.
+	TotalInvested float64
+	// TotalCoinAcquired is the sum of the coin amounts bought, each the fiat amount divided by
+	// the historical price at the purchase time.
+	TotalCoinAcquired float64
+	// AverageAcquisitionPrice is TotalInvested divided by TotalCoinAcquired, i.e. the price
+	// weighted by the coin amounts bought. It is 0 if no coin was acquired.
+	AverageAcquisitionPrice float64
+	// CurrentValue is the value of the acquired coins at the latest price.
+	CurrentValue float64
+	// UnrealizedPnL is CurrentValue minus TotalInvested.
+	UnrealizedPnL float64
+	// SkippedPurchases is the number of purchases left out since there is no historical price
+	// at their time.
+	SkippedPurchases int
+}
+
+// DCAAnalysis computes the cost basis of a series of purchases, e.g. of a dollar-cost averaging
+// strategy, using the historical prices at the purchase times and the latest prices, see
+// HistoricalPriceAt and LatestPrice. The purchases need historical rates to be configured
+// with ReconfigureHistory for their coin and fiat.
+//
+// The purchases may be of different coins, in which case TotalCoinAcquired and
+// AverageAcquisitionPrice are meaningless, while the fiat values are not. Coins without
+// a latest price don't add to CurrentValue.
+func (updater *RateUpdater) DCAAnalysis(purchases []Purchase, fiat string) DCAResult {
+	var result DCAResult
+	for _, purchase := range purchases {
+		price := updater.historicalPriceAt(purchase.Coin, fiat, purchase.PurchaseTime)
+		if price == 0 {
+			result.SkippedPurchases++
+			continue
+		}
+		amount := purchase.FiatAmount / price
+		result.TotalInvested += purchase.FiatAmount
+		result.TotalCoinAcquired += amount
+		latest, err := updater.latestPriceForPair(geckoCoinToUnit[geckoCoin[CoinCode(purchase.Coin)]], fiat)
+		if err == nil {
+			result.CurrentValue += amount * latest
+		}
+	}
+	if result.TotalCoinAcquired > 0 {
+		result.AverageAcquisitionPrice = result.TotalInvested / result.TotalCoinAcquired
+	}
+	result.UnrealizedPnL = result.CurrentValue - result.TotalInvested
+	return result
+}
+
+// Actions of a RebalancingAction.
+const (
+	RebalancingBuy  = "buy"
+	RebalancingSell = "sell"
+)
+
+// rebalancingThreshold is the deviation of an allocation from its target, as a fraction of the
+// portfolio value, up to which RebalancingAdvisory suggests no action.
+const rebalancingThreshold = 0.02
+
+// RebalancingAction is a trade suggested by RebalancingAdvisory.
+type RebalancingAction struct {
+	// Coin is the coin unit, e.g. "BTC".
+	Coin string
+	// Action is RebalancingBuy or RebalancingSell.
+	Action string
+	// Amount is the coin amount to buy or sell.
+	Amount float64
+	// FiatValue is the value of Amount at the latest price.
+	FiatValue float64
+}
+
+// RebalancingAdvisory suggests the trades bringing the portfolio of holdings, the coin amounts
+// keyed by coin unit as in LatestPrice, to the target allocation, the fractions of the portfolio
+// value keyed by coin unit. The allocations are computed using the latest prices in fiat.
+// Coins not in targetAllocation have a target of 0.
+//
+// A trade is only suggested for a coin if its allocation deviates from the target by more than
+// 2% of the portfolio value. The actions are sorted by coin.
+// An error is returned if the target allocation doesn't sum to 1, if it has negative fractions,
+// if a coin has no latest price, or if the portfolio has no value.
+func (updater *RateUpdater) RebalancingAdvisory(
+	holdings map[string]float64, targetAllocation map[string]float64, fiat string) ([]RebalancingAction, error) {
+	var targetSum float64
+	for coin, fraction := range targetAllocation {
+		if fraction < 0 {
+			return nil, errp.Newf("negative target allocation for %s: %v", coin, fraction)
+		}
+		targetSum += fraction
+	}
+	if math.Abs(targetSum-1) > 1e-9 {
+		return nil, errp.Newf("target allocation sums to %v instead of 1", targetSum)
+	}
+
+	coins := make(map[string]struct{}, len(holdings)+len(targetAllocation))
+	for coin := range holdings {
+		coins[coin] = struct{}{}
+	}
+	for coin := range targetAllocation {
+		coins[coin] = struct{}{}
+	}
+	last := updater.LatestPrice()
+	prices := make(map[string]float64, len(coins))
+	values := make(map[string]float64, len(coins))
+	var total float64
+	for coin := range coins {
+		price := last[coin][fiat]
+		if price <= 0 {
+			return nil, errp.Newf("no latest price for %s/%s", coin, fiat)
+		}
+		prices[coin] = price
+		values[coin] = holdings[coin] * price
+		total += values[coin]
+	}
+	if total <= 0 {
+		return nil, errp.New("the portfolio has no value")
+	}
+
+	var actions []RebalancingAction
+	for coin := range coins {
+		diff := targetAllocation[coin]*total - values[coin]
+		if math.Abs(diff)/total <= rebalancingThreshold {
+			continue
+		}
+		action := RebalancingAction{
+			Coin:      coin,
+			Action:    RebalancingBuy,
+			Amount:    math.Abs(diff) / prices[coin],
+			FiatValue: math.Abs(diff),
+		}
+		if diff < 0 {
+			action.Action = RebalancingSell
+		}
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Coin < actions[j].Coin })
+	return actions, nil
+}
+
+// PortfolioValueTimeSeries returns the value of the portfolio of holdings, the coin amounts keyed
+// by coin code as in HistoricalPriceAt, e.g. "btc", at from, from+granularity, ... up to and
+// including to, e.g. for a portfolio performance chart. The values are the sums of the holdings
+// multiplied with their historical prices in fiat. Points at which a coin with a non-zero holding
+// has no historical price are left out rather than undervalued.
+//
+// The timestamps and values are returned as parallel slices. An error is returned if
+// granularity is not positive or to is before from.
+func (updater *RateUpdater) PortfolioValueTimeSeries(
+	holdings map[string]float64, fiat string, from, to time.Time, granularity time.Duration) ([]time.Time, []float64, error) {
+	if granularity <= 0 {
+		return nil, nil, errp.Newf("invalid granularity %v", granularity)
+	}
+	if to.Before(from) {
+		return nil, nil, errp.Newf("invalid time range %s to %s", from, to)
+	}
+	var timestamps []time.Time
+	var values []float64
+points:
+	for at := from; !at.After(to); at = at.Add(granularity) {
+		var total float64
+		for coin, amount := range holdings {
+			if amount == 0 {
+				continue
+			}
+			price := updater.historicalPriceAt(coin, fiat, at)
+			if price == 0 {
+				continue points
+			}
+			total += amount * price
+		}
+		timestamps = append(timestamps, at)
+		values = append(values, total)
+	}
+	return timestamps, values, nil
+}
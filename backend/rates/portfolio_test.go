@@ -0,0 +1,146 @@
+package rates
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDCAAnalysis(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	month := func(m int) time.Time { return time.Date(2020, time.Month(1+m), 1, 0, 0, 0, 0, time.UTC) }
+	// Monthly prices from 10000 to 21000 USD.
+	var history []exchangeRate
+	for m := 0; m < 12; m++ {
+		history = append(history, exchangeRate{value: float64(10000 + 1000*m), timestamp: month(m)})
+	}
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": history})
+	updater.last = map[string]map[string]float64{"BTC": {"USD": 25000}}
+
+	var purchases []Purchase
+	var wantCoins float64
+	for m := 0; m < 12; m++ {
+		purchases = append(purchases, Purchase{Coin: "btc", FiatAmount: 100, PurchaseTime: month(m)})
+		wantCoins += 100 / float64(10000+1000*m)
+	}
+	result := updater.DCAAnalysis(purchases, "USD")
+	assert.InDelta(t, 1200, result.TotalInvested, 1e-9)
+	assert.InDelta(t, wantCoins, result.TotalCoinAcquired, 1e-12)
+	// The harmonic mean of the prices, lower than their arithmetic mean of 15500.
+	assert.InDelta(t, 1200/wantCoins, result.AverageAcquisitionPrice, 1e-6)
+	assert.Less(t, result.AverageAcquisitionPrice, 15500.0)
+	assert.InDelta(t, 25000*wantCoins, result.CurrentValue, 1e-9)
+	assert.InDelta(t, 25000*wantCoins-1200, result.UnrealizedPnL, 1e-9)
+	assert.Zero(t, result.SkippedPurchases)
+
+	// Purchases without a historical price are skipped.
+	result = updater.DCAAnalysis(append(purchases,
+		Purchase{Coin: "btc", FiatAmount: 100, PurchaseTime: month(12)},
+		Purchase{Coin: "eth", FiatAmount: 100, PurchaseTime: month(0)},
+	), "USD")
+	assert.InDelta(t, 1200, result.TotalInvested, 1e-9)
+	assert.Equal(t, 2, result.SkippedPurchases)
+
+	assert.Equal(t, DCAResult{}, updater.DCAAnalysis(nil, "USD"))
+}
+
+func TestRebalancingAdvisory(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	updater.last = map[string]map[string]float64{
+		"BTC": {"USD": 20000},
+		"ETH": {"USD": 1000},
+		"LTC": {"USD": 100},
+	}
+	// 6000 + 3000 + 1000 = 10000 USD, i.e. 60%, 30% and 10%.
+	holdings := map[string]float64{"BTC": 0.3, "ETH": 3, "LTC": 10}
+
+	actions, err := updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 0.5, "ETH": 0.3, "LTC": 0.2}, "USD")
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+	assert.Equal(t, "BTC", actions[0].Coin)
+	assert.Equal(t, RebalancingSell, actions[0].Action)
+	assert.InDelta(t, 0.05, actions[0].Amount, 1e-12)
+	assert.InDelta(t, 1000, actions[0].FiatValue, 1e-9)
+	assert.Equal(t, "LTC", actions[1].Coin)
+	assert.Equal(t, RebalancingBuy, actions[1].Action)
+	assert.InDelta(t, 10, actions[1].Amount, 1e-12)
+	assert.InDelta(t, 1000, actions[1].FiatValue, 1e-9)
+
+	// Deviations of up to 2% are tolerated.
+	actions, err = updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 0.58, "ETH": 0.31, "LTC": 0.11}, "USD")
+	require.NoError(t, err)
+	assert.Empty(t, actions)
+	actions, err = updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 0.57, "ETH": 0.32, "LTC": 0.11}, "USD")
+	require.NoError(t, err)
+	require.Len(t, actions, 1)
+	assert.Equal(t, RebalancingAction{Coin: "BTC", Action: RebalancingSell, Amount: 0.015, FiatValue: 300}, roundAction(actions[0]))
+
+	// Coins not in the target are sold, coins not held are bought.
+	actions, err = updater.RebalancingAdvisory(map[string]float64{"BTC": 0.5}, map[string]float64{"ETH": 1}, "USD")
+	require.NoError(t, err)
+	assert.Equal(t, []RebalancingAction{
+		{Coin: "BTC", Action: RebalancingSell, Amount: 0.5, FiatValue: 10000},
+		{Coin: "ETH", Action: RebalancingBuy, Amount: 10, FiatValue: 10000},
+	}, actions)
+
+	_, err = updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 0.5, "ETH": 0.3}, "USD")
+	require.Error(t, err)
+	_, err = updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 1.5, "ETH": -0.5}, "USD")
+	require.Error(t, err)
+	_, err = updater.RebalancingAdvisory(holdings, map[string]float64{"BTC": 1}, "EUR")
+	require.Error(t, err)
+	_, err = updater.RebalancingAdvisory(map[string]float64{}, map[string]float64{"BTC": 1}, "USD")
+	require.Error(t, err)
+}
+
+// roundAction rounds the amounts of the action to avoid floating point noise in comparisons.
+func roundAction(action RebalancingAction) RebalancingAction {
+	action.Amount = math.Round(action.Amount*1e8) / 1e8
+	action.FiatValue = math.Round(action.FiatValue*1e2) / 1e2
+	return action
+}
+
+func TestPortfolioValueTimeSeries(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	day := 24 * time.Hour
+	// 30 days of daily prices: btc 1, 2, ... 30 and eth 10, 20, ... 300, the latter from day 2.
+	updater.storeHistory("btc", "USD", ratesEvery(start, day, 30))
+	eth := ratesEvery(start.Add(day), day, 29)
+	for i := range eth {
+		eth[i].value = 10 * float64(i+2)
+	}
+	updater.storeHistory("eth", "USD", eth)
+	holdings := map[string]float64{"btc": 2, "eth": 0.5, "ltc": 0}
+
+	timestamps, values, err := updater.PortfolioValueTimeSeries(holdings, "USD", start, start.Add(29*day), day)
+	require.NoError(t, err)
+	// The first day has no eth price.
+	require.Len(t, timestamps, 29)
+	require.Len(t, values, 29)
+	for i := range timestamps {
+		d := i + 1
+		assert.Equal(t, start.Add(time.Duration(d)*day), timestamps[i])
+		assert.InDelta(t, 2*float64(d+1)+0.5*10*float64(d+1), values[i], 1e-9)
+	}
+
+	// Interpolated in between.
+	timestamps, values, err = updater.PortfolioValueTimeSeries(holdings, "USD", start.Add(36*time.Hour), start.Add(2*day), day)
+	require.NoError(t, err)
+	assert.Equal(t, []time.Time{start.Add(36 * time.Hour)}, timestamps)
+	assert.InDeltaSlice(t, []float64{2*2.5 + 0.5*25}, values, 1e-9)
+
+	_, _, err = updater.PortfolioValueTimeSeries(holdings, "USD", start, start.Add(day), 0)
+	assert.Error(t, err)
+	_, _, err = updater.PortfolioValueTimeSeries(holdings, "USD", start.Add(day), start, day)
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/json"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/google/uuid"
+	"go.etcd.io/bbolt"
+)
+
+// PushAlertsTriggeredEventSubject is the Subject of the event generated when updateLast
+// triggers push alerts. The Object is the []PushAlert triggered. See PushNotificationToken.
+const PushAlertsTriggeredEventSubject = "rates/push-alerts-triggered"
+
+// pushAlertsBucket is the database bucket of the push alerts, keyed by ID with JSON encoded
+// PushAlert values. It is not a coin+fiat pair, so it doesn't clash with the history buckets.
+var pushAlertsBucket = []byte("pushalerts")
+
+// ErrPushAlertNotFound is returned for operations on push alerts which don't exist.
+var ErrPushAlertNotFound = errp.New("push alert not found")
+
+// AlertDirection is the direction of a rate move triggering a PushAlert.
+type AlertDirection string
+
+const (
+	// AlertAbove triggers once the rate is at or above the threshold.
+	AlertAbove AlertDirection = "above"
+	// AlertBelow triggers once the rate is at or below the threshold.
+	AlertBelow AlertDirection = "below"
+)
+
+// PushAlert is a one-shot alert on a significant rate move, for the mobile apps to send
+// push notifications.
+type PushAlert struct {
+	ID string `json:"id"`
+	// Coin is the coin unit and Fiat the fiat code, as in LatestPrice.
+	Coin      string         `json:"coin"`
+	Fiat      string         `json:"fiat"`
+	Threshold float64        `json:"threshold"`
+	Direction AlertDirection `json:"direction"`
+	// Rate is the latest rate which triggered the alert, zero if not triggered yet.
+	Rate float64 `json:"rate,omitempty"`
+}
+
+// triggeredBy reports whether the rate triggers the alert.
+func (alert *PushAlert) triggeredBy(rate float64) bool {
+	if rate == 0 {
+		return false
+	}
+	switch alert.Direction {
+	case AlertAbove:
+		return rate >= alert.Threshold
+	case AlertBelow:
+		return rate <= alert.Threshold
+	default:
+		return false
+	}
+}
+
+// PushNotificationToken registers a push alert triggering once the latest coin/fiat rate moves
+// past threshold in the given direction, and returns it. Alerts are stored in the database
+// cache, so they survive restarts. Failing to store the alert is logged; use PushAlerts to
+// check which alerts are registered.
+func (updater *RateUpdater) PushNotificationToken(coin, fiat string, threshold float64, direction AlertDirection) PushAlert {
+	alert := PushAlert{
+		ID:        uuid.NewString(),
+		Coin:      coin,
+		Fiat:      fiat,
+		Threshold: threshold,
+		Direction: direction,
+	}
+	if err := updater.putPushAlert(alert, false); err != nil {
+		updater.log.WithError(err).Error("could not store the push alert")
+	}
+	return alert
+}
+
+// PushAlerts returns all registered push alerts which were not triggered yet.
+func (updater *RateUpdater) PushAlerts() ([]PushAlert, error) {
+	var alerts []PushAlert
+	err := updater.historyDB.View(func(tx *bbolt.Tx) error {
+		var err error
+		alerts, err = readPushAlerts(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
+
+// UpdatePushAlert replaces the registered push alert with the same ID.
+// It returns ErrPushAlertNotFound if there is none, e.g. because it was triggered already.
+func (updater *RateUpdater) UpdatePushAlert(alert PushAlert) error {
+	return updater.putPushAlert(alert, true)
+}
+
+// RemovePushAlert unregisters the push alert with the given ID.
+// It returns ErrPushAlertNotFound if there is none, e.g. because it was triggered already.
+func (updater *RateUpdater) RemovePushAlert(id string) error {
+	return updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(pushAlertsBucket)
+		if bucket == nil || bucket.Get([]byte(id)) == nil {
+			return errp.WithStack(ErrPushAlertNotFound)
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+// CheckPushAlerts returns the push alerts triggered by the rates returned by LatestPrice and
+// removes them, so that each alert is returned only once. It is called by each update of the
+// latest rates, which emits a PushAlertsTriggeredEventSubject event if alerts are triggered.
+func (updater *RateUpdater) CheckPushAlerts() []PushAlert {
+	return updater.checkPushAlerts(updater.LatestPrice())
+}
+
+// checkPushAlerts implements CheckPushAlerts for the given latest rates.
+func (updater *RateUpdater) checkPushAlerts(rates map[string]map[string]float64) []PushAlert {
+	alerts, err := updater.PushAlerts()
+	if err != nil {
+		if err != bbolt.ErrDatabaseNotOpen {
+			updater.log.WithError(err).Error("could not check the push alerts")
+		}
+		return nil
+	}
+	var candidates []PushAlert
+	for _, alert := range alerts {
+		if rate := rates[alert.Coin][alert.Fiat]; alert.triggeredBy(rate) {
+			alert.Rate = rate
+			candidates = append(candidates, alert)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	// Only alerts still registered are triggered, e.g. not if removed concurrently.
+	var triggered []PushAlert
+	err = updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		triggered = nil
+		bucket := tx.Bucket(pushAlertsBucket)
+		for _, alert := range candidates {
+			if bucket.Get([]byte(alert.ID)) == nil {
+				continue
+			}
+			if err := bucket.Delete([]byte(alert.ID)); err != nil {
+				return err
+			}
+			triggered = append(triggered, alert)
+		}
+		return nil
+	})
+	if err != nil {
+		updater.log.WithError(err).Error("could not remove the triggered push alerts")
+		return nil
+	}
+	return triggered
+}
+
+// notifyPushAlerts emits a PushAlertsTriggeredEventSubject event for the push alerts
+// triggered by the given latest rates, if any.
+func (updater *RateUpdater) notifyPushAlerts(rates map[string]map[string]float64) {
+	triggered := updater.checkPushAlerts(rates)
+	if len(triggered) == 0 {
+		return
+	}
+	updater.log.Printf("%d push alerts triggered", len(triggered))
+	updater.Notify(observable.Event{
+		Subject: PushAlertsTriggeredEventSubject,
+		Action:  action.Replace,
+		Object:  triggered,
+	})
+}
+
+// putPushAlert stores the alert. If mustExist is true, it returns ErrPushAlertNotFound
+// unless an alert with the same ID is stored already.
+func (updater *RateUpdater) putPushAlert(alert PushAlert, mustExist bool) error {
+	value, err := json.Marshal(alert)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	return updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(pushAlertsBucket)
+		if err != nil {
+			return err
+		}
+		if mustExist && bucket.Get([]byte(alert.ID)) == nil {
+			return errp.WithStack(ErrPushAlertNotFound)
+		}
+		return bucket.Put([]byte(alert.ID), value)
+	})
+}
+
+// readPushAlerts returns all stored push alerts.
+func readPushAlerts(tx *bbolt.Tx) ([]PushAlert, error) {
+	bucket := tx.Bucket(pushAlertsBucket)
+	if bucket == nil {
+		return nil, nil
+	}
+	var alerts []PushAlert
+	err := bucket.ForEach(func(_, value []byte) error {
+		var alert PushAlert
+		if err := json.Unmarshal(value, &alert); err != nil {
+			return errp.WithStack(err)
+		}
+		alerts = append(alerts, alert)
+		return nil
+	})
+	return alerts, err
+}
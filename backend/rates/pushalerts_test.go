@@ -0,0 +1,111 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushAlertsCRUD(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("pushalerts")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	updater := NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+
+	alerts, err := updater.PushAlerts()
+	require.NoError(t, err)
+	assert.Empty(t, alerts)
+
+	above := updater.PushNotificationToken("BTC", "USD", 50000, AlertAbove)
+	below := updater.PushNotificationToken("ETH", "EUR", 1000, AlertBelow)
+	assert.NotEmpty(t, above.ID)
+	assert.NotEqual(t, above.ID, below.ID)
+	assert.Equal(t, PushAlert{ID: above.ID, Coin: "BTC", Fiat: "USD", Threshold: 50000, Direction: AlertAbove}, above)
+
+	alerts, err = updater.PushAlerts()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []PushAlert{above, below}, alerts)
+
+	below.Threshold = 900
+	require.NoError(t, updater.UpdatePushAlert(below))
+	require.ErrorIs(t, updater.UpdatePushAlert(PushAlert{ID: "unknown"}), ErrPushAlertNotFound)
+
+	require.NoError(t, updater.RemovePushAlert(above.ID))
+	require.ErrorIs(t, updater.RemovePushAlert(above.ID), ErrPushAlertNotFound)
+
+	// The alerts survive a restart.
+	updater.Stop()
+	updater = NewRateUpdater(nil, dbdir, WithLogger(newTestLogger()))
+	defer updater.Stop()
+	alerts, err = updater.PushAlerts()
+	require.NoError(t, err)
+	assert.Equal(t, []PushAlert{below}, alerts)
+}
+
+func TestCheckPushAlerts(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("pushalerts")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":40000},"litecoin":{"usd":70},"ethereum":{"usd":2000}}`)
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	var events []observable.Event
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == PushAlertsTriggeredEventSubject {
+			events = append(events, event)
+		}
+	})
+
+	btcAbove := updater.PushNotificationToken("BTC", "USD", 50000, AlertAbove)
+	btcBelow := updater.PushNotificationToken("BTC", "USD", 40000, AlertBelow)
+	ethBelow := updater.PushNotificationToken("ETH", "USD", 1500, AlertBelow)
+	unknown := updater.PushNotificationToken("XYZ", "USD", 1, AlertAbove)
+
+	updater.updateLast(context.Background())
+	require.Len(t, events, 1)
+	btcBelow.Rate = 40000
+	assert.Equal(t, []PushAlert{btcBelow}, events[0].Object)
+	// One-shot: the triggered alert is gone.
+	assert.Empty(t, updater.CheckPushAlerts())
+	alerts, err := updater.PushAlerts()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []PushAlert{btcAbove, ethBelow, unknown}, alerts)
+
+	mock.On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":51000},"litecoin":{"usd":70},"ethereum":{"usd":1400}}`)
+	updater.updateLast(context.Background())
+	require.Len(t, events, 2)
+	btcAbove.Rate = 51000
+	ethBelow.Rate = 1400
+	assert.ElementsMatch(t, []PushAlert{btcAbove, ethBelow}, events[1].Object)
+
+	// Alerts registered since are checked against the latest rates.
+	btcAgain := updater.PushNotificationToken("BTC", "USD", 51000, AlertAbove)
+	btcAgain.Rate = 51000
+	assert.Equal(t, []PushAlert{btcAgain}, updater.CheckPushAlerts())
+
+	alerts, err = updater.PushAlerts()
+	require.NoError(t, err)
+	assert.Equal(t, []PushAlert{unknown}, alerts)
+}
+
+func TestPushAlertsWithoutDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	alert := updater.PushNotificationToken("BTC", "USD", 1, AlertAbove)
+	assert.NotEmpty(t, alert.ID)
+	assert.Empty(t, updater.CheckPushAlerts())
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sync"
+	"time"
+)
+
+// QueryPlanner decides where historical rates are looked up. They are looked up in memory,
+// and in the database cache only if there are none in memory for the pair, e.g. for pairs not
+// configured with ReconfigureHistory. To avoid database reads for timestamps it can't answer,
+// the planner keeps track of the time range of the rates of each pair in the database cache.
+//
+// QueryPlanner is safe for concurrent use.
+type QueryPlanner struct {
+	updater *RateUpdater
+
+	mu sync.Mutex
+	// dbRanges are the time ranges of the rates in the database cache, keyed by coin+fiat
+	// pair. A pair is missing until its range is known, and the range is zero if the
+	// database cache has no rates for it.
+	dbRanges map[string]TimeRange
+}
+
+// newQueryPlanner returns a QueryPlanner of updater not knowing any database ranges yet.
+func newQueryPlanner(updater *RateUpdater) *QueryPlanner {
+	return &QueryPlanner{updater: updater, dbRanges: make(map[string]TimeRange)}
+}
+
+// QueryPlanner returns the QueryPlanner used by HistoricalPriceAt and related methods.
+func (updater *RateUpdater) QueryPlanner() *QueryPlanner {
+	return updater.planner
+}
+
+// InMemoryRange returns the time range of the historical rates of the coin/fiat pair in memory,
+// and false if there are none.
+func (planner *QueryPlanner) InMemoryRange(coin, fiat string) (TimeRange, bool) {
+	var result TimeRange
+	planner.updater.history.view(coin+fiat, func(rates []exchangeRate) {
+		if len(rates) > 0 {
+			result = TimeRange{From: rates[0].timestamp, To: rates[len(rates)-1].timestamp}
+		}
+	})
+	return result, !result.From.IsZero()
+}
+
+// DBRange returns the time range of the historical rates of the coin/fiat pair in the database
+// cache, and false if there are none. The range is read from the database once and kept up to
+// date on writes by the updater.
+func (planner *QueryPlanner) DBRange(coin, fiat string) (TimeRange, bool) {
+	dbRange := planner.dbRange(coin + fiat)
+	return dbRange, !dbRange.From.IsZero()
+}
+
+// dbRange implements DBRange for the coin+fiat pair given as a key.
+func (planner *QueryPlanner) dbRange(key string) TimeRange {
+	planner.mu.Lock()
+	dbRange, known := planner.dbRanges[key]
+	planner.mu.Unlock()
+	if known {
+		return dbRange
+	}
+	// If the database cache is unusable, there is nothing to look up until rates are written.
+	rates, _ := planner.updater.historyStore.ReadBucket(key)
+	return planner.recordWrite(key, rates)
+}
+
+// recordWrite remembers the range of the rates stored in the database cache for the key
+// and returns it.
+func (planner *QueryPlanner) recordWrite(key string, rates []exchangeRate) TimeRange {
+	var dbRange TimeRange
+	if len(rates) > 0 {
+		dbRange = TimeRange{From: rates[0].timestamp, To: rates[len(rates)-1].timestamp}
+	}
+	planner.mu.Lock()
+	defer planner.mu.Unlock()
+	planner.dbRanges[key] = dbRange
+	return dbRange
+}
+
+// forget makes the planner read the range of the key from the database cache again, e.g.
+// after it was modified other than by updateHistoryBucket.
+func (planner *QueryPlanner) forget(key string) {
+	planner.mu.Lock()
+	defer planner.mu.Unlock()
+	delete(planner.dbRanges, key)
+}
+
+// priceAt returns the rate of the coin+fiat pair given as a key at the given time, looked up in
+// the database cache. It returns 0 without reading the rates if at is outside of their range.
+func (planner *QueryPlanner) priceAt(key string, at time.Time) float64 {
+	return planner.pricesAt(key, []time.Time{at})[0]
+}
+
+// pricesAt is like priceAt for each of the times, reading the rates at most once.
+func (planner *QueryPlanner) pricesAt(key string, times []time.Time) []float64 {
+	prices := make([]float64, len(times))
+	dbRange := planner.dbRange(key)
+	var rates []exchangeRate
+	var read bool
+	for i, at := range times {
+		if dbRange.From.IsZero() || at.Before(dbRange.From) || at.After(dbRange.To) {
+			continue
+		}
+		if !read {
+			read = true
+			var err error
+			rates, err = planner.updater.historyStore.ReadBucket(key)
+			if err != nil {
+				planner.updater.log.WithError(err).Errorf("could not read the historical rates of %s", key)
+				return prices
+			}
+		}
+		prices[i] = priceAt(rates, at)
+	}
+	return prices
+}
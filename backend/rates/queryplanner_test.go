@@ -0,0 +1,67 @@
+package rates
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingHistoryStore counts the reads of a HistoryStore.
+type countingHistoryStore struct {
+	HistoryStore
+	reads atomic.Int32
+}
+
+func (store *countingHistoryStore) ReadBucket(name string) ([]exchangeRate, error) {
+	store.reads.Add(1)
+	return store.HistoryStore.ReadBucket(name)
+}
+
+func TestQueryPlanner(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	start := time.Unix(1598918400, 0)
+	store := &countingHistoryStore{HistoryStore: NewMemoryHistoryStore()}
+	updater := NewRateUpdater(nil, "/dev/null", WithHistoryStore(store), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	planner := updater.QueryPlanner()
+
+	// Only in the database cache, as if not configured with ReconfigureHistory.
+	require.NoError(t, store.WriteBucket("ethEUR", ratesEvery(start, time.Hour, 5)))
+	_, ok := planner.InMemoryRange("eth", "EUR")
+	assert.False(t, ok)
+	dbRange, ok := planner.DBRange("eth", "EUR")
+	require.True(t, ok)
+	assert.Equal(t, TimeRange{From: start, To: start.Add(4 * time.Hour)}, dbRange)
+	assert.Equal(t, int32(1), store.reads.Load())
+
+	assert.InDelta(t, 2.5, updater.HistoricalPriceAt("eth", "EUR", start.Add(90*time.Minute)), 1e-9)
+	assert.Equal(t, int32(2), store.reads.Load())
+	// Outside of the range: no read.
+	assert.Zero(t, updater.HistoricalPriceAt("eth", "EUR", start.Add(-time.Hour)))
+	assert.Zero(t, updater.HistoricalPriceAt("eth", "EUR", start.Add(5*time.Hour)))
+	assert.Equal(t, int32(2), store.reads.Load())
+
+	// No rates at all: the range is read once.
+	assert.Zero(t, updater.HistoricalPriceAt("ltc", "USD", start))
+	assert.Zero(t, updater.HistoricalPriceAt("ltc", "USD", start))
+	assert.Equal(t, int32(3), store.reads.Load())
+	_, ok = planner.DBRange("ltc", "USD")
+	assert.False(t, ok)
+
+	// Writes by the updater update the range.
+	updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 3))
+	reads := store.reads.Load()
+	inMemory, ok := planner.InMemoryRange("btc", "USD")
+	require.True(t, ok)
+	assert.Equal(t, TimeRange{From: start, To: start.Add(2 * time.Hour)}, inMemory)
+	dbRange, ok = planner.DBRange("btc", "USD")
+	require.True(t, ok)
+	assert.Equal(t, inMemory, dbRange)
+	// In memory: the database cache is not read.
+	assert.InDelta(t, 2, updater.HistoricalPriceAt("btc", "USD", start.Add(time.Hour)), 1e-9)
+	assert.Zero(t, updater.HistoricalPriceAt("btc", "USD", start.Add(-time.Hour)))
+	assert.Equal(t, reads, store.reads.Load())
+}
@@ -17,14 +17,18 @@ package rates
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"reflect"
+	"slices"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
@@ -32,12 +36,14 @@ import (
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/gregjones/httpcache"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/bbolt"
 )
 
 const (
-	// Latest rates are fetched for all these (coin, fiat) pairs.
+	// Latest rates are fetched for all these (coin, fiat) pairs by default.
+	// See also RateUpdater.AutoConfigureFromWallet.
 	simplePriceAllIDs        = "bitcoin,litecoin,ethereum,basic-attention-token,dai,chainlink,maker,usd-coin,tether,0x,wrapped-bitcoin,pax-gold"
 	simplePriceAllCurrencies = "usd,eur,chf,gbp,jpy,krw,cny,rub,cad,aud,ils,btc,sgd,hkd,brl,nok,sek,pln,czk"
 	// RatesEventSubject is the Subject of the event generated by new rates fetching.
@@ -45,8 +51,12 @@ const (
 
 	// ErrRatesNotAvailable is raised when the latest rates have note been fetched yet.
 	ErrRatesNotAvailable errp.ErrorCode = "ratesNotAvailable"
+	// ErrInvalidResponse is raised when the latest rates response is well-formed but implausible,
+	// e.g. because of a misconfigured mirror. See validateRatesResponse.
+	ErrInvalidResponse errp.ErrorCode = "invalidRatesResponse"
 )
 
+// interval is the default interval between updates of the latest rates, see WithUpdateInterval.
 const interval = time.Minute
 
 // unitSatoshi is 1 BTC (default unit) in Satoshi.
@@ -55,9 +65,17 @@ const unitSatoshi = 1e8
 type exchangeRate struct {
 	value     float64
 	timestamp time.Time
+	// bundled is true if the rate is from a bundled snapshot. See PrewarmFromBundledHistory.
+	bundled bool
+}
+
+// String returns the rate and its time in UTC, e.g. "20000.5 @ 2020-09-01T00:00:00Z".
+func (er exchangeRate) String() string {
+	return fmt.Sprintf("%v @ %s", er.value, er.timestamp.UTC().Format(time.RFC3339))
 }
 
 // Fiat type represents currency strings.
+// It is encoded in JSON as a string, e.g. "USD".
 type Fiat string
 
 // String return a string representing the Fiat.
@@ -65,6 +83,12 @@ func (f Fiat) String() string {
 	return string(f)
 }
 
+// FiatCode returns the currency code, e.g. "USD". It is the same as String but makes the
+// intent clearer at call sites.
+func (f Fiat) FiatCode() string {
+	return string(f)
+}
+
 // supported Fiat.
 const (
 	AUD Fiat = "AUD"
@@ -89,37 +113,310 @@ const (
 	SAT Fiat = "sat"
 )
 
+// allFiats are all Fiat constants. See ValidateFiatConstants.
+var allFiats = []Fiat{AUD, BRL, CAD, CHF, CNY, CZK, EUR, GBP, HKD, ILS, JPY, KRW, NOK, PLN, RUB, SEK, SGD, USD, BTC, SAT}
+
 // RateUpdater provides cryptocurrency-to-fiat conversion rates.
 type RateUpdater struct {
 	observable.Implementation
 
 	httpClient *http.Client
 	log        *logrus.Entry
-
-	// last contains most recent conversion to fiat, keyed by a coin.
+	// httpCache caches the responses of httpClient if not nil. See WithHTTPCache.
+	httpCache httpcache.Cache
+	// middlewares wrap fetchHTTP in fetch. See WithMiddleware.
+	middlewares []Middleware
+	// fetch makes all requests to coingeckoURL.
+	fetch FetchFunc
+	// s3, if not nil, is where the historyDB file is stored on Stop. See NewS3RateUpdater.
+	s3 *s3Sync
+	// contextEnricher, if not nil, modifies each request to coingeckoURL before it is sent.
+	// See WithContextEnricher.
+	contextEnricher func(req *http.Request, ctx context.Context) *http.Request
+
+	lastMu sync.RWMutex // guards last, lastStale and lastTrusted
+	// last contains most recent conversion to fiat, keyed by a coin. Use LatestPrice to read it.
 	last map[string]map[string]float64
+	// lastStale is true if last contains rates from a bundled snapshot and not fetched yet.
+	lastStale bool
+	// lastTrusted is whether the response of last is signed validly. See WithTrustChain.
+	lastTrusted bool
+	// responseCacheTTL is how long a successful latest rates response is reused by updateLast
+	// instead of fetching again. Zero disables the reuse. See WithResponseCacheTTL.
+	responseCacheTTL time.Duration
+	// lastResponseAt and lastResponseIDs are the time and requested CoinGecko coin IDs of the
+	// latest successful latest rates response.
+	lastResponseAt  time.Time
+	lastResponseIDs string
+	// bundledFS and bundledPath are the location of the snapshot used to warm up last
+	// in NewRateUpdater. bundledFS is nil if none is configured.
+	bundledFS   *embed.FS
+	bundledPath string
+	// bundledMaxAge is how old a bundled snapshot may be to be used.
+	bundledMaxAge time.Duration
+	// persistencePath is the file the latest rates are stored in, or empty if none.
+	// See WithRatePersistenceFile.
+	persistencePath string
+	// bundledHistoryFS and bundledHistoryPath are the location of the historical rates snapshot
+	// used by PrewarmFromBundledHistory. bundledHistoryFS is nil if none is configured.
+	bundledHistoryFS   *embed.FS
+	bundledHistoryPath string
 	// stopLastUpdateLoop is the cancel function of the lastUpdateLoop context.
 	stopLastUpdateLoop context.CancelFunc
+	// updateInterval is the interval between updates of the latest rates in lastUpdateLoop.
+	updateInterval time.Duration
+	// goroutines counts the running goroutines started with goTracked.
+	goroutines sync.WaitGroup
+
+	// clockFunc returns the current time. Use clock to call it. See WithClockFunc.
+	clockFunc func() time.Time
+	// timer is used to wait between periodic updates. See WithTimer.
+	timer Timer
 
 	// historyDB is an internal cached copy of history, transparent to the users.
 	// While RateUpdater can function without a valid historyDB,
 	// it may be impacted by API rate limits.
 	historyDB *bbolt.DB
+	// historyStore is the database cache of the historical rates, by default in historyDB.
+	// See WithHistoryStore.
+	historyStore HistoryStore
+	// historyStoreMu serializes reading, modifying and writing back buckets of historyStore.
+	historyStoreMu sync.Mutex
+	// planner looks up historical rates in historyStore if there are none in memory.
+	planner *QueryPlanner
+	// dbdir is the directory of historyDB, as passed to NewRateUpdater.
+	dbdir string
+	// bboltOptions are used to open historyDB.
+	bboltOptions *bbolt.Options
 
-	historyMu sync.RWMutex // guards both history and historyGo
 	// history contains historical conversion rates in asc order, keyed by coin+fiat pair.
 	// For example, BTC/CHF pair's key is "btcCHF".
-	history map[string][]exchangeRate
+	history *historyMap
+	// autoBackfillMaxAge limits the age of the backfilled historical rates if not zero.
+	// See WithAutoBackfill.
+	autoBackfillMaxAge time.Duration
+	// maxHistoryEntries is the maximum number of history entries kept per coin+fiat pair,
+	// both in memory and in historyDB. Zero means unlimited.
+	maxHistoryEntries int
+
+	granularityMu sync.RWMutex // guards granularity
+	// granularity is the Granularity of the historical rates, keyed by coin+fiat pair.
+	// Missing keys are GranularityHourly. See SetHistoryGranularity.
+	granularity map[string]Granularity
+
+	prunedMu sync.Mutex // guards pruned
+	// pruned contains the rates removed from history, oldest first, keyed by coin+fiat pair.
+	// See HistoryDiff.
+	pruned map[string][]prunedRate
+
+	dailyMu sync.RWMutex // guards dailyCache and dailyVersion
+	// dailyCache contains the closing rates of days, keyed by coin+fiat pair and unix day.
+	// See DailyPriceAt.
+	dailyCache map[string]map[int64]float64
+	// dailyVersion is incremented on every invalidation of dailyCache.
+	dailyVersion uint64
+
+	historyGoMu sync.Mutex // guards historyGo and bundledHistory
 	// historyGo contains context canceling funcs to stop periodic updates
 	// of historical data, keyed by coin+fiat pair.
 	// For example, BTC/EUR pair's key is "btcEUR".
 	historyGo map[string]context.CancelFunc
+	// bundledHistory contains the rates loaded by PrewarmFromBundledHistory,
+	// keyed by coin+fiat pair.
+	bundledHistory map[string][]exchangeRate
 
 	// CoinGecko is where updater gets the historical conversion rates.
 	// See https://www.coingecko.com/en/api for details.
 	coingeckoURL string
+	// geckoAPIKey authenticates requests to coingeckoURL if not empty,
+	// sent in the geckoAPIKeyHeader header. See WithCoinGeckoAPIKey.
+	geckoAPIKey       string
+	geckoAPIKeyHeader string
+	// userAgent is the User-Agent header of all requests. See WithUserAgent.
+	userAgent string
+
+	geckoLimiterMu sync.RWMutex // guards geckoLimiter, backoffLimiter, normalLimiter and backoffUntil
 	// All requests to coingeckoURL are rate-limited using geckoLimiter.
+	// Use limiter to access it.
 	geckoLimiter *ratelimit.LimitedCall
+	// adaptiveRateLimit enables adaptRateLimit. See WithAdaptiveRateLimiting.
+	adaptiveRateLimit bool
+	// backoffLimiter is the geckoLimiter set by adaptRateLimit until backoffUntil, nil if not
+	// backing off. normalLimiter is the geckoLimiter it replaced.
+	backoffLimiter *ratelimit.LimitedCall
+	normalLimiter  *ratelimit.LimitedCall
+	backoffUntil   time.Time
+	// geckoWaiting is the number of calls waiting for geckoLimiter. See geckoCall.
+	geckoWaiting atomic.Int32
+
+	callsMu sync.Mutex // guards calls, callsMonth and callBudgetWarned
+	// calls is the number of API requests made in callsMonth. See WithMonthlyCallBudget.
+	calls      int
+	callsMonth string
+	// callBudgetWarned is the month in which the exhausted call budget was logged.
+	callBudgetWarned string
+	// callBudget is the maximum number of API requests per month, zero if unlimited.
+	callBudget int
+	// callCost is the cost of an API request. See WithAPICallCost.
+	callCost float64
+
+	changeLogMu sync.Mutex // guards changeLog
+	// changeLog contains the changes of last, oldest first. See RateChangeLog.
+	changeLog []RateChangeEntry
+	// changeLogSize is the maximum number of entries in changeLog.
+	changeLogSize int
+
+	// maxClockSkew is the maximum allowed difference between the local clock and the time the
+	// latest rates were updated according to the API. Zero disables the check.
+	// See WithClockSkewDetection.
+	maxClockSkew time.Duration
+
+	// crossValidation, if not nil, is the provider the latest rates are compared with before
+	// updating last, allowing a divergence of maxDivergencePct. See WithCrossValidation.
+	crossValidation  RateProvider
+	maxDivergencePct float64
+
+	lastFetchMu sync.Mutex // guards lastFetchDuration, lastFetchErr and lastFetchOKAt
+	// lastFetchDuration is how long the latest rates request in updateLast took.
+	lastFetchDuration time.Duration
+	// lastFetchErr is the error of the latest updateLast, or nil if it succeeded.
+	lastFetchErr error
+	// lastFetchOKAt is the time of the latest successful updateLast, zero if none yet.
+	lastFetchOKAt time.Time
+
+	// telemetryHook, if not nil, is called on operational events. See WithTelemetryHook.
+	telemetryHook func(event TelemetryEvent)
+	// firstFetchSent is whether TelemetryFirstFetch was sent.
+	firstFetchSent atomic.Bool
+	// auditLog, if not nil, records all API calls. See WithAuditLog.
+	auditLog *auditLog
+	// enrichmentConcurrency is the number of workers of EnrichTransactions.
+	// See WithEnrichmentConcurrency.
+	enrichmentConcurrency int
+	// signatureVerifier, if not nil, verifies the latest rates responses. See WithTrustChain.
+	signatureVerifier SignatureVerifier
+	// retryableStatusCodes are the HTTP status codes of the responses retried by
+	// statusRetryMiddleware, the first time after statusRetryBackoff.
+	// See WithRetryableStatusCodes.
+	retryableStatusCodes map[int]bool
+	statusRetryBackoff   time.Duration
+	// goMetrics, if not nil, records the requests in a MetricsRegistry.
+	// See RegisterGoMetrics.
+	goMetrics atomic.Pointer[goMetrics]
+	// transport, if not nil, replaces the transport of httpClient. See WithTransport.
+	transport http.RoundTripper
+	// volatilityAlerts are keyed by the IDs returned by AddVolatilityAlert, guarded by
+	// volatilityAlertsMu.
+	volatilityAlerts      map[int]*volatilityAlert
+	nextVolatilityAlertID int
+	volatilityAlertsMu    sync.Mutex
+
+	// historyCleanupInterval and historyCleanupMaxAge configure the periodic PruneHistory.
+	// It is disabled if historyCleanupMaxAge is zero. See WithHistoryCleanupSchedule.
+	historyCleanupInterval time.Duration
+	historyCleanupMaxAge   time.Duration
+
+	// adminAddr is the address the admin server listens at, or empty if disabled.
+	// See WithAdminServer.
+	adminAddr string
+	// adminServer is the running admin server, nil if not started.
+	adminServer *http.Server
+	// adminListenAddr is the address adminServer actually listens at, e.g. with the port
+	// chosen by the OS if adminAddr has port 0.
+	adminListenAddr string
+	// paused makes lastUpdateLoop skip the updates of the latest rates. See Pause.
+	paused atomic.Bool
+
+	// healthCheckInterval and healthRestartAfter configure the health monitor restarting
+	// lastUpdateLoop. It is disabled if healthCheckInterval is zero. See WithHealthMonitor.
+	healthCheckInterval time.Duration
+	healthRestartAfter  time.Duration
+
+	// testnetPassthrough makes updateLast provide conversion rates for testnet
+	// coin units by copying them from their mainnet counterparts.
+	testnetPassthrough bool
+	testnetMu          sync.RWMutex // guards testnetUnits
+	// testnetUnits maps testnet coin units to their mainnet coin units,
+	// for example "TBTC" to "BTC".
+	testnetUnits map[string]string
+
+	simplePriceMu sync.RWMutex // guards both simplePriceIDs and simplePriceUnits
+	// simplePriceIDs is the comma separated list of CoinGecko coin IDs updateLast fetches rates for.
+	simplePriceIDs string
+	// simplePriceUnits maps the CoinGecko coin IDs in simplePriceIDs to BitBoxApp coin units.
+	simplePriceUnits map[string]string
+	// tokenContracts maps CoinGecko asset platforms to token contract addresses in lowercase to
+	// BitBoxApp coin units. See WithTokenContracts.
+	tokenContracts map[string]map[string]string
+}
+
+// Option configures a RateUpdater. See NewRateUpdater.
+type Option func(*RateUpdater)
+
+// Timer creates channels receiving the time after a duration, like time.After.
+// See WithTimer.
+type Timer interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// realTimer is the default Timer, using time.After.
+type realTimer struct{}
+
+func (realTimer) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithClockFunc sets the function the updater uses to get the current time, time.Now by default.
+// Together with WithTimer, it allows tests to control time, e.g. with testutil.FakeClock.
+func WithClockFunc(fn func() time.Time) Option {
+	return func(updater *RateUpdater) {
+		updater.clockFunc = fn
+	}
+}
+
+// WithTimer sets the timer the updater uses to wait between periodic updates,
+// one using time.After by default. See also WithClockFunc.
+func WithTimer(timer Timer) Option {
+	return func(updater *RateUpdater) {
+		updater.timer = timer
+	}
+}
+
+// WithUpdateInterval sets the interval between updates of the latest rates after
+// StartCurrentRates, one minute by default. Values below the API rate limit are pointless.
+func WithUpdateInterval(d time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.updateInterval = d
+	}
+}
+
+// withGeckoLimiter makes the updater use the given rate limiter for the requests to CoinGecko,
+// instead of creating one for the API URL.
+func withGeckoLimiter(limiter *ratelimit.LimitedCall) Option {
+	return func(updater *RateUpdater) {
+		updater.geckoLimiter = limiter
+	}
+}
+
+// clock returns the current time according to the clock set with WithClockFunc.
+func (updater *RateUpdater) clock() time.Time {
+	return updater.clockFunc()
+}
+
+// WithLogger sets the logger of the updater. The default is the "rates" group of the
+// app-wide logger, see util/logging.
+func WithLogger(log *logrus.Entry) Option {
+	return func(updater *RateUpdater) {
+		updater.log = log
+	}
+}
+
+// WithTestnetPassthrough controls whether the latest rates of mainnet coins are also provided
+// for their testnet counterparts, e.g. BTC rates for TBTC. Enabled by default.
+func WithTestnetPassthrough(enabled bool) Option {
+	return func(updater *RateUpdater) {
+		updater.testnetPassthrough = enabled
+	}
 }
 
 // NewRateUpdater returns a new rates updater.
@@ -135,28 +432,103 @@ type RateUpdater struct {
 //
 // The caller is advised to always call Stop as soon as the updater is no longer needed
 // to free up all used resources.
-func NewRateUpdater(client *http.Client, dbdir string) *RateUpdater {
+//
+// The updater behavior can be adjusted with opts, applied in the given order.
+func NewRateUpdater(client *http.Client, dbdir string, opts ...Option) *RateUpdater {
 	log := logging.Get().WithGroup("rates")
-	db, err := openRatesDB(dbdir)
+	apiURL := shiftGeckoMirrorAPIV3
+	updater := &RateUpdater{
+		last:               make(map[string]map[string]float64),
+		history:            newHistoryMap(nil),
+		dailyCache:         make(map[string]map[int64]float64),
+		granularity:        make(map[string]Granularity),
+		historyGo:          make(map[string]context.CancelFunc),
+		log:                log,
+		httpClient:         client,
+		coingeckoURL:       apiURL,
+		testnetPassthrough: true,
+		testnetUnits: map[string]string{
+			"TBTC":   "BTC",
+			"RBTC":   "BTC",
+			"TLTC":   "LTC",
+			"SEPETH": "ETH",
+		},
+		simplePriceIDs:   simplePriceAllIDs,
+		simplePriceUnits: geckoCoinToUnit,
+		bboltOptions:     defaultBBoltOptions(),
+		bundledMaxAge:    defaultBundledSnapshotMaxAge,
+		changeLogSize:    defaultRateChangeLogSize,
+		userAgent:        defaultUserAgent(),
+		updateInterval:   interval,
+		clockFunc:        time.Now,
+		timer:            realTimer{},
+
+		enrichmentConcurrency: defaultEnrichmentConcurrency,
+		statusRetryBackoff:    defaultStatusRetryBackoff,
+	}
+	for _, opt := range opts {
+		opt(updater)
+	}
+	if updater.geckoLimiter == nil {
+		updater.geckoLimiter = ratelimit.NewLimitedCall(apiRateLimit(updater.coingeckoURL))
+	}
+	if updater.transport != nil {
+		client := &http.Client{}
+		if updater.httpClient != nil {
+			clientCopy := *updater.httpClient
+			client = &clientCopy
+		}
+		client.Transport = updater.transport
+		updater.httpClient = client
+	}
+	if updater.httpCache != nil {
+		client := &http.Client{}
+		if updater.httpClient != nil {
+			clientCopy := *updater.httpClient
+			client = &clientCopy
+		}
+		transport := httpcache.NewTransport(updater.httpCache)
+		transport.Transport = client.Transport
+		client.Transport = transport
+		updater.httpClient = client
+	}
+	fetch := updater.fetchHTTP
+	if len(updater.retryableStatusCodes) > 0 {
+		fetch = updater.statusRetryMiddleware(fetch)
+	}
+	updater.fetch = chainMiddlewares(fetch, updater.middlewares)
+	if updater.persistencePath != "" {
+		if err := updater.loadPersistedRates(); err != nil && !os.IsNotExist(errp.Cause(err)) {
+			updater.log.WithError(err).Warning("could not load persisted latest rates")
+		}
+	}
+	if updater.bundledFS != nil && len(updater.LatestPrice()) == 0 {
+		if err := updater.WarmFromBundledAsset(*updater.bundledFS, updater.bundledPath); err != nil {
+			updater.log.WithError(err).Warning("could not warm up latest rates from bundled snapshot")
+		}
+	}
+
+	db, err := openRatesDB(dbdir, updater.bboltOptions)
 	if err != nil {
-		log.Errorf("openRatesDB(%q): %v; database is unusable", dbdir, err)
+		updater.log.Errorf("openRatesDB(%q): %v; database is unusable", dbdir, err)
 		// To avoid null pointer dereference in other methods where historyDB
 		// is used, use an unopened DB instance. This simplifies code, reducing
 		// the number of nil checks and an additional mutex.
 		// An unopened DB will simply return bbolt.ErrDatabaseNotOpen on all operations.
 		db = &bbolt.DB{}
 	}
-	apiURL := shiftGeckoMirrorAPIV3
-	return &RateUpdater{
-		last:         make(map[string]map[string]float64),
-		history:      make(map[string][]exchangeRate),
-		historyGo:    make(map[string]context.CancelFunc),
-		historyDB:    db,
-		log:          log,
-		httpClient:   client,
-		coingeckoURL: apiURL,
-		geckoLimiter: ratelimit.NewLimitedCall(apiRateLimit(apiURL)),
+	updater.historyDB = db
+	if updater.historyStore == nil {
+		store := NewBBoltHistoryStore(db, updater.log)
+		store.granularity = updater.historyGranularity
+		updater.historyStore = store
 	}
+	updater.planner = newQueryPlanner(updater)
+	updater.dbdir = dbdir
+	if err := updater.loadAPICalls(); err != nil && err != bbolt.ErrDatabaseNotOpen {
+		updater.log.WithError(err).Error("could not load the API call count")
+	}
+	return updater
 }
 
 // SetCoingeckoURL overrides the default URL the rates updater connects to. Useful for testing.
@@ -164,17 +536,138 @@ func (updater *RateUpdater) SetCoingeckoURL(url string) {
 	updater.coingeckoURL = url
 }
 
+// WithBBoltOptions sets the options used to open the historical rates database cache.
+// The default is a 5 second timeout to obtain the file lock, since network disks may take long.
+//
+// Note that bbolt has no write-ahead log: all writes are serialized and each transaction
+// is synced to disk on commit. Write throughput can be improved with NoSync or
+// NoFreelistSync at the cost of durability, which is acceptable for a cache that can
+// be refetched but should only be used with the database on a local disk.
+// A small Timeout makes NewRateUpdater fail fast if another process holds the database,
+// in which case the updater continues without the database cache.
+func WithBBoltOptions(opts *bbolt.Options) Option {
+	return func(updater *RateUpdater) {
+		updater.bboltOptions = opts
+	}
+}
+
+// UpdateRateLimit replaces the rate limit of the requests to CoinGecko, allowing at most
+// requestsPerWindow equally spaced requests per window, e.g. 500 per minute.
+// It is useful to apply an upgraded API plan without restarting the updater.
+// Requests already waiting for the old rate limit are not affected.
+func (updater *RateUpdater) UpdateRateLimit(requestsPerWindow int, window time.Duration) {
+	if requestsPerWindow <= 0 || window <= 0 {
+		updater.log.Errorf("UpdateRateLimit: invalid rate limit %d per %v", requestsPerWindow, window)
+		return
+	}
+	limiter := ratelimit.NewLimitedCall(window / time.Duration(requestsPerWindow))
+	updater.geckoLimiterMu.Lock()
+	defer updater.geckoLimiterMu.Unlock()
+	updater.geckoLimiter = limiter
+}
+
+// limiter returns the rate limiter of the requests to CoinGecko.
+func (updater *RateUpdater) limiter() *ratelimit.LimitedCall {
+	updater.geckoLimiterMu.RLock()
+	defer updater.geckoLimiterMu.RUnlock()
+	return updater.geckoLimiter
+}
+
+// geckoCall calls fn abiding the rate limit of the requests to CoinGecko,
+// keeping track of the number of waiting calls.
+func (updater *RateUpdater) geckoCall(ctx context.Context, logAnnotate string, fn func() error) error {
+	updater.geckoWaiting.Add(1)
+	waiting := true
+	defer func() {
+		if waiting {
+			updater.geckoWaiting.Add(-1)
+		}
+	}()
+	return updater.limiter().Call(ctx, logAnnotate, func() error {
+		waiting = false
+		updater.geckoWaiting.Add(-1)
+		return fn()
+	})
+}
+
+// WithMaxHistoryEntriesPerPair limits the number of historical exchange rates kept per
+// coin+fiat pair, both in memory and in the database cache. Once exceeded, the oldest
+// n/10 entries are dropped, so that trimming doesn't happen on each update.
+// Historical rates are not backfilled past the limit. The default is no limit.
+func WithMaxHistoryEntriesPerPair(n int) Option {
+	return func(updater *RateUpdater) {
+		updater.maxHistoryEntries = n
+	}
+}
+
+// WithResponseCacheTTL makes updateLast skip fetching the latest rates if the previous
+// successful response is younger than ttl, for example if it is called more often than the
+// API updates the rates. The rates are unchanged then, so no event is emitted.
+// A change of the requested coins, see AutoConfigureFromWallet, is always fetched.
+// Zero, the default, fetches on each call.
+func WithResponseCacheTTL(ttl time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.responseCacheTTL = ttl
+	}
+}
+
+// autoBackfillChunk is the range of each request backfilling the history if
+// WithAutoBackfill is set.
+const autoBackfillChunk = 90 * 24 * time.Hour
+
+// WithAutoBackfill limits the backfilling of the historical rates of newly added coin+fiat
+// pairs, see ReconfigureHistory, to the rates of the last maxAge. The rates are fetched in
+// chunks of 90 days, each abiding the rate limit. By default, all available rates are
+// backfilled in chunks of up to a year.
+func WithAutoBackfill(maxAge time.Duration) Option {
+	return func(updater *RateUpdater) {
+		updater.autoBackfillMaxAge = maxAge
+	}
+}
+
+// trimHistory drops the oldest rates exceeding maxHistoryEntries. See WithMaxHistoryEntriesPerPair.
+// The rates must be sorted by timestamp in asc order.
+func (updater *RateUpdater) trimHistory(rates []exchangeRate) []exchangeRate {
+	n := updater.maxHistoryEntries
+	if n <= 0 || len(rates) <= n {
+		return rates
+	}
+	drop := len(rates) - n
+	if drop < n/10 {
+		drop = n / 10
+	}
+	return rates[drop:]
+}
+
+// RegisterTestnetMapping makes the updater provide the latest rates of mainnetUnit
+// for testnetUnit as well, starting with the next update.
+// Registering an already known testnetUnit replaces its mapping.
+// It has no effect if the testnet passthrough is disabled, see WithTestnetPassthrough.
+func (updater *RateUpdater) RegisterTestnetMapping(testnetUnit, mainnetUnit string) {
+	updater.testnetMu.Lock()
+	defer updater.testnetMu.Unlock()
+	updater.testnetUnits[testnetUnit] = mainnetUnit
+}
+
 // LatestPrice returns the most recent conversion rates.
 // The returned map is keyed by a crypto coin with values mapped by fiat rates.
 // RateUpdater assumes the returned value is never modified by the callers.
 func (updater *RateUpdater) LatestPrice() map[string]map[string]float64 {
+	updater.lastMu.RLock()
+	defer updater.lastMu.RUnlock()
 	return updater.last
 }
 
 // LatestPriceForPair returns the conversion rate for the given (coin, fiat) pair. Returns an error
 // if the rates have not been fetched yet. `coinUnit` values are the same as `coin.Unit`.
+//
+// Deprecated: Use LatestPriceForCoin.
 func (updater *RateUpdater) LatestPriceForPair(coinUnit, fiat string) (float64, error) {
-	// TODO: use coin.Code
+	return updater.latestPriceForPair(coinUnit, fiat)
+}
+
+// latestPriceForPair implements LatestPriceForPair.
+func (updater *RateUpdater) latestPriceForPair(coinUnit, fiat string) (float64, error) {
 	last := updater.LatestPrice()
 	if last == nil {
 		return 0, ErrRatesNotAvailable
@@ -189,10 +682,41 @@ func (updater *RateUpdater) LatestPriceForPair(coinUnit, fiat string) (float64,
 // If no data is available with the given args, HistoricalPriceAt returns 0.
 // The latest rates can lag behind by many minutes (5-30min). Use `LatestPrice` get the latest
 // rates.
+//
+// Deprecated: Use HistoricalPriceForCoin.
 func (updater *RateUpdater) HistoricalPriceAt(coin, fiat string, at time.Time) float64 {
-	updater.historyMu.RLock()
-	defer updater.historyMu.RUnlock()
-	data := updater.history[coin+fiat]
+	return updater.historicalPriceAt(coin, fiat, at)
+}
+
+// historicalPriceAt implements HistoricalPriceAt. If there are no rates in memory for the pair,
+// they are looked up in the database cache, see QueryPlanner.
+func (updater *RateUpdater) historicalPriceAt(coin, fiat string, at time.Time) float64 {
+	var result float64
+	var inMemory bool
+	updater.history.view(coin+fiat, func(data []exchangeRate) {
+		inMemory = len(data) > 0
+		result = priceAt(data, at)
+	})
+	if !inMemory {
+		return updater.planner.priceAt(coin+fiat, at)
+	}
+	return result
+}
+
+// PriceAtBlock returns the historical exchange rate for the given coin at the time a block
+// was confirmed, where blockTime is the median time of the block. It is the same as
+// HistoricalPriceAt and exists to make the intent explicit at call sites valuing confirmed
+// transactions, which settle at block time and not when the rates were fetched.
+//
+// The precision is limited by the granularity of the historical rates provided by CoinGecko,
+// at best 5 minutes for recent data and hourly or daily further back. Callers needing a higher
+// resolution have to use a different data source and fall back to HistoricalPriceAt.
+func (updater *RateUpdater) PriceAtBlock(coin, fiat string, blockTime time.Time) float64 {
+	return updater.historicalPriceAt(coin, fiat, blockTime)
+}
+
+// priceAt implements HistoricalPriceAt for the given data sorted in asc order.
+func priceAt(data []exchangeRate, at time.Time) float64 {
 	if len(data) == 0 {
 		return 0 // no data at all
 	}
@@ -211,10 +735,33 @@ func (updater *RateUpdater) HistoricalPriceAt(coin, fiat string, at time.Time) f
 	// https://en.wikipedia.org/wiki/Linear_interpolation#Linear_interpolation_as_approximation
 	a := data[idx-1]
 	b := data[idx]
-	x := float64((at.Unix() - a.timestamp.Unix())) / float64((b.timestamp.Unix() - a.timestamp.Unix()))
+	x := float64(at.Sub(a.timestamp)) / float64(b.timestamp.Sub(a.timestamp))
 	return a.value + x*(b.value-a.value)
 }
 
+// minRatesResponseCoins is the minimum number of coins in a valid latest rates response.
+const minRatesResponseCoins = 3
+
+// validateRatesResponse checks that the parsed latest rates response, keyed by CoinGecko coin
+// and fiat codes, is plausible for the requested CoinGecko coin ids: it must contain rates for
+// at least minRatesResponseCoins coins, or for all of them if fewer were requested, at least one
+// rate for each coin, and a non-zero BTC/USD rate if bitcoin was requested.
+// The returned error's cause is ErrInvalidResponse.
+func validateRatesResponse(rates map[string]map[string]float64, ids []string) error {
+	if minCoins := min(minRatesResponseCoins, len(ids)); len(rates) < minCoins {
+		return errp.WithMessage(ErrInvalidResponse, fmt.Sprintf("only %d coins", len(rates)))
+	}
+	for coin, fiatRates := range rates {
+		if len(fiatRates) == 0 {
+			return errp.WithMessage(ErrInvalidResponse, fmt.Sprintf("no rates for %s", coin))
+		}
+	}
+	if slices.Contains(ids, "bitcoin") && rates["bitcoin"]["usd"] == 0 {
+		return errp.WithMessage(ErrInvalidResponse, "BTC/USD rate missing")
+	}
+	return nil
+}
+
 // StartCurrentRates spins up the updater's goroutines to periodically update
 // current exchange rates. It returns immediately.
 // StartCurrentRates panics if called twice, even after Stop'ed.
@@ -229,103 +776,203 @@ func (updater *RateUpdater) StartCurrentRates() {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	updater.stopLastUpdateLoop = cancel
-	go updater.lastUpdateLoop(ctx)
+	updater.startAdminServer()
+	if updater.historyCleanupMaxAge > 0 {
+		updater.goTracked(func() { updater.historyCleanupLoop(ctx) })
+	}
+	if updater.healthCheckInterval > 0 {
+		updater.goTracked(func() { updater.healthMonitorLoop(ctx) })
+		return
+	}
+	updater.goTracked(func() { updater.lastUpdateLoop(ctx) })
 }
 
-// Stop shuts down all running goroutines and closes history database cache.
-// It may return before the goroutines have exited.
+// Stop shuts down all running goroutines and the admin server, see WithAdminServer, closes
+// history database cache and flushes the audit log, see WithAuditLog.
+// It may return before the goroutines have exited, see StopAndWait.
 // Once Stop'ed, the updater is no longer usable.
 //
 // Stop is unsafe for concurrent use.
 func (updater *RateUpdater) Stop() {
+	updater.stopGoroutines()
+	updater.closeDB()
+	updater.flushAuditLog()
+}
+
+// StopAndWait is like Stop but also waits for all goroutines to exit before closing the
+// history database cache, so that it is safe to delete it or exit the process afterwards.
+// If ctx is done first, the database is closed regardless and ctx.Err() is returned.
+//
+// StopAndWait is unsafe for concurrent use.
+func (updater *RateUpdater) StopAndWait(ctx context.Context) error {
+	updater.stopGoroutines()
+	done := make(chan struct{})
+	go func() {
+		updater.goroutines.Wait()
+		close(done)
+	}()
+	defer updater.flushAuditLog()
+	defer updater.closeDB()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopGoroutines cancels all running goroutines. It may return before they have exited.
+func (updater *RateUpdater) stopGoroutines() {
 	updater.stopAllHistory()
 	if updater.stopLastUpdateLoop != nil {
 		updater.stopLastUpdateLoop()
 	}
+	updater.stopAdminServer()
+}
+
+// closeDB closes the history database cache, and stores it in S3 if configured.
+func (updater *RateUpdater) closeDB() {
 	if err := updater.historyDB.Close(); err != nil {
 		updater.log.Errorf("historyDB.Close: %v", err)
 	}
+	if updater.s3 != nil {
+		if err := updater.s3.upload(); err != nil {
+			updater.log.WithError(err).Error("could not store the rates database in S3")
+		}
+	}
+}
+
+// goTracked runs fn in a new goroutine, which StopAndWait waits for.
+func (updater *RateUpdater) goTracked(fn func()) {
+	updater.goroutines.Add(1)
+	go func() {
+		defer updater.goroutines.Done()
+		fn()
+	}()
 }
 
 // lastUpdateLoop periodically updates most recent exchange rates.
 // It never returns until the context is done.
 func (updater *RateUpdater) lastUpdateLoop(ctx context.Context) {
 	for {
-		updater.updateLast(ctx)
+		if !updater.Paused() {
+			updater.updateLast(ctx)
+		}
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(interval):
+		case <-updater.timer.After(updater.updateInterval):
 			// continue
 		}
 	}
 }
 
+// parseRatesResponse decodes the response body of the "simple/price" API.
+func parseRatesResponse(responseBody []byte) (map[string]map[string]float64, error) {
+	const max = 10240
+	if len(responseBody) > max {
+		return nil, errp.Newf("rates response too long (> %d bytes)", max)
+	}
+	var geckoRates map[string]map[string]float64
+	if err := json.Unmarshal(responseBody, &geckoRates); err != nil {
+		return nil, errp.WithMessage(err,
+			fmt.Sprintf("could not parse rates response: %s", string(responseBody)))
+	}
+	return geckoRates, nil
+}
+
+// fromGeckoFiatRates converts the rates of a coin keyed by CoinGecko fiat codes to a map keyed
+// by fiat units, adding the sat rate if there is a BTC rate. Unsupported fiats are skipped.
+func (updater *RateUpdater) fromGeckoFiatRates(geckoRates map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for geckoFiat, rate := range geckoRates {
+		fiat, ok := fromGeckoFiat[geckoFiat]
+		if !ok {
+			updater.log.Errorf("unsupported fiat: %s", geckoFiat)
+			continue
+		}
+		if fiat == BTC.String() {
+			result[SAT.String()] = rate * unitSatoshi
+		}
+		result[fiat] = rate
+	}
+	return result
+}
+
 func (updater *RateUpdater) updateLast(ctx context.Context) {
+	updater.simplePriceMu.RLock()
+	ids, geckoUnits := updater.simplePriceIDs, updater.simplePriceUnits
+	updater.simplePriceMu.RUnlock()
+	if updater.responseCacheTTL > 0 && ids == updater.lastResponseIDs &&
+		updater.clock().Sub(updater.lastResponseAt) < updater.responseCacheTTL {
+		return
+	}
 	param := url.Values{
-		"ids":           {simplePriceAllIDs},
+		"ids":           {ids},
 		"vs_currencies": {simplePriceAllCurrencies},
 	}
-	endpoint := fmt.Sprintf("%s/simple/price?%s", updater.coingeckoURL, param.Encode())
-	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
-	if err != nil {
-		updater.log.WithError(err).Error("could not create request")
-		updater.last = nil
-		return
+	if updater.maxClockSkew > 0 {
+		param.Set("include_last_updated_at", "true")
 	}
-
+	endpoint := fmt.Sprintf("%s/simple/price?%s", updater.coingeckoURL, param.Encode())
+	start := updater.clock()
+	var trusted bool
+	responseBody, callErr := updater.fetch(withTrustResult(ctx, &trusted), endpoint)
+	fetchDuration := updater.clock().Sub(start)
 	var geckoRates map[string]map[string]float64
-	callErr := updater.geckoLimiter.Call(ctx, "updateLast", func() error {
-		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-		res, err := updater.httpClient.Do(req.WithContext(ctx))
-		if err != nil {
-			return errp.WithStack(err)
-		}
-		defer res.Body.Close() //nolint:errcheck
-		if res.StatusCode != http.StatusOK {
-			return errp.Newf("bad response code %d", res.StatusCode)
-		}
-		const max = 10240
-		responseBody, err := io.ReadAll(io.LimitReader(res.Body, max+1))
-		if err != nil {
-			return errp.WithStack(err)
-		}
-		if len(responseBody) > max {
-			return errp.Newf("rates response too long (> %d bytes)", max)
-		}
-		if err := json.Unmarshal(responseBody, &geckoRates); err != nil {
-			return errp.WithMessage(err,
-				fmt.Sprintf("could not parse rates response: %s", string(responseBody)))
-		}
-		return nil
-	})
+	if callErr == nil {
+		geckoRates, callErr = parseRatesResponse(responseBody)
+	}
 	if callErr != nil {
+		updater.setLastFetch(fetchDuration, callErr)
 		updater.log.WithError(callErr).Errorf("updateLast")
+		updater.lastMu.Lock()
 		updater.last = nil
+		updater.lastMu.Unlock()
+		return
+	}
+	if updater.maxClockSkew > 0 {
+		updater.checkClockSkew(geckoRates)
+	}
+	// The schema check only holds if all default coins are requested, as opposed to
+	// a configuration by AutoConfigureFromWallet.
+	if ids == simplePriceAllIDs {
+		if err := ValidateResponseSchema(responseBody); err != nil {
+			updater.log.WithError(err).WithField("endpoint", endpoint).
+				Warning("unexpected rates response schema, CoinGecko may have changed it")
+		}
+	}
+	if err := validateRatesResponse(geckoRates, strings.Split(ids, ",")); err != nil {
+		updater.setLastFetch(fetchDuration, err)
+		// Keep the previous rates instead of wiping them out.
+		updater.log.WithError(err).Error("updateLast")
 		return
 	}
+	if updater.crossValidation != nil {
+		if err := updater.crossValidate(ctx, geckoRates); err != nil {
+			updater.setLastFetch(fetchDuration, err)
+			updater.log.WithError(err).Error("updateLast")
+			return
+		}
+	}
+	updater.setLastFetch(fetchDuration, nil)
+	if !updater.firstFetchSent.Swap(true) {
+		updater.telemetry(TelemetryFirstFetch, map[string]interface{}{"duration": fetchDuration})
+	}
+	updater.lastResponseAt, updater.lastResponseIDs = updater.clock(), ids
 	// Convert the map with coingecko coin/fiat codes to a map of coin/fiat units.
 	rates := map[string]map[string]float64{}
 	for coin, val := range geckoRates {
-		coinUnit := geckoCoinToUnit[coin]
+		coinUnit := geckoUnits[coin]
 		if coinUnit == "" {
 			updater.log.Errorf("unsupported CoinGecko coin: %s", coin)
 			continue
 		}
-		newVal := map[string]float64{}
-		for geckoFiat, rates := range val {
-			fiat, ok := fromGeckoFiat[geckoFiat]
-			if !ok {
-				updater.log.Errorf("unsupported fiat: %s", geckoFiat)
-				continue
-			}
-			if fiat == BTC.String() {
-				newVal[SAT.String()] = rates * unitSatoshi
-			}
-			newVal[fiat] = rates
-		}
-		rates[coinUnit] = newVal
+		rates[coinUnit] = updater.fromGeckoFiatRates(val)
+	}
+	if len(updater.tokenContracts) > 0 {
+		tokensTrusted := updater.addTokenRates(ctx, rates)
+		trusted = trusted && tokensTrusted
 	}
 
 	// Create sat rates from BTC
@@ -336,19 +983,31 @@ func (updater *RateUpdater) updateLast(ctx context.Context) {
 	rates[SAT.String()] = sat
 
 	// Provide conversion rates for testnets as well, useful for testing.
-	for _, testnetUnit := range []string{"TBTC", "RBTC", "TLTC", "SEPETH"} {
-		switch testnetUnit {
-		case "SEPETH":
-			rates[testnetUnit] = rates[testnetUnit[3:]]
-		default:
-			rates[testnetUnit] = rates[testnetUnit[1:]]
+	if updater.testnetPassthrough {
+		updater.testnetMu.RLock()
+		for testnetUnit, mainnetUnit := range updater.testnetUnits {
+			rates[testnetUnit] = rates[mainnetUnit]
 		}
+		updater.testnetMu.RUnlock()
 	}
 
-	if reflect.DeepEqual(rates, updater.last) {
-		return
+	if updater.persistencePath != "" {
+		if err := updater.persistRates(rates); err != nil {
+			updater.log.WithError(err).Error("could not persist latest rates")
+		}
 	}
+	updater.notifyPushAlerts(rates)
+	updater.checkVolatilityAlerts()
+	updater.lastMu.Lock()
+	previous := updater.last
 	updater.last = rates
+	updater.lastStale = false
+	updater.lastTrusted = updater.signatureVerifier == nil || trusted
+	updater.lastMu.Unlock()
+	if reflect.DeepEqual(rates, previous) {
+		return
+	}
+	updater.logRateChanges(previous, rates)
 	updater.Notify(observable.Event{
 		Subject: RatesEventSubject,
 		Action:  action.Replace,
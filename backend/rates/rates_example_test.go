@@ -0,0 +1,181 @@
+package rates_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+)
+
+// exampleHistory are the BTC/USD rates served by newExampleServer, hourly on 2020-09-01.
+var exampleHistory = [][2]float64{
+	{1598918400000, 11650.0},
+	{1598922000000, 11700.0},
+	{1598925600000, 11800.0},
+}
+
+// exampleNow is the time the examples pretend to run at, shortly after exampleHistory,
+// so that the mocked rates are within the backfilled range.
+func exampleNow() time.Time {
+	return time.Date(2020, 9, 2, 0, 0, 0, 0, time.UTC)
+}
+
+// newExampleServer returns a server mocking the CoinGecko API endpoints used by the updater.
+func newExampleServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/simple/price", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"bitcoin":{"usd":20000.5,"eur":18500.25},"litecoin":{"usd":70.1},"ethereum":{"usd":1500.75}}`)
+	})
+	mux.HandleFunc("/coins/bitcoin/market_chart/range", func(w http.ResponseWriter, r *http.Request) {
+		from, _ := strconv.ParseInt(r.URL.Query().Get("from"), 10, 64)
+		to, _ := strconv.ParseInt(r.URL.Query().Get("to"), 10, 64)
+		prices := [][2]float64{}
+		for _, price := range exampleHistory {
+			if ts := int64(price[0]) / 1000; from <= ts && ts <= to {
+				prices = append(prices, price)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"prices": prices}) //nolint:errcheck
+	})
+	return httptest.NewServer(mux)
+}
+
+// newExampleDBDir creates a temporary directory for the rates database and returns it
+// along with a func removing it.
+func newExampleDBDir() (string, func()) {
+	dbdir, err := os.MkdirTemp("", "rates")
+	if err != nil {
+		panic(err)
+	}
+	return dbdir, func() { _ = os.RemoveAll(dbdir) }
+}
+
+// waitForLatestRates returns a channel receiving a value once the updater fetched the latest rates.
+func waitForLatestRates(updater *rates.RateUpdater) (<-chan struct{}, func()) {
+	done := make(chan struct{}, 1)
+	unobserve := updater.Observe(func(event observable.Event) {
+		if event.Subject == rates.RatesEventSubject {
+			select {
+			case done <- struct{}{}:
+			default:
+			}
+		}
+	})
+	return done, unobserve
+}
+
+func ExampleNewRateUpdater() {
+	server := newExampleServer()
+	defer server.Close()
+	// The historical rates are cached in a database in this directory.
+	dbdir, removeDBDir := newExampleDBDir()
+	defer removeDBDir()
+
+	// The behavior is customized with options.
+	updater := rates.NewRateUpdater(http.DefaultClient, dbdir,
+		rates.WithTestnetPassthrough(false))
+	defer updater.Stop()
+	// The default is the Shift CoinGecko mirror.
+	updater.SetCoingeckoURL(server.URL)
+
+	// No rates are available until they are fetched.
+	fmt.Println(len(updater.LatestPrice()))
+	// Output: 0
+}
+
+func ExampleRateUpdater_StartCurrentRates() {
+	server := newExampleServer()
+	defer server.Close()
+	dbdir, removeDBDir := newExampleDBDir()
+	defer removeDBDir()
+	updater := rates.NewRateUpdater(http.DefaultClient, dbdir)
+	defer updater.Stop()
+	updater.SetCoingeckoURL(server.URL)
+
+	// Observers are notified whenever the latest rates change.
+	updater.Observe(func(event observable.Event) {
+		if event.Subject == rates.RatesEventSubject {
+			latest := event.Object.(map[string]map[string]float64)
+			fmt.Println("BTC/EUR:", latest["BTC"]["EUR"])
+		}
+	})
+	done, unobserve := waitForLatestRates(updater)
+	defer unobserve()
+	updater.StartCurrentRates()
+	<-done
+	// Output: BTC/EUR: 18500.25
+}
+
+func ExampleRateUpdater_LatestPriceForPair() {
+	server := newExampleServer()
+	defer server.Close()
+	dbdir, removeDBDir := newExampleDBDir()
+	defer removeDBDir()
+	updater := rates.NewRateUpdater(http.DefaultClient, dbdir)
+	defer updater.Stop()
+	updater.SetCoingeckoURL(server.URL)
+	done, unobserve := waitForLatestRates(updater)
+	defer unobserve()
+	updater.StartCurrentRates()
+	<-done
+
+	price, err := updater.LatestPriceForPair("BTC", "USD")
+	if err != nil {
+		panic(err)
+	}
+	// Convert an amount of 0.5 BTC to USD.
+	fmt.Printf("0.5 BTC = %.2f USD\n", 0.5*price)
+	// Output: 0.5 BTC = 10000.25 USD
+}
+
+func ExampleRateUpdater_ReconfigureHistory() {
+	server := newExampleServer()
+	defer server.Close()
+	dbdir, removeDBDir := newExampleDBDir()
+	defer removeDBDir()
+	updater := rates.NewRateUpdater(http.DefaultClient, dbdir, rates.WithClockFunc(exampleNow))
+	defer updater.Stop()
+	updater.SetCoingeckoURL(server.URL)
+
+	// Fetch the historical rates of the coins and fiats the user is interested in.
+	// Calling it again replaces the configuration.
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	for updater.HistoryLatestTimestamp("btc", "USD").IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fmt.Println(updater.HistoryEarliestTimestamp("btc", "USD").UTC())
+	fmt.Println(updater.HistoryLatestTimestamp("btc", "USD").UTC())
+	// Output:
+	// 2020-09-01 00:00:00 +0000 UTC
+	// 2020-09-01 02:00:00 +0000 UTC
+}
+
+func ExampleRateUpdater_HistoricalPriceAt() {
+	server := newExampleServer()
+	defer server.Close()
+	dbdir, removeDBDir := newExampleDBDir()
+	defer removeDBDir()
+	updater := rates.NewRateUpdater(http.DefaultClient, dbdir, rates.WithClockFunc(exampleNow))
+	defer updater.Stop()
+	updater.SetCoingeckoURL(server.URL)
+	updater.ReconfigureHistory([]string{"btc"}, []string{"USD"})
+	for updater.HistoryLatestTimestamp("btc", "USD").IsZero() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The value of a transaction at the time it was made. Between two historical rates,
+	// the rate is interpolated.
+	txTime := time.Date(2020, 9, 1, 1, 30, 0, 0, time.UTC)
+	fmt.Println(updater.HistoricalPriceAt("btc", "USD", txTime))
+	// Without data, the rate is 0.
+	fmt.Println(updater.HistoricalPriceAt("btc", "USD", txTime.Add(24*time.Hour)))
+	// Output:
+	// 11750
+	// 0
+}
@@ -0,0 +1,80 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+)
+
+// The fuzz targets in this file feed arbitrary response bodies to the code parsing
+// CoinGecko API responses. Without the -fuzz flag, only the seed corpus is run.
+// See README.md for how to run the fuzzer.
+
+// bodyTransport responds to all requests with status 200 and the body.
+type bodyTransport struct {
+	body []byte
+}
+
+func (transport *bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(transport.body)),
+		Request:    req,
+	}, nil
+}
+
+// newFuzzRateUpdater returns an updater making all requests through the transport.
+// It is reused across fuzzing iterations, which run sequentially.
+func newFuzzRateUpdater(f *testing.F, transport *bodyTransport) *RateUpdater {
+	f.Helper()
+	updater := NewRateUpdater(&http.Client{Transport: transport}, "/dev/null", WithLogger(newTestLogger()))
+	f.Cleanup(updater.Stop)
+	updater.coingeckoURL = "https://fuzz.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	return updater
+}
+
+func FuzzUpdateLastParse(f *testing.F) {
+	// Composed after a real response, from the /simple/price endpoint.
+	f.Add([]byte(`{"bitcoin":{"usd":62345,"eur":57000.12,"btc":1.0},"ethereum":{"usd":2456.78,"eur":2245.1,"btc":0.03938},"usd-coin":{"usd":1.001}}`))
+	f.Add([]byte(`{"bitcoin":null,"dogecoin":{"usd":0.1},"ethereum":{"xyz":1}}`))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[1,2,3]`))
+	transport := &bodyTransport{}
+	updater := newFuzzRateUpdater(f, transport)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		transport.body = body
+		updater.updateLast(context.Background())
+		for _, fiats := range updater.LatestPrice() {
+			for fiat := range fiats {
+				_, _ = updater.LatestPriceForPair("BTC", fiat)
+			}
+		}
+	})
+}
+
+func FuzzHistoryParse(f *testing.F) {
+	// Composed after a real response, from the /coins/bitcoin/market_chart/range endpoint.
+	f.Add([]byte(`{"prices":[[1598918700000,11691.3],[1598922501000,11692.7]],"market_caps":[[1598918700000,216161290432.8]],"total_volumes":[[1598918700000,28316329457.8]]}`))
+	f.Add([]byte(`{"prices":[]}`))
+	f.Add([]byte(`{"prices":[[1e300,1],[-1,-1],[0]]}`))
+	f.Add([]byte(`{"prices":null}`))
+	transport := &bodyTransport{}
+	updater := newFuzzRateUpdater(f, transport)
+	f.Fuzz(func(t *testing.T, body []byte) {
+		transport.body = body
+		updater.history = newHistoryMap(nil)
+		g := fixedTimeRange(time.Unix(1598918400, 0), time.Unix(1599004800, 0))
+		if _, err := updater.updateHistory(context.Background(), "btc", "USD", g); err != nil {
+			return
+		}
+		updater.HistoricalPriceAt("btc", "USD", time.Unix(1598920000, 0))
+		updater.HistoryGaps("btc", "USD", time.Hour, 0)
+	})
+}
@@ -0,0 +1,430 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+// newSimplePriceServer returns a test server responding to /simple/price requests
+// with the given body.
+func newSimplePriceServer(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/simple/price", r.URL.Path, "URL path")
+		fmt.Fprintln(w, body)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func sortedKeys(m map[string]map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestUpdateLastTestnetPassthrough(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK, `{
+		"bitcoin": {"usd": 20000.0, "eur": 19000.0},
+		"litecoin": {"usd": 70.0},
+		"ethereum": {"usd": 1500.0}
+	}`)
+
+	tt := []struct {
+		name         string
+		opts         []Option
+		wantTestnets bool
+	}{
+		{"default", nil, true},
+		{"enabled", []Option{WithTestnetPassthrough(true)}, true},
+		{"disabled", []Option{WithTestnetPassthrough(false)}, false},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			updater := NewRateUpdater(mock.Client(), "/dev/null", append(test.opts, WithLogger(newTestLogger()))...)
+			defer updater.Stop()
+			updater.coingeckoURL = "https://coingecko.test"
+			updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+			updater.updateLast(context.Background())
+			last := updater.LatestPrice()
+			assert.Equal(t, 20000.0, last["BTC"]["USD"])
+			assert.Equal(t, 1500.0, last["ETH"]["USD"])
+			if !test.wantTestnets {
+				assert.Equal(t, []string{"BTC", "ETH", "LTC", "sat"}, sortedKeys(last))
+				return
+			}
+			assert.Equal(t, last["BTC"], last["TBTC"])
+			assert.Equal(t, last["BTC"], last["RBTC"])
+			assert.Equal(t, last["ETH"], last["SEPETH"])
+			assert.Equal(t, last["LTC"], last["TLTC"])
+		})
+	}
+}
+
+func TestUpdateLastSepolia(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0, "chf": 1400.0}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.updateLast(context.Background())
+	assert.Equal(t, map[string]float64{"USD": 1500.0, "CHF": 1400.0}, updater.LatestPrice()["SEPETH"])
+}
+
+func TestRegisterTestnetMapping(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.RegisterTestnetMapping("HOLETH", "ETH")
+	updater.RegisterTestnetMapping("TLTC", "ETH") // replaces the default mapping
+	updater.updateLast(context.Background())
+	last := updater.LatestPrice()
+	assert.Equal(t, map[string]float64{"USD": 1500.0}, last["HOLETH"])
+	assert.Equal(t, map[string]float64{"USD": 1500.0}, last["TLTC"])
+	assert.Equal(t, map[string]float64{"USD": 70.0}, last["LTC"])
+}
+
+func TestPriceAtBlock(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	blockTime := time.Unix(1598918700, 0)
+	assert.Equal(t, 2.0, updater.PriceAtBlock("btc", "USD", blockTime))
+	assert.Equal(t, updater.HistoricalPriceAt("btc", "USD", blockTime.Add(time.Hour)),
+		updater.PriceAtBlock("btc", "USD", blockTime.Add(time.Hour)))
+	assert.Zero(t, updater.PriceAtBlock("eth", "USD", blockTime))
+}
+
+func TestWithBBoltOptions(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("TestWithBBoltOptions")
+	defer os.RemoveAll(dbdir)
+
+	// Another process holding the database is simulated by opening it separately,
+	// which obtains an exclusive file lock.
+	db, err := openRatesDB(dbdir, defaultBBoltOptions())
+	require.NoError(t, err)
+	_, err = openRatesDB(dbdir, &bbolt.Options{Timeout: time.Millisecond})
+	require.Equal(t, bbolt.ErrTimeout, err)
+
+	updater := NewRateUpdater(nil, dbdir, WithBBoltOptions(&bbolt.Options{Timeout: time.Millisecond}), WithLogger(newTestLogger()))
+	// Unusable, but still working without the database cache.
+	require.Error(t, updater.dumpHistoryBucket("btcUSD", nil))
+	updater.Stop()
+
+	require.NoError(t, db.Close())
+	updater = NewRateUpdater(nil, dbdir, WithBBoltOptions(&bbolt.Options{Timeout: time.Millisecond, NoSync: true}), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	require.NoError(t, updater.dumpHistoryBucket("btcUSD", nil))
+	assert.True(t, updater.historyDB.NoSync)
+}
+
+func TestUpdateRateLimit(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	recorder := testutil.NewRecordingRoundTripper(testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}}`))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithTransport(recorder), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.SetCoingeckoURL("https://coingecko.test")
+
+	// countRequests returns the number of requests completed within the window.
+	countRequests := func(window time.Duration) int32 {
+		before := len(recorder.Exchanges())
+		ctx, cancel := context.WithTimeout(context.Background(), window)
+		defer cancel()
+		for ctx.Err() == nil {
+			updater.updateLast(ctx)
+		}
+		return int32(len(recorder.Exchanges()) - before)
+	}
+
+	const window = 300 * time.Millisecond
+	updater.UpdateRateLimit(3, window)
+	low := countRequests(window)
+	assert.LessOrEqual(t, low, int32(4))
+
+	updater.UpdateRateLimit(300, window)
+	high := countRequests(window)
+	assert.Greater(t, high, 3*low)
+
+	// Invalid limits are ignored.
+	limiter := updater.limiter()
+	updater.UpdateRateLimit(0, window)
+	assert.Same(t, limiter, updater.limiter())
+}
+
+func TestWithLogger(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	updater := NewRateUpdater(nil, "/nonexistent", WithLogger(logrus.NewEntry(logger)))
+	defer updater.Stop()
+	assert.Contains(t, buf.String(), "database is unusable")
+}
+
+// CoinGecko returns the rates of coins with very small unit prices in scientific notation.
+func TestUpdateLastScientificNotation(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK, `{"shiba-inu":{"usd":8e-9,"btc":1.3E-13,"eur":7.5e-09}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	updater.simplePriceIDs = "shiba-inu"
+	updater.simplePriceUnits = map[string]string{"shiba-inu": "SHIB"}
+
+	updater.updateLast(context.Background())
+	mock.AssertCalledWith(t, "/simple/price", "ids", "shiba-inu")
+	last := updater.LatestPrice()["SHIB"]
+	assert.InEpsilon(t, 8e-9, last["USD"], 1e-15)
+	assert.InEpsilon(t, 7.5e-9, last["EUR"], 1e-15)
+	assert.InEpsilon(t, 1.3e-13, last["BTC"], 1e-15)
+	assert.InEpsilon(t, 1.3e-5, last["sat"], 1e-15)
+}
+
+func TestValidateRatesResponse(t *testing.T) {
+	defaultIDs := strings.Split(simplePriceAllIDs, ",")
+	valid := map[string]map[string]float64{
+		"bitcoin":  {"usd": 20000.0},
+		"litecoin": {"usd": 70.0},
+		"ethereum": {"usd": 1500.0},
+	}
+	require.NoError(t, validateRatesResponse(valid, defaultIDs))
+	// Fewer coins are enough if fewer were requested, and BTC/USD only if bitcoin was.
+	require.NoError(t, validateRatesResponse(map[string]map[string]float64{
+		"ethereum": {"usd": 1500.0},
+	}, []string{"ethereum"}))
+	require.NoError(t, validateRatesResponse(map[string]map[string]float64{
+		"bitcoin":  {"usd": 20000.0},
+		"ethereum": {"usd": 1500.0},
+	}, []string{"bitcoin", "ethereum"}))
+
+	tt := []struct {
+		name  string
+		ids   []string
+		rates map[string]map[string]float64
+	}{
+		{"too few coins", defaultIDs, map[string]map[string]float64{
+			"bitcoin":  {"usd": 20000.0},
+			"ethereum": {"usd": 1500.0},
+		}},
+		{"too few requested coins", []string{"bitcoin", "ethereum"}, map[string]map[string]float64{
+			"bitcoin": {"usd": 20000.0},
+		}},
+		{"no coins", []string{"ethereum"}, map[string]map[string]float64{}},
+		{"coin without rates", defaultIDs, map[string]map[string]float64{
+			"bitcoin":  {"usd": 20000.0},
+			"litecoin": {},
+			"ethereum": {"usd": 1500.0},
+		}},
+		{"mirror returning empty objects", defaultIDs, map[string]map[string]float64{
+			"bitcoin":  {},
+			"litecoin": {},
+			"ethereum": {},
+		}},
+		{"mirror returning empty objects for configured coins", []string{"ethereum", "tether"},
+			map[string]map[string]float64{
+				"ethereum": {},
+				"tether":   {},
+			}},
+		{"BTC/USD missing", defaultIDs, map[string]map[string]float64{
+			"bitcoin":  {"eur": 19000.0},
+			"litecoin": {"usd": 70.0},
+			"ethereum": {"usd": 1500.0},
+		}},
+		{"BTC/USD zero", []string{"bitcoin"}, map[string]map[string]float64{
+			"bitcoin": {"usd": 0},
+		}},
+	}
+	for _, test := range tt {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRatesResponse(test.rates, test.ids)
+			require.Error(t, err)
+			assert.Equal(t, ErrInvalidResponse, errp.Cause(err))
+		})
+	}
+}
+
+func TestUpdateLastInvalidResponse(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK, `{"bitcoin": {}, "litecoin": {}, "ethereum": {}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	previous := map[string]map[string]float64{"BTC": {"USD": 20000.0}}
+	updater.last = previous
+
+	updater.updateLast(context.Background())
+	assert.Equal(t, previous, updater.LatestPrice())
+
+	// Also if the coins were configured by AutoConfigureFromWallet.
+	mock.On("/simple/price", http.StatusOK, `{"ethereum": {}, "tether": {}}`)
+	require.NoError(t, updater.AutoConfigureFromWallet([]string{"ETH", "USDT"}))
+	updater.updateLast(context.Background())
+	assert.Equal(t, previous, updater.LatestPrice())
+}
+
+func TestUpdateLastResponseCacheTTL(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	recorder := testutil.NewRecordingRoundTripper(testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`))
+	calls := func() int { return len(recorder.Exchanges()) }
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithTransport(recorder),
+		WithResponseCacheTTL(5*time.Second), WithClockFunc(clock.Now), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.SetCoingeckoURL("https://coingecko.test")
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+	var events int
+	updater.Observe(func(observable.Event) { events++ })
+
+	for i := 0; i < 3; i++ {
+		updater.updateLast(context.Background())
+		clock.Advance(time.Second)
+	}
+	assert.Equal(t, 1, calls())
+	assert.Equal(t, 1, events)
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+
+	clock.Advance(2 * time.Second)
+	updater.updateLast(context.Background())
+	assert.Equal(t, 2, calls())
+	assert.Equal(t, 1, events)
+
+	// Other coins are fetched regardless.
+	require.NoError(t, updater.AutoConfigureFromWallet([]string{"BTC"}))
+	updater.updateLast(context.Background())
+	assert.Equal(t, 3, calls())
+}
+
+func TestLastUpdateLoop(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	requests := make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+		requests <- struct{}{}
+	}))
+	defer ts.Close()
+	clock := testutil.NewFakeClock(time.Unix(1598832000, 0))
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithClockFunc(clock.Now), WithTimer(clock), WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.StartCurrentRates()
+	<-requests
+	for i := 0; i < 3; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(interval - time.Second)
+		select {
+		case <-requests:
+			t.Fatal("updated before the interval passed")
+		case <-time.After(10 * time.Millisecond):
+		}
+		clock.Advance(time.Second)
+		<-requests
+	}
+}
+
+func TestLatestPriceConcurrentUpdates(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every other update fails, resetting the latest rates, and the others change them.
+		n := requests.Add(1)
+		if n%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"bitcoin": {"usd": %d}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`, 20000+n)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	admin := updater.adminHandler()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			updater.updateLast(context.Background())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if last := updater.LatestPrice(); len(last) > 0 {
+			assert.Equal(t, 70.0, last["LTC"]["USD"])
+		}
+		_, _ = updater.LatestPriceForPair("BTC", "USD")
+		_ = updater.Clone().LatestPrice()
+		_ = updater.Snapshot()
+		_ = updater.CheckPushAlerts()
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rates/current", nil))
+		assert.Contains(t, []int{http.StatusOK, http.StatusServiceUnavailable}, rec.Code)
+	}
+}
+
+func TestExchangeRateString(t *testing.T) {
+	rate := exchangeRate{value: 20000.5, timestamp: time.Unix(1598918400, 0)}
+	assert.Equal(t, "20000.5 @ 2020-09-01T00:00:00Z", rate.String())
+	assert.Equal(t, "20000.5 @ 2020-09-01T00:00:00Z", fmt.Sprint(rate))
+}
+
+func TestFiatJSON(t *testing.T) {
+	for _, fiat := range allFiats {
+		assert.Equal(t, fiat.String(), fiat.FiatCode())
+		encoded, err := json.Marshal(fiat)
+		require.NoError(t, err)
+		assert.Equal(t, `"`+fiat.FiatCode()+`"`, string(encoded))
+		var decoded Fiat
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, fiat, decoded)
+	}
+	// Also as a field and a map key.
+	encoded, err := json.Marshal(map[Fiat]struct{ Fiat Fiat }{CHF: {Fiat: SAT}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"CHF":{"Fiat":"sat"}}`, string(encoded))
+}
@@ -0,0 +1,276 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// RepairReport is the result of RepairDB.
+type RepairReport struct {
+	// BucketsScanned is the number of coin+fiat pair buckets checked.
+	BucketsScanned int
+	// EntriesRemoved is the number of malformed key/value pairs deleted.
+	EntriesRemoved int
+	// EntriesRestored is the number of rates fetched again to replace the removed ones.
+	EntriesRestored int
+}
+
+// corruptHistoryBucket is a history bucket with malformed entries, found by RepairDB.
+type corruptHistoryBucket struct {
+	key string
+	// malformed are the keys of the malformed entries.
+	malformed [][]byte
+	// malformedChunks are the keys of the version 3 chunks which can't be decoded.
+	malformedChunks [][]byte
+	// deleteBucket is whether the whole bucket is unusable, e.g. because its version 2
+	// rates can't be decoded.
+	deleteBucket bool
+	// timestamps are the timestamps of malformed version 1 entries with an intact key, and the
+	// start and end of the months of malformed version 3 chunks.
+	timestamps []time.Time
+	// lostUnknown is whether rates of unknown timestamps were lost.
+	lostUnknown bool
+}
+
+// RepairDB removes malformed entries from the history buckets of the database cache, e.g.
+// values truncated by a power loss during a write, and fetches the lost rates again from
+// CoinGecko. In the bbolt database, version 1 entries and version 3 chunks are checked
+// individually, and a version 2 bucket is removed entirely if its rates can't be decoded.
+// In other HistoryStores, see WithHistoryStore, a bucket is removed entirely if it can't be
+// read, counting as one removed entry. Where the timestamps of the lost rates are unknown, the
+// last 90 days are fetched again, leaving older rates to be backfilled by the history update
+// loop.
+//
+// Errors are logged, and the report covers the work done until then.
+func (updater *RateUpdater) RepairDB(ctx context.Context) RepairReport {
+	var report RepairReport
+	var corrupt []*corruptHistoryBucket
+	var err error
+	if repairer, ok := updater.historyStore.(historyRepairer); ok {
+		report.BucketsScanned, corrupt, err = repairer.repair(ctx)
+	} else {
+		report.BucketsScanned, corrupt, err = repairHistoryStore(ctx, updater.historyStore)
+	}
+	for _, found := range corrupt {
+		updater.planner.forget(found.key)
+		removed := len(found.malformed) + len(found.malformedChunks)
+		report.EntriesRemoved += removed
+		updater.log.Printf("RepairDB: removed %d malformed entries of %s", removed, found.key)
+	}
+	if err != nil {
+		updater.log.WithError(err).Error("RepairDB: could not repair the database")
+		return report
+	}
+
+	for _, found := range corrupt {
+		n, err := updater.restoreHistory(ctx, found)
+		report.EntriesRestored += n
+		if err != nil {
+			updater.log.WithError(err).Errorf("RepairDB: could not restore the rates of %s", found.key)
+		}
+	}
+	return report
+}
+
+// historyRepairer is implemented by HistoryStores which can find and remove malformed entries
+// within their buckets. See RepairDB.
+type historyRepairer interface {
+	// repair removes the malformed entries of all history buckets. It returns the number of
+	// buckets scanned and the corrupt ones, of which the malformed entries were removed.
+	repair(ctx context.Context) (int, []*corruptHistoryBucket, error)
+}
+
+// repair implements historyRepairer.
+func (store *BBoltHistoryStore) repair(ctx context.Context) (int, []*corruptHistoryBucket, error) {
+	var scanned int
+	var corrupt []*corruptHistoryBucket
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if _, _, ok := splitHistoryKey(string(name)); !ok {
+				return nil
+			}
+			scanned++
+			if found := scanHistoryBucket(string(name), bucket); found != nil {
+				corrupt = append(corrupt, found)
+			}
+			return nil
+		})
+	})
+	if err != nil || len(corrupt) == 0 {
+		return scanned, nil, err
+	}
+
+	err = store.db.Update(func(tx *bbolt.Tx) error {
+		for _, found := range corrupt {
+			if found.deleteBucket {
+				if err := tx.DeleteBucket([]byte(found.key)); err != nil {
+					return err
+				}
+				continue
+			}
+			bucket := tx.Bucket([]byte(found.key))
+			for _, key := range found.malformed {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			for _, key := range found.malformedChunks {
+				if err := bucket.Bucket(historyChunksKey).Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return scanned, nil, err
+	}
+	return scanned, corrupt, nil
+}
+
+// repairHistoryStore deletes the history buckets of store which can't be read. It returns the
+// number of buckets scanned and the deleted ones, until the first error.
+func repairHistoryStore(ctx context.Context, store HistoryStore) (int, []*corruptHistoryBucket, error) {
+	keys, err := historyKeys(store)
+	if err != nil {
+		return 0, nil, err
+	}
+	var scanned int
+	var corrupt []*corruptHistoryBucket
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return scanned, corrupt, err
+		}
+		scanned++
+		if _, err := store.ReadBucket(key); err == nil {
+			continue
+		}
+		if err := store.DeleteBucket(key); err != nil {
+			return scanned, corrupt, err
+		}
+		corrupt = append(corrupt, &corruptHistoryBucket{
+			key:          key,
+			malformed:    [][]byte{[]byte(key)},
+			deleteBucket: true,
+			lostUnknown:  true,
+		})
+	}
+	return scanned, corrupt, nil
+}
+
+// scanHistoryBucket returns the malformed entries of a history bucket, or nil if there are none.
+func scanHistoryBucket(key string, bucket *bbolt.Bucket) *corruptHistoryBucket {
+	found := &corruptHistoryBucket{key: key}
+	switch historyBucketSchema(bucket) {
+	case historySchemaV3:
+		_ = bucket.Bucket(historyChunksKey).ForEach(func(k, v []byte) error {
+			if _, err := decodeDelta(v); err == nil {
+				return nil
+			}
+			found.malformedChunks = append(found.malformedChunks, append([]byte(nil), k...))
+			month, err := time.Parse(historyChunkLayout, string(k))
+			if err != nil {
+				found.lostUnknown = true
+				return nil
+			}
+			found.timestamps = append(found.timestamps, month, month.AddDate(0, 1, 0))
+			return nil
+		})
+		if value := bucket.Get(historyGranularityKey); value != nil && len(value) != 1 {
+			found.malformed = append(found.malformed, historyGranularityKey)
+		}
+	case historySchemaV2:
+		if _, err := decodeDelta(bucket.Get(historyDeltaKey)); err != nil {
+			found.deleteBucket = true
+			found.lostUnknown = true
+			_ = bucket.ForEach(func(k, _ []byte) error {
+				found.malformed = append(found.malformed, append([]byte(nil), k...))
+				return nil
+			})
+			return found
+		}
+		if value := bucket.Get(historyGranularityKey); value != nil && len(value) != 1 {
+			found.malformed = append(found.malformed, historyGranularityKey)
+		}
+	default:
+		_ = bucket.ForEach(func(k, v []byte) error {
+			if len(k) == 8 && len(v) == 8 {
+				return nil
+			}
+			found.malformed = append(found.malformed, append([]byte(nil), k...))
+			if len(k) == 8 {
+				found.timestamps = append(found.timestamps, time.Unix(int64(binary.BigEndian.Uint64(k)), 0))
+			} else {
+				found.lostUnknown = true
+			}
+			return nil
+		})
+	}
+	if len(found.malformed) == 0 && len(found.malformedChunks) == 0 {
+		return nil
+	}
+	return found
+}
+
+// restoreHistory fetches the rates lost in a corrupt bucket and stores them.
+// It returns the number of rates stored.
+func (updater *RateUpdater) restoreHistory(ctx context.Context, found *corruptHistoryBucket) (int, error) {
+	coin, fiat, _ := splitHistoryKey(found.key)
+	var start, end time.Time
+	if found.lostUnknown {
+		end = updater.clock()
+		start = end.Add(-90*24*time.Hour + time.Hour) // as in backfillHistory
+	}
+	if len(found.timestamps) > 0 {
+		sort.Slice(found.timestamps, func(i, j int) bool {
+			return found.timestamps[i].Before(found.timestamps[j])
+		})
+		// Pad by an hour to get the rates at the boundaries.
+		first := found.timestamps[0].Add(-time.Hour)
+		last := found.timestamps[len(found.timestamps)-1].Add(time.Hour)
+		if start.IsZero() || first.Before(start) {
+			start = first
+		}
+		if last.After(end) {
+			end = last
+		}
+		if now := updater.clock(); end.After(now) {
+			end = now
+		}
+	}
+	var total int
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(maxGeckoRange) {
+		chunkEnd := chunkStart.Add(maxGeckoRange)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		fetchedRates, err := updater.fetchGeckoMarketRange(ctx, coin, fiat, fixedTimeRange(chunkStart, chunkEnd))
+		if err != nil {
+			return total, err
+		}
+		updater.storeHistory(coin, fiat, fetchedRates)
+		total += len(fetchedRates)
+	}
+	return total, nil
+}
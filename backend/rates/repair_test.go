@@ -0,0 +1,206 @@
+package rates
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestRepairDB(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("repair")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	now := time.Unix(1700000000, 0)
+	mock := testutil.NewMockHTTPClient().
+		On("/coins/bitcoin/market_chart/range", http.StatusOK, `{"prices":[[1699999200000,10],[1700002800000,20]]}`).
+		On("/coins/ethereum/market_chart/range", http.StatusOK, `{"prices":[[1699992000000,30],[1699995600000,40],[1699999200000,50]]}`)
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+
+	// Healthy version 2 bucket.
+	require.NoError(t, updater.dumpHistoryBucket("ltcUSD", ratesEvery(now.Add(-10*time.Hour), time.Hour, 5)))
+	// Corrupt version 2 bucket.
+	require.NoError(t, updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		if err := writeHistoryBucketV2(tx, "ethUSD", ratesEvery(now.Add(-10*time.Hour), time.Hour, 5), GranularityHourly); err != nil {
+			return err
+		}
+		bucket := tx.Bucket([]byte("ethUSD"))
+		return bucket.Put(historyDeltaKey, bucket.Get(historyDeltaKey)[:5])
+	}))
+	// Version 1 bucket with truncated values and keys.
+	require.NoError(t, updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("btcUSD"))
+		if err != nil {
+			return err
+		}
+		for i, rate := range ratesEvery(now.Add(-3*time.Hour), time.Hour, 3) {
+			var tsbytes, vbytes [8]byte
+			binary.BigEndian.PutUint64(tsbytes[:], uint64(rate.timestamp.Unix()))
+			binary.BigEndian.PutUint64(vbytes[:], math.Float64bits(rate.value))
+			value := vbytes[:]
+			if i == 1 {
+				value = value[:3] // truncated
+			}
+			if err := bucket.Put(tsbytes[:], value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	report := updater.RepairDB(context.Background())
+	assert.Equal(t, RepairReport{
+		BucketsScanned: 3,
+		// 1 truncated value, the delta and granularity of ethUSD.
+		EntriesRemoved:  3,
+		EntriesRestored: 5,
+	}, report)
+
+	requests := mock.Requests()
+	require.Len(t, requests, 2)
+	for _, req := range requests {
+		switch req.URL.Path {
+		case "/coins/bitcoin/market_chart/range":
+			// The hour around the truncated value at now-2h.
+			assert.Equal(t, "1699989200", req.URL.Query().Get("from"))
+			assert.Equal(t, "1699996400", req.URL.Query().Get("to"))
+		case "/coins/ethereum/market_chart/range":
+			// The last 90 days.
+			assert.Equal(t, "1700000000", req.URL.Query().Get("to"))
+		}
+	}
+
+	// All buckets are readable now.
+	loaded := map[string][]exchangeRate{}
+	require.NoError(t, updater.historyDB.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bbolt.Bucket) error {
+			if _, _, ok := splitHistoryKey(string(name)); !ok {
+				return nil
+			}
+			rates, err := readHistoryBucket(bucket)
+			loaded[string(name)] = rates
+			return err
+		})
+	}))
+	assert.Len(t, loaded["ltcUSD"], 5)
+	assert.Len(t, loaded["ethUSD"], 3)
+	// 2 intact entries and 2 restored ones.
+	assert.Len(t, loaded["btcUSD"], 4)
+
+	// Nothing left to repair.
+	assert.Equal(t, RepairReport{BucketsScanned: 3}, updater.RepairDB(context.Background()))
+}
+
+func TestRepairDBChunk(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dbdir := test.TstTempDir("repair-chunk")
+	defer func() { _ = os.RemoveAll(dbdir) }()
+	now := time.Unix(1711886400, 0) // 2024-03-31 12:00 UTC
+	mock := testutil.NewMockHTTPClient().
+		On("/coins/bitcoin/market_chart/range", http.StatusOK, `{"prices":[[1707264000000,10],[1707350400000,20]]}`)
+	updater := NewRateUpdater(mock.Client(), dbdir,
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+
+	// Daily rates of January to March 2024, with the chunk of February truncated.
+	require.NoError(t, updater.dumpHistoryBucket("btcUSD", ratesEvery(time.Unix(1704067200, 0), 24*time.Hour, 91)))
+	require.NoError(t, updater.historyDB.Update(func(tx *bbolt.Tx) error {
+		chunks := tx.Bucket([]byte("btcUSD")).Bucket(historyChunksKey)
+		return chunks.Put([]byte("2024-02"), chunks.Get([]byte("2024-02"))[:5])
+	}))
+
+	assert.Equal(t, RepairReport{
+		BucketsScanned:  1,
+		EntriesRemoved:  1,
+		EntriesRestored: 2,
+	}, updater.RepairDB(context.Background()))
+	requests := mock.Requests()
+	require.Len(t, requests, 1)
+	// February, padded by an hour.
+	assert.Equal(t, "1706742000", requests[0].URL.Query().Get("from"))
+	assert.Equal(t, "1709254800", requests[0].URL.Query().Get("to"))
+
+	rates, err := updater.historyStore.ReadBucket("btcUSD")
+	require.NoError(t, err)
+	// January, the restored rates and March.
+	assert.Len(t, rates, 31+2+31)
+	assert.Equal(t, RepairReport{BucketsScanned: 1}, updater.RepairDB(context.Background()))
+}
+
+// unreadableHistoryStore is a MemoryHistoryStore failing to read the buckets in unreadable.
+type unreadableHistoryStore struct {
+	*MemoryHistoryStore
+	unreadable map[string]bool
+}
+
+func (store *unreadableHistoryStore) ReadBucket(name string) ([]exchangeRate, error) {
+	if store.unreadable[name] {
+		return nil, errp.New("corrupt bucket")
+	}
+	return store.MemoryHistoryStore.ReadBucket(name)
+}
+
+func (store *unreadableHistoryStore) DeleteBucket(name string) error {
+	delete(store.unreadable, name)
+	return store.MemoryHistoryStore.DeleteBucket(name)
+}
+
+func TestRepairDBHistoryStore(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Unix(1700000000, 0)
+	mock := testutil.NewMockHTTPClient().
+		On("/coins/ethereum/market_chart/range", http.StatusOK, `{"prices":[[1699992000000,30],[1699995600000,40],[1699999200000,50]]}`)
+	store := &unreadableHistoryStore{
+		MemoryHistoryStore: NewMemoryHistoryStore(),
+		unreadable:         map[string]bool{"ethUSD": true},
+	}
+	require.NoError(t, store.WriteBucket("ltcUSD", ratesEvery(now.Add(-10*time.Hour), time.Hour, 5)))
+	require.NoError(t, store.WriteBucket("ethUSD", ratesEvery(now.Add(-10*time.Hour), time.Hour, 5)))
+	updater := NewRateUpdater(mock.Client(), "/dev/null",
+		WithHistoryStore(store),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+
+	assert.Equal(t, RepairReport{
+		BucketsScanned:  2,
+		EntriesRemoved:  1,
+		EntriesRestored: 3,
+	}, updater.RepairDB(context.Background()))
+	// The last 90 days.
+	requests := mock.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "1700000000", requests[0].URL.Query().Get("to"))
+
+	rates, err := store.ReadBucket("ethUSD")
+	require.NoError(t, err)
+	assert.Len(t, rates, 3)
+	rates, err = store.ReadBucket("ltcUSD")
+	require.NoError(t, err)
+	assert.Len(t, rates, 5)
+	assert.Equal(t, RepairReport{BucketsScanned: 2}, updater.RepairDB(context.Background()))
+}
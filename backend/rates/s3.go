@@ -0,0 +1,139 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// s3Timeout is the timeout of the S3 download in NewS3RateUpdater and the upload in Stop.
+const s3Timeout = time.Minute
+
+var (
+	// ErrS3ObjectNotFound is returned by S3Client.GetObject if the object does not exist.
+	ErrS3ObjectNotFound = errors.New("s3 object not found")
+	// ErrS3PreconditionFailed is returned by S3Client.PutObject if the object's ETag does not
+	// match, i.e. the object was modified concurrently.
+	ErrS3PreconditionFailed = errors.New("s3 precondition failed")
+)
+
+// S3Client is the subset of an S3-compatible object store client used by NewS3RateUpdater.
+// It is implemented by wrapping e.g. the AWS SDK client.
+type S3Client interface {
+	// GetObject returns the content of the object and its ETag. It returns an error wrapping
+	// ErrS3ObjectNotFound if there is no such object.
+	GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, string, error)
+	// PutObject stores the object if its current ETag is ifMatch (If-Match header), or if
+	// ifMatch is empty and the object doesn't exist yet (If-None-Match: *). It returns the new
+	// ETag, or an error wrapping ErrS3PreconditionFailed if the condition is not met.
+	PutObject(ctx context.Context, bucket, key string, body io.Reader, ifMatch string) (string, error)
+}
+
+// s3Sync is the location of the historical rates database in an object store.
+// See NewS3RateUpdater.
+type s3Sync struct {
+	client      S3Client
+	bucket, key string
+	// path is the local database file.
+	path string
+	// etag is the ETag of the downloaded object, empty if it did not exist.
+	etag string
+}
+
+// NewS3RateUpdater returns a rate updater like NewRateUpdater, with the historical rates
+// database stored under the key in an S3 bucket. The database is downloaded into the
+// localCachePath directory and used from there. Stop uploads it again, unless the object was
+// modified in the meantime, e.g. by another instance sharing the bucket, in which case the
+// local changes are discarded and an error is logged. A missing object starts an empty database.
+func NewS3RateUpdater(client S3Client, bucket, key, localCachePath string, httpClient *http.Client, opts ...Option) (*RateUpdater, error) {
+	store := &s3Sync{client: client, bucket: bucket, key: key, path: filepath.Join(localCachePath, "rates.db")}
+	if err := store.download(); err != nil {
+		return nil, err
+	}
+	updater := NewRateUpdater(httpClient, localCachePath, opts...)
+	updater.s3 = store
+	return updater, nil
+}
+
+// download writes the database object to the local file, replacing any existing one.
+func (store *s3Sync) download() error {
+	if err := os.MkdirAll(filepath.Dir(store.path), 0700); err != nil {
+		return errp.WithStack(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	body, etag, err := store.client.GetObject(ctx, store.bucket, store.key)
+	if errors.Is(err, ErrS3ObjectNotFound) {
+		if err := os.Remove(store.path); err != nil && !os.IsNotExist(err) {
+			return errp.WithStack(err)
+		}
+		return nil
+	}
+	if err != nil {
+		return errp.WithMessage(err, "could not download the rates database")
+	}
+	defer body.Close() //nolint:errcheck
+	tmp := store.path + ".tmp"
+	if err := writeS3Download(tmp, body); err != nil {
+		// Don't leave a partial download behind.
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		_ = os.Remove(tmp)
+		return errp.WithStack(err)
+	}
+	store.etag = etag
+	return nil
+}
+
+// writeS3Download writes the body of a downloaded object to a new file at path.
+func writeS3Download(path string, body io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return errp.WithMessage(err, "could not download the rates database")
+	}
+	return errp.WithStack(f.Close())
+}
+
+// upload stores the local database file as the object, unless it was modified since it was
+// downloaded or last uploaded.
+func (store *s3Sync) upload() error {
+	data, err := os.ReadFile(store.path)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s3Timeout)
+	defer cancel()
+	etag, err := store.client.PutObject(ctx, store.bucket, store.key, bytes.NewReader(data), store.etag)
+	if err != nil {
+		return errp.WithMessage(err, "could not upload the rates database")
+	}
+	store.etag = etag
+	return nil
+}
@@ -0,0 +1,146 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockS3Client is an in-memory S3Client with ETags counting the versions of the objects.
+type mockS3Client struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	etags   map[string]string
+	version int
+}
+
+func newMockS3Client() *mockS3Client {
+	return &mockS3Client{objects: map[string][]byte{}, etags: map[string]string{}}
+}
+
+func (client *mockS3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, string, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	data, ok := client.objects[bucket+"/"+key]
+	if !ok {
+		return nil, "", ErrS3ObjectNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), client.etags[bucket+"/"+key], nil
+}
+
+func (client *mockS3Client) PutObject(ctx context.Context, bucket, key string, body io.Reader, ifMatch string) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.etags[bucket+"/"+key] != ifMatch {
+		return "", ErrS3PreconditionFailed
+	}
+	client.version++
+	etag := fmt.Sprintf("v%d", client.version)
+	client.objects[bucket+"/"+key] = data
+	client.etags[bucket+"/"+key] = etag
+	return etag, nil
+}
+
+func TestNewS3RateUpdater(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestNewS3RateUpdater")
+	defer os.RemoveAll(dir)
+	client := newMockS3Client()
+
+	// Starts with an empty database if there is none yet.
+	updater, err := NewS3RateUpdater(client, "bucket", "rates.db", filepath.Join(dir, "a"), nil,
+		WithLogger(newTestLogger()))
+	require.NoError(t, err)
+	updater.storeHistory("btc", "USD", []exchangeRate{{value: 1, timestamp: time.Unix(1598832000, 0)}})
+	updater.Stop()
+	require.Equal(t, "v1", client.etags["bucket/rates.db"])
+
+	// Another instance downloads the uploaded database.
+	updater, err = NewS3RateUpdater(client, "bucket", "rates.db", filepath.Join(dir, "b"), nil,
+		WithLogger(newTestLogger()))
+	require.NoError(t, err)
+	rates, err := updater.loadHistoryBucket("btcUSD")
+	require.NoError(t, err)
+	require.Len(t, rates, 1)
+	assert.Equal(t, 1.0, rates[0].value)
+	updater.storeHistory("btc", "USD", []exchangeRate{{value: 2, timestamp: time.Unix(1598835600, 0)}})
+	updater.Stop()
+	assert.Equal(t, "v2", client.etags["bucket/rates.db"])
+}
+
+func TestNewS3RateUpdaterConcurrentModification(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestNewS3RateUpdaterConcurrentModification")
+	defer os.RemoveAll(dir)
+	client := newMockS3Client()
+	_, err := client.PutObject(context.Background(), "bucket", "rates.db", bytes.NewReader(nil), "")
+	require.NoError(t, err)
+
+	updater1, err := NewS3RateUpdater(client, "bucket", "rates.db", filepath.Join(dir, "a"), nil,
+		WithLogger(newTestLogger()))
+	require.NoError(t, err)
+	updater2, err := NewS3RateUpdater(client, "bucket", "rates.db", filepath.Join(dir, "b"), nil,
+		WithLogger(newTestLogger()))
+	require.NoError(t, err)
+	updater1.Stop()
+	uploaded := client.objects["bucket/rates.db"]
+	require.Equal(t, "v2", client.etags["bucket/rates.db"])
+
+	// The upload of the stale database is rejected.
+	updater2.storeHistory("btc", "USD", []exchangeRate{{value: 1, timestamp: time.Unix(1598832000, 0)}})
+	updater2.Stop()
+	assert.Equal(t, "v2", client.etags["bucket/rates.db"])
+	assert.Equal(t, uploaded, client.objects["bucket/rates.db"])
+}
+
+type failingS3Client struct{ *mockS3Client }
+
+func (*failingS3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, string, error) {
+	return nil, "", errors.New("access denied")
+}
+
+func TestNewS3RateUpdaterDownloadError(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestNewS3RateUpdaterDownloadError")
+	defer os.RemoveAll(dir)
+	_, err := NewS3RateUpdater(&failingS3Client{newMockS3Client()}, "bucket", "rates.db", dir, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "access denied")
+}
+
+// truncatingS3Client returns objects whose body fails after a few bytes, like a dropped
+// connection.
+type truncatingS3Client struct{ *mockS3Client }
+
+func (*truncatingS3Client) GetObject(ctx context.Context, bucket, key string) (io.ReadCloser, string, error) {
+	body := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection reset")))
+	return io.NopCloser(body), "v1", nil
+}
+
+func TestNewS3RateUpdaterPartialDownload(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	dir := test.TstTempDir("TestNewS3RateUpdaterPartialDownload")
+	defer os.RemoveAll(dir)
+	_, err := NewS3RateUpdater(&truncatingS3Client{newMockS3Client()}, "bucket", "rates.db", dir, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection reset")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
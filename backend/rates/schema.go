@@ -0,0 +1,71 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// ValidateResponseSchema checks a "simple/price" response body against the invariants of its
+// schema, to detect CoinGecko renaming fields: it must contain the "bitcoin" coin, each coin must
+// have a "usd" rate and all rates must be positive finite numbers. The coins and fields are
+// checked in sorted order and the first violation is returned.
+//
+// The latest rates response is checked on each update if the default coins are requested, see
+// AutoConfigureFromWallet. A violation is logged as a warning but the rates are still used,
+// unless rejected by other checks.
+func ValidateResponseSchema(body []byte) error {
+	var response map[string]interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return errp.WithMessage(err, "could not parse response")
+	}
+	if _, ok := response["bitcoin"]; !ok {
+		return errp.New(`missing coin "bitcoin"`)
+	}
+	coins := make([]string, 0, len(response))
+	for coin := range response {
+		coins = append(coins, coin)
+	}
+	sort.Strings(coins)
+	for _, coin := range coins {
+		fields, ok := response[coin].(map[string]interface{})
+		if !ok {
+			return errp.Newf("coin %q is not an object", coin)
+		}
+		if _, ok := fields["usd"]; !ok {
+			return errp.Newf(`coin %q is missing "usd"`, coin)
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value, ok := fields[name].(float64)
+			if !ok {
+				return errp.Newf("%s.%s is not a number: %s", coin, name, fmt.Sprint(fields[name]))
+			}
+			if value <= 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+				return errp.Newf("%s.%s is not positive: %v", coin, name, value)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package rates
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateResponseSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"valid", `{"bitcoin": {"usd": 20000.0, "eur": 19000}, "ethereum": {"usd": 1500.0}}`, ""},
+		{"last updated at", `{"bitcoin": {"usd": 20000.0, "last_updated_at": 1598832000}}`, ""},
+		{"not json", `bitcoin`, "could not parse response"},
+		{"array", `[{"bitcoin": {"usd": 1}}]`, "could not parse response"},
+		// (a) bitcoin is required.
+		{"no bitcoin", `{"ethereum": {"usd": 1500.0}}`, `missing coin "bitcoin"`},
+		{"renamed bitcoin", `{"btc": {"usd": 20000.0}}`, `missing coin "bitcoin"`},
+		{"empty", `{}`, `missing coin "bitcoin"`},
+		// (b) each coin has usd.
+		{"no usd", `{"bitcoin": {"usd": 20000.0}, "ethereum": {"eur": 1400.0}}`, `coin "ethereum" is missing "usd"`},
+		{"renamed usd", `{"bitcoin": {"USD": 20000.0}}`, `coin "bitcoin" is missing "usd"`},
+		{"coin not an object", `{"bitcoin": 20000.0}`, `coin "bitcoin" is not an object`},
+		// (c) positive finite rates.
+		{"zero", `{"bitcoin": {"usd": 0}}`, "bitcoin.usd is not positive: 0"},
+		{"negative", `{"bitcoin": {"usd": 20000.0, "eur": -1}}`, "bitcoin.eur is not positive: -1"},
+		{"string", `{"bitcoin": {"usd": "20000.0"}}`, "bitcoin.usd is not a number: 20000.0"},
+		{"null", `{"bitcoin": {"usd": null}}`, "bitcoin.usd is not a number: <nil>"},
+		{"nested", `{"bitcoin": {"usd": {"price": 20000.0}}}`, "bitcoin.usd is not a number: map[price:20000]"},
+		{"overflow", `{"bitcoin": {"usd": 1e400}}`, "could not parse response"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateResponseSchema([]byte(test.body))
+			if test.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpdateLastSchemaWarning(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	// The rates of "ethereum" are keyed by "USD", which is not a valid CoinGecko fiat.
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusOK,
+		`{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"USD": 1500.0}}`)
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	updater := NewRateUpdater(mock.Client(), "/dev/null", WithLogger(logrus.NewEntry(logger)))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.updateLast(context.Background())
+	assert.Contains(t, buf.String(), "unexpected rates response schema")
+	assert.Contains(t, buf.String(), `coin \"ethereum\" is missing \"usd\"`)
+	// The rates are still used.
+	assert.Equal(t, 20000.0, updater.LatestPrice()["BTC"]["USD"])
+	assert.Equal(t, 70.0, updater.LatestPrice()["LTC"]["USD"])
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+)
+
+// selfTestFixture is the latest rates response served to the updater in SelfTest.
+const selfTestFixture = `{"bitcoin":{"usd":12345.67,"eur":11111.11},"litecoin":{"usd":70.5},"ethereum":{"usd":1500.25}}`
+
+// selfTestBTCUSD is the BTC/USD rate in selfTestFixture.
+const selfTestBTCUSD = 12345.67
+
+// selfTestTransport serves selfTestFixture to all requests, without a network connection.
+type selfTestTransport struct{}
+
+func (selfTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(selfTestFixture)),
+		ContentLength: int64(len(selfTestFixture)),
+		Request:       req,
+	}, nil
+}
+
+// SelfTest checks that the latest rates pipeline works end-to-end: it serves a known response
+// from memory to a new updater configured like this one, and checks the resulting rate and
+// event. It doesn't affect the state of this updater and releases all resources before
+// returning. It can be run periodically, e.g. for a health check.
+func (updater *RateUpdater) SelfTest(ctx context.Context) error {
+	dbdir, err := os.MkdirTemp("", "rates-selftest")
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer os.RemoveAll(dbdir) //nolint:errcheck
+	limiter := ratelimit.NewLimitedCall(time.Millisecond)
+	defer limiter.Stop()
+	testUpdater := NewRateUpdater(&http.Client{Transport: selfTestTransport{}}, dbdir,
+		WithLogger(updater.log.WithField("selfTest", true)),
+		WithClockFunc(updater.clockFunc),
+		withGeckoLimiter(limiter))
+	defer testUpdater.Stop()
+
+	events := make(chan observable.Event, 1)
+	unobserve := testUpdater.Observe(func(event observable.Event) {
+		select {
+		case events <- event:
+		default:
+		}
+	})
+	defer unobserve()
+
+	testUpdater.updateLast(ctx)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rate, err := testUpdater.latestPriceForPair("BTC", "USD")
+	if err != nil {
+		return errp.WithMessage(err, "self-test")
+	}
+	if rate != selfTestBTCUSD {
+		return errp.Newf("self-test: got BTC/USD rate %v, expected %v", rate, selfTestBTCUSD)
+	}
+	select {
+	case event := <-events:
+		if event.Subject != RatesEventSubject {
+			return errp.Newf("self-test: unexpected event subject %q", event.Subject)
+		}
+	default:
+		return errp.New("self-test: no rates event emitted")
+	}
+	return nil
+}
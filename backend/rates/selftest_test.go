@@ -0,0 +1,38 @@
+package rates
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// limiterGoroutines returns the number of goroutines of ratelimit.LimitedCall instances.
+func limiterGoroutines() int {
+	buf := make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]), "ratelimit.(*LimitedCall).tick")
+}
+
+func TestSelfTest(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+
+	require.NoError(t, updater.SelfTest(context.Background()))
+	// The goroutine of the limiter of updater has started by now.
+	before := limiterGoroutines()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, updater.SelfTest(context.Background()))
+	}
+	// Each self-test stops its rate limiter.
+	require.Eventually(t, func() bool { return limiterGoroutines() <= before },
+		time.Second, 10*time.Millisecond)
+	require.Empty(t, updater.LatestPrice(), "updater state changed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Error(t, updater.SelfTest(ctx))
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// RateSnapshot is the latest rates at a point in time, see Snapshot and CompareSnapshots. It is
+// also the format of the bundled latest rates generated at release build time, see
+// WithBundledAsset, and of the persisted ones, see WithRatePersistenceFile, so those can be
+// used as snapshots, e.g. as golden files in tests.
+type RateSnapshot struct {
+	// Timestamp is when the snapshot was taken, which for the bundled and persisted rates is when
+	// they were fetched.
+	Timestamp time.Time `json:"timestamp"`
+	// Rates has the same format as LatestPrice.
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// SnapshotPair is a (coin, fiat) pair in a SnapshotDiff.
+type SnapshotPair struct {
+	// Coin and Fiat are the units as in LatestPrice, e.g. "BTC" and "USD".
+	Coin string `json:"coin"`
+	Fiat string `json:"fiat"`
+}
+
+// SnapshotDiff is the difference between two rate snapshots, see CompareSnapshots. All lists
+// are sorted by coin, then by fiat.
+type SnapshotDiff struct {
+	// Changed are the pairs with a rate in both snapshots which differs between them. The
+	// Timestamp of the entries is the one of the second snapshot.
+	Changed []RateChangeEntry `json:"changed"`
+	// AppearedCoins are the coins only in the second snapshot, DisappearedCoins the ones only in
+	// the first one.
+	AppearedCoins    []string `json:"appearedCoins"`
+	DisappearedCoins []string `json:"disappearedCoins"`
+	// AppearedPairs and DisappearedPairs are the same for the pairs of coins in both snapshots.
+	AppearedPairs    []SnapshotPair `json:"appearedPairs"`
+	DisappearedPairs []SnapshotPair `json:"disappearedPairs"`
+}
+
+// Empty returns true if there is no difference between the snapshots.
+func (diff SnapshotDiff) Empty() bool {
+	return len(diff.Changed) == 0 &&
+		len(diff.AppearedCoins) == 0 && len(diff.DisappearedCoins) == 0 &&
+		len(diff.AppearedPairs) == 0 && len(diff.DisappearedPairs) == 0
+}
+
+// MaxAbsPctChange returns the largest absolute change in percent of the changed rates, or 0 if
+// no rate changed.
+func (diff SnapshotDiff) MaxAbsPctChange() float64 {
+	var maxChange float64
+	for _, entry := range diff.Changed {
+		if change := math.Abs(entry.PctChange); change > maxChange {
+			maxChange = change
+		}
+	}
+	return maxChange
+}
+
+// Snapshot returns a copy of the latest rates, timestamped with the current time.
+func (updater *RateUpdater) Snapshot() RateSnapshot {
+	last := updater.LatestPrice()
+	rates := make(map[string]map[string]float64, len(last))
+	for coin, fiatRates := range last {
+		rates[coin] = make(map[string]float64, len(fiatRates))
+		for fiat, rate := range fiatRates {
+			rates[coin][fiat] = rate
+		}
+	}
+	return RateSnapshot{Timestamp: updater.clock(), Rates: rates}
+}
+
+// CompareSnapshots returns the difference from snap1 to snap2. It can be used to detect rates
+// drifting silently, e.g. by comparing against a golden snapshot in tests or against the rates
+// of another source.
+func CompareSnapshots(snap1, snap2 RateSnapshot) SnapshotDiff {
+	var diff SnapshotDiff
+	for coin, fiatRates2 := range snap2.Rates {
+		fiatRates1, ok := snap1.Rates[coin]
+		if !ok {
+			diff.AppearedCoins = append(diff.AppearedCoins, coin)
+			continue
+		}
+		for fiat, newRate := range fiatRates2 {
+			oldRate, ok := fiatRates1[fiat]
+			if !ok {
+				diff.AppearedPairs = append(diff.AppearedPairs, SnapshotPair{Coin: coin, Fiat: fiat})
+				continue
+			}
+			if oldRate == newRate {
+				continue
+			}
+			entry := RateChangeEntry{
+				Timestamp: snap2.Timestamp, Coin: coin, Fiat: fiat, OldRate: oldRate, NewRate: newRate,
+			}
+			if oldRate != 0 {
+				entry.PctChange = 100 * (newRate - oldRate) / oldRate
+			}
+			diff.Changed = append(diff.Changed, entry)
+		}
+		for fiat := range fiatRates1 {
+			if _, ok := fiatRates2[fiat]; !ok {
+				diff.DisappearedPairs = append(diff.DisappearedPairs, SnapshotPair{Coin: coin, Fiat: fiat})
+			}
+		}
+	}
+	for coin := range snap1.Rates {
+		if _, ok := snap2.Rates[coin]; !ok {
+			diff.DisappearedCoins = append(diff.DisappearedCoins, coin)
+		}
+	}
+
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		if diff.Changed[i].Coin != diff.Changed[j].Coin {
+			return diff.Changed[i].Coin < diff.Changed[j].Coin
+		}
+		return diff.Changed[i].Fiat < diff.Changed[j].Fiat
+	})
+	sort.Strings(diff.AppearedCoins)
+	sort.Strings(diff.DisappearedCoins)
+	sortSnapshotPairs(diff.AppearedPairs)
+	sortSnapshotPairs(diff.DisappearedPairs)
+	return diff
+}
+
+// sortSnapshotPairs sorts the pairs by coin, then by fiat.
+func sortSnapshotPairs(pairs []SnapshotPair) {
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Coin != pairs[j].Coin {
+			return pairs[i].Coin < pairs[j].Coin
+		}
+		return pairs[i].Fiat < pairs[j].Fiat
+	})
+}
@@ -0,0 +1,102 @@
+package rates
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	snap1 := RateSnapshot{
+		Timestamp: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		Rates: map[string]map[string]float64{
+			"BTC": {"USD": 60000, "EUR": 55000, "CHF": 53000},
+			"ETH": {"USD": 3000, "EUR": 2750},
+			"LTC": {"USD": 80},
+		},
+	}
+	snap2 := RateSnapshot{
+		Timestamp: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC),
+		Rates: map[string]map[string]float64{
+			"BTC": {"USD": 66000, "EUR": 55000, "GBP": 47000},
+			"ETH": {"USD": 2970, "EUR": 2750},
+			"SOL": {"USD": 120},
+		},
+	}
+
+	diff := CompareSnapshots(snap1, snap2)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, []RateChangeEntry{
+		{Timestamp: snap2.Timestamp, Coin: "BTC", Fiat: "USD", OldRate: 60000, NewRate: 66000, PctChange: 10},
+		{Timestamp: snap2.Timestamp, Coin: "ETH", Fiat: "USD", OldRate: 3000, NewRate: 2970, PctChange: -1},
+	}, diff.Changed)
+	assert.Equal(t, []string{"SOL"}, diff.AppearedCoins)
+	assert.Equal(t, []string{"LTC"}, diff.DisappearedCoins)
+	assert.Equal(t, []SnapshotPair{{Coin: "BTC", Fiat: "GBP"}}, diff.AppearedPairs)
+	assert.Equal(t, []SnapshotPair{{Coin: "BTC", Fiat: "CHF"}}, diff.DisappearedPairs)
+	assert.InDelta(t, 10, diff.MaxAbsPctChange(), 1e-9)
+
+	// Reversed.
+	diff = CompareSnapshots(snap2, snap1)
+	require.Len(t, diff.Changed, 2)
+	assert.InDelta(t, -100.0/11, diff.Changed[0].PctChange, 1e-9)
+	assert.Equal(t, []string{"LTC"}, diff.AppearedCoins)
+	assert.Equal(t, []string{"SOL"}, diff.DisappearedCoins)
+
+	// Same snapshot.
+	diff = CompareSnapshots(snap1, snap1)
+	assert.True(t, diff.Empty())
+	assert.Zero(t, diff.MaxAbsPctChange())
+
+	// Empty snapshots.
+	assert.True(t, CompareSnapshots(RateSnapshot{}, RateSnapshot{}).Empty())
+	diff = CompareSnapshots(RateSnapshot{}, snap1)
+	assert.Equal(t, []string{"BTC", "ETH", "LTC"}, diff.AppearedCoins)
+	assert.Empty(t, diff.Changed)
+}
+
+func TestCompareSnapshotsZeroRate(t *testing.T) {
+	diff := CompareSnapshots(
+		RateSnapshot{Rates: map[string]map[string]float64{"BTC": {"USD": 0}}},
+		RateSnapshot{Rates: map[string]map[string]float64{"BTC": {"USD": 60000}}},
+	)
+	require.Len(t, diff.Changed, 1)
+	assert.Equal(t, 60000.0, diff.Changed[0].NewRate)
+	assert.Zero(t, diff.Changed[0].PctChange)
+}
+
+func TestSnapshot(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	updater := NewRateUpdater(nil, "/dev/null",
+		WithClockFunc(func() time.Time { return now }),
+		WithLogger(newTestLogger()))
+	updater.last = map[string]map[string]float64{"BTC": {"USD": 60000}}
+
+	snapshot := updater.Snapshot()
+	assert.Equal(t, now, snapshot.Timestamp)
+	assert.Equal(t, updater.last, snapshot.Rates)
+
+	// The snapshot is a copy.
+	updater.last["BTC"]["USD"] = 61000
+	assert.Equal(t, 60000.0, snapshot.Rates["BTC"]["USD"])
+
+	// Persisted rates can be read as snapshots, e.g. as golden files.
+	path := filepath.Join(t.TempDir(), "rates.json")
+	persisting := NewRateUpdater(nil, "/dev/null",
+		WithClockFunc(func() time.Time { return now }),
+		WithRatePersistenceFile(path),
+		WithLogger(newTestLogger()))
+	require.NoError(t, persisting.persistRates(snapshot.Rates))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var persisted RateSnapshot
+	require.NoError(t, json.Unmarshal(data, &persisted))
+	assert.Equal(t, snapshot.Rates, persisted.Rates)
+	assert.True(t, snapshot.Timestamp.Equal(persisted.Timestamp))
+}
@@ -0,0 +1,285 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+)
+
+// historicalPriceAtOrErr is like HistoricalPriceAt but returns an error if no data is available.
+func (updater *RateUpdater) historicalPriceAtOrErr(coin, fiat string, at time.Time) (float64, error) {
+	price := updater.historicalPriceAt(coin, fiat, at)
+	if price == 0 {
+		return 0, errp.Newf("no historical rate for %s/%s at %s", coin, fiat, at)
+	}
+	return price, nil
+}
+
+// RateOfChange returns the relative price change of the given coin/fiat pair between t1 and t2
+// as a fraction: (priceAt(t2) - priceAt(t1)) / priceAt(t1). For example, 0.1 is a 10% increase.
+// Prices are obtained using HistoricalPriceAt. An error is returned if either is unavailable.
+func (updater *RateUpdater) RateOfChange(coin, fiat string, t1, t2 time.Time) (float64, error) {
+	p1, err := updater.historicalPriceAtOrErr(coin, fiat, t1)
+	if err != nil {
+		return 0, err
+	}
+	p2, err := updater.historicalPriceAtOrErr(coin, fiat, t2)
+	if err != nil {
+		return 0, err
+	}
+	return (p2 - p1) / p1, nil
+}
+
+// Acceleration returns the difference between the rates of change in the periods [t2, t3] and
+// [t1, t2], see RateOfChange. A positive value means the price is rising faster or declining
+// slower in the second period than in the first one.
+func (updater *RateUpdater) Acceleration(coin, fiat string, t1, t2, t3 time.Time) (float64, error) {
+	roc1, err := updater.RateOfChange(coin, fiat, t1, t2)
+	if err != nil {
+		return 0, err
+	}
+	roc2, err := updater.RateOfChange(coin, fiat, t2, t3)
+	if err != nil {
+		return 0, err
+	}
+	return roc2 - roc1, nil
+}
+
+// TWAP returns the time-weighted average price of the given coin/fiat pair in the period
+// [from, to]. The price is assumed to change linearly between the historical data points,
+// like in HistoricalPriceAt, and the average is its integral over the period using the
+// trapezoidal rule, divided by the period duration.
+//
+// An error is returned if from is not before to, or if the history doesn't cover the whole period.
+func (updater *RateUpdater) TWAP(coin, fiat string, from, to time.Time) (float64, error) {
+	if !from.Before(to) {
+		return 0, errp.Newf("invalid period: %s is not before %s", from, to)
+	}
+	var result float64
+	var err error
+	updater.history.view(coin+fiat, func(data []exchangeRate) {
+		first, last := priceAt(data, from), priceAt(data, to)
+		if first == 0 || last == 0 {
+			err = errp.Newf("no historical rates for %s/%s covering %s to %s", coin, fiat, from, to)
+			return
+		}
+		prev := exchangeRate{value: first, timestamp: from}
+		var integral float64
+		add := func(rate exchangeRate) {
+			dt := rate.timestamp.Sub(prev.timestamp).Seconds()
+			integral += dt * (prev.value + rate.value) / 2
+			prev = rate
+		}
+		for _, rate := range data {
+			if rate.timestamp.After(from) && rate.timestamp.Before(to) {
+				add(rate)
+			}
+		}
+		add(exchangeRate{value: last, timestamp: to})
+		result = integral / to.Sub(from).Seconds()
+	})
+	return result, err
+}
+
+// Volatility returns the annualized volatility of the given coin/fiat pair: the sample
+// standard deviation of the log returns ln(p[i]/p[i-1]) of the consecutive historical data
+// points within the window, multiplied by the square root of the number of periods per year.
+// The period is the average interval between the data points, so for hourly data
+// the multiplier is sqrt(365*24).
+//
+// The window ends at the latest available data point, see HistoryLatestTimestamp.
+// An error is returned if there are less than 3 data points in the window, which are
+// needed to have at least two log returns.
+func (updater *RateUpdater) Volatility(coin, fiat string, window time.Duration) (float64, error) {
+	var prices []float64
+	var period time.Duration
+	updater.history.view(coin+fiat, func(data []exchangeRate) {
+		if len(data) == 0 {
+			return
+		}
+		end := data[len(data)-1].timestamp
+		start := end.Add(-window)
+		idx := sort.Search(len(data), func(i int) bool {
+			return !data[i].timestamp.Before(start)
+		})
+		for _, rate := range data[idx:] {
+			prices = append(prices, rate.value)
+		}
+		if len(prices) > 1 {
+			period = end.Sub(data[idx].timestamp) / time.Duration(len(prices)-1)
+		}
+	})
+	if len(prices) < 3 || period <= 0 {
+		return 0, errp.Newf("not enough historical rates for %s/%s in the last %s", coin, fiat, window)
+	}
+
+	returns := make([]float64, len(prices)-1)
+	var mean float64
+	for i := 1; i < len(prices); i++ {
+		returns[i-1] = math.Log(prices[i] / prices[i-1])
+		mean += returns[i-1]
+	}
+	mean /= float64(len(returns))
+	var variance float64
+	for _, r := range returns {
+		variance += (r - mean) * (r - mean)
+	}
+	variance /= float64(len(returns) - 1)
+
+	periodsPerYear := float64(365*24*time.Hour) / float64(period)
+	return math.Sqrt(variance) * math.Sqrt(periodsPerYear), nil
+}
+
+// PercentileRank returns the percentage, from 0 to 100, of the historical prices of the given
+// coin/fiat pair within the window which are below price. For example, a result of 90 means that
+// price was higher than 90% of the prices in the window.
+//
+// The window ends at the latest available data point, see HistoryLatestTimestamp.
+// An error is returned if there are no data points in the window.
+func (updater *RateUpdater) PercentileRank(coin, fiat string, price float64, window time.Duration) (float64, error) {
+	var prices []float64
+	updater.history.view(coin+fiat, func(data []exchangeRate) {
+		if len(data) == 0 {
+			return
+		}
+		start := data[len(data)-1].timestamp.Add(-window)
+		idx := sort.Search(len(data), func(i int) bool {
+			return !data[i].timestamp.Before(start)
+		})
+		prices = make([]float64, 0, len(data)-idx)
+		for _, rate := range data[idx:] {
+			prices = append(prices, rate.value)
+		}
+	})
+	if len(prices) == 0 {
+		return 0, errp.Newf("no historical rates for %s/%s in the last %s", coin, fiat, window)
+	}
+	sort.Float64s(prices)
+	// The index of the first price not below price is the number of prices below it.
+	below := sort.SearchFloat64s(prices, price)
+	return 100 * float64(below) / float64(len(prices)), nil
+}
+
+// PriceCorrelation returns the Pearson correlation coefficient of the historical prices of coinA
+// and coinB in fiat within the window, from -1 for perfectly inverse to 1 for perfectly
+// correlated price movements.
+//
+// The series are aligned on the union of their timestamps within the window, interpolating
+// the prices like HistoricalPriceAt. The window ends at the latest timestamp both series cover.
+// An error is returned if there are less than 2 aligned data points, or if either series
+// is constant, in which case the coefficient is undefined.
+func (updater *RateUpdater) PriceCorrelation(coinA, coinB, fiat string, window time.Duration) (float64, error) {
+	dataA := updater.history.get(coinA + fiat)
+	dataB := updater.history.get(coinB + fiat)
+	notEnough := errp.Newf("not enough historical rates for %s/%s and %s/%s in the last %s",
+		coinA, fiat, coinB, fiat, window)
+	if len(dataA) == 0 || len(dataB) == 0 {
+		return 0, notEnough
+	}
+	end := dataA[len(dataA)-1].timestamp
+	if latestB := dataB[len(dataB)-1].timestamp; latestB.Before(end) {
+		end = latestB
+	}
+	start := end.Add(-window)
+	if earliest := dataA[0].timestamp; earliest.After(start) {
+		start = earliest
+	}
+	if earliest := dataB[0].timestamp; earliest.After(start) {
+		start = earliest
+	}
+
+	var grid []time.Time
+	for _, data := range [][]exchangeRate{dataA, dataB} {
+		for _, rate := range data {
+			if !rate.timestamp.Before(start) && !rate.timestamp.After(end) {
+				grid = append(grid, rate.timestamp)
+			}
+		}
+	}
+	sort.Slice(grid, func(i, j int) bool { return grid[i].Before(grid[j]) })
+
+	var xs, ys []float64
+	for i, at := range grid {
+		if i > 0 && at.Equal(grid[i-1]) {
+			continue
+		}
+		xs = append(xs, priceAt(dataA, at))
+		ys = append(ys, priceAt(dataB, at))
+	}
+	if len(xs) < 2 {
+		return 0, notEnough
+	}
+
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= float64(len(xs))
+	meanY /= float64(len(ys))
+	var cov, varX, varY float64
+	for i := range xs {
+		dx, dy := xs[i]-meanX, ys[i]-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return 0, errp.Newf("constant historical rates for %s/%s or %s/%s in the last %s",
+			coinA, fiat, coinB, fiat, window)
+	}
+	return cov / math.Sqrt(varX*varY), nil
+}
+
+// MaxDrawdown returns the maximum peak-to-trough decline of the historical prices of the given
+// coin/fiat pair within [from, to] as a positive fraction, e.g. 0.83 for a decline of 83%, and
+// the timestamps of the peak and the trough. Only the historical data points within the range
+// are considered, in a single pass keeping track of the highest price so far.
+//
+// If the price never declines, the drawdown is 0 and both timestamps are zero.
+// An error is returned if from is after to or there are less than 2 data points in the range.
+func (updater *RateUpdater) MaxDrawdown(coin, fiat string, from, to time.Time) (maxDD float64, peakTime, troughTime time.Time, err error) {
+	if from.After(to) {
+		return 0, time.Time{}, time.Time{}, errp.Newf("invalid range: %s is after %s", from, to)
+	}
+	var count int
+	updater.history.view(coin+fiat, func(data []exchangeRate) {
+		idx := sort.Search(len(data), func(i int) bool {
+			return !data[i].timestamp.Before(from)
+		})
+		var peak exchangeRate
+		for _, rate := range data[idx:] {
+			if rate.timestamp.After(to) {
+				break
+			}
+			count++
+			if rate.value > peak.value {
+				peak = rate
+				continue
+			}
+			if drawdown := (peak.value - rate.value) / peak.value; drawdown > maxDD {
+				maxDD, peakTime, troughTime = drawdown, peak.timestamp, rate.timestamp
+			}
+		}
+	})
+	if count < 2 {
+		return 0, time.Time{}, time.Time{}, errp.Newf("not enough historical rates for %s/%s from %s to %s", coin, fiat, from, to)
+	}
+	return maxDD, peakTime, troughTime, nil
+}
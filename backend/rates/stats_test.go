@@ -0,0 +1,298 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateOfChangeAcceleration(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	day := func(d int) time.Time { return time.Date(2020, 9, d, 0, 0, 0, 0, time.UTC) }
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 100, timestamp: day(1)},
+			{value: 80, timestamp: day(2)},
+			{value: 72, timestamp: day(3)},
+			{value: 90, timestamp: day(4)},
+		},
+	})
+
+	roc, err := updater.RateOfChange("btc", "USD", day(1), day(2))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.2, roc, 1e-9) // (80-100)/100
+	roc, err = updater.RateOfChange("btc", "USD", day(2), day(3))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.1, roc, 1e-9) // (72-80)/80
+	// Interpolated: 90 at day 1 12:00.
+	roc, err = updater.RateOfChange("btc", "USD", day(1).Add(12*time.Hour), day(3))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.2, roc, 1e-9) // (72-90)/90
+
+	// The decline slows down from -20% to -10%.
+	acc, err := updater.Acceleration("btc", "USD", day(1), day(2), day(3))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.1, acc, 1e-9)
+	// From -10% to +25%.
+	acc, err = updater.Acceleration("btc", "USD", day(2), day(3), day(4))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.35, acc, 1e-9)
+
+	_, err = updater.RateOfChange("btc", "USD", day(1), day(5))
+	assert.Error(t, err)
+	_, err = updater.RateOfChange("eth", "USD", day(1), day(2))
+	assert.Error(t, err)
+	_, err = updater.Acceleration("btc", "USD", time.Date(2020, 8, 31, 0, 0, 0, 0, time.UTC), day(2), day(3))
+	assert.Error(t, err)
+	_, err = updater.Acceleration("btc", "USD", day(1), day(2), day(5))
+	assert.Error(t, err)
+}
+
+func TestTWAP(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	hour := func(h int) time.Time { return time.Date(2020, 9, 1, h, 0, 0, 0, time.UTC) }
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		// Uniformly spaced.
+		"btcUSD": {
+			{value: 10, timestamp: hour(0)},
+			{value: 20, timestamp: hour(1)},
+			{value: 30, timestamp: hour(2)},
+			{value: 40, timestamp: hour(3)},
+			{value: 50, timestamp: hour(4)},
+		},
+		// Unevenly spaced.
+		"ltcUSD": {
+			{value: 10, timestamp: hour(0)},
+			{value: 30, timestamp: hour(1)},
+			{value: 10, timestamp: hour(4)},
+		},
+	})
+
+	tt := []struct {
+		coin     string
+		from, to time.Time
+		want     float64
+	}{
+		// Same as the simple average of 10, 20, 30, 40, 50.
+		{"btc", hour(0), hour(4), 30},
+		// Interpolated boundaries: 15 at 00:30 and 45 at 03:30.
+		{"btc", hour(0).Add(30 * time.Minute), hour(3).Add(30 * time.Minute), 30},
+		// Area: (10+30)/2*1h + (30+10)/2*3h = 80; divided by 4h.
+		// The simple average of 10, 30, 10 would be 16.67.
+		{"ltc", hour(0), hour(4), 20},
+		// Within a single segment: 30 at 01:00, 23.33 at 02:00.
+		{"ltc", hour(1), hour(2), (30 + 30 - 20.0/3) / 2},
+	}
+	for _, test := range tt {
+		twap, err := updater.TWAP(test.coin, "USD", test.from, test.to)
+		require.NoError(t, err)
+		assert.InDelta(t, test.want, twap, 1e-9, "%s %s-%s", test.coin, test.from, test.to)
+	}
+
+	_, err := updater.TWAP("btc", "USD", hour(2), hour(2))
+	assert.Error(t, err, "empty period")
+	_, err = updater.TWAP("btc", "USD", hour(3), hour(2))
+	assert.Error(t, err, "reversed period")
+	_, err = updater.TWAP("btc", "USD", hour(2), hour(5))
+	assert.Error(t, err, "past the history")
+	_, err = updater.TWAP("eth", "USD", hour(0), hour(1))
+	assert.Error(t, err, "no history")
+}
+
+func TestVolatility(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	start := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	series := func(interval time.Duration, values ...float64) []exchangeRate {
+		rates := make([]exchangeRate, len(values))
+		for i, v := range values {
+			rates[i] = exchangeRate{value: v, timestamp: start.Add(time.Duration(i) * interval)}
+		}
+		return rates
+	}
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": series(time.Hour, 100, 102, 101, 105, 103, 104),
+		"ltcUSD": series(24*time.Hour, 1000, 100, 110, 99),
+	})
+
+	// Reference values computed with:
+	//   r = np.diff(np.log(p)); np.std(r, ddof=1) * np.sqrt(periods_per_year)
+	vol, err := updater.Volatility("btc", "USD", 5*time.Hour)
+	require.NoError(t, err)
+	assert.InDelta(t, 2.171567117216489, vol, 1e-9) // p = [100, 102, 101, 105, 103, 104], hourly
+	// The first data point is outside the window.
+	vol, err = updater.Volatility("ltc", "USD", 2*24*time.Hour)
+	require.NoError(t, err)
+	assert.InDelta(t, 2.7109118139752493, vol, 1e-9) // p = [100, 110, 99], daily
+
+	_, err = updater.Volatility("btc", "USD", time.Hour)
+	assert.Error(t, err, "only two data points")
+	_, err = updater.Volatility("eth", "USD", time.Hour)
+	assert.Error(t, err, "no history")
+}
+
+func TestPercentileRank(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	start := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	// Hourly prices 1 to 100 in shuffled order, since 37 and 100 are coprime.
+	rates := make([]exchangeRate, 100)
+	for i := range rates {
+		rates[i] = exchangeRate{value: float64(i*37%100 + 1), timestamp: start.Add(time.Duration(i) * time.Hour)}
+	}
+	updater.history = newHistoryMap(map[string][]exchangeRate{"btcUSD": rates})
+	year := 365 * 24 * time.Hour
+
+	tt := []struct {
+		price  float64
+		window time.Duration
+		want   float64
+	}{
+		// k of the prices 1 to 100 are below k+1.
+		{1, year, 0},
+		{1.5, year, 1},
+		{50, year, 49},
+		{50.5, year, 50},
+		{100, year, 99},
+		{1000, year, 100},
+		{0, year, 0},
+		// The window starts at the 99th hour and includes the prices 27 and 64.
+		{50, time.Hour, 50},
+		{27, time.Hour, 0},
+		{64, time.Hour, 50},
+		{65, time.Hour, 100},
+		// The last 10 prices are 1, 68, 5, 42, 79, 16, 53, 90, 27 and 64.
+		{50, 9 * time.Hour, 50},
+		{1, 9 * time.Hour, 0},
+		{80, 9 * time.Hour, 90},
+	}
+	for _, test := range tt {
+		rank, err := updater.PercentileRank("btc", "USD", test.price, test.window)
+		require.NoError(t, err)
+		assert.InDelta(t, test.want, rank, 1e-9, "price %v, window %s", test.price, test.window)
+	}
+
+	_, err := updater.PercentileRank("btc", "EUR", 1, year)
+	require.Error(t, err)
+}
+
+func TestPriceCorrelation(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger())) // don't need to make HTTP requests or load DB
+	defer updater.Stop()
+	start := time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)
+	hour := func(h int) time.Time { return start.Add(time.Duration(h) * time.Hour) }
+	prices := []float64{100, 120, 90, 150, 130, 170}
+	var btc, eth, ltc, shifted []exchangeRate
+	for i, price := range prices {
+		btc = append(btc, exchangeRate{value: price, timestamp: hour(i)})
+		eth = append(eth, exchangeRate{value: price, timestamp: hour(i)})
+		// Perfectly inverse.
+		ltc = append(ltc, exchangeRate{value: 300 - price, timestamp: hour(i)})
+	}
+	// The same prices as btc at half past, linearly interpolated, so the series
+	// don't share any timestamp.
+	for i := 1; i < len(prices); i++ {
+		shifted = append(shifted, exchangeRate{
+			value:     (prices[i-1] + prices[i]) / 2,
+			timestamp: hour(i).Add(-30 * time.Minute),
+		})
+	}
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD":  btc,
+		"ethUSD":  eth,
+		"ltcUSD":  ltc,
+		"daiUSD":  shifted,
+		"linkUSD": {{value: 1, timestamp: hour(0)}, {value: 1, timestamp: hour(5)}},
+	})
+	day := 24 * time.Hour
+
+	corr, err := updater.PriceCorrelation("btc", "eth", "USD", day)
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, corr, 1e-9)
+	corr, err = updater.PriceCorrelation("btc", "ltc", "USD", day)
+	require.NoError(t, err)
+	assert.InDelta(t, -1.0, corr, 1e-9)
+	corr, err = updater.PriceCorrelation("btc", "btc", "USD", 2*time.Hour)
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, corr, 1e-9)
+	// Aligned by interpolating btc at half past and dai at full hours.
+	corr, err = updater.PriceCorrelation("btc", "dai", "USD", day)
+	require.NoError(t, err)
+	assert.Greater(t, corr, 0.5)
+	assert.Less(t, corr, 1.0)
+
+	// Less than 2 aligned points.
+	_, err = updater.PriceCorrelation("btc", "eth", "USD", 0)
+	require.Error(t, err)
+	_, err = updater.PriceCorrelation("btc", "eth", "EUR", day)
+	require.Error(t, err)
+	// Undefined for constant prices.
+	_, err = updater.PriceCorrelation("btc", "link", "USD", day)
+	require.Error(t, err)
+}
+
+func TestMaxDrawdown(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	day := func(d int) time.Time { return time.Date(2020, 9, d, 0, 0, 0, 0, time.UTC) }
+	updater.history = newHistoryMap(map[string][]exchangeRate{
+		"btcUSD": {
+			{value: 100, timestamp: day(1)},
+			{value: 120, timestamp: day(2)}, // peak
+			{value: 90, timestamp: day(3)},  // -25%
+			{value: 150, timestamp: day(4)}, // higher peak
+			{value: 60, timestamp: day(5)},  // trough: -60%
+			{value: 140, timestamp: day(6)},
+			{value: 70, timestamp: day(7)}, // -53.3%, less than at the trough
+		},
+		"ethUSD": {
+			{value: 10, timestamp: day(1)},
+			{value: 20, timestamp: day(2)},
+			{value: 30, timestamp: day(3)},
+		},
+	})
+
+	maxDD, peak, trough, err := updater.MaxDrawdown("btc", "USD", day(1), day(7))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.6, maxDD, 1e-9) // (150-60)/150
+	assert.Equal(t, day(4), peak)
+	assert.Equal(t, day(5), trough)
+
+	// Before the higher peak.
+	maxDD, peak, trough, err = updater.MaxDrawdown("btc", "USD", day(1), day(3))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.25, maxDD, 1e-9) // (120-90)/120
+	assert.Equal(t, day(2), peak)
+	assert.Equal(t, day(3), trough)
+
+	// After the trough.
+	maxDD, peak, trough, err = updater.MaxDrawdown("btc", "USD", day(5).Add(time.Hour), day(7))
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, maxDD, 1e-9) // (140-70)/140
+	assert.Equal(t, day(6), peak)
+	assert.Equal(t, day(7), trough)
+
+	// Never declining.
+	maxDD, peak, trough, err = updater.MaxDrawdown("eth", "USD", day(1), day(3))
+	require.NoError(t, err)
+	assert.Zero(t, maxDD)
+	assert.True(t, peak.IsZero())
+	assert.True(t, trough.IsZero())
+
+	_, _, _, err = updater.MaxDrawdown("btc", "USD", day(7), day(8))
+	assert.Error(t, err)
+	_, _, _, err = updater.MaxDrawdown("btc", "USD", day(3), day(1))
+	assert.Error(t, err)
+	_, _, _, err = updater.MaxDrawdown("ltc", "USD", day(1), day(7))
+	assert.Error(t, err)
+}
@@ -0,0 +1,235 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+)
+
+// DropPolicy determines which rate is dropped if a subscriber is too slow to receive it.
+type DropPolicy int
+
+const (
+	// DropOldest drops the oldest buffered rates to make room for the new one,
+	// so that the subscriber always receives the most recent rate.
+	DropOldest DropPolicy = iota
+	// DropLatest drops the new rate if the buffer is full.
+	DropLatest
+)
+
+// Subscription delivers the latest rate of a (coin, fiat) pair whenever it is updated.
+// See RateUpdater.SubscribeWithBackpressure.
+type Subscription struct {
+	coin, fiat string
+	policy     DropPolicy
+	dropped    atomic.Uint64
+
+	mu        sync.Mutex // serializes send and Unsubscribe
+	ch        chan float64
+	closed    bool
+	unobserve func()
+}
+
+// SubscribeWithBackpressure subscribes to the latest rate of the coin unit in fiat, e.g. "BTC"
+// and "USD". Updates are buffered up to bufSize, at least 1. If the buffer is full, an update
+// is dropped according to dropPolicy, and counted in DroppedCount.
+//
+// Sending to the subscription never blocks the updater. The caller must call Unsubscribe
+// when done.
+func (updater *RateUpdater) SubscribeWithBackpressure(coin, fiat string, bufSize int, dropPolicy DropPolicy) *Subscription {
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	sub := &Subscription{
+		coin:   coin,
+		fiat:   fiat,
+		policy: dropPolicy,
+		ch:     make(chan float64, bufSize),
+	}
+	sub.unobserve = updater.Observe(sub.onEvent)
+	return sub
+}
+
+// C returns the channel on which the rates are delivered. It is closed by Unsubscribe.
+func (sub *Subscription) C() <-chan float64 {
+	return sub.ch
+}
+
+// DroppedCount returns the number of rates dropped because the buffer was full.
+func (sub *Subscription) DroppedCount() uint64 {
+	return sub.dropped.Load()
+}
+
+// Unsubscribe stops the delivery of rates and closes the channel returned by C.
+// It is safe to call multiple times.
+func (sub *Subscription) Unsubscribe() {
+	sub.unobserve()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.ch)
+	}
+}
+
+func (sub *Subscription) onEvent(event observable.Event) {
+	if event.Subject != RatesEventSubject {
+		return
+	}
+	rates, ok := event.Object.(map[string]map[string]float64)
+	if !ok {
+		return
+	}
+	rate, ok := rates[sub.coin][sub.fiat]
+	if !ok {
+		return
+	}
+	sub.send(rate)
+}
+
+func (sub *Subscription) send(rate float64) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	for {
+		select {
+		case sub.ch <- rate:
+			return
+		default:
+		}
+		if sub.policy == DropLatest {
+			sub.dropped.Add(1)
+			return
+		}
+		// Drain the oldest rate to make room. The subscriber may have received it
+		// in the meantime, in which case nothing is dropped.
+		select {
+		case <-sub.ch:
+			sub.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// CoalescingSubscription delivers the latest rates, merging the updates which arrive in quick
+// succession into a single one. See RateUpdater.CoalescingSubscription.
+type CoalescingSubscription struct {
+	window time.Duration
+
+	mu        sync.Mutex // guards all fields below
+	ch        chan map[string]map[string]float64
+	pending   map[string]map[string]float64
+	timer     *time.Timer
+	closed    bool
+	unobserve func()
+}
+
+// CoalescingSubscription subscribes to the latest rates. Updates are collected until no new
+// update arrived for the duration of window, and then delivered as one update containing the
+// union of all changed rates, the most recent rate of a pair winning.
+//
+// Sending to the subscription never blocks the updater: if the subscriber did not receive the
+// previous update yet, it is merged into the new one. The caller must call Unsubscribe
+// when done.
+func (updater *RateUpdater) CoalescingSubscription(window time.Duration) *CoalescingSubscription {
+	sub := &CoalescingSubscription{
+		window: window,
+		ch:     make(chan map[string]map[string]float64, 1),
+	}
+	sub.unobserve = updater.Observe(sub.onEvent)
+	return sub
+}
+
+// C returns the channel on which the coalesced rates are delivered, keyed by coin unit and
+// fiat. It is closed by Unsubscribe.
+func (sub *CoalescingSubscription) C() <-chan map[string]map[string]float64 {
+	return sub.ch
+}
+
+// Unsubscribe stops the delivery of rates and closes the channel returned by C. Pending
+// updates are discarded. It is safe to call multiple times.
+func (sub *CoalescingSubscription) Unsubscribe() {
+	sub.unobserve()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	if sub.timer != nil {
+		sub.timer.Stop()
+	}
+	close(sub.ch)
+}
+
+// mergeRates copies the rates of src into dst, overwriting existing pairs.
+func mergeRates(dst, src map[string]map[string]float64) {
+	for coin, fiats := range src {
+		if dst[coin] == nil {
+			dst[coin] = make(map[string]float64, len(fiats))
+		}
+		for fiat, rate := range fiats {
+			dst[coin][fiat] = rate
+		}
+	}
+}
+
+func (sub *CoalescingSubscription) onEvent(event observable.Event) {
+	if event.Subject != RatesEventSubject {
+		return
+	}
+	rates, ok := event.Object.(map[string]map[string]float64)
+	if !ok {
+		return
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	if sub.pending == nil {
+		sub.pending = map[string]map[string]float64{}
+	}
+	mergeRates(sub.pending, rates)
+	if sub.timer == nil {
+		sub.timer = time.AfterFunc(sub.window, sub.flush)
+	} else {
+		sub.timer.Reset(sub.window)
+	}
+}
+
+func (sub *CoalescingSubscription) flush() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed || sub.pending == nil {
+		return
+	}
+	rates := sub.pending
+	sub.pending = nil
+	// Merge the undelivered previous update, so that no change is lost.
+	select {
+	case previous := <-sub.ch:
+		mergeRates(previous, rates)
+		rates = previous
+	default:
+	}
+	sub.ch <- rates
+}
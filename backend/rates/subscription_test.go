@@ -0,0 +1,137 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func notifyBTCUSD(updater *RateUpdater, rates ...float64) {
+	for _, rate := range rates {
+		updater.Notify(observable.Event{
+			Subject: RatesEventSubject,
+			Action:  action.Replace,
+			Object:  map[string]map[string]float64{"BTC": {"USD": rate}},
+		})
+	}
+}
+
+// receiveAll returns all rates buffered in the subscription.
+func receiveAll(sub *Subscription) []float64 {
+	var rates []float64
+	for {
+		select {
+		case rate := <-sub.C():
+			rates = append(rates, rate)
+		default:
+			return rates
+		}
+	}
+}
+
+func TestSubscribeWithBackpressureDropOldest(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	sub := updater.SubscribeWithBackpressure("BTC", "USD", 2, DropOldest)
+	defer sub.Unsubscribe()
+
+	notifyBTCUSD(updater, 1, 2, 3, 4, 5)
+	assert.Equal(t, []float64{4, 5}, receiveAll(sub))
+	assert.Equal(t, uint64(3), sub.DroppedCount())
+
+	notifyBTCUSD(updater, 6)
+	assert.Equal(t, []float64{6}, receiveAll(sub))
+	assert.Equal(t, uint64(3), sub.DroppedCount())
+}
+
+func TestSubscribeWithBackpressureDropLatest(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	sub := updater.SubscribeWithBackpressure("BTC", "USD", 2, DropLatest)
+	defer sub.Unsubscribe()
+
+	notifyBTCUSD(updater, 1, 2, 3, 4, 5)
+	assert.Equal(t, []float64{1, 2}, receiveAll(sub))
+	assert.Equal(t, uint64(3), sub.DroppedCount())
+
+	// Other pairs and subjects are ignored.
+	updater.Notify(observable.Event{Subject: "other", Object: map[string]map[string]float64{"BTC": {"USD": 7}}})
+	updater.Notify(observable.Event{Subject: RatesEventSubject, Object: map[string]map[string]float64{"ETH": {"USD": 8}}})
+	assert.Empty(t, receiveAll(sub))
+}
+
+func TestSubscriptionUnsubscribe(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	sub := updater.SubscribeWithBackpressure("BTC", "USD", 0, DropLatest)
+	notifyBTCUSD(updater, 1)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	notifyBTCUSD(updater, 2)
+
+	rate, ok := <-sub.C()
+	require.True(t, ok)
+	assert.Equal(t, 1.0, rate)
+	_, ok = <-sub.C()
+	assert.False(t, ok)
+}
+
+func TestCoalescingSubscription(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	sub := updater.CoalescingSubscription(50 * time.Millisecond)
+	defer sub.Unsubscribe()
+
+	for i := 1; i <= 10; i++ {
+		notifyBTCUSD(updater, float64(i))
+		if i == 5 {
+			updater.Notify(observable.Event{
+				Subject: RatesEventSubject,
+				Object:  map[string]map[string]float64{"ETH": {"EUR": 1500}},
+			})
+		}
+		time.Sleep(500 * time.Microsecond)
+	}
+	select {
+	case rates := <-sub.C():
+		assert.Equal(t, map[string]map[string]float64{"BTC": {"USD": 10}, "ETH": {"EUR": 1500}}, rates)
+	case <-time.After(time.Second):
+		require.Fail(t, "no coalesced update")
+	}
+	select {
+	case rates := <-sub.C():
+		require.Failf(t, "unexpected update", "%v", rates)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// An undelivered update is merged into the next one.
+	notifyBTCUSD(updater, 11)
+	time.Sleep(100 * time.Millisecond)
+	updater.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Object:  map[string]map[string]float64{"ETH": {"EUR": 1600}},
+	})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, map[string]map[string]float64{"BTC": {"USD": 11}, "ETH": {"EUR": 1600}}, <-sub.C())
+}
+
+func TestCoalescingSubscriptionUnsubscribe(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := MockRateUpdater()
+	defer updater.Stop()
+	sub := updater.CoalescingSubscription(time.Hour)
+	notifyBTCUSD(updater, 1)
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	notifyBTCUSD(updater, 2)
+	_, ok := <-sub.C()
+	assert.False(t, ok)
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+// Event types of TelemetryEvent.
+const (
+	// TelemetryFirstFetch is sent on the first successful update of the latest rates.
+	// Properties: "duration", the time.Duration of the request.
+	TelemetryFirstFetch = "rates/first-fetch"
+	// TelemetryRateLimited is sent when the API responds with HTTP status 429 Too Many Requests.
+	// Properties: "endpoint", the URL path of the request.
+	TelemetryRateLimited = "rates/rate-limited"
+	// TelemetryHistoryCompacted is sent after CompactHistory or PruneHistory.
+	// Properties: "operation", "compact" or "prune", "removed", the number of removed rates,
+	// and "pair", the coin+fiat pair of CompactHistory.
+	TelemetryHistoryCompacted = "rates/history-compacted"
+	// TelemetryBackfillCompleted is sent when the history of a coin+fiat pair is backfilled
+	// completely. Properties: "pair", the coin+fiat pair, and "reason", why the backfill
+	// stopped: "end of data", "max age" or "max entries".
+	TelemetryBackfillCompleted = "rates/backfill-completed"
+)
+
+// TelemetryEvent is an operational event passed to the hook set with WithTelemetryHook.
+type TelemetryEvent struct {
+	// EventType is one of the Telemetry* constants.
+	EventType string
+	// Properties depend on the EventType.
+	Properties map[string]interface{}
+}
+
+// WithTelemetryHook makes the updater call fn on operational events, for the app's telemetry.
+// fn is called synchronously from the updater's goroutines and must not block.
+func WithTelemetryHook(fn func(event TelemetryEvent)) Option {
+	return func(updater *RateUpdater) {
+		updater.telemetryHook = fn
+	}
+}
+
+// telemetry calls the hook set with WithTelemetryHook, if any.
+func (updater *RateUpdater) telemetry(eventType string, properties map[string]interface{}) {
+	if updater.telemetryHook == nil {
+		return
+	}
+	updater.telemetryHook(TelemetryEvent{EventType: eventType, Properties: properties})
+}
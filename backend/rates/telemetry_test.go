@@ -0,0 +1,139 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// telemetryRecorder records the events passed to the hook of WithTelemetryHook.
+type telemetryRecorder struct {
+	mu     sync.Mutex
+	events []TelemetryEvent
+}
+
+func (r *telemetryRecorder) hook(event TelemetryEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// take returns and forgets the recorded events.
+func (r *telemetryRecorder) take() []TelemetryEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func newTelemetryTestUpdater(t *testing.T, mock *testutil.MockHTTPClient, recorder *telemetryRecorder, opts ...Option) *RateUpdater {
+	t.Helper()
+	dbdir := test.TstTempDir("telemetry")
+	t.Cleanup(func() { _ = os.RemoveAll(dbdir) })
+	updater := NewRateUpdater(mock.Client(), dbdir, append([]Option{
+		WithTelemetryHook(recorder.hook),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	}, opts...)...)
+	t.Cleanup(updater.Stop)
+	updater.coingeckoURL = "https://coingecko.test"
+	return updater
+}
+
+func TestTelemetryFirstFetch(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	recorder := &telemetryRecorder{}
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusInternalServerError, "")
+	updater := newTelemetryTestUpdater(t, mock, recorder)
+
+	updater.updateLast(context.Background())
+	assert.Empty(t, recorder.take())
+
+	mock.On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater.updateLast(context.Background())
+	events := recorder.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, TelemetryFirstFetch, events[0].EventType)
+	assert.Contains(t, events[0].Properties, "duration")
+
+	updater.updateLast(context.Background())
+	assert.Empty(t, recorder.take())
+}
+
+func TestTelemetryRateLimited(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	recorder := &telemetryRecorder{}
+	mock := testutil.NewMockHTTPClient().On("/simple/price", http.StatusTooManyRequests, "")
+	updater := newTelemetryTestUpdater(t, mock, recorder)
+
+	updater.updateLast(context.Background())
+	assert.Equal(t, []TelemetryEvent{{
+		EventType:  TelemetryRateLimited,
+		Properties: map[string]interface{}{"endpoint": "/simple/price"},
+	}}, recorder.take())
+}
+
+func TestTelemetryHistoryCompacted(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	recorder := &telemetryRecorder{}
+	start := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+	now := start.Add(10 * 24 * time.Hour)
+	updater := newTelemetryTestUpdater(t, testutil.NewMockHTTPClient(), recorder,
+		WithClockFunc(func() time.Time { return now }))
+	updater.storeHistory("btc", "USD", ratesEvery(start, time.Hour, 10*24))
+
+	_, err := updater.CompactHistory("btc", "USD", 5*24*time.Hour, 24*time.Hour)
+	require.NoError(t, err)
+	_, err = updater.PruneHistory(2 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []TelemetryEvent{
+		{
+			EventType:  TelemetryHistoryCompacted,
+			Properties: map[string]interface{}{"operation": "compact", "pair": "btcUSD", "removed": 5 * 23},
+		},
+		{
+			EventType:  TelemetryHistoryCompacted,
+			Properties: map[string]interface{}{"operation": "prune", "removed": 5 + 3*24},
+		},
+	}, recorder.take())
+}
+
+func TestTelemetryBackfillCompleted(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	now := time.Unix(1598918400, 0) // 2020-09-01 00:00 UTC
+
+	t.Run("end of data", func(t *testing.T) {
+		recorder := &telemetryRecorder{}
+		mock := testutil.NewMockHTTPClient().On("/coins/bitcoin/market_chart/range", http.StatusOK, `{"prices":[]}`)
+		updater := newTelemetryTestUpdater(t, mock, recorder, WithClockFunc(func() time.Time { return now }))
+
+		updater.backfillHistory(context.Background(), "btc", "USD")
+		assert.Equal(t, []TelemetryEvent{{
+			EventType:  TelemetryBackfillCompleted,
+			Properties: map[string]interface{}{"pair": "btcUSD", "reason": "end of data"},
+		}}, recorder.take())
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		recorder := &telemetryRecorder{}
+		updater := newTelemetryTestUpdater(t, testutil.NewMockHTTPClient(), recorder,
+			WithAutoBackfill(24*time.Hour), WithClockFunc(func() time.Time { return now }))
+		updater.storeHistory("btc", "USD", ratesEvery(now.Add(-2*24*time.Hour), time.Hour, 48))
+
+		updater.backfillHistory(context.Background(), "btc", "USD")
+		assert.Equal(t, []TelemetryEvent{{
+			EventType:  TelemetryBackfillCompleted,
+			Properties: map[string]interface{}{"pair": "btcUSD", "reason": "max age"},
+		}}, recorder.take())
+	})
+}
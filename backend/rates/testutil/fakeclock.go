@@ -0,0 +1,92 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides helpers for testing code using the rates package.
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a clock for tests that only advances on demand, with Advance.
+// Its Now and After methods can be passed to rates.WithClockFunc and rates.WithTimer.
+// All methods are safe for concurrent use.
+type FakeClock struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	now  time.Time
+	// waiters are the channels returned by After which haven't fired yet.
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a fake clock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	clock := &FakeClock{now: now}
+	clock.cond = sync.NewCond(&clock.mu)
+	return clock
+}
+
+// Now returns the current time of the clock.
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// After is like time.After: it returns a channel receiving the current time once the clock
+// is advanced by at least d.
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- clock.now
+		return ch
+	}
+	clock.waiters = append(clock.waiters, fakeWaiter{at: clock.now.Add(d), ch: ch})
+	clock.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the channels returned by After which are due.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(d)
+	pending := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.at.After(clock.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.ch <- clock.now
+	}
+	clock.waiters = pending
+}
+
+// BlockUntil waits until at least n channels returned by After haven't fired yet.
+// It allows advancing the clock only after the goroutines under test started waiting.
+func (clock *FakeClock) BlockUntil(n int) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for len(clock.waiters) < n {
+		clock.cond.Wait()
+	}
+}
@@ -0,0 +1,35 @@
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1598832000, 0)
+	clock := NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+
+	short := clock.After(time.Minute)
+	long := clock.After(time.Hour)
+	clock.BlockUntil(2)
+	select {
+	case <-short:
+		t.Fatal("fired too early")
+	default:
+	}
+
+	clock.Advance(2 * time.Minute)
+	assert.Equal(t, start.Add(2*time.Minute), <-short)
+	assert.Equal(t, start.Add(2*time.Minute), clock.Now())
+	select {
+	case <-long:
+		t.Fatal("fired too early")
+	default:
+	}
+	clock.Advance(time.Hour)
+	assert.Equal(t, start.Add(62*time.Minute), <-long)
+	assert.Equal(t, clock.Now(), <-clock.After(0))
+}
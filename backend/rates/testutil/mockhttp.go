@@ -0,0 +1,110 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// MockHTTPClient is an http.RoundTripper serving canned responses by URL path, without
+// starting a server. Register responses with On and pass Client() to rates.NewRateUpdater.
+// Requests to unregistered paths get a 404 response. All requests are recorded, see Requests.
+// All methods are safe for concurrent use.
+type MockHTTPClient struct {
+	mu        sync.Mutex
+	responses map[string]mockResponse
+	requests  []*http.Request
+}
+
+type mockResponse struct {
+	status int
+	body   string
+}
+
+// NewMockHTTPClient returns a mock without any registered responses.
+func NewMockHTTPClient() *MockHTTPClient {
+	return &MockHTTPClient{responses: map[string]mockResponse{}}
+}
+
+// On makes requests with the given URL path, e.g. "/simple/price", respond with status and body,
+// replacing a previously registered response. It returns the mock so that calls can be chained.
+func (mock *MockHTTPClient) On(path string, status int, body string) *MockHTTPClient {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.responses[path] = mockResponse{status: status, body: body}
+	return mock
+}
+
+// Client returns an HTTP client sending all requests to the mock.
+func (mock *MockHTTPClient) Client() *http.Client {
+	return &http.Client{Transport: mock}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (mock *MockHTTPClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.requests = append(mock.requests, req)
+	resp, ok := mock.responses[req.URL.Path]
+	if !ok {
+		resp = mockResponse{status: http.StatusNotFound, body: "no response registered for " + req.URL.Path}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", resp.status, http.StatusText(resp.status)),
+		StatusCode:    resp.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(strings.NewReader(resp.body)),
+		ContentLength: int64(len(resp.body)),
+		Request:       req,
+	}, nil
+}
+
+// Requests returns all requests received so far, in order.
+func (mock *MockHTTPClient) Requests() []*http.Request {
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	return append([]*http.Request(nil), mock.requests...)
+}
+
+// AssertCalledWith checks that at least one request to path had the query parameter set to
+// expectedValue, and reports a test error otherwise. It returns whether the check passed.
+func (mock *MockHTTPClient) AssertCalledWith(t *testing.T, path, queryParam, expectedValue string) bool {
+	t.Helper()
+	var got []string
+	for _, req := range mock.Requests() {
+		if req.URL.Path != path {
+			continue
+		}
+		value := req.URL.Query().Get(queryParam)
+		if value == expectedValue {
+			return true
+		}
+		got = append(got, value)
+	}
+	if got == nil {
+		t.Errorf("no request to %s", path)
+	} else {
+		t.Errorf("no request to %s with %s=%q, got %q", path, queryParam, expectedValue, got)
+	}
+	return false
+}
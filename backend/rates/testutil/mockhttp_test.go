@@ -0,0 +1,43 @@
+package testutil
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockHTTPClient(t *testing.T) {
+	mock := NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":1}}`).
+		On("/error", http.StatusTooManyRequests, "slow down")
+	client := mock.Client()
+
+	resp, err := client.Get("https://example.test/simple/price?ids=bitcoin")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"bitcoin":{"usd":1}}`, string(body))
+
+	resp, err = client.Get("https://example.test/error")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	resp, err = client.Get("https://example.test/unknown")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	require.Len(t, mock.Requests(), 3)
+	assert.Equal(t, "/simple/price", mock.Requests()[0].URL.Path)
+	assert.True(t, mock.AssertCalledWith(t, "/simple/price", "ids", "bitcoin"))
+
+	inner := &testing.T{}
+	assert.False(t, mock.AssertCalledWith(inner, "/simple/price", "ids", "ethereum"))
+	assert.False(t, mock.AssertCalledWith(inner, "/never", "ids", "bitcoin"))
+}
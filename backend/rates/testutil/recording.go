@@ -0,0 +1,98 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Exchange is a request and its response recorded by RecordingRoundTripper.
+type Exchange struct {
+	Method string
+	URL    string
+	// StatusCode is 0 and Err set if no response was received.
+	StatusCode   int
+	ResponseBody []byte
+	Err          error
+}
+
+// RecordingRoundTripper is an http.RoundTripper recording all requests passed to the wrapped
+// one and their responses, e.g. to compare them with a golden file, see Transcript.
+// Pass it to rates.WithTransport, wrapping a MockHTTPClient for hermetic tests.
+// All methods are safe for concurrent use.
+type RecordingRoundTripper struct {
+	base      http.RoundTripper
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// NewRecordingRoundTripper returns a RecordingRoundTripper sending requests to base.
+func NewRecordingRoundTripper(base http.RoundTripper) *RecordingRoundTripper {
+	return &RecordingRoundTripper{base: base}
+}
+
+// RoundTrip implements http.RoundTripper. The response body is read completely to record it,
+// and replaced with a copy.
+func (recorder *RecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := Exchange{Method: req.Method, URL: req.URL.String()}
+	res, err := recorder.base.RoundTrip(req)
+	if err == nil {
+		var body []byte
+		body, err = io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(body))
+		exchange.StatusCode = res.StatusCode
+		exchange.ResponseBody = body
+	}
+	exchange.Err = err
+	recorder.mu.Lock()
+	recorder.exchanges = append(recorder.exchanges, exchange)
+	recorder.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Exchanges returns all exchanges recorded so far, in order.
+func (recorder *RecordingRoundTripper) Exchanges() []Exchange {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return append([]Exchange(nil), recorder.exchanges...)
+}
+
+// Transcript formats the recorded exchanges for comparison with a golden file: per exchange,
+// a line with the method and URL, a line with the status code or error, and the response body,
+// separated by empty lines.
+func (recorder *RecordingRoundTripper) Transcript() string {
+	var sb strings.Builder
+	for i, exchange := range recorder.Exchanges() {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "%s %s\n", exchange.Method, exchange.URL)
+		if exchange.Err != nil {
+			fmt.Fprintf(&sb, "error: %v\n", exchange.Err)
+			continue
+		}
+		fmt.Fprintf(&sb, "%d\n%s\n", exchange.StatusCode, strings.TrimRight(string(exchange.ResponseBody), "\n"))
+	}
+	return sb.String()
+}
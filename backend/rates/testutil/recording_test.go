@@ -0,0 +1,60 @@
+package testutil
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRecordingRoundTripper(t *testing.T) {
+	recorder := NewRecordingRoundTripper(NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, "{\"bitcoin\":{\"usd\":1}}\n"))
+	client := &http.Client{Transport: recorder}
+
+	resp, err := client.Get("https://example.test/simple/price?ids=bitcoin")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "{\"bitcoin\":{\"usd\":1}}\n", string(body), "body still readable")
+
+	resp, err = client.Get("https://example.test/unknown")
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+
+	exchanges := recorder.Exchanges()
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, Exchange{
+		Method:       http.MethodGet,
+		URL:          "https://example.test/simple/price?ids=bitcoin",
+		StatusCode:   http.StatusOK,
+		ResponseBody: []byte("{\"bitcoin\":{\"usd\":1}}\n"),
+	}, exchanges[0])
+	assert.Equal(t, `GET https://example.test/simple/price?ids=bitcoin
+200
+{"bitcoin":{"usd":1}}
+
+GET https://example.test/unknown
+404
+no response registered for /unknown
+`, recorder.Transcript())
+}
+
+func TestRecordingRoundTripperError(t *testing.T) {
+	recorder := NewRecordingRoundTripper(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}))
+	_, err := (&http.Client{Transport: recorder}).Get("https://example.test/ping")
+	require.Error(t, err)
+	assert.Equal(t, "GET https://example.test/ping\nerror: connection refused\n", recorder.Transcript())
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// WithTokenContracts makes updateLast also fetch the latest rates of tokens identified by their
+// contract address on a CoinGecko asset platform, e.g. "ethereum", using the
+// "simple/token_price" API. This supports tokens which have no CoinGecko coin ID but a price by
+// contract address. contracts maps contract addresses to BitBoxApp coin units, e.g. "DAI".
+//
+// The option can be given once per platform; each platform takes one request per update,
+// subject to the same rate limit. Rates by contract replace the ones by coin ID of the same
+// coin unit. If the request fails, the update continues without the rates of the platform.
+func WithTokenContracts(platform string, contracts map[string]string) Option {
+	return func(updater *RateUpdater) {
+		if updater.tokenContracts == nil {
+			updater.tokenContracts = make(map[string]map[string]string)
+		}
+		// CoinGecko responds with lowercase addresses.
+		units := make(map[string]string, len(contracts))
+		for contract, unit := range contracts {
+			units[strings.ToLower(contract)] = unit
+		}
+		updater.tokenContracts[platform] = units
+	}
+}
+
+// addTokenRates fetches the latest rates of the tokens configured with WithTokenContracts and
+// adds them to rates, keyed by coin unit and fiat unit. Failures are logged. It returns whether
+// all responses of the added rates are signed validly, see WithTrustChain.
+func (updater *RateUpdater) addTokenRates(ctx context.Context, rates map[string]map[string]float64) bool {
+	platforms := make([]string, 0, len(updater.tokenContracts))
+	for platform := range updater.tokenContracts {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	allTrusted := true
+	for _, platform := range platforms {
+		units := updater.tokenContracts[platform]
+		var trusted bool
+		geckoRates, err := updater.fetchTokenPrices(withTrustResult(ctx, &trusted), platform, units)
+		if err != nil {
+			updater.log.WithError(err).Errorf("could not fetch token prices on %s", platform)
+			continue
+		}
+		allTrusted = allTrusted && trusted
+		for contract, val := range geckoRates {
+			unit, ok := units[strings.ToLower(contract)]
+			if !ok {
+				updater.log.Errorf("unexpected token contract on %s: %s", platform, contract)
+				continue
+			}
+			rates[unit] = updater.fromGeckoFiatRates(val)
+		}
+	}
+	return allTrusted
+}
+
+// fetchTokenPrices returns the latest rates of the contracts, keys of units, on the platform,
+// keyed by contract address and CoinGecko fiat code.
+func (updater *RateUpdater) fetchTokenPrices(
+	ctx context.Context, platform string, units map[string]string,
+) (map[string]map[string]float64, error) {
+	contracts := make([]string, 0, len(units))
+	for contract := range units {
+		contracts = append(contracts, contract)
+	}
+	sort.Strings(contracts)
+	param := url.Values{
+		"contract_addresses": {strings.Join(contracts, ",")},
+		"vs_currencies":      {simplePriceAllCurrencies},
+	}
+	endpoint := fmt.Sprintf("%s/simple/token_price/%s?%s",
+		updater.coingeckoURL, url.PathEscape(platform), param.Encode())
+	body, err := updater.fetch(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return parseRatesResponse(body)
+}
@@ -0,0 +1,63 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTokenContracts(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	const (
+		contractA = "0x6B175474E89094C44Da98b954EedeAC495271d0F"
+		contractB = "0x514910771af9ca656af840dff83e8264ecf986ca"
+	)
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`).
+		On("/simple/token_price/ethereum", http.StatusOK, `{
+			"`+strings.ToLower(contractA)+`": {"usd": 1.001, "chf": 0.9, "btc": 0.00005},
+			"`+contractB+`": {"usd": 7.5}
+		}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null",
+		WithTokenContracts("ethereum", map[string]string{contractA: "TKNA", contractB: "TKNB"}),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.updateLast(context.Background())
+	last := updater.LatestPrice()
+	require.NotNil(t, last)
+	assert.Equal(t, 20000.0, last["BTC"]["USD"])
+	assert.Equal(t, map[string]float64{"USD": 1.001, "CHF": 0.9, "BTC": 0.00005, "sat": 5000}, last["TKNA"])
+	assert.Equal(t, map[string]float64{"USD": 7.5}, last["TKNB"])
+	mock.AssertCalledWith(t, "/simple/token_price/ethereum", "contract_addresses",
+		strings.ToLower(contractB)+","+strings.ToLower(contractA))
+	mock.AssertCalledWith(t, "/simple/token_price/ethereum", "vs_currencies", simplePriceAllCurrencies)
+}
+
+func TestWithTokenContractsFailure(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	// No response registered for the token prices.
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null",
+		WithTokenContracts("polygon-pos", map[string]string{"0xabc": "TKN"}),
+		WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+	updater.geckoLimiter = ratelimit.NewLimitedCall(time.Nanosecond)
+
+	updater.updateLast(context.Background())
+	last := updater.LatestPrice()
+	assert.Equal(t, 20000.0, last["BTC"]["USD"])
+	assert.NotContains(t, last, "TKN")
+	assert.Len(t, mock.Requests(), 2)
+}
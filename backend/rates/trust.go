@@ -0,0 +1,117 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"context"
+	"net/http"
+)
+
+// dataSignatureHeader is the response header verified by the SignatureVerifier of
+// WithTrustChain.
+const dataSignatureHeader = "X-Data-Signature"
+
+// RateTrustLevel tells how far the latest rates can be trusted, see TrustLevel.
+type RateTrustLevel int
+
+const (
+	// TrustLevelFull means the latest rates were fetched and, if WithTrustChain is used,
+	// their signature is valid.
+	TrustLevelFull RateTrustLevel = iota
+	// TrustLevelUnverified means the latest rates were fetched but their signature is
+	// missing or invalid.
+	TrustLevelUnverified
+	// TrustLevelStale means the latest rates were not fetched yet, or are from a snapshot.
+	TrustLevelStale
+)
+
+// String implements fmt.Stringer.
+func (level RateTrustLevel) String() string {
+	switch level {
+	case TrustLevelFull:
+		return "full"
+	case TrustLevelUnverified:
+		return "unverified"
+	case TrustLevelStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// SignatureVerifier verifies the signature of a response of the rates API, e.g. of the Shift
+// mirror, as a trust signal independent of the transport.
+type SignatureVerifier interface {
+	// Verify returns an error if signature, the value of the X-Data-Signature response header,
+	// is not a valid signature of body. signature is empty if the header is absent.
+	Verify(body []byte, signature string) error
+}
+
+// WithTrustChain makes the updater verify the X-Data-Signature header of the latest rates
+// responses with verifier, including the token prices of WithTokenContracts. Rates of responses
+// without a valid signature are used anyway, but flagged with TrustLevelUnverified. Responses
+// served from a cache, see WithHTTPCache, are verified with their cached headers.
+func WithTrustChain(verifier SignatureVerifier) Option {
+	return func(updater *RateUpdater) {
+		updater.signatureVerifier = verifier
+	}
+}
+
+// TrustLevel reports how far the rates returned by LatestPrice can be trusted. Without
+// WithTrustChain, fetched rates are trusted fully.
+func (updater *RateUpdater) TrustLevel() RateTrustLevel {
+	updater.lastMu.RLock()
+	defer updater.lastMu.RUnlock()
+	switch {
+	case len(updater.last) == 0 || updater.lastStale:
+		return TrustLevelStale
+	case !updater.lastTrusted:
+		return TrustLevelUnverified
+	default:
+		return TrustLevelFull
+	}
+}
+
+type trustResultKey struct{}
+
+// withTrustResult returns a context making fetchHTTP store in trusted whether the response
+// is signed validly, see WithTrustChain. A response served by CachingMiddleware stores the
+// result of the request it was cached from. trusted is left unchanged if no request is sent.
+func withTrustResult(ctx context.Context, trusted *bool) context.Context {
+	return context.WithValue(ctx, trustResultKey{}, trusted)
+}
+
+// setTrustResult stores trusted in the trust result of ctx, if any.
+func setTrustResult(ctx context.Context, trusted bool) {
+	if result, ok := ctx.Value(trustResultKey{}).(*bool); ok {
+		*result = trusted
+	}
+}
+
+// verifyResponse records in the trust result of ctx, if any, whether res with the given body
+// is signed validly.
+func (updater *RateUpdater) verifyResponse(ctx context.Context, res *http.Response, body []byte) {
+	if updater.signatureVerifier == nil {
+		return
+	}
+	if _, ok := ctx.Value(trustResultKey{}).(*bool); !ok {
+		return
+	}
+	err := updater.signatureVerifier.Verify(body, res.Header.Get(dataSignatureHeader))
+	if err != nil {
+		updater.log.WithError(err).Warning("untrusted rates response")
+	}
+	setTrustResult(ctx, err == nil)
+}
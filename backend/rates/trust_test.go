@@ -0,0 +1,212 @@
+package rates
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+)
+
+// hmacVerifier verifies hex encoded HMAC-SHA256 signatures.
+type hmacVerifier []byte
+
+func (key hmacVerifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (key hmacVerifier) Verify(body []byte, signature string) error {
+	if !hmac.Equal([]byte(key.sign(body)), []byte(signature)) {
+		return errp.New("invalid signature")
+	}
+	return nil
+}
+
+func TestTrustLevel(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	verifier := hmacVerifier("secret")
+	const body = `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`
+	// signature is the X-Data-Signature header sent by the server.
+	var signature atomic.Value
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sig := signature.Load().(string); sig != "" {
+			w.Header().Set(dataSignatureHeader, sig)
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithTrustChain(verifier),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	assert.Equal(t, TrustLevelStale, updater.TrustLevel())
+
+	signature.Store(verifier.sign([]byte(body)))
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+
+	// Unsigned responses are used, but flagged.
+	signature.Store("")
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelUnverified, updater.TrustLevel())
+	assert.InDelta(t, 20000.0, updater.LatestPrice()["BTC"]["USD"], 1e-9)
+
+	signature.Store(hmacVerifier("other").sign([]byte(body)))
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelUnverified, updater.TrustLevel())
+
+	signature.Store(verifier.sign([]byte(body)))
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+	assert.Equal(t, "full", updater.TrustLevel().String())
+}
+
+func TestTrustLevelWithoutTrustChain(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	ts := newSimplePriceServer(t, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null", WithLogger(newTestLogger()))
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+	assert.Equal(t, TrustLevelStale, updater.TrustLevel())
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+}
+
+func TestTrustLevelCachingMiddleware(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	verifier := hmacVerifier("secret")
+	const body = `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`
+	var signed atomic.Bool
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if signed.Load() {
+			w.Header().Set(dataSignatureHeader, verifier.sign([]byte(body)))
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+	now := time.Unix(1598832000, 0)
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithTrustChain(verifier),
+		WithMiddleware(newResponseCache(time.Minute, func() time.Time { return now }).middleware),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	signed.Store(true)
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+	// The cached response keeps its trust.
+	updater.updateLast(context.Background())
+	assert.Equal(t, int32(1), requests.Load())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+
+	now = now.Add(time.Minute)
+	signed.Store(false)
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelUnverified, updater.TrustLevel())
+	signed.Store(true)
+	updater.updateLast(context.Background())
+	assert.Equal(t, int32(2), requests.Load())
+	assert.Equal(t, TrustLevelUnverified, updater.TrustLevel())
+}
+
+func TestTrustLevelTokenContracts(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	verifier := hmacVerifier("secret")
+	const (
+		body      = `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`
+		tokenBody = `{"0xabc": {"usd": 1.0}}`
+	)
+	var tokensSigned atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/simple/price":
+			w.Header().Set(dataSignatureHeader, verifier.sign([]byte(body)))
+			fmt.Fprint(w, body)
+		case "/simple/token_price/ethereum":
+			if tokensSigned.Load() {
+				w.Header().Set(dataSignatureHeader, verifier.sign([]byte(tokenBody)))
+			}
+			fmt.Fprint(w, tokenBody)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithTrustChain(verifier),
+		WithTokenContracts("ethereum", map[string]string{"0xabc": "TKN"}),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	updater.updateLast(context.Background())
+	assert.Equal(t, 1.0, updater.LatestPrice()["TKN"]["USD"])
+	assert.Equal(t, TrustLevelUnverified, updater.TrustLevel())
+
+	tokensSigned.Store(true)
+	updater.updateLast(context.Background())
+	assert.Equal(t, TrustLevelFull, updater.TrustLevel())
+}
+
+func TestTrustLevelConcurrentUpdates(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every other update fails, resetting the latest rates.
+		if requests.Add(1)%2 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"bitcoin": {"usd": 20000.0}, "litecoin": {"usd": 70.0}, "ethereum": {"usd": 1500.0}}`)
+	}))
+	defer ts.Close()
+	updater := NewRateUpdater(http.DefaultClient, "/dev/null",
+		WithTrustChain(hmacVerifier("secret")),
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = ts.URL
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			updater.updateLast(context.Background())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			level := updater.TrustLevel()
+			assert.Contains(t, []RateTrustLevel{TrustLevelStale, TrustLevelUnverified}, level)
+			updater.IsLatestPriceStale()
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"sort"
+	"time"
+)
+
+// volatilityAlert is an alert added with AddVolatilityAlert.
+type volatilityAlert struct {
+	coin, fiat string
+	window     time.Duration
+	threshold  float64
+	callback   func(coin, fiat string, volatility float64)
+	// exceeded is whether the volatility exceeded the threshold in the previous check.
+	exceeded bool
+}
+
+// AddVolatilityAlert makes the updater call callback when the annualized volatility of the
+// coin/fiat pair over the given window, see Volatility, exceeds threshold, e.g. 0.8 for 80%.
+// The volatility is checked on each update of the latest rates. callback is called when the
+// threshold is crossed and not again until the volatility dropped to or below it. It is called
+// synchronously and must not block. Any number of alerts may be added per pair.
+// The returned ID is to be passed to RemoveVolatilityAlert.
+func (updater *RateUpdater) AddVolatilityAlert(
+	coin, fiat string,
+	windowDuration time.Duration,
+	threshold float64,
+	callback func(coin, fiat string, volatility float64),
+) int {
+	updater.volatilityAlertsMu.Lock()
+	defer updater.volatilityAlertsMu.Unlock()
+	if updater.volatilityAlerts == nil {
+		updater.volatilityAlerts = make(map[int]*volatilityAlert)
+	}
+	id := updater.nextVolatilityAlertID
+	updater.nextVolatilityAlertID++
+	updater.volatilityAlerts[id] = &volatilityAlert{
+		coin:      coin,
+		fiat:      fiat,
+		window:    windowDuration,
+		threshold: threshold,
+		callback:  callback,
+	}
+	return id
+}
+
+// RemoveVolatilityAlert removes the alert with the ID returned by AddVolatilityAlert.
+// Unknown IDs are ignored.
+func (updater *RateUpdater) RemoveVolatilityAlert(id int) {
+	updater.volatilityAlertsMu.Lock()
+	defer updater.volatilityAlertsMu.Unlock()
+	delete(updater.volatilityAlerts, id)
+}
+
+// checkVolatilityAlerts calls the callbacks of the alerts whose threshold is crossed.
+// Pairs without enough historical rates are skipped.
+func (updater *RateUpdater) checkVolatilityAlerts() {
+	type firing struct {
+		alert      *volatilityAlert
+		volatility float64
+	}
+	var fired []firing
+	updater.volatilityAlertsMu.Lock()
+	ids := make([]int, 0, len(updater.volatilityAlerts))
+	for id := range updater.volatilityAlerts {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		alert := updater.volatilityAlerts[id]
+		volatility, err := updater.Volatility(alert.coin, alert.fiat, alert.window)
+		if err != nil {
+			continue
+		}
+		exceeded := volatility > alert.threshold
+		if exceeded && !alert.exceeded {
+			fired = append(fired, firing{alert, volatility})
+		}
+		alert.exceeded = exceeded
+	}
+	updater.volatilityAlertsMu.Unlock()
+	// Call without holding the lock, so that callbacks may add or remove alerts.
+	for _, f := range fired {
+		f.alert.callback(f.alert.coin, f.alert.fiat, f.volatility)
+	}
+}
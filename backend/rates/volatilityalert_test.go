@@ -0,0 +1,103 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/backend/rates/testutil"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hourlyRates returns rates with the given values one hour apart, starting at start.
+func hourlyRates(start time.Time, values ...float64) []exchangeRate {
+	rates := make([]exchangeRate, len(values))
+	for i, value := range values {
+		rates[i] = exchangeRate{value: value, timestamp: start.Add(time.Duration(i) * time.Hour)}
+	}
+	return rates
+}
+
+func TestVolatilityAlert(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	mock := testutil.NewMockHTTPClient().
+		On("/simple/price", http.StatusOK, `{"bitcoin":{"usd":1},"litecoin":{"usd":2},"ethereum":{"usd":3}}`)
+	updater := NewRateUpdater(mock.Client(), "/dev/null",
+		withGeckoLimiter(ratelimit.NewLimitedCall(time.Nanosecond)),
+		WithLogger(newTestLogger()),
+	)
+	defer updater.Stop()
+	updater.coingeckoURL = "https://coingecko.test"
+
+	type call struct {
+		coin, fiat string
+		volatility float64
+	}
+	var calls1, calls2, callsEth []call
+	record := func(calls *[]call) func(coin, fiat string, volatility float64) {
+		return func(coin, fiat string, volatility float64) {
+			*calls = append(*calls, call{coin, fiat, volatility})
+		}
+	}
+	id1 := updater.AddVolatilityAlert("btc", "USD", 5*time.Hour, 1, record(&calls1))
+	id2 := updater.AddVolatilityAlert("btc", "USD", 5*time.Hour, 1000, record(&calls2))
+	updater.AddVolatilityAlert("eth", "USD", 5*time.Hour, 1, record(&callsEth))
+	assert.NotEqual(t, id1, id2)
+
+	// Not enough data.
+	updater.updateLast(context.Background())
+	assert.Empty(t, calls1)
+
+	start := time.Unix(1700000000, 0)
+	updater.storeHistory("btc", "USD", hourlyRates(start, 100, 100, 100, 100, 100, 100))
+	updater.updateLast(context.Background())
+	assert.Empty(t, calls1)
+
+	updater.storeHistory("btc", "USD", hourlyRates(start.Add(6*time.Hour), 110, 100, 110, 100, 110))
+	want, err := updater.Volatility("btc", "USD", 5*time.Hour)
+	require.NoError(t, err)
+	require.Greater(t, want, 1.0)
+	require.Less(t, want, 1000.0)
+	updater.updateLast(context.Background())
+	assert.Equal(t, []call{{"btc", "USD", want}}, calls1)
+	assert.Empty(t, calls2)
+	assert.Empty(t, callsEth)
+
+	// Still exceeded: not fired again.
+	updater.updateLast(context.Background())
+	assert.Len(t, calls1, 1)
+
+	// Calm again, then volatile: fired again.
+	updater.storeHistory("btc", "USD", hourlyRates(start.Add(11*time.Hour), 110, 110, 110, 110, 110, 110))
+	updater.updateLast(context.Background())
+	assert.Len(t, calls1, 1)
+	updater.storeHistory("btc", "USD", hourlyRates(start.Add(17*time.Hour), 100, 110, 100, 110, 100))
+	updater.updateLast(context.Background())
+	assert.Len(t, calls1, 2)
+
+	// Removed alerts are not fired anymore.
+	updater.RemoveVolatilityAlert(id1)
+	updater.RemoveVolatilityAlert(id1)
+	updater.storeHistory("btc", "USD", hourlyRates(start.Add(22*time.Hour), 100, 100, 100, 100, 100, 100))
+	updater.updateLast(context.Background())
+	updater.storeHistory("btc", "USD", hourlyRates(start.Add(28*time.Hour), 110, 100, 110, 100, 110))
+	updater.updateLast(context.Background())
+	assert.Len(t, calls1, 2)
+}
+
+func TestVolatilityAlertCallbackRemovesAlert(t *testing.T) {
+	defer verifyNoLeakedGoroutines(t)
+	updater := NewRateUpdater(nil, "/dev/null")
+	updater.storeHistory("btc", "USD", hourlyRates(time.Unix(1700000000, 0), 100, 110, 100, 110))
+	var id, calls int
+	id = updater.AddVolatilityAlert("btc", "USD", 24*time.Hour, 0, func(string, string, float64) {
+		calls++
+		updater.RemoveVolatilityAlert(id)
+	})
+	updater.checkVolatilityAlerts()
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, updater.volatilityAlerts)
+}
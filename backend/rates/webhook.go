@@ -0,0 +1,204 @@
+// Copyright 2024 Shift Crypto AG
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rates
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/errp"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/sirupsen/logrus"
+)
+
+// WebhookSignatureHeader is the header of a webhook request containing the hex encoded
+// HMAC-SHA256 of the request body, keyed with the secret of the WebhookNotifier.
+const WebhookSignatureHeader = "X-BitBox-Signature"
+
+const (
+	// webhookAttempts is the number of attempts to deliver a webhook payload.
+	webhookAttempts = 3
+	// webhookQueueSize is the number of payloads waiting for delivery. Once full,
+	// new payloads are dropped.
+	webhookQueueSize = 16
+)
+
+// WebhookPayload is the JSON body of a webhook request.
+type WebhookPayload struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Rates has the same format as LatestPrice.
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// WebhookNotifier POSTs the latest rates to a URL whenever they are updated, for server-side
+// deployments. See NewWebhookNotifier and Observe.
+//
+// The payloads are delivered in order in a separate goroutine, so that slow or failing
+// deliveries don't delay rate updates. Failed deliveries are retried with exponential backoff,
+// and dropped after 3 attempts. Errors are logged.
+type WebhookNotifier struct {
+	targetURL string
+	secret    []byte
+	client    *http.Client
+	log       *logrus.Entry
+	// backoff is the delay before the first retry, doubled for each further one.
+	backoff time.Duration
+
+	queue chan WebhookPayload
+	// stop cancels the context of the deliveries.
+	stop context.CancelFunc
+	// done is closed once the delivery goroutine has exited.
+	done chan struct{}
+
+	mu sync.Mutex // guards the fields below
+	// closed is true once Close was called.
+	closed bool
+	// unobserve stops queueing events of the observable set in Observe.
+	unobserve func()
+}
+
+// NewWebhookNotifier returns a notifier POSTing to targetURL with payloads signed using secret,
+// see WebhookSignatureHeader. It delivers payloads until Close is called. Failed deliveries are
+// logged to log, e.g. the one passed to WithLogger of the observed RateUpdater.
+func NewWebhookNotifier(targetURL string, secret string, log *logrus.Entry) *WebhookNotifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &WebhookNotifier{
+		targetURL: targetURL,
+		secret:    []byte(secret),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		log:       log,
+		backoff:   time.Second,
+		queue:     make(chan WebhookPayload, webhookQueueSize),
+		stop:      cancel,
+		done:      make(chan struct{}),
+	}
+	go n.deliverLoop(ctx)
+	return n
+}
+
+// Observe delivers all RatesEventSubject events notified by o, e.g. a RateUpdater, until Close
+// is called. Only one observable can be observed at a time.
+func (n *WebhookNotifier) Observe(o observable.Interface) {
+	unobserve := o.Observe(func(event observable.Event) {
+		if event.Subject != RatesEventSubject {
+			return
+		}
+		rates, ok := event.Object.(map[string]map[string]float64)
+		if !ok {
+			return
+		}
+		n.enqueue(WebhookPayload{Timestamp: time.Now(), Rates: rates})
+	})
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.unobserve != nil {
+		n.unobserve()
+	}
+	n.unobserve = unobserve
+}
+
+// enqueue queues the payload for delivery, or drops it if the queue is full or n is closed.
+func (n *WebhookNotifier) enqueue(payload WebhookPayload) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- payload:
+	default:
+		n.log.Error("webhook queue is full; dropping rates payload")
+	}
+}
+
+func (n *WebhookNotifier) deliverLoop(ctx context.Context) {
+	defer close(n.done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-n.queue:
+			if err := n.deliver(ctx, payload); err != nil && ctx.Err() == nil {
+				n.log.WithError(err).Error("could not deliver rates webhook")
+			}
+		}
+	}
+}
+
+// deliver POSTs the payload, retrying failed attempts with exponential backoff.
+func (n *WebhookNotifier) deliver(ctx context.Context, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(body) //nolint:errcheck // never returns an error
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, body, signature)
+		if err == nil || attempt == webhookAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+}
+
+func (n *WebhookNotifier) post(ctx context.Context, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.targetURL, bytes.NewReader(body))
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+	res, err := n.client.Do(req)
+	if err != nil {
+		return errp.WithStack(err)
+	}
+	defer res.Body.Close() //nolint:errcheck
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errp.Newf("bad response code %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Close stops observing and delivering. Payloads not delivered yet are dropped.
+// It waits for an ongoing delivery to be canceled.
+func (n *WebhookNotifier) Close() {
+	n.mu.Lock()
+	unobserve := n.unobserve
+	n.unobserve = nil
+	n.closed = true
+	n.mu.Unlock()
+	// Unobserve without holding mu, since a concurrent notification may wait for it in enqueue.
+	if unobserve != nil {
+		unobserve()
+	}
+	n.stop()
+	<-n.done
+}
@@ -0,0 +1,127 @@
+package rates
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable"
+	"github.com/BitBoxSwiss/bitbox-wallet-app/util/observable/action"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWebhookServer returns a server sending the verified payloads to the returned channel.
+// The first failures requests are responded with an error.
+func newTestWebhookServer(t *testing.T, secret string, failures int32) (*httptest.Server, <-chan WebhookPayload, *atomic.Int32) {
+	t.Helper()
+	payloads := make(chan WebhookPayload, 10)
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		signature, err := hex.DecodeString(r.Header.Get(WebhookSignatureHeader))
+		if err != nil || !hmac.Equal(mac.Sum(nil), signature) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload WebhookPayload
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		payloads <- payload
+	}))
+	t.Cleanup(ts.Close)
+	return ts, payloads, &requests
+}
+
+func newTestWebhookNotifier(targetURL, secret string) *WebhookNotifier {
+	n := NewWebhookNotifier(targetURL, secret, newTestLogger())
+	n.log = newTestLogger()
+	n.backoff = time.Millisecond
+	return n
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	ts, payloads, _ := newTestWebhookServer(t, "secret", 0)
+	n := newTestWebhookNotifier(ts.URL, "secret")
+	var o observable.Implementation
+	n.Observe(&o)
+	o.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Action:  action.Replace,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 1}},
+	})
+	o.Notify(observable.Event{Subject: "other", Object: map[string]map[string]float64{}})
+	o.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Action:  action.Replace,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 2}},
+	})
+
+	for _, want := range []float64{1, 2} {
+		select {
+		case payload := <-payloads:
+			assert.Equal(t, want, payload.Rates["BTC"]["USD"])
+			assert.False(t, payload.Timestamp.IsZero())
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "webhook not delivered")
+		}
+	}
+	n.Close()
+	o.Notify(observable.Event{
+		Subject: RatesEventSubject,
+		Object:  map[string]map[string]float64{"BTC": {"USD": 3}},
+	})
+	select {
+	case <-payloads:
+		require.Fail(t, "delivered after Close")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifierRetry(t *testing.T) {
+	payload := WebhookPayload{Timestamp: time.Unix(1598918400, 0), Rates: map[string]map[string]float64{"BTC": {"USD": 1}}}
+
+	// Delivered on the last attempt.
+	ts, payloads, requests := newTestWebhookServer(t, "secret", 2)
+	n := newTestWebhookNotifier(ts.URL, "secret")
+	defer n.Close()
+	require.NoError(t, n.deliver(context.Background(), payload))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Len(t, payloads, 1)
+
+	// Given up after 3 attempts.
+	ts, payloads, requests = newTestWebhookServer(t, "secret", 3)
+	n2 := newTestWebhookNotifier(ts.URL, "secret")
+	defer n2.Close()
+	require.Error(t, n2.deliver(context.Background(), payload))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Empty(t, payloads)
+}
+
+func TestWebhookNotifierWrongSecret(t *testing.T) {
+	ts, payloads, requests := newTestWebhookServer(t, "secret", 0)
+	n := newTestWebhookNotifier(ts.URL, "other secret")
+	defer n.Close()
+	payload := WebhookPayload{Rates: map[string]map[string]float64{"BTC": {"USD": 1}}}
+	require.EqualError(t, n.deliver(context.Background(), payload), "bad response code 401")
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Empty(t, payloads)
+}
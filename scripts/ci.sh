@@ -24,6 +24,8 @@ export GOTOOLCHAIN="local"
 # This script has to be called from the project root directory.
 go build -mod=vendor ./...
 go test -race -mod=vendor ./... -count=1 -v
+go test -mod=vendor ./backend/rates -run=XXX -fuzz=FuzzUpdateLastParse -fuzztime=60s
+go test -mod=vendor ./backend/rates -run=XXX -fuzz=FuzzHistoryParse -fuzztime=60s
 golangci-lint --version
 golangci-lint config verify
 golangci-lint run
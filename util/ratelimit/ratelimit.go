@@ -18,6 +18,7 @@ package ratelimit
 import (
 	"context"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/BitBoxSwiss/bitbox-wallet-app/util/logging"
@@ -70,6 +71,8 @@ func (transport *RateLimitedHTTPTransport) RoundTrip(req *http.Request) (*http.R
 type LimitedCall struct {
 	tickInterval time.Duration
 	tickCh       chan struct{}
+	stopCh       chan struct{}
+	stopOnce     sync.Once
 	log          *logrus.Entry
 }
 
@@ -79,15 +82,30 @@ func NewLimitedCall(minInterval time.Duration) *LimitedCall {
 	l := &LimitedCall{
 		tickInterval: minInterval,
 		tickCh:       make(chan struct{}),
+		stopCh:       make(chan struct{}),
 		log:          logging.Get().WithGroup("ratelimit"),
 	}
 	go l.tick()
 	return l
 }
 
+// Interval returns the minimum interval between calls.
+func (l *LimitedCall) Interval() time.Duration {
+	return l.tickInterval
+}
+
+// Stop releases the goroutine allowing the calls. Calls made afterwards block until their
+// context is done.
+func (l *LimitedCall) Stop() {
+	l.stopOnce.Do(func() { close(l.stopCh) })
+}
+
 func (l *LimitedCall) tick() {
-	l.tickCh <- struct{}{}
-	time.AfterFunc(l.tickInterval, l.tick)
+	select {
+	case l.tickCh <- struct{}{}:
+		time.AfterFunc(l.tickInterval, l.tick)
+	case <-l.stopCh:
+	}
 }
 
 // Call blocks fn from being executed until at least minInterval, specified